@@ -1,78 +1,190 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"time"
 
+	"github.com/curtisbraxdale/taday/internal/auth"
+	"github.com/curtisbraxdale/taday/internal/billing"
 	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/entitlements"
 	"github.com/curtisbraxdale/taday/internal/handlers"
+	"github.com/curtisbraxdale/taday/internal/logging"
+	"github.com/curtisbraxdale/taday/internal/mailer"
+	"github.com/curtisbraxdale/taday/internal/metrics"
 	"github.com/curtisbraxdale/taday/internal/middleware"
+	"github.com/curtisbraxdale/taday/internal/oidc"
+	"github.com/curtisbraxdale/taday/internal/ratelimit"
+	"github.com/curtisbraxdale/taday/internal/tracing"
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
-	"github.com/stripe/stripe-go/v82"
 )
 
 func main() {
 	godotenv.Load()
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	slog.SetDefault(logging.New(os.Stdout))
+	// The API runs until it is killed, so spans are left to the exporter's
+	// regular flushes rather than flushed on the way out.
+	if _, err := tracing.Setup(context.Background(), "taday-api"); err != nil {
+		fatal("Error setting up tracing", err)
+	}
 	dbURL := os.Getenv("DATABASE_URL")
 	platform := os.Getenv("PLATFORM")
-	secret := os.Getenv("SECRET")
+	keyring, err := auth.KeyringFromEnv()
+	if err != nil {
+		fatal("Error loading signing keys", err)
+	}
 	db, err := sql.Open("postgres", dbURL)
 	if err != nil {
-		log.Printf("Error connecting to database: %v", err)
+		fatal("Error opening database", err)
+	}
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, "taday"))
+	dbQueries := database.New(tracing.DB{DBTX: metrics.DB{DBTX: db}})
+
+	err = middleware.TrustProxyFromEnv()
+	if err != nil {
+		fatal("Error reading TRUST_PROXY", err)
+	}
+	oidcProviders, err := oidc.RegistryFromEnv()
+	if err != nil {
+		fatal("Error loading OIDC providers", err)
+	}
+	plans, err := entitlements.CatalogFromEnv()
+	if err != nil {
+		fatal("Error loading plans", err)
+	}
+	billingProvider, err := billing.FromEnv()
+	if err != nil {
+		fatal("Error configuring billing", err)
 	}
-	dbQueries := database.New(db)
+
+	var limitStore ratelimit.Store = ratelimit.NewMemoryStore()
+	if os.Getenv("RATE_LIMIT_STORE") == "postgres" {
+		limitStore = ratelimit.NewPostgresStore(db, dbQueries)
+	}
+	loginLimiter := ratelimit.New(limitStore, "login", ratelimit.Every(6*time.Second, 10))
+	signupLimiter := ratelimit.New(limitStore, "signup", ratelimit.Every(12*time.Minute, 5))
+	verifyLimiter := ratelimit.New(limitStore, "verify", ratelimit.Every(time.Minute, 10))
+	resendLimiter := ratelimit.New(limitStore, "verify-resend", ratelimit.Every(10*time.Minute, 3))
+	accountLimiter := ratelimit.New(limitStore, "account", ratelimit.Every(time.Minute, 10))
 
 	serveMux := http.NewServeMux()
-	apiCfg := handlers.ApiConfig{Queries: dbQueries, Platform: platform, Secret: secret}
+	apiCfg := handlers.ApiConfig{DB: db, Queries: dbQueries, Platform: platform, Keyring: keyring, Mailer: mailer.FromEnv(), AccountLimiter: accountLimiter, OIDC: oidcProviders, Billing: billingProvider, Plans: plans}
+	// Accounts scheduled for deletion are locked out even with an access
+	// token that hasn't expired yet.
+	requireAuth := func(next http.Handler) http.Handler {
+		return middleware.RequireAuth(keyring, apiCfg.UserActive, next)
+	}
 
-	serveMux.HandleFunc("GET /api/ready", handlers.ReadyCheck)
-	serveMux.HandleFunc("POST /api/login", apiCfg.Login)
-	serveMux.HandleFunc("POST /api/users", apiCfg.CreateUser)
+	serveMux.HandleFunc("GET /api/healthz", handlers.Healthz)
+	serveMux.HandleFunc("GET /api/readyz", apiCfg.Readyz)
+	serveMux.HandleFunc("GET /api/plans", apiCfg.GetPlans)
+	serveMux.HandleFunc("GET /.well-known/jwks.json", apiCfg.GetJWKS)
+	serveMux.HandleFunc("POST /api/refresh", apiCfg.Refresh)
 	serveMux.HandleFunc("POST /api/webhook", apiCfg.StripeWebhookHandler)
-	secure(serveMux, "POST /api/logout", apiCfg.Logout, secret)
-	secure(serveMux, "POST /api/cancel", apiCfg.CancelSub, secret)
-	secure(serveMux, "POST /api/refresh", apiCfg.Refresh, secret)
-	secure(serveMux, "POST /api/revoke", apiCfg.Revoke, secret)
-	secure(serveMux, "POST /api/todos", apiCfg.CreateToDo, secret)
-	secure(serveMux, "POST /api/events", apiCfg.CreateEvent, secret)
-	secure(serveMux, "POST /api/tags", apiCfg.CreateTag, secret)
-	secure(serveMux, "POST /api/events/{event_id}/tags", apiCfg.CreateEventTag, secret)
-	secure(serveMux, "POST /api/checkout", apiCfg.CreateCheckoutSession, secret)
-	secure(serveMux, "GET /api/users", apiCfg.GetUser, secret)
-	secure(serveMux, "GET /api/events", apiCfg.GetUserEvents, secret)
-	secure(serveMux, "GET /api/events/{event_id}", apiCfg.GetEvent, secret)
-	secure(serveMux, "GET /api/tags", apiCfg.GetUserTags, secret)
-	secure(serveMux, "GET /api/events/{event_id}/tags", apiCfg.GetEventTags, secret)
-	secure(serveMux, "GET /api/todos", apiCfg.GetUserToDos, secret)
-	secure(serveMux, "GET /api/todos/{todo_id}", apiCfg.GetToDo, secret)
-	secure(serveMux, "PUT /api/users", apiCfg.UpdateUser, secret)
-	secure(serveMux, "PUT /api/events/{event_id}", apiCfg.UpdateEvent, secret)
-	secure(serveMux, "PUT /api/todos/{todo_id}", apiCfg.UpdateToDo, secret)
-	secure(serveMux, "PUT /api/tags/{tag_id}", apiCfg.UpdateTag, secret)
-	secure(serveMux, "DELETE /api/users", apiCfg.DeleteUser, secret)
-	secure(serveMux, "DELETE /api/todos/{todo_id}", apiCfg.DeleteToDo, secret)
-	secure(serveMux, "DELETE /api/events/{event_id}", apiCfg.DeleteEvent, secret)
-	secure(serveMux, "DELETE /api/tags/{tag_id}", apiCfg.DeleteTag, secret)
-	secure(serveMux, "DELETE /api/events/{event_id}/tags/{tag_id}", apiCfg.DeleteEventTag, secret)
+	limited(serveMux, "POST /api/login", apiCfg.Login, loginLimiter)
+	limited(serveMux, "POST /api/login/2fa", apiCfg.LoginTwoFactor, loginLimiter)
+	limited(serveMux, "POST /api/users", apiCfg.CreateUser, signupLimiter)
+	limited(serveMux, "GET /api/auth/{provider}/start", apiCfg.StartOIDCLogin, loginLimiter)
+	limited(serveMux, "GET /api/auth/{provider}/callback", apiCfg.OIDCCallback, loginLimiter)
+	limited(serveMux, "POST /api/users/verify", apiCfg.VerifyEmail, verifyLimiter)
+	secure(serveMux, "POST /api/logout", apiCfg.Logout, requireAuth)
+	secure(serveMux, "POST /api/cancel", apiCfg.CancelSub, requireAuth)
+	secure(serveMux, "POST /api/subscription/resume", apiCfg.ResumeSub, requireAuth)
+	secure(serveMux, "POST /api/billing/portal", apiCfg.CreateBillingPortalSession, requireAuth)
+	secure(serveMux, "POST /api/revoke", apiCfg.Revoke, requireAuth)
+	secure(serveMux, "POST /api/todos", apiCfg.CreateToDo, requireAuth)
+	entitled(serveMux, "POST /api/events", apiCfg.CreateEvent, requireAuth, apiCfg.Entitlements)
+	entitled(serveMux, "POST /api/tags", apiCfg.CreateTag, requireAuth, apiCfg.Entitlements)
+	secure(serveMux, "POST /api/events/{event_id}/tags", apiCfg.CreateEventTag, requireAuth)
+	entitled(serveMux, "POST /api/batch", apiCfg.Batch, requireAuth, apiCfg.Entitlements)
+	secure(serveMux, "POST /api/checkout", apiCfg.CreateCheckoutSession, requireAuth)
+	serveMux.Handle("POST /api/users/verify/resend", middleware.RateLimit(resendLimiter, requireAuth(tracing.Handler("POST /api/users/verify/resend", http.HandlerFunc(apiCfg.ResendVerificationEmail)))))
+	secure(serveMux, "POST /api/2fa/enroll", apiCfg.EnrollTOTP, requireAuth)
+	secure(serveMux, "POST /api/2fa/confirm", apiCfg.ConfirmTOTP, requireAuth)
+	secure(serveMux, "POST /api/2fa/disable", apiCfg.DisableTOTP, requireAuth)
+	secure(serveMux, "POST /api/2fa/recovery-codes", apiCfg.RegenerateRecoveryCodes, requireAuth)
+	secure(serveMux, "GET /api/users", apiCfg.GetUser, requireAuth)
+	secure(serveMux, "GET /api/entitlements", apiCfg.GetEntitlements, requireAuth)
+	secure(serveMux, "GET /api/subscription", apiCfg.GetSubscription, requireAuth)
+	secure(serveMux, "GET /api/sessions", apiCfg.GetSessions, requireAuth)
+	secure(serveMux, "GET /api/identities", apiCfg.GetIdentities, requireAuth)
+	secure(serveMux, "GET /api/events", apiCfg.GetUserEvents, requireAuth)
+	secure(serveMux, "GET /api/events/{event_id}", apiCfg.GetEvent, requireAuth)
+	secure(serveMux, "GET /api/tags", apiCfg.GetUserTags, requireAuth)
+	secure(serveMux, "GET /api/events/{event_id}/tags", apiCfg.GetEventTags, requireAuth)
+	secure(serveMux, "GET /api/todos", apiCfg.GetUserToDos, requireAuth)
+	secure(serveMux, "GET /api/todos/{todo_id}", apiCfg.GetToDo, requireAuth)
+	secure(serveMux, "GET /api/search", apiCfg.Search, requireAuth)
+	secure(serveMux, "GET /api/sync", apiCfg.Sync, requireAuth)
+	secure(serveMux, "GET /api/export", apiCfg.Export, requireAuth)
+	secure(serveMux, "GET /api/trash", apiCfg.GetTrash, requireAuth)
+	secure(serveMux, "GET /api/audit", apiCfg.GetAuditLog, requireAuth)
+	entitled(serveMux, "POST /api/trash/{type}/{id}/restore", apiCfg.RestoreFromTrash, requireAuth, apiCfg.Entitlements)
+	secure(serveMux, "PUT /api/users", apiCfg.UpdateUser, requireAuth)
+	entitled(serveMux, "PUT /api/events/{event_id}", apiCfg.UpdateEvent, requireAuth, apiCfg.Entitlements)
+	secure(serveMux, "PUT /api/todos/{todo_id}", apiCfg.UpdateToDo, requireAuth)
+	secure(serveMux, "PUT /api/tags/{tag_id}", apiCfg.UpdateTag, requireAuth)
+	secure(serveMux, "PATCH /api/users", apiCfg.PatchUser, requireAuth)
+	entitled(serveMux, "PATCH /api/events/{event_id}", apiCfg.PatchEvent, requireAuth, apiCfg.Entitlements)
+	secure(serveMux, "PATCH /api/todos/{todo_id}", apiCfg.PatchToDo, requireAuth)
+	secure(serveMux, "DELETE /api/users", apiCfg.DeleteUser, requireAuth)
+	secure(serveMux, "DELETE /api/sessions", apiCfg.DeleteAllSessions, requireAuth)
+	secure(serveMux, "DELETE /api/sessions/{session_id}", apiCfg.DeleteSession, requireAuth)
+	secure(serveMux, "DELETE /api/identities/{identity_id}", apiCfg.DeleteIdentity, requireAuth)
+	secure(serveMux, "DELETE /api/todos/{todo_id}", apiCfg.DeleteToDo, requireAuth)
+	secure(serveMux, "DELETE /api/events/{event_id}", apiCfg.DeleteEvent, requireAuth)
+	secure(serveMux, "DELETE /api/tags/{tag_id}", apiCfg.DeleteTag, requireAuth)
+	secure(serveMux, "DELETE /api/events/{event_id}/tags/{tag_id}", apiCfg.DeleteEventTag, requireAuth)
 
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"https://taday.io"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", "If-Match", "If-None-Match", "X-Request-ID"},
+		ExposedHeaders:   []string{"ETag", "Retry-After", "X-Request-ID"},
 		AllowCredentials: true,
 	})
 	server := http.Server{}
-	server.Handler = c.Handler(serveMux)
+	server.Handler = middleware.Trace(serveMux, middleware.RequestLog(serveMux, middleware.Metrics(serveMux, c.Handler(serveMux))))
 	server.Addr = ":8080"
 
-	log.Fatal(server.ListenAndServe())
+	// Metrics are served on their own port so they aren't public.
+	metricsAddr := os.Getenv("METRICS_ADDR")
+	if metricsAddr == "" {
+		metricsAddr = ":9091"
+	}
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("GET /metrics", promhttp.Handler())
+	go func() {
+		fatal("Metrics server stopped", http.ListenAndServe(metricsAddr, metricsMux))
+	}()
+
+	fatal("Server stopped", server.ListenAndServe())
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+func secure(mux *http.ServeMux, methodAndPath string, handlerFunc http.HandlerFunc, requireAuth func(http.Handler) http.Handler) {
+	mux.Handle(methodAndPath, requireAuth(tracing.Handler(methodAndPath, handlerFunc)))
+}
+
+// entitled is secure for routes whose handlers enforce plan limits.
+func entitled(mux *http.ServeMux, methodAndPath string, handlerFunc http.HandlerFunc, requireAuth func(http.Handler) http.Handler, resolve func(context.Context, uuid.UUID) (entitlements.Entitlements, error)) {
+	mux.Handle(methodAndPath, requireAuth(middleware.LoadEntitlements(resolve, tracing.Handler(methodAndPath, handlerFunc))))
 }
 
-func secure(mux *http.ServeMux, methodAndPath string, handlerFunc http.HandlerFunc, secret string) {
-	mux.Handle(methodAndPath, middleware.RequireAuth(secret, handlerFunc))
+func limited(mux *http.ServeMux, methodAndPath string, handlerFunc http.HandlerFunc, limiter *ratelimit.Limiter) {
+	mux.Handle(methodAndPath, middleware.RateLimit(limiter, tracing.Handler(methodAndPath, handlerFunc)))
 }
@@ -3,81 +3,358 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
-	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/entitlements"
 	"github.com/curtisbraxdale/taday/internal/handlers"
+	"github.com/curtisbraxdale/taday/internal/logging"
+	"github.com/curtisbraxdale/taday/internal/mailer"
+	"github.com/curtisbraxdale/taday/internal/metrics"
+	"github.com/curtisbraxdale/taday/internal/ratelimit"
+	"github.com/curtisbraxdale/taday/internal/tracing"
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
 	"github.com/twilio/twilio-go"
 	twilioApi "github.com/twilio/twilio-go/rest/api/v2010"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	agendasRendered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "taday_sender_agendas_rendered_total",
+		Help: "Agendas rendered, by kind.",
+	}, []string{"kind"})
+	messagesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "taday_sender_messages_total",
+		Help: "Messages the sender tried to deliver, by channel and status.",
+	}, []string{"channel", "status"})
+	sendDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "taday_sender_send_duration_seconds",
+		Help: "Time taken to hand a message to the provider, by channel.",
+	}, []string{"channel"})
+	lastRun = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "taday_sender_last_run_timestamp_seconds",
+		Help: "When the sender last finished, by result.",
+	}, []string{"result"})
 )
 
 func main() {
 	godotenv.Load()
+	slog.SetDefault(logging.New(os.Stdout))
 	dbURL := os.Getenv("DATABASE_URL")
 	platform := os.Getenv("PLATFORM")
-	secret := os.Getenv("SECRET")
 	twilAccountSid := os.Getenv("TWILIO_ACCOUNT_SID")
 	twilAuthToken := os.Getenv("TWILIO_AUTH_TOKEN")
 	twilNumber := os.Getenv("TWILIO_PHONE_NUMBER")
+	shutdownTracing, err := tracing.Setup(context.Background(), "taday-sender")
+	if err != nil {
+		slog.Error("Error setting up tracing", "error", err)
+		os.Exit(1)
+	}
 	db, err := sql.Open("postgres", dbURL)
 	if err != nil {
-		log.Printf("Error connecting to database: %v", err)
+		slog.Error("Error opening database", "error", err)
+		os.Exit(1)
+	}
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, "taday"))
+	dbQueries := database.New(tracing.DB{DBTX: metrics.DB{DBTX: db}})
+	plans, err := entitlements.CatalogFromEnv()
+	if err != nil {
+		slog.Error("Error loading plans", "error", err)
+		os.Exit(1)
 	}
-	dbQueries := database.New(db)
-	apiCfg := handlers.ApiConfig{Queries: dbQueries, Platform: platform, Secret: secret}
+	apiCfg := handlers.ApiConfig{DB: db, Queries: dbQueries, Platform: platform, Mailer: mailer.FromEnv(), Plans: plans}
 	client := twilio.NewRestClientWithParams(twilio.ClientParams{
 		Username: twilAccountSid,
 		Password: twilAuthToken,
 	})
+	sms := func(ctx context.Context, to, body string) (string, error) {
+		return sendSMS(ctx, client, twilNumber, to, body)
+	}
+
+	runOnce := func(ctx context.Context) error {
+		// Each run is one trace, with a span per user sent an agenda.
+		ctx, span := tracing.Start(ctx, "sender run")
+		err := run(ctx, &apiCfg, db, sms)
+		tracing.End(span, err)
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		pushMetrics(result)
+		return err
+	}
+
+	// With SENDER_RUN_AT the sender keeps running and sends every day at
+	// that time. Without it, it runs once and exits, for a scheduled machine.
+	if runAt := os.Getenv("SENDER_RUN_AT"); runAt != "" {
+		err = serve(&apiCfg, runAt, runOnce)
+	} else {
+		err = runOnce(context.Background())
+	}
+	// Buffered spans would be lost on exit, so they are sent now.
+	if flushErr := shutdownTracing(context.Background()); flushErr != nil {
+		slog.Error("Error flushing traces", "error", flushErr)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// serve calls runOnce every day at runAt, an HH:MM time in UTC, until the
+// process is told to stop. In between it serves the same health checks as
+// the API, and metrics for Prometheus to scrape, on HEALTH_ADDR (default
+// :8080). A failed run is logged and tried again the next day.
+func serve(cfg *handlers.ApiConfig, runAt string, runOnce func(context.Context) error) error {
+	at, err := time.Parse("15:04", runAt)
+	if err != nil {
+		slog.Error("Error parsing SENDER_RUN_AT", "error", err)
+		return err
+	}
+	addr := os.Getenv("HEALTH_ADDR")
+	if addr == "" {
+		addr = ":8080"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/healthz", handlers.Healthz)
+	mux.HandleFunc("GET /api/readyz", cfg.Readyz)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	server := &http.Server{Addr: addr, Handler: mux}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
 
-	day := time.Now().Weekday().String()
-	userIDs, err := apiCfg.Queries.GetAllUsers(context.Background())
-	if err != nil {
-		log.Fatalf("Error getting userIDs: %s", err)
-	}
-	if day == "Monday" {
-		for _, user := range userIDs {
-			agenda, err := apiCfg.CreateWeeklyAgenda(user.ID)
-			if err != nil {
-				log.Printf("Error creating agenda for user %v : %s", user.Username, err)
-			}
-			params := &twilioApi.CreateMessageParams{}
-			params.SetTo(user.PhoneNumber)
-			params.SetFrom(twilNumber)
-			params.SetBody(agenda)
-
-			resp, err := client.Api.CreateMessage(params)
-			if err != nil {
-				fmt.Println("Error sending SMS message: " + err.Error())
-			} else {
-				response, _ := json.Marshal(*resp)
-				fmt.Println("Response: " + string(response))
-			}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for {
+		next := nextRun(time.Now(), at)
+		slog.Info("Waiting for next run", "at", next)
+		select {
+		case <-ctx.Done():
+			return server.Shutdown(context.Background())
+		case err := <-serverErr:
+			slog.Error("Health server stopped", "error", err)
+			return err
+		case <-time.After(time.Until(next)):
+			runOnce(ctx)
 		}
+	}
+}
+
+// nextRun returns the first time after now at the time of day of at, in UTC.
+func nextRun(now, at time.Time) time.Time {
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, time.UTC)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// run does the housekeeping and sends the dunning notices and agendas. It
+// only fails if the users to send agendas to can't be listed.
+func run(ctx context.Context, cfg *handlers.ApiConfig, db *sql.DB, sms func(ctx context.Context, to, body string) (string, error)) error {
+	// Buckets that have not been touched for a day are full again and can go.
+	err := ratelimit.NewPostgresStore(db, cfg.Queries).Prune(ctx, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		slog.Error("Error pruning rate limit buckets", "error", err)
+	}
+	err = cfg.Queries.DeleteExpiredOIDCLoginStates(ctx)
+	if err != nil {
+		slog.Error("Error pruning OIDC login states", "error", err)
+	}
+	// Stripe stops retrying an event after three days, so by now its ID is no
+	// longer needed to spot redeliveries.
+	_, err = cfg.Queries.DeleteStripeEventsBefore(ctx, time.Now().Add(-30*24*time.Hour))
+	if err != nil {
+		slog.Error("Error pruning Stripe events", "error", err)
+	}
+	purgeTrash(ctx, cfg.Queries, time.Now().Add(-handlers.TrashRetention))
+	n, err := cfg.Queries.PurgeDeletedUsers(ctx, time.Now().Add(-handlers.AccountDeletionGrace))
+	if err != nil {
+		slog.Error("Error purging deleted users", "error", err)
+	} else if n > 0 {
+		slog.Info("Purged deleted users", "count", n)
+	}
+
+	sendDunningNotices(ctx, cfg, sms)
+
+	weekly := time.Now().Weekday() == time.Monday
+	users, err := cfg.Queries.GetAllUsers(ctx)
+	if err != nil {
+		slog.Error("Error getting users", "error", err)
+		return err
+	}
+	for _, user := range users {
+		// Accounts created through an external sign-in provider may not
+		// have added a phone number yet.
+		if user.PhoneNumber == "" {
+			continue
+		}
+		sendAgenda(ctx, cfg, user.ID, user.PhoneNumber, weekly, sms)
+	}
+	return nil
+}
+
+// sendAgenda texts a user their agenda if their plan includes it.
+func sendAgenda(ctx context.Context, cfg *handlers.ApiConfig, userID uuid.UUID, phoneNumber string, weekly bool, sms func(ctx context.Context, to, body string) (string, error)) {
+	ctx, span := tracing.Start(ctx, "user", attribute.String("user_id", userID.String()))
+	var err error
+	defer func() { tracing.End(span, err) }()
+
+	e, err := cfg.Entitlements(ctx, userID)
+	if err != nil {
+		slog.Error("Error resolving entitlements", "user_id", userID, "error", err)
+		return
+	}
+	if !e.SMSAgenda {
+		return
+	}
+	// Plans without the weekly agenda get the daily one on Mondays too.
+	kind := "daily_agenda"
+	var agenda string
+	if weekly && e.WeeklyAgenda {
+		kind = "weekly_agenda"
+		agenda, err = cfg.CreateWeeklyAgenda(ctx, userID)
 	} else {
-		for _, user := range userIDs {
-			agenda, err := apiCfg.CreateDailyAgenda(user.ID)
-			if err != nil {
-				log.Printf("Error creating agenda for user %v : %s", user.Username, err)
-			}
-			params := &twilioApi.CreateMessageParams{}
-			params.SetTo(user.PhoneNumber)
-			params.SetFrom(twilNumber)
-			params.SetBody(agenda)
-
-			resp, err := client.Api.CreateMessage(params)
-			if err != nil {
-				fmt.Println("Error sending SMS message: " + err.Error())
-			} else {
-				response, _ := json.Marshal(*resp)
-				fmt.Println("Response: " + string(response))
-			}
+		agenda, err = cfg.CreateDailyAgenda(ctx, userID)
+	}
+	if err != nil {
+		slog.Error("Error creating agenda", "user_id", userID, "error", err)
+		return
+	}
+	span.SetAttributes(attribute.String("agenda.kind", kind))
+	agendasRendered.WithLabelValues(kind).Inc()
+	sid, err := sms(ctx, phoneNumber, agenda)
+	recordDelivery(ctx, cfg.Queries, userID, "sms", kind, phoneNumber, agenda, sid, err)
+}
+
+// pushMetrics records the end of the run and sends the metrics to the
+// Pushgateway at PROMETHEUS_PUSHGATEWAY_URL, if there is one. A sender that
+// runs once exits when it is done, so there is nothing for Prometheus to
+// scrape.
+func pushMetrics(result string) {
+	lastRun.WithLabelValues(result).SetToCurrentTime()
+	url := os.Getenv("PROMETHEUS_PUSHGATEWAY_URL")
+	if url == "" {
+		return
+	}
+	err := push.New(url, "taday_sender").Gatherer(prometheus.DefaultGatherer).Push()
+	if err != nil {
+		slog.Error("Error pushing metrics", "error", err)
+	}
+}
+
+// sendSMS texts body to a phone number and returns the Twilio message SID.
+func sendSMS(ctx context.Context, client *twilio.RestClient, from, to, body string) (string, error) {
+	params := &twilioApi.CreateMessageParams{}
+	params.SetTo(to)
+	params.SetFrom(from)
+	params.SetBody(body)
+
+	defer prometheus.NewTimer(sendDuration.WithLabelValues("sms")).ObserveDuration()
+	_, span := tracing.StartClient(ctx, "twilio CreateMessage")
+	resp, err := client.Api.CreateMessage(params)
+	tracing.End(span, err)
+	if err != nil {
+		slog.Error("Error sending SMS message", "to", to, "error", err)
+		return "", err
+	}
+	sid := ""
+	if resp.Sid != nil {
+		sid = *resp.Sid
+	}
+	slog.Info("Sent SMS message", "to", to, "sid", sid)
+	return sid, nil
+}
+
+// sendDunningNotices tells users whose payment failed how to fix it, by email
+// and by text if they have a phone number, and schedules the next reminder.
+func sendDunningNotices(ctx context.Context, cfg *handlers.ApiConfig, sms func(ctx context.Context, to, body string) (string, error)) {
+	now := time.Now()
+	cases, err := cfg.Queries.GetDueDunningCases(ctx, now)
+	if err != nil {
+		slog.Error("Error getting dunning cases", "error", err)
+		return
+	}
+	for _, c := range cases {
+		notice, ok, err := cfg.DunningNotice(ctx, c, now)
+		if err != nil {
+			slog.Error("Error preparing dunning notice", "dunning_case_id", c.ID, "error", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		user, err := cfg.Queries.GetUserByID(ctx, c.UserID)
+		if err != nil {
+			slog.Error("Error getting user for dunning notice", "dunning_case_id", c.ID, "error", err)
+			continue
+		}
+
+		start := time.Now()
+		err = cfg.Mailer.Send(ctx, user.Email, notice.Subject, notice.Body)
+		sendDuration.WithLabelValues("email").Observe(time.Since(start).Seconds())
+		recordDelivery(ctx, cfg.Queries, user.ID, "email", notice.Kind, user.Email, notice.Body, "", err)
+		if user.PhoneNumber != "" {
+			sid, err := sms(ctx, user.PhoneNumber, notice.Body)
+			recordDelivery(ctx, cfg.Queries, user.ID, "sms", notice.Kind, user.PhoneNumber, notice.Body, sid, err)
+		}
+
+		err = cfg.Queries.RecordDunningNotice(ctx, database.RecordDunningNoticeParams{ID: c.ID, NextNoticeAt: notice.Next})
+		if err != nil {
+			slog.Error("Error recording dunning notice", "dunning_case_id", c.ID, "error", err)
+		}
+	}
+}
+
+// purgeTrash permanently deletes everything that has been in the trash since
+// before the cutoff.
+func purgeTrash(ctx context.Context, q *database.Queries, before time.Time) {
+	purges := []struct {
+		name  string
+		purge func(context.Context, time.Time) (int64, error)
+	}{
+		{"events", q.PurgeDeletedEvents},
+		{"todos", q.PurgeDeletedTodos},
+		{"tags", q.PurgeDeletedTags},
+	}
+	for _, p := range purges {
+		n, err := p.purge(ctx, before)
+		if err != nil {
+			slog.Error("Error purging deleted "+p.name, "error", err)
+			continue
+		}
+		if n > 0 {
+			slog.Info("Purged deleted "+p.name, "count", n)
 		}
 	}
 }
+
+// recordDelivery stores the outcome of a message so it shows up in the user's
+// data export.
+func recordDelivery(ctx context.Context, q *database.Queries, userID uuid.UUID, channel, kind, recipient, body, providerMessageID string, sendErr error) {
+	params := database.CreateDeliveryParams{UserID: userID, Channel: channel, Kind: kind, Recipient: recipient, Body: body, Status: "sent", ProviderMessageID: providerMessageID}
+	if sendErr != nil {
+		params.Status = "failed"
+		params.Error = sendErr.Error()
+	}
+	messagesSent.WithLabelValues(channel, params.Status).Inc()
+	err := q.CreateDelivery(ctx, params)
+	if err != nil {
+		slog.Error("Error recording delivery", "user_id", userID, "error", err)
+	}
+}
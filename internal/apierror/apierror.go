@@ -0,0 +1,98 @@
+// Package apierror defines the JSON error body returned by the API.
+//
+// Every error response has the shape
+//
+//	{"error": "Human readable message", "code": "machine_readable_code", "details": [...]}
+//
+// where details is only present for validation failures and lists the
+// offending fields.
+package apierror
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+const (
+	CodeBadRequest   = "bad_request"
+	CodeInvalidJSON  = "invalid_json"
+	CodeInvalidID    = "invalid_id"
+	CodeValidation   = "validation_failed"
+	CodeUnauthorized = "unauthorized"
+	CodeForbidden    = "forbidden"
+	CodeNotFound     = "not_found"
+	CodeConflict     = "conflict"
+	CodePrecondition = "precondition_failed"
+	CodeTooLarge     = "payload_too_large"
+	CodeRateLimited  = "rate_limited"
+	CodePlanLimit    = "plan_limit"
+	CodeInternal     = "internal_error"
+	CodeUnavailable  = "upstream_unavailable"
+)
+
+// FieldError describes a single invalid field in a request body.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type Error struct {
+	Status  int          `json:"-"`
+	Message string       `json:"error"`
+	Code    string       `json:"code"`
+	Details []FieldError `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func New(status int, code, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+// FromStatus builds an error with the default code for the status.
+func FromStatus(status int, message string) *Error {
+	return New(status, CodeForStatus(status), message)
+}
+
+func CodeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusPreconditionFailed:
+		return CodePrecondition
+	case http.StatusRequestEntityTooLarge:
+		return CodeTooLarge
+	case http.StatusUnprocessableEntity:
+		return CodeValidation
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return CodeUnavailable
+	default:
+		return CodeInternal
+	}
+}
+
+func Write(w http.ResponseWriter, e *Error) {
+	dat, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Error marshalling JSON", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	w.Write(dat)
+}
@@ -3,11 +3,9 @@ package auth
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
-	"errors"
-	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -41,41 +39,27 @@ func CheckPasswordHash(hash, password string) error {
 	return nil
 }
 
-func MakeAccessToken(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (string, error) {
-	unsignedAccessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Issuer: "taday", IssuedAt: jwt.NewNumericDate(time.Now()), ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)), Subject: userID.String()})
-	signedAccessToken, err := unsignedAccessToken.SignedString([]byte(tokenSecret))
+func MakeRefreshToken() (string, error) {
+	bytes := make([]byte, 32)
+	_, err := rand.Read(bytes)
 	if err != nil {
 		return "", err
 	}
-	return signedAccessToken, nil
+	token := hex.EncodeToString(bytes)
+	return token, nil
 }
 
-func ValidateAccessToken(tokenString, tokenSecret string) (uuid.UUID, error) {
-	accessToken, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil })
-	if err != nil {
-		return uuid.Nil, err
-	}
-	claims, ok := accessToken.Claims.(*jwt.RegisteredClaims)
-	if !ok {
-		return uuid.Nil, errors.New("Invalid token.")
-	}
-	subject, err := claims.GetSubject()
-	if err != nil {
-		return uuid.Nil, err
-	}
-	userID, err := uuid.Parse(subject)
+// MakeVerificationToken returns a random single-use token along with the hash
+// that should be stored in its place.
+func MakeVerificationToken() (string, string, error) {
+	token, err := MakeRefreshToken()
 	if err != nil {
-		return uuid.Nil, err
+		return "", "", err
 	}
-	return userID, nil
+	return token, HashToken(token), nil
 }
 
-func MakeRefreshToken() (string, error) {
-	bytes := make([]byte, 32)
-	_, err := rand.Read(bytes)
-	if err != nil {
-		return "", err
-	}
-	token := hex.EncodeToString(bytes)
-	return token, nil
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// signingKey is one entry in a Keyring. Keys without a private half can only
+// verify tokens, which is how retired keys are kept around until every token
+// they signed has expired.
+type signingKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private any
+	public  any
+}
+
+// Keyring signs and validates access tokens. Every token carries the ID of the
+// key that signed it in its kid header, so several keys can be valid at once
+// while a new key is rolled out.
+type Keyring struct {
+	Issuer   string
+	Audience string
+	active   string
+	keys     map[string]signingKey
+}
+
+func NewKeyring(issuer, audience string) *Keyring {
+	return &Keyring{Issuer: issuer, Audience: audience, keys: map[string]signingKey{}}
+}
+
+func (k *Keyring) AddHMAC(id string, secret []byte) error {
+	if len(secret) == 0 {
+		return fmt.Errorf("key %q: HMAC secret is empty", id)
+	}
+	return k.add(signingKey{id: id, method: jwt.SigningMethodHS256, private: secret, public: secret})
+}
+
+func (k *Keyring) AddPrivateKey(id string, key crypto.PrivateKey) error {
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		return k.add(signingKey{id: id, method: jwt.SigningMethodEdDSA, private: key, public: key.Public()})
+	case *rsa.PrivateKey:
+		return k.add(signingKey{id: id, method: jwt.SigningMethodRS256, private: key, public: &key.PublicKey})
+	default:
+		return fmt.Errorf("key %q: unsupported private key type %T", id, key)
+	}
+}
+
+// AddPublicKey adds a verify-only key.
+func (k *Keyring) AddPublicKey(id string, key crypto.PublicKey) error {
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		return k.add(signingKey{id: id, method: jwt.SigningMethodEdDSA, public: key})
+	case *rsa.PublicKey:
+		return k.add(signingKey{id: id, method: jwt.SigningMethodRS256, public: key})
+	default:
+		return fmt.Errorf("key %q: unsupported public key type %T", id, key)
+	}
+}
+
+func (k *Keyring) add(key signingKey) error {
+	if key.id == "" {
+		return errors.New("keys must have an ID")
+	}
+	if _, ok := k.keys[key.id]; ok {
+		return fmt.Errorf("duplicate key ID %q", key.id)
+	}
+	k.keys[key.id] = key
+	return nil
+}
+
+// SetActive selects the key used to sign new tokens.
+func (k *Keyring) SetActive(id string) error {
+	key, ok := k.keys[id]
+	if !ok {
+		return fmt.Errorf("unknown key ID %q", id)
+	}
+	if key.private == nil {
+		return fmt.Errorf("key %q has no private key and cannot sign", id)
+	}
+	k.active = id
+	return nil
+}
+
+func (k *Keyring) MakeAccessToken(userID uuid.UUID, expiresIn time.Duration) (string, error) {
+	key, ok := k.keys[k.active]
+	if !ok {
+		return "", errors.New("no active signing key")
+	}
+	now := time.Now()
+	claims := jwt.RegisteredClaims{
+		Issuer:    k.Issuer,
+		Audience:  jwt.ClaimStrings{k.Audience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
+		Subject:   userID.String(),
+	}
+	unsignedAccessToken := jwt.NewWithClaims(key.method, claims)
+	unsignedAccessToken.Header["kid"] = key.id
+	return unsignedAccessToken.SignedString(key.private)
+}
+
+func (k *Keyring) ValidateAccessToken(tokenString string) (uuid.UUID, error) {
+	methods := []string{}
+	for _, key := range k.keys {
+		methods = append(methods, key.method.Alg())
+	}
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := k.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key ID %q", kid)
+		}
+		// A token must use the algorithm its key was registered with,
+		// otherwise an RSA public key could be passed off as an HMAC secret.
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s for key %q", token.Method.Alg(), kid)
+		}
+		return key.public, nil
+	}
+	accessToken, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, keyFunc,
+		jwt.WithValidMethods(methods),
+		jwt.WithIssuer(k.Issuer),
+		jwt.WithAudience(k.Audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	claims, ok := accessToken.Claims.(*jwt.RegisteredClaims)
+	if !ok {
+		return uuid.Nil, errors.New("Invalid token.")
+	}
+	subject, err := claims.GetSubject()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return uuid.Parse(subject)
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public halves of all asymmetric keys so other services can
+// verify access tokens. HMAC secrets are never published.
+func (k *Keyring) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range k.keys {
+		switch pub := key.public.(type) {
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JWK{Kty: "OKP", Kid: key.id, Use: "sig", Alg: key.method.Alg(), Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(pub)})
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, JWK{Kty: "RSA", Kid: key.id, Use: "sig", Alg: key.method.Alg(), N: base64.RawURLEncoding.EncodeToString(pub.N.Bytes()), E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())})
+		}
+	}
+	return set
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeyringFromEnv builds the access token keyring from the environment.
+//
+// JWT_KEYS is a comma separated list of kid:alg:source entries. For HS256 the
+// source is the secret itself; for EdDSA and RS256 it is the path to a PEM
+// encoded PKCS#8 private key, or to a PKIX public key for a retired key that
+// should only be used for verification. JWT_ACTIVE_KEY picks the signing key
+// and defaults to the first entry. Without JWT_KEYS the legacy SECRET is used
+// as a single HS256 key with the ID "default".
+func KeyringFromEnv() (*Keyring, error) {
+	issuer := os.Getenv("JWT_ISSUER")
+	if issuer == "" {
+		issuer = "taday"
+	}
+	audience := os.Getenv("JWT_AUDIENCE")
+	if audience == "" {
+		audience = "taday-api"
+	}
+	keyring := NewKeyring(issuer, audience)
+
+	spec := os.Getenv("JWT_KEYS")
+	if spec == "" {
+		err := keyring.AddHMAC("default", []byte(os.Getenv("SECRET")))
+		if err != nil {
+			return nil, err
+		}
+		return keyring, keyring.SetActive("default")
+	}
+
+	active := os.Getenv("JWT_ACTIVE_KEY")
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid JWT_KEYS entry %q, expected kid:alg:source", entry)
+		}
+		kid, alg, source := parts[0], parts[1], parts[2]
+		if active == "" {
+			active = kid
+		}
+		var err error
+		switch alg {
+		case "HS256":
+			err = keyring.AddHMAC(kid, []byte(source))
+		case "EdDSA", "RS256":
+			err = addPEMKey(keyring, kid, alg, source)
+		default:
+			err = fmt.Errorf("key %q: unsupported algorithm %q", kid, alg)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keyring, keyring.SetActive(active)
+}
+
+func addPEMKey(keyring *Keyring, kid, alg, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("key %q: %w", kid, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("key %q: no PEM data in %s", kid, path)
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("key %q: %w", kid, err)
+		}
+		err = keyring.AddPrivateKey(kid, key)
+		if err != nil {
+			return err
+		}
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("key %q: %w", kid, err)
+		}
+		err = keyring.AddPublicKey(kid, key)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("key %q: unsupported PEM block %q", kid, block.Type)
+	}
+	if keyring.keys[kid].method.Alg() != alg {
+		return fmt.Errorf("key %q: algorithm %q does not match key type", kid, alg)
+	}
+	return nil
+}
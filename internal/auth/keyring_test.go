@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const testHMACSecret = "hmac-secret"
+
+// testKeyring has an HS256, an RS256 and an EdDSA key, with the HS256 key
+// active.
+func testKeyring(t *testing.T) (*Keyring, *rsa.PrivateKey) {
+	t.Helper()
+	k := NewKeyring("taday", "taday-api")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{
+		k.AddHMAC("hs", []byte(testHMACSecret)),
+		k.AddPrivateKey("rs", rsaKey),
+		k.AddPrivateKey("ed", edKey),
+		k.SetActive("hs"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return k, rsaKey
+}
+
+func validClaims(userID uuid.UUID) jwt.RegisteredClaims {
+	now := time.Now()
+	return jwt.RegisteredClaims{
+		Issuer:    "taday",
+		Audience:  jwt.ClaimStrings{"taday-api"},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		Subject:   userID.String(),
+	}
+}
+
+// signToken signs claims with method and key, claiming to be signed by kid.
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, claims jwt.Claims, key any) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestKeyringRoundTrip(t *testing.T) {
+	k, _ := testKeyring(t)
+	userID := uuid.New()
+	for _, kid := range []string{"hs", "rs", "ed"} {
+		if err := k.SetActive(kid); err != nil {
+			t.Fatal(err)
+		}
+		token, err := k.MakeAccessToken(userID, time.Hour)
+		if err != nil {
+			t.Fatalf("%s: %v", kid, err)
+		}
+		got, err := k.ValidateAccessToken(token)
+		if err != nil || got != userID {
+			t.Errorf("%s: got %v, %v; want %v", kid, got, err, userID)
+		}
+	}
+}
+
+func TestKeyringRejectsAlgorithmConfusion(t *testing.T) {
+	k, rsaKey := testKeyring(t)
+	claims := validClaims(uuid.New())
+	publicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+
+	tokens := map[string]string{
+		// The classic attack: the RSA public key used as an HMAC secret.
+		"HS256 with the RS256 public key PEM": signToken(t, jwt.SigningMethodHS256, "rs", claims, publicPEM),
+		"HS256 with the RS256 public key DER": signToken(t, jwt.SigningMethodHS256, "rs", claims, publicDER),
+		"RS256 token for the HS256 key":       signToken(t, jwt.SigningMethodRS256, "hs", claims, rsaKey),
+		"HS256 token for the EdDSA key":       signToken(t, jwt.SigningMethodHS256, "ed", claims, []byte(testHMACSecret)),
+		"none":                                signToken(t, jwt.SigningMethodNone, "hs", claims, jwt.UnsafeAllowNoneSignatureType),
+	}
+	for name, token := range tokens {
+		if _, err := k.ValidateAccessToken(token); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestKeyringRejectsInvalidClaims(t *testing.T) {
+	k, _ := testKeyring(t)
+	hs := []byte(testHMACSecret)
+	userID := uuid.New()
+
+	wrongIssuer := validClaims(userID)
+	wrongIssuer.Issuer = "someone-else"
+	wrongAudience := validClaims(userID)
+	wrongAudience.Audience = jwt.ClaimStrings{"other-api"}
+	noExpiry := validClaims(userID)
+	noExpiry.ExpiresAt = nil
+	expired := validClaims(userID)
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+
+	tokens := map[string]string{
+		"unknown kid":    signToken(t, jwt.SigningMethodHS256, "retired", validClaims(userID), hs),
+		"missing kid":    signToken(t, jwt.SigningMethodHS256, "", validClaims(userID), hs),
+		"wrong secret":   signToken(t, jwt.SigningMethodHS256, "hs", validClaims(userID), []byte("other-secret")),
+		"wrong issuer":   signToken(t, jwt.SigningMethodHS256, "hs", wrongIssuer, hs),
+		"wrong audience": signToken(t, jwt.SigningMethodHS256, "hs", wrongAudience, hs),
+		"missing exp":    signToken(t, jwt.SigningMethodHS256, "hs", noExpiry, hs),
+		"expired":        signToken(t, jwt.SigningMethodHS256, "hs", expired, hs),
+	}
+	for name, token := range tokens {
+		if _, err := k.ValidateAccessToken(token); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestKeyringJWKSOmitsHMACKeys(t *testing.T) {
+	k, _ := testKeyring(t)
+	set := k.JWKS()
+	kids := map[string]string{}
+	for _, key := range set.Keys {
+		kids[key.Kid] = key.Kty
+		if key.Kty == "oct" || key.Alg == "HS256" {
+			t.Errorf("JWKS contains HMAC key %q", key.Kid)
+		}
+	}
+	if kids["rs"] != "RSA" || kids["ed"] != "OKP" || len(kids) != 2 {
+		t.Errorf("got JWKS keys %v, want rs (RSA) and ed (OKP)", kids)
+	}
+
+	hmacOnly := NewKeyring("taday", "taday-api")
+	if err := hmacOnly.AddHMAC("hs", []byte(testHMACSecret)); err != nil {
+		t.Fatal(err)
+	}
+	if keys := hmacOnly.JWKS().Keys; len(keys) != 0 {
+		t.Errorf("HMAC only keyring published %d keys", len(keys))
+	}
+}
+
+func TestKeyringFromEnvRejectsMismatchedAlgorithm(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ed.pem")
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("JWT_KEYS", "k1:RS256:"+path)
+	_, err = KeyringFromEnv()
+	if err == nil || !strings.Contains(err.Error(), "does not match key type") {
+		t.Fatalf("got error %v, want an algorithm mismatch", err)
+	}
+
+	t.Setenv("JWT_KEYS", "k1:EdDSA:"+path)
+	if _, err := KeyringFromEnv(); err != nil {
+		t.Fatalf("matching algorithm: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 test key from RFC 6238, "12345678901234567890",
+// in base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// The RFC's vectors are eight digits; the last six are the six digit code.
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestValidateTOTPVectors(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		step, ok := ValidateTOTP(rfc6238Secret, v.code, time.Unix(v.unix, 0))
+		if !ok {
+			t.Errorf("%d: code %s rejected", v.unix, v.code)
+			continue
+		}
+		if want := v.unix / totpPeriod; step != want {
+			t.Errorf("%d: got step %d, want %d", v.unix, step, want)
+		}
+	}
+}
+
+func TestValidateTOTPSkew(t *testing.T) {
+	const unix, code = 1111111111, "050471"
+	for _, tt := range []struct {
+		name   string
+		offset int64
+		ok     bool
+	}{
+		{"one step early", -totpPeriod, true},
+		{"one step late", totpPeriod, true},
+		{"two steps early", -2 * totpPeriod, false},
+		{"two steps late", 2 * totpPeriod, false},
+	} {
+		step, ok := ValidateTOTP(rfc6238Secret, code, time.Unix(unix+tt.offset, 0))
+		if ok != tt.ok {
+			t.Errorf("%s: got ok %v, want %v", tt.name, ok, tt.ok)
+		}
+		// A code accepted with skew reports the step it was generated for,
+		// so it can't be used again in the next step.
+		if ok && step != unix/totpPeriod {
+			t.Errorf("%s: got step %d, want %d", tt.name, step, unix/totpPeriod)
+		}
+	}
+}
+
+func TestValidateTOTPStepReuse(t *testing.T) {
+	const unix, code = 1234567890, "005924"
+	first, ok := ValidateTOTP(rfc6238Secret, code, time.Unix(unix, 0))
+	if !ok {
+		t.Fatal("code rejected")
+	}
+	again, ok := ValidateTOTP(rfc6238Secret, code, time.Unix(unix+totpPeriod, 0))
+	if !ok || again != first {
+		t.Errorf("reused in the next step: got step %d, %v; want %d so callers reject it", again, ok, first)
+	}
+	next, ok := ValidateTOTP(rfc6238Secret, totpCode(mustDecode(t, rfc6238Secret), first+1), time.Unix(unix+totpPeriod, 0))
+	if !ok || next <= first {
+		t.Errorf("next code: got step %d, %v; want a step after %d", next, ok, first)
+	}
+}
+
+func TestValidateTOTPRejectsMalformed(t *testing.T) {
+	now := time.Unix(59, 0)
+	for _, tt := range []struct{ secret, code string }{
+		{rfc6238Secret, "28708"},
+		{rfc6238Secret, "2870820"},
+		{rfc6238Secret, ""},
+		{"not base32!", "287082"},
+	} {
+		if _, ok := ValidateTOTP(tt.secret, tt.code, now); ok {
+			t.Errorf("secret %q code %q accepted", tt.secret, tt.code)
+		}
+	}
+	if _, ok := ValidateTOTP(" "+rfc6238Secret+" ", "287 082", now); !ok {
+		t.Error("spaces in the secret or code not ignored")
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	for _, in := range []string{"K3M9Q-7TXPA", "k3m9q-7txpa", "K3M9Q7TXPA", " k3m9q 7txpa "} {
+		if got := NormalizeRecoveryCode(in); got != "K3M9Q7TXPA" {
+			t.Errorf("NormalizeRecoveryCode(%q) = %q, want K3M9Q7TXPA", in, got)
+		}
+	}
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("code %q isn't two groups of five", code)
+		}
+		normalized := NormalizeRecoveryCode(code)
+		if seen[normalized] {
+			t.Errorf("code %q generated twice", code)
+		}
+		seen[normalized] = true
+	}
+}
+
+func mustDecode(t *testing.T, secret string) []byte {
+	t.Helper()
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
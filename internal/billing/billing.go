@@ -0,0 +1,59 @@
+// Package billing talks to the payment provider: it creates customers and
+// checkout sessions, changes subscriptions and verifies webhook events.
+package billing
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+// Provider is what the handlers need from the payment provider. Webhook
+// events come back as Stripe events, which the fake produces as well.
+type Provider interface {
+	CreateCustomer(ctx context.Context, email string) (string, error)
+	// CreateCheckoutSession returns the URL of the checkout page.
+	CreateCheckoutSession(ctx context.Context, params CheckoutParams) (string, error)
+	// CreatePortalSession returns the URL of the customer portal.
+	CreatePortalSession(ctx context.Context, customerID, returnURL string) (string, error)
+	SetCancelAtPeriodEnd(ctx context.Context, subscriptionID string, cancel bool) error
+	// ConstructEvent verifies the signature of a webhook payload and parses it.
+	ConstructEvent(payload []byte, signature string) (stripe.Event, error)
+}
+
+type CheckoutParams struct {
+	CustomerID string
+	// ClientReferenceID is sent back in the checkout.session.completed event.
+	ClientReferenceID   string
+	PriceID             string
+	Plan                string
+	TrialDays           int64
+	AllowPromotionCodes bool
+	SuccessURL          string
+	CancelURL           string
+}
+
+// FromEnv returns a Fake when BILLING_PROVIDER is "fake" and Stripe otherwise.
+// The fake posts its events to BILLING_FAKE_WEBHOOK_URL, by default the
+// webhook of an API running locally. Anyone who knows its webhook secret can
+// sign events that grant a paid plan, so it is refused unless PLATFORM is
+// "dev" and STRIPE_WEBHOOK_SECRET is set.
+func FromEnv() (Provider, error) {
+	if os.Getenv("BILLING_PROVIDER") == "fake" {
+		if os.Getenv("PLATFORM") != "dev" {
+			return nil, errors.New("BILLING_PROVIDER=fake is only allowed with PLATFORM=dev")
+		}
+		secret := os.Getenv("STRIPE_WEBHOOK_SECRET")
+		if secret == "" {
+			return nil, errors.New("BILLING_PROVIDER=fake needs STRIPE_WEBHOOK_SECRET")
+		}
+		webhookURL := os.Getenv("BILLING_FAKE_WEBHOOK_URL")
+		if webhookURL == "" {
+			webhookURL = "http://localhost:8080/api/webhook"
+		}
+		return NewFake(webhookURL, secret), nil
+	}
+	return NewStripe(os.Getenv("STRIPE_SECRET_KEY"), os.Getenv("STRIPE_WEBHOOK_SECRET")), nil
+}
@@ -0,0 +1,293 @@
+package billing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/webhook"
+)
+
+// Fake is an in-memory Provider for development and tests. Checkouts
+// complete straight away, and every change is sent to the webhook as a
+// signed event in the order it happened, the way Stripe would send it.
+type Fake struct {
+	webhookURL string
+	secret     string
+	client     *http.Client
+	events     chan []byte
+
+	mu            sync.Mutex
+	pending       [][]byte
+	nextID        int
+	customers     map[string]string
+	subscriptions map[string]*fakeSubscription
+}
+
+type fakeSubscription struct {
+	ID                string
+	Customer          string
+	PriceID           string
+	Plan              string
+	Status            string
+	PeriodStart       time.Time
+	PeriodEnd         time.Time
+	TrialEnd          time.Time
+	CancelAtPeriodEnd bool
+}
+
+// NewFake returns a Fake that signs its events with secret and posts them to
+// webhookURL. Without a URL events are kept for tests to take with Events and
+// deliver themselves.
+func NewFake(webhookURL, secret string) *Fake {
+	f := &Fake{
+		webhookURL:    webhookURL,
+		secret:        secret,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		events:        make(chan []byte, 100),
+		customers:     map[string]string{},
+		subscriptions: map[string]*fakeSubscription{},
+	}
+	if webhookURL != "" {
+		go f.deliver()
+	}
+	return f
+}
+
+func (f *Fake) id(prefix string) string {
+	f.nextID++
+	return fmt.Sprintf("%s_fake%d", prefix, f.nextID)
+}
+
+func (f *Fake) CreateCustomer(ctx context.Context, email string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.id("cus")
+	f.customers[id] = email
+	return id, nil
+}
+
+// CreateCheckoutSession starts the subscription right away and returns the
+// success URL in place of a checkout page.
+func (f *Fake) CreateCheckoutSession(ctx context.Context, params CheckoutParams) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.customers[params.CustomerID]; !ok {
+		return "", fmt.Errorf("no such customer: %s", params.CustomerID)
+	}
+	now := time.Now()
+	sub := &fakeSubscription{
+		ID:          f.id("sub"),
+		Customer:    params.CustomerID,
+		PriceID:     params.PriceID,
+		Plan:        params.Plan,
+		Status:      "active",
+		PeriodStart: now,
+		PeriodEnd:   now.AddDate(0, 1, 0),
+	}
+	if params.TrialDays > 0 {
+		sub.Status = "trialing"
+		sub.TrialEnd = now.AddDate(0, 0, int(params.TrialDays))
+		sub.PeriodEnd = sub.TrialEnd
+	}
+	f.subscriptions[sub.ID] = sub
+
+	f.emit("checkout.session.completed", map[string]any{
+		"id":                  f.id("cs"),
+		"object":              "checkout.session",
+		"customer":            sub.Customer,
+		"subscription":        sub.ID,
+		"client_reference_id": params.ClientReferenceID,
+	})
+	f.emit("customer.subscription.created", sub.object())
+	return params.SuccessURL, nil
+}
+
+func (f *Fake) CreatePortalSession(ctx context.Context, customerID, returnURL string) (string, error) {
+	return returnURL, nil
+}
+
+func (f *Fake) SetCancelAtPeriodEnd(ctx context.Context, subscriptionID string, cancel bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sub, ok := f.subscriptions[subscriptionID]
+	if !ok {
+		return fmt.Errorf("no such subscription: %s", subscriptionID)
+	}
+	sub.CancelAtPeriodEnd = cancel
+	f.emit("customer.subscription.updated", sub.object())
+	return nil
+}
+
+func (f *Fake) ConstructEvent(payload []byte, signature string) (stripe.Event, error) {
+	return webhook.ConstructEvent(payload, signature, f.secret)
+}
+
+// FailPayment makes the renewal of a subscription fail, sending the
+// invoice.payment_failed and customer.subscription.updated events.
+func (f *Fake) FailPayment(subscriptionID string) error {
+	return f.invoice(subscriptionID, "invoice.payment_failed", "past_due")
+}
+
+// PayInvoice settles the open invoice of a subscription, renewing it.
+func (f *Fake) PayInvoice(subscriptionID string) error {
+	return f.invoice(subscriptionID, "invoice.paid", "active")
+}
+
+func (f *Fake) invoice(subscriptionID, eventType, status string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sub, ok := f.subscriptions[subscriptionID]
+	if !ok {
+		return fmt.Errorf("no such subscription: %s", subscriptionID)
+	}
+	if status == "active" && sub.Status != "active" {
+		sub.PeriodStart = time.Now()
+		sub.PeriodEnd = sub.PeriodStart.AddDate(0, 1, 0)
+	}
+	sub.Status = status
+	f.emit(eventType, map[string]any{
+		"id":       f.id("in"),
+		"object":   "invoice",
+		"customer": sub.Customer,
+		"parent": map[string]any{
+			"type":                 "subscription_details",
+			"subscription_details": map[string]any{"subscription": sub.ID},
+		},
+	})
+	f.emit("customer.subscription.updated", sub.object())
+	return nil
+}
+
+// DeleteSubscription ends a subscription immediately.
+func (f *Fake) DeleteSubscription(subscriptionID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sub, ok := f.subscriptions[subscriptionID]
+	if !ok {
+		return fmt.Errorf("no such subscription: %s", subscriptionID)
+	}
+	sub.Status = "canceled"
+	f.emit("customer.subscription.deleted", sub.object())
+	delete(f.subscriptions, subscriptionID)
+	return nil
+}
+
+func (s *fakeSubscription) object() map[string]any {
+	trialEnd := int64(0)
+	trialStart := int64(0)
+	if !s.TrialEnd.IsZero() {
+		trialStart = s.PeriodStart.Unix()
+		trialEnd = s.TrialEnd.Unix()
+	}
+	return map[string]any{
+		"id":                   s.ID,
+		"object":               "subscription",
+		"customer":             s.Customer,
+		"status":               s.Status,
+		"cancel_at_period_end": s.CancelAtPeriodEnd,
+		"trial_start":          trialStart,
+		"trial_end":            trialEnd,
+		"metadata":             map[string]string{"plan": s.Plan},
+		"items": map[string]any{
+			"object": "list",
+			"data": []map[string]any{{
+				"id":                   s.ID + "_item",
+				"object":               "subscription_item",
+				"current_period_start": s.PeriodStart.Unix(),
+				"current_period_end":   s.PeriodEnd.Unix(),
+				"price":                map[string]any{"id": s.PriceID, "object": "price"},
+			}},
+		},
+	}
+}
+
+// Event builds a webhook payload for an event carrying object, and the
+// Stripe-Signature header that goes with it.
+func (f *Fake) Event(eventType string, object any) ([]byte, string, error) {
+	f.mu.Lock()
+	id := f.id("evt")
+	f.mu.Unlock()
+	return f.event(id, eventType, object)
+}
+
+func (f *Fake) event(id, eventType string, object any) ([]byte, string, error) {
+	payload, err := json.Marshal(map[string]any{
+		"id":          id,
+		"object":      "event",
+		"api_version": stripe.APIVersion,
+		"created":     time.Now().Unix(),
+		"type":        eventType,
+		"data":        map[string]any{"object": object},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: f.secret})
+	return payload, signed.Header, nil
+}
+
+// SignedEvent is a webhook payload and the Stripe-Signature header for it.
+type SignedEvent struct {
+	Payload   []byte
+	Signature string
+}
+
+// Events returns the events built since the last call, in the order they
+// happened, signed now. It is always empty when events go to a webhook URL.
+func (f *Fake) Events() []SignedEvent {
+	f.mu.Lock()
+	pending := f.pending
+	f.pending = nil
+	f.mu.Unlock()
+	events := make([]SignedEvent, len(pending))
+	for i, payload := range pending {
+		signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: f.secret})
+		events[i] = SignedEvent{Payload: payload, Signature: signed.Header}
+	}
+	return events
+}
+
+// emit queues an event for the webhook, or for Events. f.mu must be held.
+func (f *Fake) emit(eventType string, object any) {
+	payload, _, err := f.event(f.id("evt"), eventType, object)
+	if err != nil {
+		slog.Error("Error building fake billing event", "type", eventType, "error", err)
+		return
+	}
+	if f.webhookURL == "" {
+		f.pending = append(f.pending, payload)
+		return
+	}
+	f.events <- payload
+}
+
+// deliver posts queued events one at a time, signing them when they are sent
+// so that a slow webhook doesn't make the signatures expire.
+func (f *Fake) deliver() {
+	for payload := range f.events {
+		signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: f.secret})
+		req, err := http.NewRequest(http.MethodPost, f.webhookURL, bytes.NewReader(payload))
+		if err != nil {
+			slog.Error("Error posting fake billing event", "error", err)
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Stripe-Signature", signed.Header)
+		resp, err := f.client.Do(req)
+		if err != nil {
+			slog.Error("Error posting fake billing event", "error", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			slog.Warn("Webhook rejected fake billing event", "status", resp.StatusCode)
+		}
+	}
+}
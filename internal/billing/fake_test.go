@@ -0,0 +1,74 @@
+package billing
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestFakeQueuesEventsWithoutWebhook(t *testing.T) {
+	f := NewFake("", "whsec_test")
+	ctx := context.Background()
+	customerID, err := f.CreateCustomer(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.CreateCheckoutSession(ctx, CheckoutParams{CustomerID: customerID, PriceID: "price_pro", Plan: "pro"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var subscriptionID string
+	var types []string
+	for _, e := range f.Events() {
+		event, err := f.ConstructEvent(e.Payload, e.Signature)
+		if err != nil {
+			t.Fatalf("event doesn't verify: %v", err)
+		}
+		types = append(types, string(event.Type))
+		if event.Type == "customer.subscription.created" {
+			subscriptionID, _ = event.Data.Object["id"].(string)
+		}
+	}
+	if err := f.FailPayment(subscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range f.Events() {
+		event, err := f.ConstructEvent(e.Payload, e.Signature)
+		if err != nil {
+			t.Fatalf("event doesn't verify: %v", err)
+		}
+		types = append(types, string(event.Type))
+	}
+
+	want := []string{"checkout.session.completed", "customer.subscription.created", "invoice.payment_failed", "customer.subscription.updated"}
+	if !slices.Equal(types, want) {
+		t.Fatalf("got events %v, want %v", types, want)
+	}
+	if events := f.Events(); len(events) != 0 {
+		t.Errorf("got %d events after draining, want 0", len(events))
+	}
+}
+
+func TestFromEnvRefusesFakeOutsideDev(t *testing.T) {
+	t.Setenv("BILLING_PROVIDER", "fake")
+	for _, tt := range []struct {
+		platform, secret string
+		ok               bool
+	}{
+		{"", "whsec_local", false},
+		{"prod", "whsec_local", false},
+		{"dev", "", false},
+		{"dev", "whsec_local", true},
+	} {
+		t.Setenv("PLATFORM", tt.platform)
+		t.Setenv("STRIPE_WEBHOOK_SECRET", tt.secret)
+		provider, err := FromEnv()
+		if tt.ok != (err == nil) {
+			t.Errorf("PLATFORM=%q STRIPE_WEBHOOK_SECRET=%q: got error %v", tt.platform, tt.secret, err)
+		}
+		if _, isFake := provider.(*Fake); tt.ok && !isFake {
+			t.Errorf("PLATFORM=%q: got %T, want the fake", tt.platform, provider)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package billing
+
+import (
+	"context"
+
+	"github.com/curtisbraxdale/taday/internal/tracing"
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/webhook"
+)
+
+// Stripe is the Provider backed by the Stripe API.
+type Stripe struct {
+	client        *stripe.Client
+	webhookSecret string
+}
+
+func NewStripe(key, webhookSecret string) *Stripe {
+	return &Stripe{client: stripe.NewClient(key), webhookSecret: webhookSecret}
+}
+
+func (s *Stripe) CreateCustomer(ctx context.Context, email string) (_ string, err error) {
+	ctx, span := tracing.StartClient(ctx, "stripe CreateCustomer")
+	defer func() { tracing.End(span, err) }()
+	c, err := s.client.V1Customers.Create(ctx, &stripe.CustomerCreateParams{
+		Email: stripe.String(email),
+	})
+	if err != nil {
+		return "", err
+	}
+	return c.ID, nil
+}
+
+func (s *Stripe) CreateCheckoutSession(ctx context.Context, params CheckoutParams) (_ string, err error) {
+	ctx, span := tracing.StartClient(ctx, "stripe CreateCheckoutSession")
+	defer func() { tracing.End(span, err) }()
+	sessionParams := &stripe.CheckoutSessionCreateParams{
+		LineItems: []*stripe.CheckoutSessionCreateLineItemParams{
+			{
+				Price:    stripe.String(params.PriceID),
+				Quantity: stripe.Int64(1),
+			},
+		},
+		Mode: stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+
+		SuccessURL: stripe.String(params.SuccessURL),
+		CancelURL:  stripe.String(params.CancelURL),
+
+		AllowPromotionCodes: stripe.Bool(params.AllowPromotionCodes),
+		// The webhook falls back to the plan key if the price is ever
+		// removed from the catalog.
+		SubscriptionData: &stripe.CheckoutSessionCreateSubscriptionDataParams{
+			Metadata: map[string]string{"plan": params.Plan},
+		},
+
+		AutomaticTax: &stripe.CheckoutSessionCreateAutomaticTaxParams{
+			Enabled: stripe.Bool(true),
+		},
+
+		Customer:          stripe.String(params.CustomerID),
+		ClientReferenceID: stripe.String(params.ClientReferenceID),
+
+		CustomerUpdate: &stripe.CheckoutSessionCreateCustomerUpdateParams{
+			Address: stripe.String("auto"),
+		},
+	}
+	if params.TrialDays > 0 {
+		sessionParams.SubscriptionData.TrialPeriodDays = stripe.Int64(params.TrialDays)
+	}
+
+	session, err := s.client.V1CheckoutSessions.Create(ctx, sessionParams)
+	if err != nil {
+		return "", err
+	}
+	return session.URL, nil
+}
+
+func (s *Stripe) CreatePortalSession(ctx context.Context, customerID, returnURL string) (_ string, err error) {
+	ctx, span := tracing.StartClient(ctx, "stripe CreatePortalSession")
+	defer func() { tracing.End(span, err) }()
+	session, err := s.client.V1BillingPortalSessions.Create(ctx, &stripe.BillingPortalSessionCreateParams{
+		Customer:  stripe.String(customerID),
+		ReturnURL: stripe.String(returnURL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return session.URL, nil
+}
+
+func (s *Stripe) SetCancelAtPeriodEnd(ctx context.Context, subscriptionID string, cancel bool) error {
+	ctx, span := tracing.StartClient(ctx, "stripe UpdateSubscription")
+	_, err := s.client.V1Subscriptions.Update(ctx, subscriptionID, &stripe.SubscriptionUpdateParams{
+		CancelAtPeriodEnd: stripe.Bool(cancel),
+	})
+	tracing.End(span, err)
+	return err
+}
+
+func (s *Stripe) ConstructEvent(payload []byte, signature string) (stripe.Event, error) {
+	return webhook.ConstructEvent(payload, signature, s.webhookSecret)
+}
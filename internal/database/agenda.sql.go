@@ -14,7 +14,7 @@ import (
 )
 
 const getAllUsers = `-- name: GetAllUsers :many
-SELECT id, username, phone_number FROM users
+SELECT id, username, phone_number FROM users WHERE deleted_at IS NULL
 `
 
 type GetAllUsersRow struct {
@@ -52,6 +52,7 @@ FROM events
 WHERE user_id = $1
   AND start_date < $2
   AND end_date >= $3
+  AND deleted_at IS NULL
 ORDER BY start_date ASC
 `
 
@@ -95,6 +96,7 @@ FROM events
 WHERE user_id = $1
   AND start_date < $2
   AND end_date >= $3
+  AND deleted_at IS NULL
 ORDER BY start_date ASC
 `
 
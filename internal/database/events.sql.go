@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 const createEvent = `-- name: CreateEvent :one
@@ -30,7 +31,7 @@ VALUES (
     $9,
     $10
 )
-RETURNING id, user_id, created_at, updated_at, start_date, end_date, title, description, priority, recur_d, recur_w, recur_m, recur_y
+RETURNING id, user_id, created_at, updated_at, start_date, end_date, title, description, priority, recur_d, recur_w, recur_m, recur_y, deleted_at
 `
 
 type CreateEventParams struct {
@@ -74,17 +75,26 @@ func (q *Queries) CreateEvent(ctx context.Context, arg CreateEventParams) (Event
 		&i.RecurW,
 		&i.RecurM,
 		&i.RecurY,
+		&i.DeletedAt,
 	)
 	return i, err
 }
 
-const deleteEventByID = `-- name: DeleteEventByID :exec
-DELETE FROM events WHERE id = $1
+const deleteEventByID = `-- name: DeleteEventByID :execrows
+UPDATE events SET deleted_at = NOW() WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL
 `
 
-func (q *Queries) DeleteEventByID(ctx context.Context, id uuid.UUID) error {
-	_, err := q.db.ExecContext(ctx, deleteEventByID, id)
-	return err
+type DeleteEventByIDParams struct {
+	ID     uuid.UUID
+	UserID uuid.UUID
+}
+
+func (q *Queries) DeleteEventByID(ctx context.Context, arg DeleteEventByIDParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteEventByID, arg.ID, arg.UserID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
 }
 
 const deleteEvents = `-- name: DeleteEvents :exec
@@ -97,7 +107,7 @@ func (q *Queries) DeleteEvents(ctx context.Context) error {
 }
 
 const getEventByID = `-- name: GetEventByID :one
-SELECT id, user_id, created_at, updated_at, start_date, end_date, title, description, priority, recur_d, recur_w, recur_m, recur_y FROM events WHERE id = $1
+SELECT id, user_id, created_at, updated_at, start_date, end_date, title, description, priority, recur_d, recur_w, recur_m, recur_y, deleted_at FROM events WHERE id = $1 AND deleted_at IS NULL
 `
 
 func (q *Queries) GetEventByID(ctx context.Context, id uuid.UUID) (Event, error) {
@@ -117,12 +127,60 @@ func (q *Queries) GetEventByID(ctx context.Context, id uuid.UUID) (Event, error)
 		&i.RecurW,
 		&i.RecurM,
 		&i.RecurY,
+		&i.DeletedAt,
 	)
 	return i, err
 }
 
+const getEventsByIDs = `-- name: GetEventsByIDs :many
+SELECT id, user_id, created_at, updated_at, start_date, end_date, title, description, priority, recur_d, recur_w, recur_m, recur_y, deleted_at FROM events WHERE user_id = $1 AND id = ANY($2::uuid[]) AND deleted_at IS NULL
+`
+
+type GetEventsByIDsParams struct {
+	UserID uuid.UUID
+	Ids    []uuid.UUID
+}
+
+func (q *Queries) GetEventsByIDs(ctx context.Context, arg GetEventsByIDsParams) ([]Event, error) {
+	rows, err := q.db.QueryContext(ctx, getEventsByIDs, arg.UserID, pq.Array(arg.Ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Event
+	for rows.Next() {
+		var i Event
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.StartDate,
+			&i.EndDate,
+			&i.Title,
+			&i.Description,
+			&i.Priority,
+			&i.RecurD,
+			&i.RecurW,
+			&i.RecurM,
+			&i.RecurY,
+			&i.DeletedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getEventsByUserID = `-- name: GetEventsByUserID :many
-SELECT id, user_id, created_at, updated_at, start_date, end_date, title, description, priority, recur_d, recur_w, recur_m, recur_y FROM events WHERE user_id = $1
+SELECT id, user_id, created_at, updated_at, start_date, end_date, title, description, priority, recur_d, recur_w, recur_m, recur_y, deleted_at FROM events WHERE user_id = $1 AND deleted_at IS NULL
 `
 
 func (q *Queries) GetEventsByUserID(ctx context.Context, userID uuid.UUID) ([]Event, error) {
@@ -148,6 +206,7 @@ func (q *Queries) GetEventsByUserID(ctx context.Context, userID uuid.UUID) ([]Ev
 			&i.RecurW,
 			&i.RecurM,
 			&i.RecurY,
+			&i.DeletedAt,
 		); err != nil {
 			return nil, err
 		}
@@ -162,6 +221,52 @@ func (q *Queries) GetEventsByUserID(ctx context.Context, userID uuid.UUID) ([]Ev
 	return items, nil
 }
 
+const purgeDeletedEvents = `-- name: PurgeDeletedEvents :execrows
+DELETE FROM events WHERE deleted_at < $1::timestamp
+`
+
+func (q *Queries) PurgeDeletedEvents(ctx context.Context, before time.Time) (int64, error) {
+	result, err := q.db.ExecContext(ctx, purgeDeletedEvents, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const restoreEvent = `-- name: RestoreEvent :one
+UPDATE events
+SET updated_at = NOW(), deleted_at = NULL
+WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL
+RETURNING id, user_id, created_at, updated_at, start_date, end_date, title, description, priority, recur_d, recur_w, recur_m, recur_y, deleted_at
+`
+
+type RestoreEventParams struct {
+	ID     uuid.UUID
+	UserID uuid.UUID
+}
+
+func (q *Queries) RestoreEvent(ctx context.Context, arg RestoreEventParams) (Event, error) {
+	row := q.db.QueryRowContext(ctx, restoreEvent, arg.ID, arg.UserID)
+	var i Event
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.StartDate,
+		&i.EndDate,
+		&i.Title,
+		&i.Description,
+		&i.Priority,
+		&i.RecurD,
+		&i.RecurW,
+		&i.RecurM,
+		&i.RecurY,
+		&i.DeletedAt,
+	)
+	return i, err
+}
+
 const updateEvent = `-- name: UpdateEvent :one
 UPDATE events
 SET
@@ -175,8 +280,9 @@ SET
     recur_w = $7,
     recur_m = $8,
     recur_y = $9
-WHERE id = $10
-RETURNING id, user_id, created_at, updated_at, start_date, end_date, title, description, priority, recur_d, recur_w, recur_m, recur_y
+WHERE id = $10 AND user_id = $11 AND deleted_at IS NULL
+    AND ($12::timestamp IS NULL OR updated_at = $12)
+RETURNING id, user_id, created_at, updated_at, start_date, end_date, title, description, priority, recur_d, recur_w, recur_m, recur_y, deleted_at
 `
 
 type UpdateEventParams struct {
@@ -190,6 +296,8 @@ type UpdateEventParams struct {
 	RecurM      bool
 	RecurY      bool
 	EventID     uuid.UUID
+	UserID      uuid.UUID
+	IfUpdatedAt sql.NullTime
 }
 
 func (q *Queries) UpdateEvent(ctx context.Context, arg UpdateEventParams) (Event, error) {
@@ -204,6 +312,8 @@ func (q *Queries) UpdateEvent(ctx context.Context, arg UpdateEventParams) (Event
 		arg.RecurM,
 		arg.RecurY,
 		arg.EventID,
+		arg.UserID,
+		arg.IfUpdatedAt,
 	)
 	var i Event
 	err := row.Scan(
@@ -220,6 +330,7 @@ func (q *Queries) UpdateEvent(ctx context.Context, arg UpdateEventParams) (Event
 		&i.RecurW,
 		&i.RecurM,
 		&i.RecurY,
+		&i.DeletedAt,
 	)
 	return i, err
 }
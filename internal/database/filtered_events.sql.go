@@ -7,47 +7,86 @@ package database
 
 import (
 	"context"
-	"time"
+	"database/sql"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
-const getFilteredEvents = `-- name: GetFilteredEvents :many
-SELECT id, user_id, created_at, updated_at, start_date, end_date, title, description, priority, recur_d, recur_w, recur_m, recur_y
+const listEvents = `-- name: ListEvents :many
+SELECT id, user_id, created_at, updated_at, start_date, end_date, title, description, priority, recur_d, recur_w, recur_m, recur_y, deleted_at
 FROM events
 WHERE events.user_id = $1
+  AND events.deleted_at IS NULL
   AND (
-      $2::timestamptz IS NULL OR
+      $2::timestamp IS NULL OR
       events.start_date >= $2
   )
   AND (
-      $3::timestamptz IS NULL OR
+      $3::timestamp IS NULL OR
       events.start_date < $3
   )
   AND (
-      $4::text IS NULL OR
-      EXISTS (
-          SELECT 1
-          FROM event_tags et
-          JOIN tags t ON t.id = et.tag_id
-          WHERE et.event_id = events.id AND t.name = $4
+      $4::boolean IS NULL OR
+      events.priority = $4
+  )
+  AND (
+      cardinality($5::text[]) = 0 OR
+      (
+          $6::boolean AND (
+              SELECT COUNT(DISTINCT t.name)
+              FROM event_tags et
+              JOIN tags t ON t.id = et.tag_id AND t.deleted_at IS NULL
+              WHERE et.event_id = events.id AND t.name = ANY($5::text[])
+          ) = cardinality($5::text[])
+      ) OR
+      (
+          NOT $6::boolean AND EXISTS (
+              SELECT 1
+              FROM event_tags et
+              JOIN tags t ON t.id = et.tag_id AND t.deleted_at IS NULL
+              WHERE et.event_id = events.id AND t.name = ANY($5::text[])
+          )
       )
   )
+  AND (
+      $7::timestamp IS NULL OR
+      ($8::boolean AND (events.start_date, events.id) < ($7, $9::uuid)) OR
+      (NOT $8::boolean AND (events.start_date, events.id) > ($7, $9::uuid))
+  )
+ORDER BY
+    CASE WHEN $8::boolean THEN events.start_date END DESC,
+    CASE WHEN $8::boolean THEN events.id END DESC,
+    events.start_date ASC,
+    events.id ASC
+LIMIT $10
 `
 
-type GetFilteredEventsParams struct {
-	UserID    uuid.UUID
-	StartDate time.Time
-	EndDate   time.Time
-	Tag       string
+type ListEventsParams struct {
+	UserID          uuid.UUID
+	FromDate        sql.NullTime
+	ToDate          sql.NullTime
+	Priority        sql.NullBool
+	Tags            []string
+	MatchAllTags    bool
+	CursorStartDate sql.NullTime
+	Descending      bool
+	CursorID        uuid.NullUUID
+	RowLimit        int32
 }
 
-func (q *Queries) GetFilteredEvents(ctx context.Context, arg GetFilteredEventsParams) ([]Event, error) {
-	rows, err := q.db.QueryContext(ctx, getFilteredEvents,
+func (q *Queries) ListEvents(ctx context.Context, arg ListEventsParams) ([]Event, error) {
+	rows, err := q.db.QueryContext(ctx, listEvents,
 		arg.UserID,
-		arg.StartDate,
-		arg.EndDate,
-		arg.Tag,
+		arg.FromDate,
+		arg.ToDate,
+		arg.Priority,
+		pq.Array(arg.Tags),
+		arg.MatchAllTags,
+		arg.CursorStartDate,
+		arg.Descending,
+		arg.CursorID,
+		arg.RowLimit,
 	)
 	if err != nil {
 		return nil, err
@@ -70,6 +109,7 @@ func (q *Queries) GetFilteredEvents(ctx context.Context, arg GetFilteredEventsPa
 			&i.RecurW,
 			&i.RecurM,
 			&i.RecurY,
+			&i.DeletedAt,
 		); err != nil {
 			return nil, err
 		}
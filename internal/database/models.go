@@ -11,6 +11,63 @@ import (
 	"github.com/google/uuid"
 )
 
+type AuditEvent struct {
+	ID         uuid.UUID
+	UserID     uuid.UUID
+	Actor      string
+	Action     string
+	ResourceID uuid.NullUUID
+	Details    string
+	IpAddress  string
+	UserAgent  string
+	CreatedAt  time.Time
+}
+
+type Change struct {
+	Seq       int64
+	UserID    uuid.UUID
+	Resource  string
+	RecordID  uuid.UUID
+	TagID     uuid.NullUUID
+	Deleted   bool
+	ChangedAt time.Time
+}
+
+type Delivery struct {
+	ID                uuid.UUID
+	UserID            uuid.UUID
+	Channel           string
+	Kind              string
+	Recipient         string
+	Body              string
+	Status            string
+	ProviderMessageID string
+	Error             string
+	CreatedAt         time.Time
+}
+
+type DunningCase struct {
+	ID                   uuid.UUID
+	UserID               uuid.UUID
+	StripeSubscriptionID string
+	InvoiceID            string
+	NoticesSent          int32
+	NextNoticeAt         sql.NullTime
+	Resolution           string
+	ResolvedAt           sql.NullTime
+	CreatedAt            time.Time
+	UpdatedAt            time.Time
+}
+
+type EmailVerificationToken struct {
+	TokenHash string
+	UserID    uuid.UUID
+	Email     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    sql.NullTime
+}
+
 type Event struct {
 	ID          uuid.UUID
 	UserID      uuid.UUID
@@ -25,6 +82,7 @@ type Event struct {
 	RecurW      bool
 	RecurM      bool
 	RecurY      bool
+	DeletedAt   sql.NullTime
 }
 
 type EventTag struct {
@@ -32,13 +90,57 @@ type EventTag struct {
 	TagID   uuid.UUID
 }
 
-type RefreshToken struct {
-	Token     string
+type LoginChallenge struct {
+	TokenHash string
+	UserID    uuid.UUID
 	CreatedAt time.Time
+	ExpiresAt time.Time
+	Attempts  int32
+	UsedAt    sql.NullTime
+}
+
+type OidcLoginState struct {
+	State        string
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	LinkUserID   uuid.NullUUID
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+}
+
+type RateLimitBucket struct {
+	Key       string
+	Tokens    float64
 	UpdatedAt time.Time
-	ExpiresAt sql.NullTime
-	RevokedAt sql.NullTime
+}
+
+type RecoveryCode struct {
+	ID        uuid.UUID
 	UserID    uuid.UUID
+	CodeHash  string
+	CreatedAt time.Time
+	UsedAt    sql.NullTime
+}
+
+type RefreshToken struct {
+	Token      string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	ExpiresAt  sql.NullTime
+	RevokedAt  sql.NullTime
+	UserID     uuid.UUID
+	FamilyID   uuid.UUID
+	ReplacedBy sql.NullString
+	UserAgent  string
+	IpAddress  string
+}
+
+type RenamedUserIdentifier struct {
+	UserID        uuid.UUID
+	Field         string
+	OriginalValue string
+	CreatedAt     time.Time
 }
 
 type Subscription struct {
@@ -56,13 +158,15 @@ type Subscription struct {
 	TrialEnd             sql.NullTime
 	CreatedAt            time.Time
 	UpdatedAt            time.Time
+	LastEventAt          sql.NullTime
 }
 
 type Tag struct {
-	ID     uuid.UUID
-	UserID uuid.UUID
-	Name   string
-	Color  string
+	ID        uuid.UUID
+	UserID    uuid.UUID
+	Name      string
+	Color     string
+	DeletedAt sql.NullTime
 }
 
 type Todo struct {
@@ -73,15 +177,33 @@ type Todo struct {
 	Date        sql.NullTime
 	Title       string
 	Description sql.NullString
+	DeletedAt   sql.NullTime
 }
 
 type User struct {
-	ID               uuid.UUID
-	CreatedAt        time.Time
-	UpdatedAt        time.Time
-	Username         string
-	Email            string
-	HashedPassword   string
-	PhoneNumber      string
-	StripeCustomerID sql.NullString
+	ID                  uuid.UUID
+	CreatedAt           time.Time
+	UpdatedAt           time.Time
+	Username            string
+	Email               string
+	HashedPassword      string
+	PhoneNumber         string
+	StripeCustomerID    sql.NullString
+	VerifiedAt          sql.NullTime
+	TotpSecret          sql.NullString
+	TotpEnabledAt       sql.NullTime
+	TotpLastStep        int64
+	FailedLoginAttempts int32
+	LockedUntil         sql.NullTime
+	DeletedAt           sql.NullTime
+}
+
+type UserIdentity struct {
+	ID          uuid.UUID
+	UserID      uuid.UUID
+	Provider    string
+	Subject     string
+	Email       string
+	CreatedAt   time.Time
+	LastLoginAt sql.NullTime
 }
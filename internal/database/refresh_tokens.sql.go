@@ -8,21 +8,25 @@ package database
 import (
 	"context"
 	"database/sql"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 const createRefreshToken = `-- name: CreateRefreshToken :one
-INSERT INTO refresh_tokens (token, created_at, updated_at, expires_at, revoked_at, user_id)
+INSERT INTO refresh_tokens (token, created_at, updated_at, expires_at, revoked_at, user_id, family_id, user_agent, ip_address)
 VALUES (
     $1,
     NOW(),
     NOW(),
     $2,
     $3,
-    $4
+    $4,
+    $5,
+    $6,
+    $7
 )
-RETURNING token, created_at, updated_at, expires_at, revoked_at, user_id
+RETURNING token, created_at, updated_at, expires_at, revoked_at, user_id, family_id, replaced_by, user_agent, ip_address
 `
 
 type CreateRefreshTokenParams struct {
@@ -30,6 +34,9 @@ type CreateRefreshTokenParams struct {
 	ExpiresAt sql.NullTime
 	RevokedAt sql.NullTime
 	UserID    uuid.UUID
+	FamilyID  uuid.UUID
+	UserAgent string
+	IpAddress string
 }
 
 func (q *Queries) CreateRefreshToken(ctx context.Context, arg CreateRefreshTokenParams) (RefreshToken, error) {
@@ -38,6 +45,9 @@ func (q *Queries) CreateRefreshToken(ctx context.Context, arg CreateRefreshToken
 		arg.ExpiresAt,
 		arg.RevokedAt,
 		arg.UserID,
+		arg.FamilyID,
+		arg.UserAgent,
+		arg.IpAddress,
 	)
 	var i RefreshToken
 	err := row.Scan(
@@ -47,12 +57,16 @@ func (q *Queries) CreateRefreshToken(ctx context.Context, arg CreateRefreshToken
 		&i.ExpiresAt,
 		&i.RevokedAt,
 		&i.UserID,
+		&i.FamilyID,
+		&i.ReplacedBy,
+		&i.UserAgent,
+		&i.IpAddress,
 	)
 	return i, err
 }
 
 const getUserByToken = `-- name: GetUserByToken :one
-SELECT token, created_at, updated_at, expires_at, revoked_at, user_id FROM refresh_tokens WHERE token = $1
+SELECT token, created_at, updated_at, expires_at, revoked_at, user_id, family_id, replaced_by, user_agent, ip_address FROM refresh_tokens WHERE token = $1
 `
 
 func (q *Queries) GetUserByToken(ctx context.Context, token string) (RefreshToken, error) {
@@ -65,10 +79,79 @@ func (q *Queries) GetUserByToken(ctx context.Context, token string) (RefreshToke
 		&i.ExpiresAt,
 		&i.RevokedAt,
 		&i.UserID,
+		&i.FamilyID,
+		&i.ReplacedBy,
+		&i.UserAgent,
+		&i.IpAddress,
 	)
 	return i, err
 }
 
+const getUserSessions = `-- name: GetUserSessions :many
+SELECT
+    rt.family_id,
+    rt.user_agent,
+    rt.ip_address,
+    rt.expires_at,
+    rt.created_at AS last_used_at,
+    (SELECT MIN(f.created_at) FROM refresh_tokens f WHERE f.family_id = rt.family_id)::timestamp AS started_at
+FROM refresh_tokens rt
+WHERE rt.user_id = $1
+  AND rt.revoked_at IS NULL
+  AND rt.expires_at > NOW()
+ORDER BY rt.created_at DESC
+`
+
+type GetUserSessionsRow struct {
+	FamilyID   uuid.UUID
+	UserAgent  string
+	IpAddress  string
+	ExpiresAt  sql.NullTime
+	LastUsedAt time.Time
+	StartedAt  time.Time
+}
+
+func (q *Queries) GetUserSessions(ctx context.Context, userID uuid.UUID) ([]GetUserSessionsRow, error) {
+	rows, err := q.db.QueryContext(ctx, getUserSessions, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetUserSessionsRow
+	for rows.Next() {
+		var i GetUserSessionsRow
+		if err := rows.Scan(
+			&i.FamilyID,
+			&i.UserAgent,
+			&i.IpAddress,
+			&i.ExpiresAt,
+			&i.LastUsedAt,
+			&i.StartedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const revokeAllUserTokens = `-- name: RevokeAllUserTokens :exec
+UPDATE refresh_tokens
+SET updated_at = NOW(), revoked_at = NOW()
+WHERE user_id = $1 AND revoked_at IS NULL
+`
+
+func (q *Queries) RevokeAllUserTokens(ctx context.Context, userID uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, revokeAllUserTokens, userID)
+	return err
+}
+
 const revokeToken = `-- name: RevokeToken :exec
 UPDATE refresh_tokens
 SET updated_at = NOW(), revoked_at = NOW()
@@ -79,3 +162,52 @@ func (q *Queries) RevokeToken(ctx context.Context, token string) error {
 	_, err := q.db.ExecContext(ctx, revokeToken, token)
 	return err
 }
+
+const revokeTokenFamily = `-- name: RevokeTokenFamily :exec
+UPDATE refresh_tokens
+SET updated_at = NOW(), revoked_at = NOW()
+WHERE family_id = $1 AND revoked_at IS NULL
+`
+
+func (q *Queries) RevokeTokenFamily(ctx context.Context, familyID uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, revokeTokenFamily, familyID)
+	return err
+}
+
+const revokeUserSession = `-- name: RevokeUserSession :execrows
+UPDATE refresh_tokens
+SET updated_at = NOW(), revoked_at = NOW()
+WHERE family_id = $1 AND user_id = $2 AND revoked_at IS NULL
+`
+
+type RevokeUserSessionParams struct {
+	FamilyID uuid.UUID
+	UserID   uuid.UUID
+}
+
+func (q *Queries) RevokeUserSession(ctx context.Context, arg RevokeUserSessionParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, revokeUserSession, arg.FamilyID, arg.UserID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const rotateRefreshToken = `-- name: RotateRefreshToken :execrows
+UPDATE refresh_tokens
+SET updated_at = NOW(), revoked_at = NOW(), replaced_by = $1
+WHERE token = $2 AND revoked_at IS NULL
+`
+
+type RotateRefreshTokenParams struct {
+	ReplacedBy sql.NullString
+	Token      string
+}
+
+func (q *Queries) RotateRefreshToken(ctx context.Context, arg RotateRefreshTokenParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, rotateRefreshToken, arg.ReplacedBy, arg.Token)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
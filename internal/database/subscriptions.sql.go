@@ -11,61 +11,39 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
-const createSubscription = `-- name: CreateSubscription :one
-INSERT INTO subscriptions (id, user_id, stripe_customer_id, stripe_subscription_id, plan, status, current_period_start, current_period_end, cancel_at_period_end, canceled_at, trial_start, trial_end, created_at, updated_at)
-VALUES (
-    gen_random_uuid(),
-    $1,
-    $2,
-    $3,
-    $4,
-    $5,
-    $6,
-    $7,
-    $8,
-    $9,
-    $10,
-    $11,
-    $12,
-    $13
-)
-RETURNING id, user_id, stripe_customer_id, stripe_subscription_id, plan, status, current_period_start, current_period_end, cancel_at_period_end, canceled_at, trial_start, trial_end, created_at, updated_at
+const cancelSubscriptionsByCustomerID = `-- name: CancelSubscriptionsByCustomerID :exec
+UPDATE subscriptions
+SET
+    updated_at = NOW(),
+    status = 'canceled',
+    canceled_at = COALESCE(canceled_at, NOW())
+WHERE stripe_customer_id = $1 AND status <> 'canceled'
 `
 
-type CreateSubscriptionParams struct {
-	UserID               uuid.UUID
-	StripeCustomerID     string
-	StripeSubscriptionID string
-	Plan                 string
-	Status               string
-	CurrentPeriodStart   time.Time
-	CurrentPeriodEnd     time.Time
-	CancelAtPeriodEnd    bool
-	CanceledAt           sql.NullTime
-	TrialStart           sql.NullTime
-	TrialEnd             sql.NullTime
-	CreatedAt            time.Time
-	UpdatedAt            time.Time
+func (q *Queries) CancelSubscriptionsByCustomerID(ctx context.Context, stripeCustomerID string) error {
+	_, err := q.db.ExecContext(ctx, cancelSubscriptionsByCustomerID, stripeCustomerID)
+	return err
 }
 
-func (q *Queries) CreateSubscription(ctx context.Context, arg CreateSubscriptionParams) (Subscription, error) {
-	row := q.db.QueryRowContext(ctx, createSubscription,
-		arg.UserID,
-		arg.StripeCustomerID,
-		arg.StripeSubscriptionID,
-		arg.Plan,
-		arg.Status,
-		arg.CurrentPeriodStart,
-		arg.CurrentPeriodEnd,
-		arg.CancelAtPeriodEnd,
-		arg.CanceledAt,
-		arg.TrialStart,
-		arg.TrialEnd,
-		arg.CreatedAt,
-		arg.UpdatedAt,
-	)
+const deleteSubscriptions = `-- name: DeleteSubscriptions :exec
+DELETE FROM subscriptions
+`
+
+func (q *Queries) DeleteSubscriptions(ctx context.Context) error {
+	_, err := q.db.ExecContext(ctx, deleteSubscriptions)
+	return err
+}
+
+const getOpenSubscriptionByUserID = `-- name: GetOpenSubscriptionByUserID :one
+SELECT id, user_id, stripe_customer_id, stripe_subscription_id, plan, status, current_period_start, current_period_end, cancel_at_period_end, canceled_at, trial_start, trial_end, created_at, updated_at, last_event_at FROM subscriptions WHERE user_id = $1 AND status IN ('active', 'trialing', 'past_due', 'unpaid', 'incomplete') ORDER BY created_at DESC LIMIT 1
+`
+
+// Returns the user's latest subscription that Stripe may still charge for.
+func (q *Queries) GetOpenSubscriptionByUserID(ctx context.Context, userID uuid.UUID) (Subscription, error) {
+	row := q.db.QueryRowContext(ctx, getOpenSubscriptionByUserID, userID)
 	var i Subscription
 	err := row.Scan(
 		&i.ID,
@@ -82,25 +60,17 @@ func (q *Queries) CreateSubscription(ctx context.Context, arg CreateSubscription
 		&i.TrialEnd,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.LastEventAt,
 	)
 	return i, err
 }
 
-const deleteSubscriptions = `-- name: DeleteSubscriptions :exec
-DELETE FROM subscriptions
+const getSubscriptionByStripeID = `-- name: GetSubscriptionByStripeID :one
+SELECT id, user_id, stripe_customer_id, stripe_subscription_id, plan, status, current_period_start, current_period_end, cancel_at_period_end, canceled_at, trial_start, trial_end, created_at, updated_at, last_event_at FROM subscriptions WHERE stripe_subscription_id = $1
 `
 
-func (q *Queries) DeleteSubscriptions(ctx context.Context) error {
-	_, err := q.db.ExecContext(ctx, deleteSubscriptions)
-	return err
-}
-
-const getActiveSubscriptionByUserID = `-- name: GetActiveSubscriptionByUserID :one
-SELECT id, user_id, stripe_customer_id, stripe_subscription_id, plan, status, current_period_start, current_period_end, cancel_at_period_end, canceled_at, trial_start, trial_end, created_at, updated_at FROM subscriptions WHERE user_id = $1 AND status = "active"
-`
-
-func (q *Queries) GetActiveSubscriptionByUserID(ctx context.Context, userID uuid.UUID) (Subscription, error) {
-	row := q.db.QueryRowContext(ctx, getActiveSubscriptionByUserID, userID)
+func (q *Queries) GetSubscriptionByStripeID(ctx context.Context, stripeSubscriptionID string) (Subscription, error) {
+	row := q.db.QueryRowContext(ctx, getSubscriptionByStripeID, stripeSubscriptionID)
 	var i Subscription
 	err := row.Scan(
 		&i.ID,
@@ -117,12 +87,13 @@ func (q *Queries) GetActiveSubscriptionByUserID(ctx context.Context, userID uuid
 		&i.TrialEnd,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.LastEventAt,
 	)
 	return i, err
 }
 
 const getSubscriptionByUserID = `-- name: GetSubscriptionByUserID :one
-SELECT id, user_id, stripe_customer_id, stripe_subscription_id, plan, status, current_period_start, current_period_end, cancel_at_period_end, canceled_at, trial_start, trial_end, created_at, updated_at FROM subscriptions WHERE user_id = $1
+SELECT id, user_id, stripe_customer_id, stripe_subscription_id, plan, status, current_period_start, current_period_end, cancel_at_period_end, canceled_at, trial_start, trial_end, created_at, updated_at, last_event_at FROM subscriptions WHERE user_id = $1 ORDER BY created_at DESC LIMIT 1
 `
 
 func (q *Queries) GetSubscriptionByUserID(ctx context.Context, userID uuid.UUID) (Subscription, error) {
@@ -143,38 +114,161 @@ func (q *Queries) GetSubscriptionByUserID(ctx context.Context, userID uuid.UUID)
 		&i.TrialEnd,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.LastEventAt,
 	)
 	return i, err
 }
 
-const updateSubscription = `-- name: UpdateSubscription :one
+const getSubscriptionsByUserID = `-- name: GetSubscriptionsByUserID :many
+SELECT id, user_id, stripe_customer_id, stripe_subscription_id, plan, status, current_period_start, current_period_end, cancel_at_period_end, canceled_at, trial_start, trial_end, created_at, updated_at, last_event_at FROM subscriptions WHERE user_id = $1 ORDER BY created_at
+`
+
+func (q *Queries) GetSubscriptionsByUserID(ctx context.Context, userID uuid.UUID) ([]Subscription, error) {
+	rows, err := q.db.QueryContext(ctx, getSubscriptionsByUserID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Subscription
+	for rows.Next() {
+		var i Subscription
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.StripeCustomerID,
+			&i.StripeSubscriptionID,
+			&i.Plan,
+			&i.Status,
+			&i.CurrentPeriodStart,
+			&i.CurrentPeriodEnd,
+			&i.CancelAtPeriodEnd,
+			&i.CanceledAt,
+			&i.TrialStart,
+			&i.TrialEnd,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.LastEventAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const transitionSubscriptionStatus = `-- name: TransitionSubscriptionStatus :one
 UPDATE subscriptions
 SET
     updated_at = NOW(),
     status = $1,
-    current_period_start = $2,
-    current_period_end = $3,
-    cancel_at_period_end = $4,
-    canceled_at = $5,
-    trial_start = $6,
-    trial_end = $7
-WHERE user_id = $8
-RETURNING id, user_id, stripe_customer_id, stripe_subscription_id, plan, status, current_period_start, current_period_end, cancel_at_period_end, canceled_at, trial_start, trial_end, created_at, updated_at
+    last_event_at = $2::timestamp
+WHERE stripe_subscription_id = $3
+    AND status = ANY($4::text[])
+    AND (last_event_at IS NULL OR last_event_at <= $2::timestamp)
+RETURNING id, user_id, stripe_customer_id, stripe_subscription_id, plan, status, current_period_start, current_period_end, cancel_at_period_end, canceled_at, trial_start, trial_end, created_at, updated_at, last_event_at
 `
 
-type UpdateSubscriptionParams struct {
-	Status             string
-	CurrentPeriodStart time.Time
-	CurrentPeriodEnd   time.Time
-	CancelAtPeriodEnd  bool
-	CanceledAt         sql.NullTime
-	TrialStart         sql.NullTime
-	TrialEnd           sql.NullTime
-	UserID             uuid.UUID
+type TransitionSubscriptionStatusParams struct {
+	Status               string
+	EventAt              time.Time
+	StripeSubscriptionID string
+	FromStatuses         []string
 }
 
-func (q *Queries) UpdateSubscription(ctx context.Context, arg UpdateSubscriptionParams) (Subscription, error) {
-	row := q.db.QueryRowContext(ctx, updateSubscription,
+// Moves a subscription to status if it is in one of from_statuses, so an
+// invoice event can't override a state Stripe has since moved past.
+func (q *Queries) TransitionSubscriptionStatus(ctx context.Context, arg TransitionSubscriptionStatusParams) (Subscription, error) {
+	row := q.db.QueryRowContext(ctx, transitionSubscriptionStatus,
+		arg.Status,
+		arg.EventAt,
+		arg.StripeSubscriptionID,
+		pq.Array(arg.FromStatuses),
+	)
+	var i Subscription
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.StripeCustomerID,
+		&i.StripeSubscriptionID,
+		&i.Plan,
+		&i.Status,
+		&i.CurrentPeriodStart,
+		&i.CurrentPeriodEnd,
+		&i.CancelAtPeriodEnd,
+		&i.CanceledAt,
+		&i.TrialStart,
+		&i.TrialEnd,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.LastEventAt,
+	)
+	return i, err
+}
+
+const upsertSubscription = `-- name: UpsertSubscription :one
+INSERT INTO subscriptions (id, user_id, stripe_customer_id, stripe_subscription_id, plan, status, current_period_start, current_period_end, cancel_at_period_end, canceled_at, trial_start, trial_end, created_at, updated_at, last_event_at)
+VALUES (
+    gen_random_uuid(),
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    $6,
+    $7,
+    $8,
+    $9,
+    $10,
+    $11,
+    NOW(),
+    NOW(),
+    $12::timestamp
+)
+ON CONFLICT (stripe_subscription_id) DO UPDATE
+SET
+    updated_at = NOW(),
+    plan = EXCLUDED.plan,
+    status = EXCLUDED.status,
+    current_period_start = EXCLUDED.current_period_start,
+    current_period_end = EXCLUDED.current_period_end,
+    cancel_at_period_end = EXCLUDED.cancel_at_period_end,
+    canceled_at = EXCLUDED.canceled_at,
+    trial_start = EXCLUDED.trial_start,
+    trial_end = EXCLUDED.trial_end,
+    last_event_at = EXCLUDED.last_event_at
+WHERE subscriptions.last_event_at IS NULL OR subscriptions.last_event_at <= EXCLUDED.last_event_at
+RETURNING id, user_id, stripe_customer_id, stripe_subscription_id, plan, status, current_period_start, current_period_end, cancel_at_period_end, canceled_at, trial_start, trial_end, created_at, updated_at, last_event_at
+`
+
+type UpsertSubscriptionParams struct {
+	UserID               uuid.UUID
+	StripeCustomerID     string
+	StripeSubscriptionID string
+	Plan                 string
+	Status               string
+	CurrentPeriodStart   time.Time
+	CurrentPeriodEnd     time.Time
+	CancelAtPeriodEnd    bool
+	CanceledAt           sql.NullTime
+	TrialStart           sql.NullTime
+	TrialEnd             sql.NullTime
+	EventAt              time.Time
+}
+
+// Stripe can deliver events out of order, so an existing row is only
+// overwritten by an event at least as new as the one that last wrote it.
+func (q *Queries) UpsertSubscription(ctx context.Context, arg UpsertSubscriptionParams) (Subscription, error) {
+	row := q.db.QueryRowContext(ctx, upsertSubscription,
+		arg.UserID,
+		arg.StripeCustomerID,
+		arg.StripeSubscriptionID,
+		arg.Plan,
 		arg.Status,
 		arg.CurrentPeriodStart,
 		arg.CurrentPeriodEnd,
@@ -182,7 +276,7 @@ func (q *Queries) UpdateSubscription(ctx context.Context, arg UpdateSubscription
 		arg.CanceledAt,
 		arg.TrialStart,
 		arg.TrialEnd,
-		arg.UserID,
+		arg.EventAt,
 	)
 	var i Subscription
 	err := row.Scan(
@@ -200,6 +294,7 @@ func (q *Queries) UpdateSubscription(ctx context.Context, arg UpdateSubscription
 		&i.TrialEnd,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.LastEventAt,
 	)
 	return i, err
 }
@@ -7,26 +7,42 @@ package database
 
 import (
 	"context"
+	"database/sql"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
+const countTagsByUserID = `-- name: CountTagsByUserID :one
+SELECT COUNT(*) FROM tags WHERE user_id = $1 AND deleted_at IS NULL
+`
+
+func (q *Queries) CountTagsByUserID(ctx context.Context, userID uuid.UUID) (int64, error) {
+	row := q.db.QueryRowContext(ctx, countTagsByUserID, userID)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
 const createEventTag = `-- name: CreateEventTag :one
 INSERT INTO event_tags (event_id, tag_id)
-VALUES (
-    $1,
-    $2
-)
+SELECT events.id, tags.id
+FROM events
+JOIN tags ON tags.user_id = events.user_id
+WHERE events.id = $1 AND tags.id = $2 AND events.user_id = $3
+    AND events.deleted_at IS NULL AND tags.deleted_at IS NULL
 RETURNING event_id, tag_id
 `
 
 type CreateEventTagParams struct {
 	EventID uuid.UUID
 	TagID   uuid.UUID
+	UserID  uuid.UUID
 }
 
 func (q *Queries) CreateEventTag(ctx context.Context, arg CreateEventTagParams) (EventTag, error) {
-	row := q.db.QueryRowContext(ctx, createEventTag, arg.EventID, arg.TagID)
+	row := q.db.QueryRowContext(ctx, createEventTag, arg.EventID, arg.TagID, arg.UserID)
 	var i EventTag
 	err := row.Scan(&i.EventID, &i.TagID)
 	return i, err
@@ -40,7 +56,7 @@ VALUES (
     $2,
     $3
 )
-RETURNING id, user_id, name, color
+RETURNING id, user_id, name, color, deleted_at
 `
 
 type CreateTagParams struct {
@@ -57,39 +73,58 @@ func (q *Queries) CreateTag(ctx context.Context, arg CreateTagParams) (Tag, erro
 		&i.UserID,
 		&i.Name,
 		&i.Color,
+		&i.DeletedAt,
 	)
 	return i, err
 }
 
-const deleteEventTag = `-- name: DeleteEventTag :exec
-DELETE FROM event_tags WHERE event_id = $1 AND tag_id = $2
+const deleteEventTag = `-- name: DeleteEventTag :execrows
+DELETE FROM event_tags
+WHERE event_id = $1 AND tag_id = $2
+    AND event_id IN (SELECT id FROM events WHERE deleted_at IS NULL AND user_id = $3)
 `
 
 type DeleteEventTagParams struct {
 	EventID uuid.UUID
 	TagID   uuid.UUID
+	UserID  uuid.UUID
 }
 
-func (q *Queries) DeleteEventTag(ctx context.Context, arg DeleteEventTagParams) error {
-	_, err := q.db.ExecContext(ctx, deleteEventTag, arg.EventID, arg.TagID)
-	return err
+func (q *Queries) DeleteEventTag(ctx context.Context, arg DeleteEventTagParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteEventTag, arg.EventID, arg.TagID, arg.UserID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
 }
 
-const deleteTag = `-- name: DeleteTag :exec
-DELETE FROM tags WHERE id = $1
+const deleteTag = `-- name: DeleteTag :execrows
+UPDATE tags SET deleted_at = NOW() WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL
 `
 
-func (q *Queries) DeleteTag(ctx context.Context, id uuid.UUID) error {
-	_, err := q.db.ExecContext(ctx, deleteTag, id)
-	return err
+type DeleteTagParams struct {
+	ID     uuid.UUID
+	UserID uuid.UUID
+}
+
+func (q *Queries) DeleteTag(ctx context.Context, arg DeleteTagParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteTag, arg.ID, arg.UserID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
 }
 
-const getEventTagsByEventID = `-- name: GetEventTagsByEventID :many
-SELECT event_id, tag_id FROM event_tags WHERE event_id = $1
+const getEventTagsByUserID = `-- name: GetEventTagsByUserID :many
+SELECT event_tags.event_id, event_tags.tag_id
+FROM event_tags
+JOIN events ON events.id = event_tags.event_id
+JOIN tags ON tags.id = event_tags.tag_id
+WHERE events.user_id = $1 AND events.deleted_at IS NULL AND tags.deleted_at IS NULL
 `
 
-func (q *Queries) GetEventTagsByEventID(ctx context.Context, eventID uuid.UUID) ([]EventTag, error) {
-	rows, err := q.db.QueryContext(ctx, getEventTagsByEventID, eventID)
+func (q *Queries) GetEventTagsByUserID(ctx context.Context, userID uuid.UUID) ([]EventTag, error) {
+	rows, err := q.db.QueryContext(ctx, getEventTagsByUserID, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -114,18 +149,26 @@ func (q *Queries) GetEventTagsByEventID(ctx context.Context, eventID uuid.UUID)
 const getTagsByEventID = `-- name: GetTagsByEventID :many
 SELECT tags.id, tags.name, tags.color
 FROM event_tags
+JOIN events ON events.id = event_tags.event_id
 JOIN tags ON tags.id = event_tags.tag_id
 WHERE event_tags.event_id = $1
+    AND events.user_id = $2 AND events.deleted_at IS NULL
+    AND tags.user_id = $2 AND tags.deleted_at IS NULL
 `
 
+type GetTagsByEventIDParams struct {
+	EventID uuid.UUID
+	UserID  uuid.UUID
+}
+
 type GetTagsByEventIDRow struct {
 	ID    uuid.UUID
 	Name  string
 	Color string
 }
 
-func (q *Queries) GetTagsByEventID(ctx context.Context, eventID uuid.UUID) ([]GetTagsByEventIDRow, error) {
-	rows, err := q.db.QueryContext(ctx, getTagsByEventID, eventID)
+func (q *Queries) GetTagsByEventID(ctx context.Context, arg GetTagsByEventIDParams) ([]GetTagsByEventIDRow, error) {
+	rows, err := q.db.QueryContext(ctx, getTagsByEventID, arg.EventID, arg.UserID)
 	if err != nil {
 		return nil, err
 	}
@@ -147,8 +190,46 @@ func (q *Queries) GetTagsByEventID(ctx context.Context, eventID uuid.UUID) ([]Ge
 	return items, nil
 }
 
+const getTagsByIDs = `-- name: GetTagsByIDs :many
+SELECT id, user_id, name, color, deleted_at FROM tags WHERE user_id = $1 AND id = ANY($2::uuid[]) AND deleted_at IS NULL
+`
+
+type GetTagsByIDsParams struct {
+	UserID uuid.UUID
+	Ids    []uuid.UUID
+}
+
+func (q *Queries) GetTagsByIDs(ctx context.Context, arg GetTagsByIDsParams) ([]Tag, error) {
+	rows, err := q.db.QueryContext(ctx, getTagsByIDs, arg.UserID, pq.Array(arg.Ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Tag
+	for rows.Next() {
+		var i Tag
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.Name,
+			&i.Color,
+			&i.DeletedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getTagsByUserID = `-- name: GetTagsByUserID :many
-SELECT id, user_id, name, color FROM tags WHERE user_id = $1
+SELECT id, user_id, name, color, deleted_at FROM tags WHERE user_id = $1 AND deleted_at IS NULL
 `
 
 func (q *Queries) GetTagsByUserID(ctx context.Context, userID uuid.UUID) ([]Tag, error) {
@@ -165,6 +246,7 @@ func (q *Queries) GetTagsByUserID(ctx context.Context, userID uuid.UUID) ([]Tag,
 			&i.UserID,
 			&i.Name,
 			&i.Color,
+			&i.DeletedAt,
 		); err != nil {
 			return nil, err
 		}
@@ -179,29 +261,126 @@ func (q *Queries) GetTagsByUserID(ctx context.Context, userID uuid.UUID) ([]Tag,
 	return items, nil
 }
 
+const listTags = `-- name: ListTags :many
+SELECT id, user_id, name, color, deleted_at FROM tags
+WHERE user_id = $1
+  AND deleted_at IS NULL
+  AND (
+      $2::text IS NULL OR
+      (name, id) > ($2, $3::uuid)
+  )
+ORDER BY name, id
+LIMIT $4
+`
+
+type ListTagsParams struct {
+	UserID     uuid.UUID
+	CursorName sql.NullString
+	CursorID   uuid.NullUUID
+	RowLimit   int32
+}
+
+func (q *Queries) ListTags(ctx context.Context, arg ListTagsParams) ([]Tag, error) {
+	rows, err := q.db.QueryContext(ctx, listTags,
+		arg.UserID,
+		arg.CursorName,
+		arg.CursorID,
+		arg.RowLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Tag
+	for rows.Next() {
+		var i Tag
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.Name,
+			&i.Color,
+			&i.DeletedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const purgeDeletedTags = `-- name: PurgeDeletedTags :execrows
+DELETE FROM tags WHERE deleted_at < $1::timestamp
+`
+
+func (q *Queries) PurgeDeletedTags(ctx context.Context, before time.Time) (int64, error) {
+	result, err := q.db.ExecContext(ctx, purgeDeletedTags, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const restoreTag = `-- name: RestoreTag :one
+UPDATE tags
+SET deleted_at = NULL
+WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL
+RETURNING id, user_id, name, color, deleted_at
+`
+
+type RestoreTagParams struct {
+	ID     uuid.UUID
+	UserID uuid.UUID
+}
+
+func (q *Queries) RestoreTag(ctx context.Context, arg RestoreTagParams) (Tag, error) {
+	row := q.db.QueryRowContext(ctx, restoreTag, arg.ID, arg.UserID)
+	var i Tag
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.Name,
+		&i.Color,
+		&i.DeletedAt,
+	)
+	return i, err
+}
+
 const updateTag = `-- name: UpdateTag :one
 UPDATE tags
 SET
     name = $1,
     color = $2
-WHERE id = $3
-RETURNING id, user_id, name, color
+WHERE id = $3 AND user_id = $4 AND deleted_at IS NULL
+RETURNING id, user_id, name, color, deleted_at
 `
 
 type UpdateTagParams struct {
-	Name  string
-	Color string
-	TagID uuid.UUID
+	Name   string
+	Color  string
+	TagID  uuid.UUID
+	UserID uuid.UUID
 }
 
 func (q *Queries) UpdateTag(ctx context.Context, arg UpdateTagParams) (Tag, error) {
-	row := q.db.QueryRowContext(ctx, updateTag, arg.Name, arg.Color, arg.TagID)
+	row := q.db.QueryRowContext(ctx, updateTag,
+		arg.Name,
+		arg.Color,
+		arg.TagID,
+		arg.UserID,
+	)
 	var i Tag
 	err := row.Scan(
 		&i.ID,
 		&i.UserID,
 		&i.Name,
 		&i.Color,
+		&i.DeletedAt,
 	)
 	return i, err
 }
@@ -8,8 +8,10 @@ package database
 import (
 	"context"
 	"database/sql"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 const createTodo = `-- name: CreateTodo :one
@@ -23,7 +25,7 @@ VALUES (
     $3,
     $4
 )
-RETURNING id, user_id, created_at, updated_at, date, title, description
+RETURNING id, user_id, created_at, updated_at, date, title, description, deleted_at
 `
 
 type CreateTodoParams struct {
@@ -49,17 +51,26 @@ func (q *Queries) CreateTodo(ctx context.Context, arg CreateTodoParams) (Todo, e
 		&i.Date,
 		&i.Title,
 		&i.Description,
+		&i.DeletedAt,
 	)
 	return i, err
 }
 
-const deleteTodoByID = `-- name: DeleteTodoByID :exec
-DELETE FROM todos WHERE id = $1
+const deleteTodoByID = `-- name: DeleteTodoByID :execrows
+UPDATE todos SET deleted_at = NOW() WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL
 `
 
-func (q *Queries) DeleteTodoByID(ctx context.Context, id uuid.UUID) error {
-	_, err := q.db.ExecContext(ctx, deleteTodoByID, id)
-	return err
+type DeleteTodoByIDParams struct {
+	ID     uuid.UUID
+	UserID uuid.UUID
+}
+
+func (q *Queries) DeleteTodoByID(ctx context.Context, arg DeleteTodoByIDParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteTodoByID, arg.ID, arg.UserID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
 }
 
 const deleteTodos = `-- name: DeleteTodos :exec
@@ -72,7 +83,7 @@ func (q *Queries) DeleteTodos(ctx context.Context) error {
 }
 
 const getTodoByID = `-- name: GetTodoByID :one
-SELECT id, user_id, created_at, updated_at, date, title, description FROM todos WHERE id = $1
+SELECT id, user_id, created_at, updated_at, date, title, description, deleted_at FROM todos WHERE id = $1 AND deleted_at IS NULL
 `
 
 func (q *Queries) GetTodoByID(ctx context.Context, id uuid.UUID) (Todo, error) {
@@ -86,12 +97,54 @@ func (q *Queries) GetTodoByID(ctx context.Context, id uuid.UUID) (Todo, error) {
 		&i.Date,
 		&i.Title,
 		&i.Description,
+		&i.DeletedAt,
 	)
 	return i, err
 }
 
+const getTodosByIDs = `-- name: GetTodosByIDs :many
+SELECT id, user_id, created_at, updated_at, date, title, description, deleted_at FROM todos WHERE user_id = $1 AND id = ANY($2::uuid[]) AND deleted_at IS NULL
+`
+
+type GetTodosByIDsParams struct {
+	UserID uuid.UUID
+	Ids    []uuid.UUID
+}
+
+func (q *Queries) GetTodosByIDs(ctx context.Context, arg GetTodosByIDsParams) ([]Todo, error) {
+	rows, err := q.db.QueryContext(ctx, getTodosByIDs, arg.UserID, pq.Array(arg.Ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Todo
+	for rows.Next() {
+		var i Todo
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Date,
+			&i.Title,
+			&i.Description,
+			&i.DeletedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getTodosByUserID = `-- name: GetTodosByUserID :many
-SELECT id, user_id, created_at, updated_at, date, title, description FROM todos WHERE user_id = $1
+SELECT id, user_id, created_at, updated_at, date, title, description, deleted_at FROM todos WHERE user_id = $1 AND deleted_at IS NULL
 `
 
 func (q *Queries) GetTodosByUserID(ctx context.Context, userID uuid.UUID) ([]Todo, error) {
@@ -111,6 +164,7 @@ func (q *Queries) GetTodosByUserID(ctx context.Context, userID uuid.UUID) ([]Tod
 			&i.Date,
 			&i.Title,
 			&i.Description,
+			&i.DeletedAt,
 		); err != nil {
 			return nil, err
 		}
@@ -125,6 +179,121 @@ func (q *Queries) GetTodosByUserID(ctx context.Context, userID uuid.UUID) ([]Tod
 	return items, nil
 }
 
+const listTodos = `-- name: ListTodos :many
+SELECT id, user_id, created_at, updated_at, date, title, description, deleted_at FROM todos
+WHERE user_id = $1
+  AND deleted_at IS NULL
+  AND (
+      $2::timestamp IS NULL OR
+      todos.date >= $2
+  )
+  AND (
+      $3::timestamp IS NULL OR
+      todos.date < $3
+  )
+  AND (
+      $4::timestamp IS NULL OR
+      ($5::boolean AND (COALESCE(todos.date, '0001-01-01'), todos.id) < ($4, $6::uuid)) OR
+      (NOT $5::boolean AND (COALESCE(todos.date, '0001-01-01'), todos.id) > ($4, $6::uuid))
+  )
+ORDER BY
+    CASE WHEN $5::boolean THEN COALESCE(todos.date, '0001-01-01') END DESC,
+    CASE WHEN $5::boolean THEN todos.id END DESC,
+    COALESCE(todos.date, '0001-01-01') ASC,
+    todos.id ASC
+LIMIT $7
+`
+
+type ListTodosParams struct {
+	UserID     uuid.UUID
+	FromDate   sql.NullTime
+	ToDate     sql.NullTime
+	CursorDate sql.NullTime
+	Descending bool
+	CursorID   uuid.NullUUID
+	RowLimit   int32
+}
+
+func (q *Queries) ListTodos(ctx context.Context, arg ListTodosParams) ([]Todo, error) {
+	rows, err := q.db.QueryContext(ctx, listTodos,
+		arg.UserID,
+		arg.FromDate,
+		arg.ToDate,
+		arg.CursorDate,
+		arg.Descending,
+		arg.CursorID,
+		arg.RowLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Todo
+	for rows.Next() {
+		var i Todo
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Date,
+			&i.Title,
+			&i.Description,
+			&i.DeletedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const purgeDeletedTodos = `-- name: PurgeDeletedTodos :execrows
+DELETE FROM todos WHERE deleted_at < $1::timestamp
+`
+
+func (q *Queries) PurgeDeletedTodos(ctx context.Context, before time.Time) (int64, error) {
+	result, err := q.db.ExecContext(ctx, purgeDeletedTodos, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const restoreTodo = `-- name: RestoreTodo :one
+UPDATE todos
+SET updated_at = NOW(), deleted_at = NULL
+WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL
+RETURNING id, user_id, created_at, updated_at, date, title, description, deleted_at
+`
+
+type RestoreTodoParams struct {
+	ID     uuid.UUID
+	UserID uuid.UUID
+}
+
+func (q *Queries) RestoreTodo(ctx context.Context, arg RestoreTodoParams) (Todo, error) {
+	row := q.db.QueryRowContext(ctx, restoreTodo, arg.ID, arg.UserID)
+	var i Todo
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Date,
+		&i.Title,
+		&i.Description,
+		&i.DeletedAt,
+	)
+	return i, err
+}
+
 const updateToDo = `-- name: UpdateToDo :one
 UPDATE todos
 SET
@@ -132,8 +301,9 @@ SET
     date = $1,
     title = $2,
     description = $3
-WHERE id = $4
-RETURNING id, user_id, created_at, updated_at, date, title, description
+WHERE id = $4 AND user_id = $5 AND deleted_at IS NULL
+    AND ($6::timestamp IS NULL OR updated_at = $6)
+RETURNING id, user_id, created_at, updated_at, date, title, description, deleted_at
 `
 
 type UpdateToDoParams struct {
@@ -141,6 +311,8 @@ type UpdateToDoParams struct {
 	Title       string
 	Description sql.NullString
 	TodoID      uuid.UUID
+	UserID      uuid.UUID
+	IfUpdatedAt sql.NullTime
 }
 
 func (q *Queries) UpdateToDo(ctx context.Context, arg UpdateToDoParams) (Todo, error) {
@@ -149,6 +321,8 @@ func (q *Queries) UpdateToDo(ctx context.Context, arg UpdateToDoParams) (Todo, e
 		arg.Title,
 		arg.Description,
 		arg.TodoID,
+		arg.UserID,
+		arg.IfUpdatedAt,
 	)
 	var i Todo
 	err := row.Scan(
@@ -159,6 +333,7 @@ func (q *Queries) UpdateToDo(ctx context.Context, arg UpdateToDoParams) (Todo, e
 		&i.Date,
 		&i.Title,
 		&i.Description,
+		&i.DeletedAt,
 	)
 	return i, err
 }
@@ -8,10 +8,22 @@ package database
 import (
 	"context"
 	"database/sql"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+const cancelUserDeletion = `-- name: CancelUserDeletion :exec
+UPDATE users
+SET updated_at = NOW(), deleted_at = NULL
+WHERE id = $1 AND deleted_at IS NOT NULL
+`
+
+func (q *Queries) CancelUserDeletion(ctx context.Context, id uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, cancelUserDeletion, id)
+	return err
+}
+
 const createUser = `-- name: CreateUser :one
 INSERT INTO users (id, created_at, updated_at, username, email, hashed_password, phone_number)
 VALUES (
@@ -23,7 +35,7 @@ VALUES (
     $3,
     $4
 )
-RETURNING id, created_at, updated_at, username, email, hashed_password, phone_number, stripe_customer_id
+RETURNING id, created_at, updated_at, username, email, hashed_password, phone_number, stripe_customer_id, verified_at, totp_secret, totp_enabled_at, totp_last_step, failed_login_attempts, locked_until, deleted_at
 `
 
 type CreateUserParams struct {
@@ -50,12 +62,19 @@ func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (User, e
 		&i.HashedPassword,
 		&i.PhoneNumber,
 		&i.StripeCustomerID,
+		&i.VerifiedAt,
+		&i.TotpSecret,
+		&i.TotpEnabledAt,
+		&i.TotpLastStep,
+		&i.FailedLoginAttempts,
+		&i.LockedUntil,
+		&i.DeletedAt,
 	)
 	return i, err
 }
 
 const deleteUserByID = `-- name: DeleteUserByID :exec
-DELETE FROM users WHERE id = $1
+UPDATE users SET deleted_at = NOW() WHERE id = $1
 `
 
 func (q *Queries) DeleteUserByID(ctx context.Context, id uuid.UUID) error {
@@ -73,7 +92,7 @@ func (q *Queries) DeleteUsers(ctx context.Context) error {
 }
 
 const getEmail = `-- name: GetEmail :one
-SELECT email FROM users WHERE id = $1
+SELECT email FROM users WHERE id = $1 AND deleted_at IS NULL
 `
 
 func (q *Queries) GetEmail(ctx context.Context, id uuid.UUID) (string, error) {
@@ -83,8 +102,66 @@ func (q *Queries) GetEmail(ctx context.Context, id uuid.UUID) (string, error) {
 	return email, err
 }
 
+const getLoginUserByEmail = `-- name: GetLoginUserByEmail :one
+SELECT id, created_at, updated_at, username, email, hashed_password, phone_number, stripe_customer_id, verified_at, totp_secret, totp_enabled_at, totp_last_step, failed_login_attempts, locked_until, deleted_at FROM users WHERE LOWER(email) = LOWER($1)
+`
+
+// Unlike GetUserByEmail and GetUserByID this also finds accounts that are
+// scheduled for deletion, so logging in can cancel it.
+func (q *Queries) GetLoginUserByEmail(ctx context.Context, email string) (User, error) {
+	row := q.db.QueryRowContext(ctx, getLoginUserByEmail, email)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Username,
+		&i.Email,
+		&i.HashedPassword,
+		&i.PhoneNumber,
+		&i.StripeCustomerID,
+		&i.VerifiedAt,
+		&i.TotpSecret,
+		&i.TotpEnabledAt,
+		&i.TotpLastStep,
+		&i.FailedLoginAttempts,
+		&i.LockedUntil,
+		&i.DeletedAt,
+	)
+	return i, err
+}
+
+const getLoginUserByID = `-- name: GetLoginUserByID :one
+SELECT id, created_at, updated_at, username, email, hashed_password, phone_number, stripe_customer_id, verified_at, totp_secret, totp_enabled_at, totp_last_step, failed_login_attempts, locked_until, deleted_at FROM users WHERE id = $1
+`
+
+// Unlike GetUserByEmail and GetUserByID this also finds accounts that are
+// scheduled for deletion, so logging in can cancel it.
+func (q *Queries) GetLoginUserByID(ctx context.Context, id uuid.UUID) (User, error) {
+	row := q.db.QueryRowContext(ctx, getLoginUserByID, id)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Username,
+		&i.Email,
+		&i.HashedPassword,
+		&i.PhoneNumber,
+		&i.StripeCustomerID,
+		&i.VerifiedAt,
+		&i.TotpSecret,
+		&i.TotpEnabledAt,
+		&i.TotpLastStep,
+		&i.FailedLoginAttempts,
+		&i.LockedUntil,
+		&i.DeletedAt,
+	)
+	return i, err
+}
+
 const getStripeID = `-- name: GetStripeID :one
-SELECT stripe_customer_id FROM users WHERE id = $1
+SELECT stripe_customer_id FROM users WHERE id = $1 AND deleted_at IS NULL
 `
 
 func (q *Queries) GetStripeID(ctx context.Context, id uuid.UUID) (sql.NullString, error) {
@@ -95,7 +172,7 @@ func (q *Queries) GetStripeID(ctx context.Context, id uuid.UUID) (sql.NullString
 }
 
 const getUserByEmail = `-- name: GetUserByEmail :one
-SELECT id, created_at, updated_at, username, email, hashed_password, phone_number, stripe_customer_id FROM users WHERE email = $1
+SELECT id, created_at, updated_at, username, email, hashed_password, phone_number, stripe_customer_id, verified_at, totp_secret, totp_enabled_at, totp_last_step, failed_login_attempts, locked_until, deleted_at FROM users WHERE LOWER(email) = LOWER($1) AND deleted_at IS NULL
 `
 
 func (q *Queries) GetUserByEmail(ctx context.Context, email string) (User, error) {
@@ -110,12 +187,19 @@ func (q *Queries) GetUserByEmail(ctx context.Context, email string) (User, error
 		&i.HashedPassword,
 		&i.PhoneNumber,
 		&i.StripeCustomerID,
+		&i.VerifiedAt,
+		&i.TotpSecret,
+		&i.TotpEnabledAt,
+		&i.TotpLastStep,
+		&i.FailedLoginAttempts,
+		&i.LockedUntil,
+		&i.DeletedAt,
 	)
 	return i, err
 }
 
 const getUserByID = `-- name: GetUserByID :one
-SELECT id, created_at, updated_at, username, email, hashed_password, phone_number, stripe_customer_id FROM users WHERE id = $1
+SELECT id, created_at, updated_at, username, email, hashed_password, phone_number, stripe_customer_id, verified_at, totp_secret, totp_enabled_at, totp_last_step, failed_login_attempts, locked_until, deleted_at FROM users WHERE id = $1 AND deleted_at IS NULL
 `
 
 func (q *Queries) GetUserByID(ctx context.Context, id uuid.UUID) (User, error) {
@@ -130,14 +214,23 @@ func (q *Queries) GetUserByID(ctx context.Context, id uuid.UUID) (User, error) {
 		&i.HashedPassword,
 		&i.PhoneNumber,
 		&i.StripeCustomerID,
+		&i.VerifiedAt,
+		&i.TotpSecret,
+		&i.TotpEnabledAt,
+		&i.TotpLastStep,
+		&i.FailedLoginAttempts,
+		&i.LockedUntil,
+		&i.DeletedAt,
 	)
 	return i, err
 }
 
 const getUserByStripeID = `-- name: GetUserByStripeID :one
-SELECT id, created_at, updated_at, username, email, hashed_password, phone_number, stripe_customer_id FROM users WHERE stripe_customer_id = $1
+SELECT id, created_at, updated_at, username, email, hashed_password, phone_number, stripe_customer_id, verified_at, totp_secret, totp_enabled_at, totp_last_step, failed_login_attempts, locked_until, deleted_at FROM users WHERE stripe_customer_id = $1
 `
 
+// Accounts pending deletion are included, since their subscription keeps
+// sending events until it ends.
 func (q *Queries) GetUserByStripeID(ctx context.Context, stripeCustomerID sql.NullString) (User, error) {
 	row := q.db.QueryRowContext(ctx, getUserByStripeID, stripeCustomerID)
 	var i User
@@ -150,10 +243,86 @@ func (q *Queries) GetUserByStripeID(ctx context.Context, stripeCustomerID sql.Nu
 		&i.HashedPassword,
 		&i.PhoneNumber,
 		&i.StripeCustomerID,
+		&i.VerifiedAt,
+		&i.TotpSecret,
+		&i.TotpEnabledAt,
+		&i.TotpLastStep,
+		&i.FailedLoginAttempts,
+		&i.LockedUntil,
+		&i.DeletedAt,
 	)
 	return i, err
 }
 
+const markUserVerified = `-- name: MarkUserVerified :exec
+UPDATE users
+SET updated_at = NOW(), verified_at = NOW()
+WHERE id = $1 AND LOWER(email) = LOWER($2) AND deleted_at IS NULL
+`
+
+type MarkUserVerifiedParams struct {
+	ID    uuid.UUID
+	Email string
+}
+
+func (q *Queries) MarkUserVerified(ctx context.Context, arg MarkUserVerifiedParams) error {
+	_, err := q.db.ExecContext(ctx, markUserVerified, arg.ID, arg.Email)
+	return err
+}
+
+const purgeDeletedUsers = `-- name: PurgeDeletedUsers :execrows
+DELETE FROM users WHERE deleted_at < $1::timestamp
+`
+
+func (q *Queries) PurgeDeletedUsers(ctx context.Context, before time.Time) (int64, error) {
+	result, err := q.db.ExecContext(ctx, purgeDeletedUsers, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const recordFailedLogin = `-- name: RecordFailedLogin :one
+UPDATE users
+SET
+    failed_login_attempts = failed_login_attempts + 1,
+    locked_until = CASE
+        WHEN failed_login_attempts + 1 >= $1::int
+        THEN NOW() + MAKE_INTERVAL(mins => LEAST(POWER(2, failed_login_attempts + 1 - $1::int), 60)::int)
+        ELSE locked_until
+    END
+WHERE id = $2
+RETURNING failed_login_attempts, locked_until
+`
+
+type RecordFailedLoginParams struct {
+	LockoutThreshold int32
+	ID               uuid.UUID
+}
+
+type RecordFailedLoginRow struct {
+	FailedLoginAttempts int32
+	LockedUntil         sql.NullTime
+}
+
+func (q *Queries) RecordFailedLogin(ctx context.Context, arg RecordFailedLoginParams) (RecordFailedLoginRow, error) {
+	row := q.db.QueryRowContext(ctx, recordFailedLogin, arg.LockoutThreshold, arg.ID)
+	var i RecordFailedLoginRow
+	err := row.Scan(&i.FailedLoginAttempts, &i.LockedUntil)
+	return i, err
+}
+
+const resetFailedLogins = `-- name: ResetFailedLogins :exec
+UPDATE users
+SET failed_login_attempts = 0, locked_until = NULL
+WHERE id = $1
+`
+
+func (q *Queries) ResetFailedLogins(ctx context.Context, id uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, resetFailedLogins, id)
+	return err
+}
+
 const updateStripeCustomerID = `-- name: UpdateStripeCustomerID :exec
 UPDATE users
 SET stripe_customer_id = $2
@@ -177,9 +346,11 @@ SET
     username = $1,
     email = $2,
     hashed_password = $3,
-    phone_number = $4
-WHERE id = $5
-RETURNING id, created_at, updated_at, username, email, hashed_password, phone_number, stripe_customer_id
+    phone_number = $4,
+    verified_at = CASE WHEN LOWER(email) = LOWER($2) THEN verified_at ELSE NULL END
+WHERE id = $5 AND deleted_at IS NULL
+    AND ($6::timestamp IS NULL OR updated_at = $6)
+RETURNING id, created_at, updated_at, username, email, hashed_password, phone_number, stripe_customer_id, verified_at, totp_secret, totp_enabled_at, totp_last_step, failed_login_attempts, locked_until, deleted_at
 `
 
 type UpdateUserParams struct {
@@ -188,6 +359,7 @@ type UpdateUserParams struct {
 	HashedPassword string
 	PhoneNumber    string
 	Userid         uuid.UUID
+	IfUpdatedAt    sql.NullTime
 }
 
 func (q *Queries) UpdateUser(ctx context.Context, arg UpdateUserParams) (User, error) {
@@ -197,6 +369,7 @@ func (q *Queries) UpdateUser(ctx context.Context, arg UpdateUserParams) (User, e
 		arg.HashedPassword,
 		arg.PhoneNumber,
 		arg.Userid,
+		arg.IfUpdatedAt,
 	)
 	var i User
 	err := row.Scan(
@@ -208,6 +381,13 @@ func (q *Queries) UpdateUser(ctx context.Context, arg UpdateUserParams) (User, e
 		&i.HashedPassword,
 		&i.PhoneNumber,
 		&i.StripeCustomerID,
+		&i.VerifiedAt,
+		&i.TotpSecret,
+		&i.TotpEnabledAt,
+		&i.TotpLastStep,
+		&i.FailedLoginAttempts,
+		&i.LockedUntil,
+		&i.DeletedAt,
 	)
 	return i, err
 }
@@ -0,0 +1,88 @@
+// Package dbtest gives tests a freshly migrated Postgres schema of their own.
+package dbtest
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/curtisbraxdale/taday/sql/schema"
+	_ "github.com/lib/pq"
+)
+
+// Open connects to the Postgres server at TEST_DATABASE_URL, creates a schema
+// for the test with every migration applied, and drops it when the test ends.
+// Tests are skipped when TEST_DATABASE_URL isn't set.
+func Open(t testing.TB) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	b := make([]byte, 8)
+	rand.Read(b)
+	name := "test_" + hex.EncodeToString(b)
+	if _, err := admin.Exec("CREATE SCHEMA " + name); err != nil {
+		t.Fatalf("creating schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP SCHEMA " + name + " CASCADE"); err != nil {
+			t.Errorf("dropping schema: %v", err)
+		}
+	})
+
+	db, err := sql.Open("postgres", withSearchPath(dsn, name))
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migrate(db); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	return db
+}
+
+// withSearchPath points every connection at schema. lib/pq sends options it
+// doesn't know as run-time parameters.
+func withSearchPath(dsn, schema string) string {
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	return dsn + " search_path=" + schema
+}
+
+// migrate runs the up half of every goose migration, in order.
+func migrate(db *sql.DB) error {
+	files, err := fs.Glob(schema.Migrations, "*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		b, err := fs.ReadFile(schema.Migrations, file)
+		if err != nil {
+			return err
+		}
+		up, _, _ := strings.Cut(string(b), "-- +goose Down")
+		if _, err := db.Exec(up); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return nil
+}
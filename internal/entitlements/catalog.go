@@ -0,0 +1,152 @@
+package entitlements
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Plan is a paid plan users can check out, and what it grants.
+type Plan struct {
+	Key string `json:"key"`
+	// PriceID is the Stripe price the plan is billed with.
+	PriceID string `json:"-"`
+	// Interval is how often the plan renews, "month" or "year".
+	Interval            string `json:"interval"`
+	TrialDays           int64  `json:"trial_days"`
+	AllowPromotionCodes bool   `json:"allow_promotion_codes"`
+	// Grants holds the features and limits of the plan. Its Plan and Status
+	// are left empty.
+	Grants Entitlements `json:"entitlements"`
+}
+
+// Catalog holds the plans on offer. A nil catalog has no plans.
+type Catalog struct {
+	plans   map[string]Plan
+	byPrice map[string]string
+}
+
+func NewCatalog(plans ...Plan) *Catalog {
+	c := &Catalog{plans: map[string]Plan{}, byPrice: map[string]string{}}
+	for _, p := range plans {
+		c.plans[p.Key] = p
+		if p.PriceID != "" {
+			c.byPrice[p.PriceID] = p.Key
+		}
+	}
+	return c
+}
+
+// legacyPriceID is the price the "pro" plan was billed with before plans
+// were configurable. Existing subscriptions still carry it.
+const legacyPriceID = "price_1RkrUj03wkQu8EDp7ZBLneeB"
+
+// CatalogFromEnv builds the catalog from PLANS, a comma separated list of plan
+// keys, each configured with PLAN_<KEY>_PRICE_ID, PLAN_<KEY>_INTERVAL,
+// PLAN_<KEY>_TRIAL_DAYS, PLAN_<KEY>_PROMOTION_CODES, PLAN_<KEY>_FEATURES and
+// PLAN_<KEY>_MAX_TAGS. Without PLANS there is a single monthly "pro" plan
+// billed with STRIPE_PRICE_ID, or the original price if that isn't set, that
+// grants everything.
+func CatalogFromEnv() (*Catalog, error) {
+	if strings.TrimSpace(os.Getenv("PLANS")) == "" {
+		priceID := os.Getenv("STRIPE_PRICE_ID")
+		if priceID == "" {
+			priceID = legacyPriceID
+		}
+		return NewCatalog(Plan{
+			Key:      "pro",
+			PriceID:  priceID,
+			Interval: "month",
+			Grants:   Entitlements{SMSAgenda: true, WeeklyAgenda: true, RecurringEvents: true, MaxTags: Unlimited},
+		}), nil
+	}
+
+	plans := []Plan{}
+	for _, key := range strings.Split(os.Getenv("PLANS"), ",") {
+		key = strings.TrimSpace(strings.ToLower(key))
+		if key == "" {
+			continue
+		}
+		if key == FreePlan {
+			return nil, fmt.Errorf("plan key %q is reserved", FreePlan)
+		}
+		prefix := "PLAN_" + strings.ToUpper(key) + "_"
+		p := Plan{
+			Key:                 key,
+			PriceID:             os.Getenv(prefix + "PRICE_ID"),
+			Interval:            os.Getenv(prefix + "INTERVAL"),
+			AllowPromotionCodes: os.Getenv(prefix+"PROMOTION_CODES") == "true",
+			Grants:              Entitlements{MaxTags: Unlimited},
+		}
+		if p.PriceID == "" {
+			return nil, fmt.Errorf("plan %q needs %sPRICE_ID", key, prefix)
+		}
+		if p.Interval == "" {
+			p.Interval = "month"
+		}
+		if p.Interval != "month" && p.Interval != "year" {
+			return nil, fmt.Errorf("%sINTERVAL must be month or year", prefix)
+		}
+		var err error
+		if raw := os.Getenv(prefix + "TRIAL_DAYS"); raw != "" {
+			p.TrialDays, err = strconv.ParseInt(raw, 10, 64)
+			if err != nil || p.TrialDays < 0 {
+				return nil, fmt.Errorf("%sTRIAL_DAYS must be a number of days", prefix)
+			}
+		}
+		if raw := os.Getenv(prefix + "MAX_TAGS"); raw != "" {
+			p.Grants.MaxTags, err = strconv.Atoi(raw)
+			if err != nil || p.Grants.MaxTags < Unlimited {
+				return nil, fmt.Errorf("%sMAX_TAGS must be a number, or -1 for no limit", prefix)
+			}
+		}
+		for _, feature := range strings.Split(os.Getenv(prefix+"FEATURES"), ",") {
+			switch strings.TrimSpace(feature) {
+			case "":
+			case "sms_agenda":
+				p.Grants.SMSAgenda = true
+			case "weekly_agenda":
+				p.Grants.WeeklyAgenda = true
+			case "recurring_events":
+				p.Grants.RecurringEvents = true
+			default:
+				return nil, fmt.Errorf("%sFEATURES has unknown feature %q", prefix, feature)
+			}
+		}
+		plans = append(plans, p)
+	}
+	return NewCatalog(plans...), nil
+}
+
+func (c *Catalog) Plan(key string) (Plan, bool) {
+	if c == nil {
+		return Plan{}, false
+	}
+	p, ok := c.plans[key]
+	return p, ok
+}
+
+// PlanForPrice finds the plan billed with a Stripe price.
+func (c *Catalog) PlanForPrice(priceID string) (Plan, bool) {
+	if c == nil {
+		return Plan{}, false
+	}
+	return c.Plan(c.byPrice[priceID])
+}
+
+// Plans lists the plans that can be checked out, ordered by key.
+func (c *Catalog) Plans() []Plan {
+	plans := []Plan{}
+	if c == nil {
+		return plans
+	}
+	for _, p := range c.plans {
+		if p.PriceID != "" {
+			plans = append(plans, p)
+		}
+	}
+	sort.Slice(plans, func(i, j int) bool { return plans[i].Key < plans[j].Key })
+	return plans
+}
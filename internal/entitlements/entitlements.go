@@ -0,0 +1,98 @@
+// Package entitlements decides what a user may do based on their
+// subscription plan and its billing status.
+package entitlements
+
+import (
+	"context"
+	"time"
+)
+
+// Unlimited is the value of a limit that doesn't apply.
+const Unlimited = -1
+
+// PastDueGrace is how long a subscription whose renewal payment failed keeps
+// its plan, giving Stripe time to retry.
+const PastDueGrace = 7 * 24 * time.Hour
+
+// GraceEndsAt is when a subscription that went past due at pastDueSince
+// loses its plan. Stripe has already moved the period forward by the time a
+// renewal fails, so the grace runs from the failure, not the period end.
+func GraceEndsAt(pastDueSince time.Time) time.Time {
+	return pastDueSince.Add(PastDueGrace)
+}
+
+// FreePlan is the plan of users without a subscription that grants one.
+const FreePlan = "free"
+
+type Entitlements struct {
+	Plan string `json:"plan,omitempty"`
+	// Status is the status of the subscription, or "none" without one.
+	Status string `json:"status,omitempty"`
+	// SMSAgenda allows the daily agenda to be sent by text message.
+	SMSAgenda bool `json:"sms_agenda"`
+	// WeeklyAgenda sends a week's agenda on Mondays in place of the daily one.
+	WeeklyAgenda    bool `json:"weekly_agenda"`
+	RecurringEvents bool `json:"recurring_events"`
+	MaxTags         int  `json:"max_tags"`
+	// GraceEndsAt is when a past due subscription loses its plan.
+	GraceEndsAt *time.Time `json:"grace_ends_at,omitempty"`
+}
+
+// free is what users get without a paid plan.
+var free = Entitlements{MaxTags: 5}
+
+// Free returns the entitlements of a user without a subscription.
+func Free() Entitlements {
+	e := free
+	e.Plan = FreePlan
+	e.Status = "none"
+	return e
+}
+
+// Resolve returns the entitlements a subscription to the catalog's plan
+// grants at now. Active and trialing subscriptions get their plan; past due
+// ones keep it until the grace period after pastDueSince is over; anything
+// else, and plans that are not in the catalog, fall back to the free plan.
+func (c *Catalog) Resolve(plan, status string, pastDueSince, now time.Time) Entitlements {
+	p, ok := c.Plan(plan)
+	granted := p.Grants
+	var graceEndsAt *time.Time
+	switch status {
+	case "active", "trialing":
+	case "past_due":
+		end := GraceEndsAt(pastDueSince)
+		if !now.Before(end) {
+			ok = false
+		}
+		graceEndsAt = &end
+	default:
+		ok = false
+	}
+	if !ok {
+		e := Free()
+		e.Status = status
+		return e
+	}
+	granted.Plan = plan
+	granted.Status = status
+	granted.GraceEndsAt = graceEndsAt
+	return granted
+}
+
+// AllowsTags reports whether a user with count tags may add another.
+func (e Entitlements) AllowsTags(count int64) bool {
+	return e.MaxTags == Unlimited || count < int64(e.MaxTags)
+}
+
+type contextKey string
+
+const entitlementsContextKey = contextKey("entitlements")
+
+func NewContext(ctx context.Context, e Entitlements) context.Context {
+	return context.WithValue(ctx, entitlementsContextKey, e)
+}
+
+func FromContext(ctx context.Context) (Entitlements, bool) {
+	e, ok := ctx.Value(entitlementsContextKey).(Entitlements)
+	return e, ok
+}
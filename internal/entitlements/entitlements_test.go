@@ -0,0 +1,55 @@
+package entitlements
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResolve(t *testing.T) {
+	catalog := NewCatalog(Plan{Key: "pro", PriceID: "price_pro", Interval: "month", Grants: Entitlements{SMSAgenda: true, MaxTags: Unlimited}})
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	pro, _ := catalog.Plan("pro")
+
+	tests := []struct {
+		name         string
+		plan         string
+		status       string
+		pastDueSince time.Time
+		wantPlan     string
+		wantGrace    *time.Time
+	}{
+		{name: "active", plan: "pro", status: "active", wantPlan: "pro"},
+		{name: "trialing", plan: "pro", status: "trialing", wantPlan: "pro"},
+		{name: "past due inside grace", plan: "pro", status: "past_due", pastDueSince: now.Add(-6 * 24 * time.Hour), wantPlan: "pro", wantGrace: ptr(now.Add(24 * time.Hour))},
+		{name: "past due after grace", plan: "pro", status: "past_due", pastDueSince: now.Add(-PastDueGrace), wantPlan: FreePlan},
+		{name: "canceled", plan: "pro", status: "canceled", wantPlan: FreePlan},
+		{name: "plan not in catalog", plan: "gold", status: "active", wantPlan: FreePlan},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := catalog.Resolve(tt.plan, tt.status, tt.pastDueSince, now)
+			if got.Plan != tt.wantPlan {
+				t.Errorf("plan = %q, want %q", got.Plan, tt.wantPlan)
+			}
+			if got.Status != tt.status {
+				t.Errorf("status = %q, want %q", got.Status, tt.status)
+			}
+			if tt.wantPlan == FreePlan && got.MaxTags != free.MaxTags {
+				t.Errorf("max tags = %d, want the free plan's %d", got.MaxTags, free.MaxTags)
+			}
+			if tt.wantPlan == "pro" && got.MaxTags != pro.Grants.MaxTags {
+				t.Errorf("max tags = %d, want the plan's %d", got.MaxTags, pro.Grants.MaxTags)
+			}
+			switch {
+			case tt.wantGrace == nil && got.GraceEndsAt != nil:
+				t.Errorf("grace ends at %v, want none", *got.GraceEndsAt)
+			case tt.wantGrace != nil && (got.GraceEndsAt == nil || !got.GraceEndsAt.Equal(*tt.wantGrace)):
+				t.Errorf("grace ends at %v, want %v", got.GraceEndsAt, *tt.wantGrace)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -3,24 +3,24 @@ package handlers
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
 	"github.com/curtisbraxdale/taday/internal/database"
 	"github.com/google/uuid"
 )
 
-func (cfg *ApiConfig) CreateDailyAgenda(userID uuid.UUID) (string, error) {
+func (cfg *ApiConfig) CreateDailyAgenda(ctx context.Context, userID uuid.UUID) (string, error) {
 	now := time.Now()
-	dbToDos, err := cfg.Queries.GetTodosByUserID(context.Background(), userID)
+	dbToDos, err := cfg.Queries.GetTodosByUserID(ctx, userID)
 	if err != nil {
-		log.Printf("Error getting ToDos for user %v: %s", userID, err)
+		slog.Error("Error getting todos for agenda", "user_id", userID, "error", err)
 		return "", err
 	}
 	dbEventParams := database.GetUserEventsTodayParams{UserID: userID, Date: now, DatePlus1Day: now.Add(24 * time.Hour)}
-	dbEvents, err := cfg.Queries.GetUserEventsToday(context.Background(), dbEventParams)
+	dbEvents, err := cfg.Queries.GetUserEventsToday(ctx, dbEventParams)
 	if err != nil {
-		log.Printf("Error getting Events for user %v: %s", userID, err)
+		slog.Error("Error getting events for agenda", "user_id", userID, "error", err)
 		return "", err
 	}
 	agendaString := "=== TADAYs AGENDA ===\n\n"
@@ -46,17 +46,17 @@ func (cfg *ApiConfig) CreateDailyAgenda(userID uuid.UUID) (string, error) {
 	return agendaString, nil
 }
 
-func (cfg *ApiConfig) CreateWeeklyAgenda(userID uuid.UUID) (string, error) {
+func (cfg *ApiConfig) CreateWeeklyAgenda(ctx context.Context, userID uuid.UUID) (string, error) {
 	now := time.Now()
-	dbToDos, err := cfg.Queries.GetTodosByUserID(context.Background(), userID)
+	dbToDos, err := cfg.Queries.GetTodosByUserID(ctx, userID)
 	if err != nil {
-		log.Fatalf("Error getting ToDos for user %v: %s", userID, err)
+		slog.Error("Error getting todos for agenda", "user_id", userID, "error", err)
 		return "", err
 	}
 	dbEventParams := database.GetUserEventsWeekParams{UserID: userID, Date: now, DatePlus7Days: now.Add(7 * 24 * time.Hour)}
-	dbEvents, err := cfg.Queries.GetUserEventsWeek(context.Background(), dbEventParams)
+	dbEvents, err := cfg.Queries.GetUserEventsWeek(ctx, dbEventParams)
 	if err != nil {
-		log.Fatalf("Error getting Events for user %v: %s", userID, err)
+		slog.Error("Error getting events for agenda", "user_id", userID, "error", err)
 		return "", err
 	}
 	agendaString := "=== TADAYs AGENDA ===\n\n"
@@ -1,9 +1,35 @@
 package handlers
 
-import "github.com/curtisbraxdale/taday/internal/database"
+import (
+	"database/sql"
+
+	"github.com/curtisbraxdale/taday/internal/auth"
+	"github.com/curtisbraxdale/taday/internal/billing"
+	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/entitlements"
+	"github.com/curtisbraxdale/taday/internal/mailer"
+	"github.com/curtisbraxdale/taday/internal/oidc"
+	"github.com/curtisbraxdale/taday/internal/ratelimit"
+)
 
 type ApiConfig struct {
+	DB       *sql.DB
 	Queries  *database.Queries
 	Platform string
-	Secret   string
+	Keyring  *auth.Keyring
+	Mailer   mailer.Mailer
+	// AccountLimiter throttles login attempts per account, on top of the
+	// per-IP limits applied to the routes.
+	AccountLimiter *ratelimit.Limiter
+	OIDC           *oidc.Registry
+	Billing        billing.Provider
+	// Plans is the catalog of paid plans and what each one grants.
+	Plans *entitlements.Catalog
+	// tx is set on the copy of the config a batch or webhook runs its
+	// queries through, while they are inside a transaction.
+	tx *sql.Tx
 }
+
+// frontendURL is where users are sent back to after flows that leave the
+// frontend, such as email links and external sign-in.
+const frontendURL = "https://taday.io"
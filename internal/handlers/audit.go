@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/middleware"
+	"github.com/curtisbraxdale/taday/internal/validate"
+	"github.com/google/uuid"
+)
+
+// AuditEvent is one entry in a user's audit log. Actor is "user" for things
+// done through the API and "stripe" for billing changes sent by webhook.
+type AuditEvent struct {
+	ID         uuid.UUID  `json:"id"`
+	Actor      string     `json:"actor"`
+	Action     string     `json:"action"`
+	ResourceID *uuid.UUID `json:"resource_id,omitempty"`
+	Details    string     `json:"details,omitempty"`
+	IPAddress  string     `json:"ip_address"`
+	UserAgent  string     `json:"user_agent"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// audit records an action the user took on their account or data. A failure
+// is logged rather than failing a request that has already done its work.
+// Inside a batch the insert runs in a savepoint, so a failure doesn't abort
+// the operations that follow.
+func (cfg *ApiConfig) audit(req *http.Request, userID uuid.UUID, action string, resourceID uuid.UUID, details string) {
+	var err error
+	if cfg.tx != nil {
+		err = cfg.inSavepoint(req.Context(), "audit_event", func() error {
+			return cfg.auditAs(req, "user", userID, action, resourceID, details)
+		})
+	} else {
+		err = cfg.auditAs(req, "user", userID, action, resourceID, details)
+	}
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error recording audit event", "action", action, "user_id", userID, "error", err)
+	}
+}
+
+// auditAs records an action taken by actor and returns the error, so the
+// webhook can fail the event and have Stripe retry it.
+func (cfg *ApiConfig) auditAs(req *http.Request, actor string, userID uuid.UUID, action string, resourceID uuid.UUID, details string) error {
+	return cfg.Queries.CreateAuditEvent(req.Context(), database.CreateAuditEventParams{
+		UserID:     userID,
+		Actor:      actor,
+		Action:     action,
+		ResourceID: uuid.NullUUID{UUID: resourceID, Valid: resourceID != uuid.Nil},
+		Details:    details,
+		IpAddress:  middleware.ClientIP(req),
+		UserAgent:  req.UserAgent(),
+	})
+}
+
+// inSavepoint runs f in a savepoint of cfg.tx and rolls back to it if f
+// fails, leaving the rest of the transaction usable.
+func (cfg *ApiConfig) inSavepoint(ctx context.Context, name string, f func() error) error {
+	_, err := cfg.tx.ExecContext(ctx, "SAVEPOINT "+name)
+	if err != nil {
+		return err
+	}
+	err = f()
+	if err != nil {
+		_, rollbackErr := cfg.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name)
+		return errors.Join(err, rollbackErr)
+	}
+	_, err = cfg.tx.ExecContext(ctx, "RELEASE SAVEPOINT "+name)
+	return err
+}
+
+// GetAuditLog lists the audit log of the user's account, newest first.
+func (cfg *ApiConfig) GetAuditLog(w http.ResponseWriter, req *http.Request) {
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+
+	v := validate.New()
+	page := parsePageParams(v, req.URL.Query())
+	dbAuditParams := database.ListAuditEventsParams{UserID: userID, RowLimit: page.Limit + 1}
+	if page.Cursor != nil {
+		dbAuditParams.CursorCreatedAt = sql.NullTime{Time: cursorTime(v, page.Cursor), Valid: true}
+		dbAuditParams.CursorID = uuid.NullUUID{UUID: page.Cursor.ID, Valid: true}
+	}
+	if respondWithValidationError(w, v.Err()) {
+		return
+	}
+
+	dbAuditEvents, err := cfg.Queries.ListAuditEvents(req.Context(), dbAuditParams)
+	if err != nil {
+		respondWithInternalError(w, req, "Error listing audit log", err)
+		return
+	}
+	auditLog := Page[AuditEvent]{Items: []AuditEvent{}}
+	if len(dbAuditEvents) > int(page.Limit) {
+		dbAuditEvents = dbAuditEvents[:page.Limit]
+		last := dbAuditEvents[len(dbAuditEvents)-1]
+		auditLog.NextCursor = encodeCursor(last.CreatedAt.Format(time.RFC3339Nano), last.ID)
+	}
+	for _, a := range dbAuditEvents {
+		auditLog.Items = append(auditLog.Items, auditEventFromDB(a))
+	}
+	respondWithJSON(w, 200, auditLog)
+}
+
+func auditEventFromDB(a database.AuditEvent) AuditEvent {
+	event := AuditEvent{ID: a.ID, Actor: a.Actor, Action: a.Action, Details: a.Details, IPAddress: a.IpAddress, UserAgent: a.UserAgent, CreatedAt: a.CreatedAt}
+	if a.ResourceID.Valid {
+		event.ResourceID = &a.ResourceID.UUID
+	}
+	return event
+}
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/curtisbraxdale/taday/internal/tracing"
+	"github.com/curtisbraxdale/taday/internal/validate"
+	"github.com/google/uuid"
+)
+
+const (
+	maxBatchOperations = 100
+	maxBatchBodyBytes  = 1 << 20
+)
+
+// batchOperation is a single create, update or delete in a batch. id names the
+// event, todo or tag being updated or deleted; event tag links use event_id and
+// tag_id instead. data is the body the matching single endpoint takes.
+type batchOperation struct {
+	Op       string          `json:"op"`
+	Resource string          `json:"resource"`
+	ID       uuid.UUID       `json:"id"`
+	EventID  uuid.UUID       `json:"event_id"`
+	TagID    uuid.UUID       `json:"tag_id"`
+	IfMatch  string          `json:"if_match"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// BatchResult is the response the single endpoint would have given for one
+// operation.
+type BatchResult struct {
+	Index  int             `json:"index"`
+	Status int             `json:"status"`
+	ETag   string          `json:"etag,omitempty"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+type BatchResponse struct {
+	Committed bool          `json:"committed"`
+	Results   []BatchResult `json:"results"`
+}
+
+// Batch runs a list of operations in one transaction. In atomic mode the
+// first failure rolls everything back; in best_effort mode failed operations
+// are undone on their own and the rest are committed.
+func (cfg *ApiConfig) Batch(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Mode       string           `json:"mode"`
+		Operations []batchOperation `json:"operations"`
+	}
+	if _, ok := requestUserID(w, req); !ok {
+		return
+	}
+
+	req.Body = http.MaxBytesReader(w, req.Body, maxBatchBodyBytes)
+	params := parameters{}
+	if !decodeJSON(w, req, &params) {
+		return
+	}
+	v := validate.New()
+	bestEffort := false
+	switch params.Mode {
+	case "", "atomic":
+	case "best_effort":
+		bestEffort = true
+	default:
+		v.Add("mode", "invalid_value", "mode must be atomic or best_effort")
+	}
+	if len(params.Operations) == 0 || len(params.Operations) > maxBatchOperations {
+		v.Add("operations", "out_of_range", fmt.Sprintf("operations must have between 1 and %d entries", maxBatchOperations))
+	}
+	for i, op := range params.Operations {
+		if _, _, ok := batchHandler(cfg, op); !ok {
+			v.Add(fmt.Sprintf("operations[%d]", i), "invalid_value", "op must be create, update or delete and resource one of event, todo, tag or event_tag")
+		}
+	}
+	if respondWithValidationError(w, v.Err()) {
+		return
+	}
+
+	tx, err := cfg.DB.BeginTx(req.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, req, "Error starting batch", err)
+		return
+	}
+	defer tx.Rollback()
+	txCfg := *cfg
+	txCfg.Queries = tracing.WithTx(tx)
+	txCfg.tx = tx
+
+	resp := BatchResponse{Committed: true, Results: []BatchResult{}}
+	for i, op := range params.Operations {
+		// A failed statement aborts the transaction, so in best effort mode
+		// each operation runs in its own savepoint.
+		if bestEffort {
+			_, err = tx.ExecContext(req.Context(), "SAVEPOINT batch_operation")
+			if err != nil {
+				respondWithInternalError(w, req, "Error running batch", err)
+				return
+			}
+		}
+		result := txCfg.runBatchOperation(req, op)
+		result.Index = i
+		resp.Results = append(resp.Results, result)
+		if result.Status < 400 {
+			continue
+		}
+		if !bestEffort {
+			resp.Committed = false
+			break
+		}
+		_, err = tx.ExecContext(req.Context(), "ROLLBACK TO SAVEPOINT batch_operation")
+		if err != nil {
+			respondWithInternalError(w, req, "Error running batch", err)
+			return
+		}
+	}
+
+	if resp.Committed {
+		err = tx.Commit()
+		if err != nil {
+			respondWithInternalError(w, req, "Error committing batch", err)
+			return
+		}
+	}
+	respondWithJSON(w, 200, resp)
+}
+
+// runBatchOperation runs op through the handler of the matching single
+// endpoint and records its response.
+func (cfg *ApiConfig) runBatchOperation(req *http.Request, op batchOperation) BatchResult {
+	handler, pathValues, _ := batchHandler(cfg, op)
+	body := op.Data
+	if op.Resource == "event_tag" && op.Op == "create" {
+		body, _ = json.Marshal(map[string]uuid.UUID{"tag_id": op.TagID})
+	}
+
+	// The clone keeps the authenticated user and the client details the audit
+	// log records from the batch request.
+	opReq := req.Clone(req.Context())
+	opReq.Body = io.NopCloser(bytes.NewReader(body))
+	opReq.Header = http.Header{}
+	for _, name := range []string{"User-Agent", "Fly-Client-IP", "X-Forwarded-For"} {
+		if value := req.Header.Get(name); value != "" {
+			opReq.Header.Set(name, value)
+		}
+	}
+	if op.IfMatch != "" {
+		opReq.Header.Set("If-Match", op.IfMatch)
+	}
+	for name, value := range pathValues {
+		opReq.SetPathValue(name, value)
+	}
+
+	rec := &batchRecorder{header: http.Header{}}
+	handler(rec, opReq)
+	rec.WriteHeader(http.StatusOK)
+	result := BatchResult{Status: rec.status, ETag: rec.header.Get("ETag")}
+	if rec.body.Len() > 0 {
+		result.Body = rec.body.Bytes()
+	}
+	return result
+}
+
+// batchHandler maps an operation to the handler and path values of the single
+// endpoint for it.
+func batchHandler(cfg *ApiConfig, op batchOperation) (http.HandlerFunc, map[string]string, bool) {
+	id := op.ID.String()
+	switch op.Resource + " " + op.Op {
+	case "event create":
+		return cfg.CreateEvent, nil, true
+	case "event update":
+		return cfg.PatchEvent, map[string]string{"event_id": id}, true
+	case "event delete":
+		return cfg.DeleteEvent, map[string]string{"event_id": id}, true
+	case "todo create":
+		return cfg.CreateToDo, nil, true
+	case "todo update":
+		return cfg.PatchToDo, map[string]string{"todo_id": id}, true
+	case "todo delete":
+		return cfg.DeleteToDo, map[string]string{"todo_id": id}, true
+	case "tag create":
+		return cfg.CreateTag, nil, true
+	case "tag update":
+		return cfg.UpdateTag, map[string]string{"tag_id": id}, true
+	case "tag delete":
+		return cfg.DeleteTag, map[string]string{"tag_id": id}, true
+	case "event_tag create":
+		return cfg.CreateEventTag, map[string]string{"event_id": op.EventID.String()}, true
+	case "event_tag delete":
+		return cfg.DeleteEventTag, map[string]string{"event_id": op.EventID.String(), "tag_id": op.TagID.String()}, true
+	default:
+		return nil, nil, false
+	}
+}
+
+// batchRecorder captures the response of a handler run inside a batch.
+type batchRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *batchRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *batchRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+}
+
+func (r *batchRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/curtisbraxdale/taday/internal/auth"
+	"github.com/google/uuid"
+)
+
+func TestBatchRejectsOversizedBody(t *testing.T) {
+	body := `{"operations": [{"op": "create", "resource": "todo", "data": {"title": "` + strings.Repeat("a", maxBatchBodyBytes) + `"}}]}`
+	req := httptest.NewRequest(http.MethodPost, "/api/batch", strings.NewReader(body))
+	req = req.WithContext(auth.ContextWithUserID(req.Context(), uuid.New()))
+	rec := httptest.NewRecorder()
+	(&ApiConfig{}).Batch(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413: %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if resp.Code != "payload_too_large" {
+		t.Errorf("code = %q, want payload_too_large", resp.Code)
+	}
+}
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// uniqueViolation reports whether err is a Postgres unique constraint violation
+// and, if so, the name of the constraint that was violated.
+func uniqueViolation(err error) (string, bool) {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return pqErr.Constraint, true
+	}
+	return "", false
+}
+
+// foreignKeyViolation reports whether err is a Postgres foreign key violation.
+func foreignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+func conflictMessage(constraint string) string {
+	switch constraint {
+	case "users_email_lower_idx":
+		return "Email is already in use"
+	case "users_username_lower_idx":
+		return "Username is already taken"
+	case "event_tags_pkey":
+		return "Tag is already on this event"
+	default:
+		return "Resource already exists"
+	}
+}
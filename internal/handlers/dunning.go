@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/entitlements"
+)
+
+// dunningReminders is how long after a payment fails each reminder goes out.
+// A last notice follows when the grace period ends and the plan is paused.
+var dunningReminders = []time.Duration{0, 3 * 24 * time.Hour, 6 * 24 * time.Hour}
+
+// dunningResolution returns how a subscription in status closes an open
+// dunning case, or "" if it doesn't.
+func dunningResolution(status string) string {
+	switch status {
+	case "active", "trialing":
+		return "recovered"
+	case "canceled", "incomplete_expired":
+		return "canceled"
+	}
+	return ""
+}
+
+func (cfg *ApiConfig) resolveDunning(ctx context.Context, stripeSubscriptionID, resolution string) error {
+	_, err := cfg.Queries.ResolveDunningCase(ctx, database.ResolveDunningCaseParams{StripeSubscriptionID: stripeSubscriptionID, Resolution: resolution})
+	return err
+}
+
+// DunningNotice is a message asking the user to fix a failed payment.
+type DunningNotice struct {
+	Kind    string
+	Subject string
+	Body    string
+	// Next is when the following notice is due. It is invalid after the last.
+	Next sql.NullTime
+}
+
+// DunningNotice prepares the notice due for a dunning case. If the
+// subscription has recovered or ended since the case was opened, the case is
+// closed instead and ok is false.
+func (cfg *ApiConfig) DunningNotice(ctx context.Context, c database.DunningCase, now time.Time) (notice DunningNotice, ok bool, err error) {
+	dbSubscription, err := cfg.Queries.GetSubscriptionByStripeID(ctx, c.StripeSubscriptionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DunningNotice{}, false, cfg.resolveDunning(ctx, c.StripeSubscriptionID, "canceled")
+	}
+	if err != nil {
+		return DunningNotice{}, false, err
+	}
+	if resolution := dunningResolution(dbSubscription.Status); resolution != "" {
+		return DunningNotice{}, false, cfg.resolveDunning(ctx, c.StripeSubscriptionID, resolution)
+	}
+
+	link := billingURL("BILLING_PORTAL_RETURN_URL", "/account")
+	// The case opened when the payment failed, which is also where the
+	// entitlements count the grace period from.
+	graceEndsAt := entitlements.GraceEndsAt(c.CreatedAt)
+	if !now.Before(graceEndsAt) {
+		return DunningNotice{
+			Kind:    "dunning_suspended",
+			Subject: "Your Taday plan is paused",
+			Body:    fmt.Sprintf("We still couldn't take the payment for your Taday subscription, so your account is on the free plan for now. Update your payment method at %s to get your plan back.", link),
+		}, true, nil
+	}
+
+	notice = DunningNotice{
+		Kind:    "dunning_reminder",
+		Subject: "Your Taday payment didn't go through",
+		Body:    fmt.Sprintf("We couldn't take the payment for your Taday subscription. Update your payment method at %s before %s to keep your plan.", link, graceEndsAt.Format("January 2")),
+		Next:    sql.NullTime{Time: graceEndsAt, Valid: true},
+	}
+	if sent := int(c.NoticesSent) + 1; sent < len(dunningReminders) {
+		if next := c.CreatedAt.Add(dunningReminders[sent]); next.Before(graceEndsAt) {
+			notice.Next.Time = next
+		}
+	}
+	return notice, true, nil
+}
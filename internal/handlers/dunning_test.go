@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/curtisbraxdale/taday/internal/entitlements"
+)
+
+func TestDunningDeadlineCountsFromFailedPayment(t *testing.T) {
+	wt := newWebhookTest(t)
+	ctx := context.Background()
+	now := time.Now()
+	// The renewal has already moved the period a month forward when the
+	// payment fails.
+	wt.send("evt_1", "customer.subscription.created", now.Add(-time.Hour), subscriptionObject("active", "price_pro"), http.StatusOK)
+	wt.send("evt_2", "invoice.payment_failed", now.Add(-time.Minute), invoiceObject("in_1"), http.StatusOK)
+
+	cases, err := wt.cfg.Queries.GetDueDunningCases(ctx, now.Add(time.Hour))
+	if err != nil || len(cases) != 1 {
+		t.Fatalf("got dunning cases %+v, %v; want one", cases, err)
+	}
+	c := cases[0]
+	deadline := entitlements.GraceEndsAt(c.CreatedAt)
+
+	notice, ok, err := wt.cfg.DunningNotice(ctx, c, c.CreatedAt)
+	if err != nil || !ok {
+		t.Fatalf("first notice: ok %v, %v", ok, err)
+	}
+	if notice.Kind != "dunning_reminder" || !strings.Contains(notice.Body, deadline.Format("January 2")) {
+		t.Errorf("first notice: got %s %q, want a reminder to pay before %s", notice.Kind, notice.Body, deadline.Format("January 2"))
+	}
+	if want := c.CreatedAt.Add(dunningReminders[1]); !notice.Next.Time.Equal(want) {
+		t.Errorf("first notice: next at %v, want %v", notice.Next.Time, want)
+	}
+
+	c.NoticesSent = int32(len(dunningReminders) - 1)
+	notice, _, err = wt.cfg.DunningNotice(ctx, c, c.CreatedAt.Add(dunningReminders[len(dunningReminders)-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !notice.Next.Time.Equal(deadline) {
+		t.Errorf("last reminder: next at %v, want the deadline %v", notice.Next.Time, deadline)
+	}
+
+	notice, _, err = wt.cfg.DunningNotice(ctx, c, deadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notice.Kind != "dunning_suspended" {
+		t.Errorf("at the deadline: got %s, want dunning_suspended", notice.Kind)
+	}
+
+	e, err := wt.cfg.Entitlements(ctx, wt.user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Plan != "pro" || e.GraceEndsAt == nil || !e.GraceEndsAt.Equal(deadline) {
+		t.Errorf("entitlements: got plan %q grace ends at %v, want pro until %v", e.Plan, e.GraceEndsAt, deadline)
+	}
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/curtisbraxdale/taday/internal/apierror"
+	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/entitlements"
+	"github.com/google/uuid"
+)
+
+// Entitlements returns what the user's subscription currently allows.
+func (cfg *ApiConfig) Entitlements(ctx context.Context, userID uuid.UUID) (entitlements.Entitlements, error) {
+	dbSubscription, err := cfg.Queries.GetSubscriptionByUserID(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entitlements.Free(), nil
+	}
+	if err != nil {
+		return entitlements.Entitlements{}, err
+	}
+	pastDueSince, err := cfg.pastDueSince(ctx, dbSubscription)
+	if err != nil {
+		return entitlements.Entitlements{}, err
+	}
+	return cfg.Plans.Resolve(dbSubscription.Plan, dbSubscription.Status, pastDueSince, time.Now()), nil
+}
+
+// pastDueSince returns when a past due subscription's payment failed: the
+// opening of its dunning case, the same time the reminders count from. Until
+// the invoice.payment_failed event opens the case, the last change to the
+// subscription stands in for it.
+func (cfg *ApiConfig) pastDueSince(ctx context.Context, dbSubscription database.Subscription) (time.Time, error) {
+	if dbSubscription.Status != "past_due" {
+		return time.Time{}, nil
+	}
+	dbCase, err := cfg.Queries.GetOpenDunningCaseBySubscriptionID(ctx, dbSubscription.StripeSubscriptionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return dbSubscription.UpdatedAt, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return dbCase.CreatedAt, nil
+}
+
+// requestEntitlements returns the entitlements the LoadEntitlements
+// middleware stored for the request, looking them up if the route doesn't
+// use it.
+func (cfg *ApiConfig) requestEntitlements(w http.ResponseWriter, req *http.Request, userID uuid.UUID) (entitlements.Entitlements, bool) {
+	if e, ok := entitlements.FromContext(req.Context()); ok {
+		return e, true
+	}
+	e, err := cfg.Entitlements(req.Context(), userID)
+	if err != nil {
+		respondWithInternalError(w, req, "Error resolving entitlements", err)
+		return entitlements.Entitlements{}, false
+	}
+	return e, true
+}
+
+func respondWithPlanLimit(w http.ResponseWriter, msg string) {
+	apierror.Write(w, apierror.New(http.StatusForbidden, apierror.CodePlanLimit, msg))
+}
+
+// GetEntitlements tells clients which features the user's plan includes, so
+// they can hide or upsell the rest.
+func (cfg *ApiConfig) GetEntitlements(w http.ResponseWriter, req *http.Request) {
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+	e, ok := cfg.requestEntitlements(w, req, userID)
+	if !ok {
+		return
+	}
+	respondWithJSON(w, 200, e)
+}
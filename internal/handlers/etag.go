@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ETags are derived from updated_at, which every write bumps, so they change
+// whenever the resource does.
+func etag(updatedAt time.Time) string {
+	return `"` + strconv.FormatInt(updatedAt.UnixMicro(), 10) + `"`
+}
+
+func setETag(w http.ResponseWriter, updatedAt time.Time) {
+	w.Header().Set("ETag", etag(updatedAt))
+}
+
+// etagMatches reports whether header, a comma separated If-Match or
+// If-None-Match value, lists the current ETag. Weak comparison is used since
+// both forms are derived from the same timestamp.
+func etagMatches(header string, updatedAt time.Time) bool {
+	current := etag(updatedAt)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == current {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified handles If-None-Match on GET requests. It sets the ETag and, if
+// the client already has the current version, responds with 304.
+func notModified(w http.ResponseWriter, req *http.Request, updatedAt time.Time) bool {
+	setETag(w, updatedAt)
+	header := req.Header.Get("If-None-Match")
+	if header == "" || !etagMatches(header, updatedAt) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// checkIfMatch handles If-Match on writes. It responds with 412 if the client
+// was editing a version other than current and otherwise returns the
+// updated_at the write must still see, so a concurrent change in between is
+// caught by the update itself. Without If-Match there is nothing to check.
+func checkIfMatch(w http.ResponseWriter, req *http.Request, current time.Time) (sql.NullTime, bool) {
+	header := req.Header.Get("If-Match")
+	if header == "" {
+		return sql.NullTime{}, true
+	}
+	if !etagMatches(header, current) {
+		respondWithError(w, http.StatusPreconditionFailed, "Resource has been modified")
+		return sql.NullTime{}, false
+	}
+	return sql.NullTime{Time: current, Valid: true}, true
+}
+
+// respondWithUpdateError reports a conditional update that matched no rows as
+// 412: the row was checked just before, so another write got in between.
+func respondWithUpdateError(w http.ResponseWriter, req *http.Request, resource string, ifUpdatedAt sql.NullTime, err error) {
+	if ifUpdatedAt.Valid && errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, http.StatusPreconditionFailed, resource+" has been modified")
+		return
+	}
+	respondWithQueryError(w, req, resource, err)
+}
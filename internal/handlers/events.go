@@ -2,14 +2,15 @@ package handlers
 
 import (
 	"database/sql"
-	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
-	"sort"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/curtisbraxdale/taday/internal/auth"
+	"github.com/curtisbraxdale/taday/internal/apierror"
 	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/validate"
 	"github.com/google/uuid"
 )
 
@@ -29,6 +30,22 @@ type Event struct {
 	RecurY      bool      `json:"recur_y"`
 }
 
+const (
+	maxTitleLength       = 200
+	maxDescriptionLength = 2000
+)
+
+func validateEvent(title, description string, startDate, endDate time.Time) *apierror.Error {
+	v := validate.New()
+	v.Required("title", title)
+	v.MaxLength("title", title, maxTitleLength)
+	v.MaxLength("description", description, maxDescriptionLength)
+	v.RequiredTime("start_date", startDate)
+	v.RequiredTime("end_date", endDate)
+	v.After("end_date", endDate, "start_date", startDate)
+	return v.Err()
+}
+
 func (cfg *ApiConfig) CreateEvent(w http.ResponseWriter, req *http.Request) {
 	type parameters struct {
 		StartDate   time.Time `json:"start_date"`
@@ -41,100 +58,112 @@ func (cfg *ApiConfig) CreateEvent(w http.ResponseWriter, req *http.Request) {
 		RecurM      bool      `json:"recur_m"`
 		RecurY      bool      `json:"recur_y"`
 	}
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	userID, ok := requestUserID(w, req)
+	if !ok {
 		return
 	}
-	accessToken := accessCookie.Value
 
-	decoder := json.NewDecoder(req.Body)
 	params := parameters{}
-	err = decoder.Decode(&params)
-	if err != nil {
-		log.Printf("Error decoding parameters: %s", err)
-		w.WriteHeader(500)
+	if !decodeJSON(w, req, &params) {
 		return
 	}
-
-	userID, err := auth.ValidateAccessToken(accessToken, cfg.Secret)
-	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	params.Title = strings.TrimSpace(params.Title)
+	if respondWithValidationError(w, validateEvent(params.Title, params.Description, params.StartDate, params.EndDate)) {
 		return
 	}
+	if (params.RecurD || params.RecurW || params.RecurM || params.RecurY) && !cfg.allowRecurrence(w, req, userID, uuid.Nil) {
+		return
+	}
+
 	dbEventParams := database.CreateEventParams{UserID: userID, StartDate: params.StartDate, EndDate: params.EndDate, Title: params.Title, Description: sql.NullString{String: params.Description, Valid: true}, Priority: params.Priority, RecurD: params.RecurD, RecurW: params.RecurW, RecurM: params.RecurM, RecurY: params.RecurY}
 	dbEvent, err := cfg.Queries.CreateEvent(req.Context(), dbEventParams)
 	if err != nil {
-		log.Printf("Error creating todo: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		respondWithQueryError(w, req, "Event", err)
 		return
 	}
+	cfg.audit(req, userID, "event_created", dbEvent.ID, "")
 
 	event := Event{ID: dbEvent.ID, UserID: dbEvent.UserID, CreatedAt: dbEvent.CreatedAt, UpdatedAt: dbEvent.UpdatedAt, StartDate: dbEvent.StartDate, EndDate: dbEvent.EndDate, Title: dbEvent.Title, Description: dbEvent.Description.String, Priority: dbEvent.Priority, RecurD: dbEvent.RecurD, RecurW: dbEvent.RecurW, RecurM: dbEvent.RecurM, RecurY: dbEvent.RecurY}
 	respondWithJSON(w, 201, event)
 }
 
 func (cfg *ApiConfig) GetUserEvents(w http.ResponseWriter, req *http.Request) {
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	userID, ok := requestUserID(w, req)
+	if !ok {
 		return
 	}
-	accessToken := accessCookie.Value
 
-	userID, err := auth.ValidateAccessToken(accessToken, cfg.Secret)
-	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+	query := req.URL.Query()
+	v := validate.New()
+	page := parsePageParams(v, query)
+	descending := parseOrder(v, query)
+	startDate := parseQueryTime(v, query, "from")
+	endDate := parseQueryTime(v, query, "to")
+	// range is shorthand for the current day, week, month or year and is only
+	// used when no explicit bounds are given.
+	if startDate.IsZero() && endDate.IsZero() {
+		startDate, endDate = rangeBounds(v, query.Get("range"), time.Now())
 	}
-
-	tagFilter := req.URL.Query().Get("tag")
-	rangeFilter := req.URL.Query().Get("range")
-	now := time.Now()
-
-	var startDate, endDate time.Time
-
-	switch rangeFilter {
-	case "day":
-		startDate = now.Truncate(24 * time.Hour)
-		endDate = startDate.Add(24 * time.Hour)
-	case "week":
-		weekday := int(now.Weekday())
-		startDate = now.AddDate(0, 0, -weekday)
-		endDate = startDate.AddDate(0, 0, 7)
-	case "month":
-		startDate = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
-		endDate = startDate.AddDate(0, 1, 0)
-	case "year":
-		startDate = time.Date(now.Year(), 1, 1, 0, 0, 0, 0, now.Location())
-		endDate = startDate.AddDate(1, 0, 0)
+	if !startDate.IsZero() && !endDate.IsZero() {
+		v.After("to", endDate, "from", startDate)
+	}
+	tags := append(queryList(query, "tag"), queryList(query, "tags")...)
+	matchAllTags := false
+	switch query.Get("tag_mode") {
+	case "", "any":
+	case "all":
+		matchAllTags = true
 	default:
-		startDate = time.Time{}
-		endDate = time.Time{}
+		v.Add("tag_mode", "invalid_value", "tag_mode must be any or all")
+	}
+	priority := sql.NullBool{}
+	if raw := query.Get("priority"); raw != "" {
+		p, err := strconv.ParseBool(raw)
+		if err != nil {
+			v.Add("priority", "invalid_value", "priority must be true or false")
+		}
+		priority = sql.NullBool{Bool: p, Valid: err == nil}
+	}
+	cursorStartDate := sql.NullTime{}
+	cursorID := uuid.NullUUID{}
+	if page.Cursor != nil {
+		cursorStartDate = sql.NullTime{Time: cursorTime(v, page.Cursor), Valid: true}
+		cursorID = uuid.NullUUID{UUID: page.Cursor.ID, Valid: true}
+	}
+	if respondWithValidationError(w, v.Err()) {
+		return
 	}
 
-	dbEventParams := database.GetFilteredEventsParams{UserID: userID, StartDate: startDate, EndDate: endDate, Tag: tagFilter}
-	dbEvents, err := cfg.Queries.GetFilteredEvents(req.Context(), dbEventParams)
+	// One extra row tells us whether there is another page.
+	dbEventParams := database.ListEventsParams{
+		UserID:          userID,
+		FromDate:        sql.NullTime{Time: startDate, Valid: !startDate.IsZero()},
+		ToDate:          sql.NullTime{Time: endDate, Valid: !endDate.IsZero()},
+		Priority:        priority,
+		Tags:            tags,
+		MatchAllTags:    matchAllTags,
+		CursorStartDate: cursorStartDate,
+		Descending:      descending,
+		CursorID:        cursorID,
+		RowLimit:        page.Limit + 1,
+	}
+	dbEvents, err := cfg.Queries.ListEvents(req.Context(), dbEventParams)
 	if err != nil {
-		log.Printf("Error finding events for given userID: %s", err)
-		w.WriteHeader(500)
+		respondWithInternalError(w, req, "Error finding events for given userID", err)
 		return
 	}
-	events := []Event{}
+	events := Page[Event]{Items: []Event{}}
+	if len(dbEvents) > int(page.Limit) {
+		dbEvents = dbEvents[:page.Limit]
+		last := dbEvents[len(dbEvents)-1]
+		events.NextCursor = encodeCursor(last.StartDate.Format(time.RFC3339Nano), last.ID)
+	}
 	for _, e := range dbEvents {
 		eventDescription := ""
 		if e.Description.String != "" {
 			eventDescription = e.Description.String
 		}
-		events = append(events, Event{ID: e.ID, UserID: e.UserID, CreatedAt: e.CreatedAt, UpdatedAt: e.UpdatedAt, StartDate: e.StartDate, EndDate: e.EndDate, Title: e.Title, Description: eventDescription, Priority: e.Priority, RecurD: e.RecurD, RecurW: e.RecurW, RecurM: e.RecurM, RecurY: e.RecurY})
-	}
-	sortDir := req.URL.Query().Get("sort")
-	if sortDir == "desc" {
-		sort.Slice(events, func(i, j int) bool { return events[j].StartDate.Before(events[i].StartDate) })
+		events.Items = append(events.Items, Event{ID: e.ID, UserID: e.UserID, CreatedAt: e.CreatedAt, UpdatedAt: e.UpdatedAt, StartDate: e.StartDate, EndDate: e.EndDate, Title: e.Title, Description: eventDescription, Priority: e.Priority, RecurD: e.RecurD, RecurW: e.RecurW, RecurM: e.RecurM, RecurY: e.RecurY})
 	}
 	respondWithJSON(w, 200, events)
 	/*
@@ -161,43 +190,99 @@ func (cfg *ApiConfig) GetUserEvents(w http.ResponseWriter, req *http.Request) {
 	*/
 }
 
-func (cfg *ApiConfig) GetEvent(w http.ResponseWriter, req *http.Request) {
-	eventID, err := uuid.Parse(req.PathValue("event_id"))
-	if err != nil {
-		log.Printf("Error parsing uuid: %s", err)
-		w.WriteHeader(500)
-		return
+// rangeBounds returns the bounds of the day, week, month or year containing
+// now. An empty range means no bounds.
+func rangeBounds(v *validate.Validator, rangeFilter string, now time.Time) (time.Time, time.Time) {
+	var startDate, endDate time.Time
+
+	switch rangeFilter {
+	case "":
+	case "day":
+		startDate = now.Truncate(24 * time.Hour)
+		endDate = startDate.Add(24 * time.Hour)
+	case "week":
+		weekday := int(now.Weekday())
+		startDate = now.AddDate(0, 0, -weekday)
+		endDate = startDate.AddDate(0, 0, 7)
+	case "month":
+		startDate = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+		endDate = startDate.AddDate(0, 1, 0)
+	case "year":
+		startDate = time.Date(now.Year(), 1, 1, 0, 0, 0, 0, now.Location())
+		endDate = startDate.AddDate(1, 0, 0)
+	default:
+		v.Add("range", "invalid_value", "range must be day, week, month or year")
 	}
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	return startDate, endDate
+}
+
+func (cfg *ApiConfig) GetEvent(w http.ResponseWriter, req *http.Request) {
+	eventID, ok := pathUUID(w, req, "event_id")
+	if !ok {
 		return
 	}
-	accessToken := accessCookie.Value
-
-	userID, err := auth.ValidateAccessToken(accessToken, cfg.Secret)
-	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	userID, ok := requestUserID(w, req)
+	if !ok {
 		return
 	}
 
 	dbEvent, err := cfg.Queries.GetEventByID(req.Context(), eventID)
 	if err != nil {
-		log.Printf("Error finding event for given id: %s", err)
-		w.WriteHeader(500)
+		respondWithQueryError(w, req, "Event", err)
 		return
 	}
+	// Other users' events are reported as missing so IDs can't be probed.
 	if dbEvent.UserID != userID {
-		log.Printf("Unauthorized access: user %s tried to access event %s owned by %s", userID, dbEvent.ID, dbEvent.UserID)
-		w.WriteHeader(http.StatusUnauthorized)
+		slog.WarnContext(req.Context(), "Unauthorized access to event", "event_id", dbEvent.ID, "owner_id", dbEvent.UserID)
+		respondWithError(w, http.StatusNotFound, "Event not found")
+		return
+	}
+	if notModified(w, req, dbEvent.UpdatedAt) {
 		return
 	}
 	event := Event{ID: dbEvent.ID, UserID: dbEvent.UserID, CreatedAt: dbEvent.CreatedAt, UpdatedAt: dbEvent.UpdatedAt, StartDate: dbEvent.StartDate, EndDate: dbEvent.EndDate, Title: dbEvent.Title, Description: dbEvent.Description.String, Priority: dbEvent.Priority, RecurD: dbEvent.RecurD, RecurW: dbEvent.RecurW, RecurM: dbEvent.RecurM, RecurY: dbEvent.RecurY}
 	respondWithJSON(w, 200, event)
 }
 
+// userEvent loads an event owned by the user, responding with 404 if there is
+// no such event.
+func (cfg *ApiConfig) userEvent(w http.ResponseWriter, req *http.Request, eventID, userID uuid.UUID) (database.Event, bool) {
+	dbEvent, err := cfg.Queries.GetEventByID(req.Context(), eventID)
+	if err != nil {
+		respondWithQueryError(w, req, "Event", err)
+		return database.Event{}, false
+	}
+	if dbEvent.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Event not found")
+		return database.Event{}, false
+	}
+	return dbEvent, true
+}
+
+// allowRecurrence checks that the user's plan includes recurring events before
+// an event is made to recur. Events that already recur can still be edited
+// after a downgrade.
+func (cfg *ApiConfig) allowRecurrence(w http.ResponseWriter, req *http.Request, userID, eventID uuid.UUID) bool {
+	e, ok := cfg.requestEntitlements(w, req, userID)
+	if !ok {
+		return false
+	}
+	if e.RecurringEvents {
+		return true
+	}
+	if eventID != uuid.Nil {
+		current, ok := cfg.userEvent(w, req, eventID, userID)
+		if !ok {
+			return false
+		}
+		if current.RecurD || current.RecurW || current.RecurM || current.RecurY {
+			return true
+		}
+	}
+	respondWithPlanLimit(w, "Recurring events are not included in your plan")
+	return false
+}
+
 func (cfg *ApiConfig) UpdateEvent(w http.ResponseWriter, req *http.Request) {
 	type parameters struct {
 		StartDate   time.Time `json:"start_date"`
@@ -211,75 +296,131 @@ func (cfg *ApiConfig) UpdateEvent(w http.ResponseWriter, req *http.Request) {
 		RecurY      bool      `json:"recur_y"`
 	}
 
-	eventID, err := uuid.Parse(req.PathValue("event_id"))
-	if err != nil {
-		log.Printf("Error parsing uuid: %s", err)
-		w.WriteHeader(500)
+	eventID, ok := pathUUID(w, req, "event_id")
+	if !ok {
 		return
 	}
-
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	userID, ok := requestUserID(w, req)
+	if !ok {
 		return
 	}
-	accessToken := accessCookie.Value
 
-	decoder := json.NewDecoder(req.Body)
 	params := parameters{}
-	err = decoder.Decode(&params)
-	if err != nil {
-		log.Printf("Error decoding parameters: %s", err)
-		w.WriteHeader(500)
+	if !decodeJSON(w, req, &params) {
 		return
 	}
-
-	_, err = auth.ValidateAccessToken(accessToken, cfg.Secret)
-	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	params.Title = strings.TrimSpace(params.Title)
+	if respondWithValidationError(w, validateEvent(params.Title, params.Description, params.StartDate, params.EndDate)) {
+		return
+	}
+	if (params.RecurD || params.RecurW || params.RecurM || params.RecurY) && !cfg.allowRecurrence(w, req, userID, eventID) {
 		return
 	}
-	dbEventParams := database.UpdateEventParams{StartDate: params.StartDate, EndDate: params.EndDate, Title: params.Title, Description: sql.NullString{String: params.Description, Valid: true}, Priority: params.Priority, RecurD: params.RecurD, RecurW: params.RecurW, RecurM: params.RecurM, RecurY: params.RecurY, EventID: eventID}
+
+	ifUpdatedAt := sql.NullTime{}
+	if req.Header.Get("If-Match") != "" {
+		current, ok := cfg.userEvent(w, req, eventID, userID)
+		if !ok {
+			return
+		}
+		ifUpdatedAt, ok = checkIfMatch(w, req, current.UpdatedAt)
+		if !ok {
+			return
+		}
+	}
+
+	dbEventParams := database.UpdateEventParams{StartDate: params.StartDate, EndDate: params.EndDate, Title: params.Title, Description: sql.NullString{String: params.Description, Valid: true}, Priority: params.Priority, RecurD: params.RecurD, RecurW: params.RecurW, RecurM: params.RecurM, RecurY: params.RecurY, EventID: eventID, UserID: userID, IfUpdatedAt: ifUpdatedAt}
 	dbEvent, err := cfg.Queries.UpdateEvent(req.Context(), dbEventParams)
 	if err != nil {
-		log.Printf("Error updating event: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		respondWithUpdateError(w, req, "Event", ifUpdatedAt, err)
 		return
 	}
+	cfg.audit(req, userID, "event_updated", dbEvent.ID, "")
 
+	setETag(w, dbEvent.UpdatedAt)
 	event := Event{ID: dbEvent.ID, UserID: dbEvent.UserID, CreatedAt: dbEvent.CreatedAt, UpdatedAt: dbEvent.UpdatedAt, StartDate: dbEvent.StartDate, EndDate: dbEvent.EndDate, Title: dbEvent.Title, Description: dbEvent.Description.String, Priority: dbEvent.Priority, RecurD: dbEvent.RecurD, RecurW: dbEvent.RecurW, RecurM: dbEvent.RecurM, RecurY: dbEvent.RecurY}
 	respondWithJSON(w, 201, event)
 }
 
-func (cfg *ApiConfig) DeleteEvent(w http.ResponseWriter, req *http.Request) {
-	eventID, err := uuid.Parse(req.PathValue("event_id"))
-	if err != nil {
-		log.Printf("Error parsing uuid: %s", err)
-		w.WriteHeader(500)
+// PatchEvent applies a JSON Merge Patch to an event, so clients only send the
+// fields they change.
+func (cfg *ApiConfig) PatchEvent(w http.ResponseWriter, req *http.Request) {
+	eventID, ok := pathUUID(w, req, "event_id")
+	if !ok {
 		return
 	}
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+	current, ok := cfg.userEvent(w, req, eventID, userID)
+	if !ok {
+		return
+	}
+	if _, ok := checkIfMatch(w, req, current.UpdatedAt); !ok {
+		return
+	}
+	patch, ok := decodeMergePatch(w, req)
+	if !ok {
 		return
 	}
-	accessToken := accessCookie.Value
 
-	_, err = auth.ValidateAccessToken(accessToken, cfg.Secret)
+	// The update only applies to the version the patch was merged into.
+	dbEventParams := database.UpdateEventParams{StartDate: current.StartDate, EndDate: current.EndDate, Title: current.Title, Description: current.Description, Priority: current.Priority, RecurD: current.RecurD, RecurW: current.RecurW, RecurM: current.RecurM, RecurY: current.RecurY, EventID: eventID, UserID: userID, IfUpdatedAt: sql.NullTime{Time: current.UpdatedAt, Valid: true}}
+	description := current.Description.String
+	v := validate.New()
+	patch.apply(v, "start_date", &dbEventParams.StartDate, false)
+	patch.apply(v, "end_date", &dbEventParams.EndDate, false)
+	patch.apply(v, "title", &dbEventParams.Title, false)
+	patch.apply(v, "description", &description, true)
+	patch.apply(v, "priority", &dbEventParams.Priority, false)
+	patch.apply(v, "recur_d", &dbEventParams.RecurD, false)
+	patch.apply(v, "recur_w", &dbEventParams.RecurW, false)
+	patch.apply(v, "recur_m", &dbEventParams.RecurM, false)
+	patch.apply(v, "recur_y", &dbEventParams.RecurY, false)
+	if respondWithValidationError(w, v.Err()) {
+		return
+	}
+	dbEventParams.Title = strings.TrimSpace(dbEventParams.Title)
+	dbEventParams.Description = sql.NullString{String: description, Valid: true}
+	if respondWithValidationError(w, validateEvent(dbEventParams.Title, description, dbEventParams.StartDate, dbEventParams.EndDate)) {
+		return
+	}
+	if (dbEventParams.RecurD || dbEventParams.RecurW || dbEventParams.RecurM || dbEventParams.RecurY) && !cfg.allowRecurrence(w, req, userID, eventID) {
+		return
+	}
+
+	dbEvent, err := cfg.Queries.UpdateEvent(req.Context(), dbEventParams)
 	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+		respondWithUpdateError(w, req, "Event", dbEventParams.IfUpdatedAt, err)
 		return
 	}
+	cfg.audit(req, userID, "event_updated", dbEvent.ID, "")
+
+	setETag(w, dbEvent.UpdatedAt)
+	event := Event{ID: dbEvent.ID, UserID: dbEvent.UserID, CreatedAt: dbEvent.CreatedAt, UpdatedAt: dbEvent.UpdatedAt, StartDate: dbEvent.StartDate, EndDate: dbEvent.EndDate, Title: dbEvent.Title, Description: dbEvent.Description.String, Priority: dbEvent.Priority, RecurD: dbEvent.RecurD, RecurW: dbEvent.RecurW, RecurM: dbEvent.RecurM, RecurY: dbEvent.RecurY}
+	respondWithJSON(w, 200, event)
+}
 
-	err = cfg.Queries.DeleteEventByID(req.Context(), eventID)
+func (cfg *ApiConfig) DeleteEvent(w http.ResponseWriter, req *http.Request) {
+	eventID, ok := pathUUID(w, req, "event_id")
+	if !ok {
+		return
+	}
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+
+	rows, err := cfg.Queries.DeleteEventByID(req.Context(), database.DeleteEventByIDParams{ID: eventID, UserID: userID})
 	if err != nil {
-		log.Printf("Error deleting event: %s", err)
-		w.WriteHeader(500)
+		respondWithInternalError(w, req, "Error deleting event", err)
+		return
+	}
+	if rows == 0 {
+		respondWithError(w, http.StatusNotFound, "Event not found")
 		return
 	}
+	cfg.audit(req, userID, "event_deleted", eventID, "")
 	w.WriteHeader(204)
 }
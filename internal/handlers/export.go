@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/curtisbraxdale/taday/internal/ical"
+	"github.com/google/uuid"
+)
+
+type ExportSubscription struct {
+	Plan               string     `json:"plan"`
+	Status             string     `json:"status"`
+	CurrentPeriodStart time.Time  `json:"current_period_start"`
+	CurrentPeriodEnd   time.Time  `json:"current_period_end"`
+	CancelAtPeriodEnd  bool       `json:"cancel_at_period_end"`
+	CanceledAt         *time.Time `json:"canceled_at"`
+	CreatedAt          time.Time  `json:"created_at"`
+}
+
+type ExportDelivery struct {
+	ID        uuid.UUID `json:"id"`
+	Channel   string    `json:"channel"`
+	Kind      string    `json:"kind"`
+	Recipient string    `json:"recipient"`
+	Body      string    `json:"body"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Export sends a zip archive with everything stored about the user as JSON,
+// plus their events and todos as an iCalendar file.
+func (cfg *ApiConfig) Export(w http.ResponseWriter, req *http.Request) {
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+	ctx := req.Context()
+
+	dbUser, err := cfg.Queries.GetUserByID(ctx, userID)
+	if err != nil {
+		respondWithQueryError(w, req, "User", err)
+		return
+	}
+	dbEvents, err := cfg.Queries.GetEventsByUserID(ctx, userID)
+	if err != nil {
+		respondWithInternalError(w, req, "Error exporting events", err)
+		return
+	}
+	dbToDos, err := cfg.Queries.GetTodosByUserID(ctx, userID)
+	if err != nil {
+		respondWithInternalError(w, req, "Error exporting todos", err)
+		return
+	}
+	dbTags, err := cfg.Queries.GetTagsByUserID(ctx, userID)
+	if err != nil {
+		respondWithInternalError(w, req, "Error exporting tags", err)
+		return
+	}
+	dbEventTags, err := cfg.Queries.GetEventTagsByUserID(ctx, userID)
+	if err != nil {
+		respondWithInternalError(w, req, "Error exporting event tags", err)
+		return
+	}
+	dbIdentities, err := cfg.Queries.GetUserIdentitiesByUserID(ctx, userID)
+	if err != nil {
+		respondWithInternalError(w, req, "Error exporting identities", err)
+		return
+	}
+	dbDeliveries, err := cfg.Queries.GetDeliveriesByUserID(ctx, userID)
+	if err != nil {
+		respondWithInternalError(w, req, "Error exporting deliveries", err)
+		return
+	}
+	dbAuditEvents, err := cfg.Queries.GetAuditEventsByUserID(ctx, userID)
+	if err != nil {
+		respondWithInternalError(w, req, "Error exporting audit log", err)
+		return
+	}
+	dbSubscriptions, err := cfg.Queries.GetSubscriptionsByUserID(ctx, userID)
+	if err != nil {
+		respondWithInternalError(w, req, "Error exporting subscriptions", err)
+		return
+	}
+
+	user := User{ID: dbUser.ID, CreatedAt: dbUser.CreatedAt, UpdatedAt: dbUser.UpdatedAt, Username: dbUser.Username, Email: dbUser.Email, PhoneNumber: dbUser.PhoneNumber, EmailVerified: dbUser.VerifiedAt.Valid, TwoFactor: dbUser.TotpEnabledAt.Valid}
+	events := []Event{}
+	calendarEvents := []ical.Event{}
+	for _, e := range dbEvents {
+		events = append(events, Event{ID: e.ID, UserID: e.UserID, CreatedAt: e.CreatedAt, UpdatedAt: e.UpdatedAt, StartDate: e.StartDate, EndDate: e.EndDate, Title: e.Title, Description: e.Description.String, Priority: e.Priority, RecurD: e.RecurD, RecurW: e.RecurW, RecurM: e.RecurM, RecurY: e.RecurY})
+		calendarEvents = append(calendarEvents, ical.Event{UID: e.ID.String() + "@taday.io", Start: e.StartDate, End: e.EndDate, Summary: e.Title, Description: e.Description.String, RRule: recurrenceRule(e.RecurD, e.RecurW, e.RecurM, e.RecurY), Created: e.CreatedAt, Modified: e.UpdatedAt})
+	}
+	toDos := []ToDo{}
+	calendarToDos := []ical.Todo{}
+	for _, t := range dbToDos {
+		toDos = append(toDos, ToDo{ID: t.ID, UserID: t.UserID, CreatedAt: t.CreatedAt, UpdatedAt: t.UpdatedAt, Date: t.Date.Time, Title: t.Title, Description: t.Description.String})
+		calendarToDos = append(calendarToDos, ical.Todo{UID: t.ID.String() + "@taday.io", Due: t.Date.Time, Summary: t.Title, Description: t.Description.String, Created: t.CreatedAt, Modified: t.UpdatedAt})
+	}
+	tags := []Tag{}
+	for _, t := range dbTags {
+		tags = append(tags, Tag{ID: t.ID, UserID: t.UserID, Name: t.Name, Color: t.Color})
+	}
+	eventTags := []EventTag{}
+	for _, et := range dbEventTags {
+		eventTags = append(eventTags, EventTag{EventID: et.EventID, TagID: et.TagID})
+	}
+	identities := []Identity{}
+	for _, i := range dbIdentities {
+		identity := Identity{ID: i.ID, Provider: i.Provider, Email: i.Email, CreatedAt: i.CreatedAt}
+		if i.LastLoginAt.Valid {
+			identity.LastLoginAt = &i.LastLoginAt.Time
+		}
+		identities = append(identities, identity)
+	}
+	deliveries := []ExportDelivery{}
+	for _, d := range dbDeliveries {
+		deliveries = append(deliveries, ExportDelivery{ID: d.ID, Channel: d.Channel, Kind: d.Kind, Recipient: d.Recipient, Body: d.Body, Status: d.Status, Error: d.Error, CreatedAt: d.CreatedAt})
+	}
+	subscriptions := []ExportSubscription{}
+	for _, sub := range dbSubscriptions {
+		s := ExportSubscription{Plan: sub.Plan, Status: sub.Status, CurrentPeriodStart: sub.CurrentPeriodStart, CurrentPeriodEnd: sub.CurrentPeriodEnd, CancelAtPeriodEnd: sub.CancelAtPeriodEnd, CreatedAt: sub.CreatedAt}
+		if sub.CanceledAt.Valid {
+			s.CanceledAt = &sub.CanceledAt.Time
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	auditLog := []AuditEvent{}
+	for _, a := range dbAuditEvents {
+		auditLog = append(auditLog, auditEventFromDB(a))
+	}
+
+	// The archive is built in memory so a failure can still be reported as a
+	// normal error response.
+	archive := &bytes.Buffer{}
+	zw := zip.NewWriter(archive)
+	files := []struct {
+		name string
+		data any
+	}{
+		{"user.json", user},
+		{"events.json", events},
+		{"todos.json", toDos},
+		{"tags.json", tags},
+		{"event_tags.json", eventTags},
+		{"identities.json", identities},
+		{"subscriptions.json", subscriptions},
+		{"deliveries.json", deliveries},
+		{"audit_log.json", auditLog},
+	}
+	for _, file := range files {
+		f, err := zw.Create(file.name)
+		if err == nil {
+			enc := json.NewEncoder(f)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(file.data)
+		}
+		if err != nil {
+			respondWithInternalError(w, req, "Error writing "+file.name, err)
+			return
+		}
+	}
+	f, err := zw.Create("calendar.ics")
+	if err == nil {
+		err = ical.Write(f, "-//Taday//Export//EN", calendarEvents, calendarToDos)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		respondWithInternalError(w, req, "Error writing export archive", err)
+		return
+	}
+
+	filename := fmt.Sprintf("taday-export-%s.zip", time.Now().UTC().Format(time.DateOnly))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.WriteHeader(http.StatusOK)
+	w.Write(archive.Bytes())
+}
+
+// recurrenceRule turns the recur flags of an event into an RRULE value. The
+// shortest interval wins if more than one flag is set.
+func recurrenceRule(daily, weekly, monthly, yearly bool) string {
+	switch {
+	case daily:
+		return "FREQ=DAILY"
+	case weekly:
+		return "FREQ=WEEKLY"
+	case monthly:
+		return "FREQ=MONTHLY"
+	case yearly:
+		return "FREQ=YEARLY"
+	default:
+		return ""
+	}
+}
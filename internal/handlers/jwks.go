@@ -0,0 +1,10 @@
+package handlers
+
+import "net/http"
+
+// GetJWKS publishes the public keys used to sign access tokens so other
+// services can verify them without sharing a secret.
+func (cfg *ApiConfig) GetJWKS(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, 200, cfg.Keyring.JWKS())
+}
@@ -1,15 +1,25 @@
 package handlers
 
 import (
-	"context"
 	"database/sql"
-	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/curtisbraxdale/taday/internal/auth"
 	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/middleware"
+	"github.com/google/uuid"
+)
+
+const (
+	loginChallengeTTL = 5 * time.Minute
+	refreshTokenTTL   = 60 * 24 * time.Hour
+	// lockoutThreshold is the number of consecutive failed logins after which
+	// an account is locked. The lock starts at one minute and doubles with
+	// each further failure, up to an hour.
+	lockoutThreshold = 5
 )
 
 func (cfg *ApiConfig) Login(w http.ResponseWriter, req *http.Request) {
@@ -20,44 +30,139 @@ func (cfg *ApiConfig) Login(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "https://taday.io")
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 
-	decoder := json.NewDecoder(req.Body)
 	params := parameters{}
-	err := decoder.Decode(&params)
-	if err != nil {
-		log.Printf("Error decoding parameters: %s", err)
-		w.WriteHeader(500)
+	if !decodeJSON(w, req, &params) {
 		return
 	}
-	dbUser, err := cfg.Queries.GetUserByEmail(context.Background(), params.Email)
+	if !cfg.allowAccountAttempt(w, req, strings.ToLower(strings.TrimSpace(params.Email))) {
+		return
+	}
+	dbUser, err := cfg.Queries.GetLoginUserByEmail(req.Context(), params.Email)
 	if err != nil {
-		log.Print("Incorrect email or password")
-		w.WriteHeader(401)
+		slog.InfoContext(req.Context(), "Incorrect email or password")
+		logins.WithLabelValues("unknown_email").Inc()
+		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password")
+		return
+	}
+	if dbUser.LockedUntil.Valid && dbUser.LockedUntil.Time.After(time.Now()) {
+		middleware.TooManyRequests(w, time.Until(dbUser.LockedUntil.Time))
 		return
 	}
 	err = auth.CheckPasswordHash(dbUser.HashedPassword, params.Password)
 	if err != nil {
-		log.Print("Incorrect email or password")
-		w.WriteHeader(401)
+		slog.InfoContext(req.Context(), "Incorrect email or password")
+		cfg.recordFailedLogin(req, dbUser.ID, "incorrect password")
+		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password")
 		return
 	}
-	// Create Access token.
-	accessToken, err := auth.MakeAccessToken(dbUser.ID, cfg.Secret, time.Hour)
+
+	// Users with two-factor enabled get a short-lived challenge instead of a
+	// session; it is exchanged for cookies at /api/login/2fa.
+	if dbUser.TotpEnabledAt.Valid {
+		challenge, challengeHash, err := auth.MakeVerificationToken()
+		if err != nil {
+			respondWithInternalError(w, req, "Error creating login challenge", err)
+			return
+		}
+		_, err = cfg.Queries.CreateLoginChallenge(req.Context(), database.CreateLoginChallengeParams{TokenHash: challengeHash, UserID: dbUser.ID, ExpiresAt: time.Now().Add(loginChallengeTTL)})
+		if err != nil {
+			respondWithInternalError(w, req, "Error storing login challenge", err)
+			return
+		}
+		respondWithJSON(w, 200, map[string]any{"mfa_required": true, "challenge": challenge})
+		return
+	}
+
+	err = cfg.Queries.ResetFailedLogins(req.Context(), dbUser.ID)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error resetting failed logins", "error", err)
+	}
+	err = cfg.startSession(w, req, dbUser)
+	if err != nil {
+		respondWithInternalError(w, req, "Error starting session", err)
+		return
+	}
+
+	user := User{ID: dbUser.ID, CreatedAt: dbUser.CreatedAt, UpdatedAt: dbUser.UpdatedAt, Email: dbUser.Email}
+	respondWithJSON(w, 200, user)
+}
+
+// allowAccountAttempt applies the per-account rate limit and writes a 429 if
+// it has been exceeded.
+func (cfg *ApiConfig) allowAccountAttempt(w http.ResponseWriter, req *http.Request, account string) bool {
+	if cfg.AccountLimiter == nil {
+		return true
+	}
+	allowed, retryAfter, err := cfg.AccountLimiter.Allow(req.Context(), account)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error checking rate limit", "error", err)
+		return true
+	}
+	if !allowed {
+		middleware.TooManyRequests(w, retryAfter)
+		return false
+	}
+	return true
+}
+
+func (cfg *ApiConfig) recordFailedLogin(req *http.Request, userID uuid.UUID, reason string) {
+	logins.WithLabelValues(strings.NewReplacer(" ", "_", "-", "_").Replace(reason)).Inc()
+	cfg.audit(req, userID, "login_failed", uuid.Nil, reason)
+	failed, err := cfg.Queries.RecordFailedLogin(req.Context(), database.RecordFailedLoginParams{LockoutThreshold: lockoutThreshold, ID: userID})
 	if err != nil {
-		log.Printf("Error creating JWT: %s", err)
-		w.WriteHeader(500)
+		slog.ErrorContext(req.Context(), "Error recording failed login", "error", err)
+		return
+	}
+	if failed.LockedUntil.Valid && failed.FailedLoginAttempts >= lockoutThreshold {
+		slog.WarnContext(req.Context(), "Account locked after failed logins", "user_id", userID, "locked_until", failed.LockedUntil.Time, "failed_logins", failed.FailedLoginAttempts)
+	}
+}
+
+// startSession begins a new session family for the user and sets the access
+// and refresh token cookies on the response. Logging in to an account that is
+// scheduled for deletion cancels the deletion.
+func (cfg *ApiConfig) startSession(w http.ResponseWriter, req *http.Request, dbUser database.User) error {
+	if dbUser.DeletedAt.Valid {
+		err := cfg.Queries.CancelUserDeletion(req.Context(), dbUser.ID)
+		if err != nil {
+			return err
+		}
+		slog.InfoContext(req.Context(), "Cancelled account deletion", "user_id", dbUser.ID)
+		cfg.audit(req, dbUser.ID, "account_deletion_cancelled", uuid.Nil, "")
 	}
-	// Create refresh token.
 	refreshToken, err := auth.MakeRefreshToken()
 	if err != nil {
-		log.Printf("Error creating refresh token: %s", err)
-		w.WriteHeader(500)
+		return err
 	}
 	// Store refresh token in database.
-	refTokenParams := database.CreateRefreshTokenParams{Token: refreshToken, ExpiresAt: sql.NullTime{Time: time.Now().Add(time.Hour * 24 * 60), Valid: true}, UserID: dbUser.ID, RevokedAt: sql.NullTime{Valid: false}}
-	_, err = cfg.Queries.CreateRefreshToken(context.Background(), refTokenParams)
+	familyID := uuid.New()
+	_, err = cfg.Queries.CreateRefreshToken(req.Context(), cfg.refreshTokenParams(req, refreshToken, dbUser.ID, familyID))
 	if err != nil {
-		log.Printf("Error storing refresh token: %s", err)
-		w.WriteHeader(500)
+		return err
+	}
+	cfg.audit(req, dbUser.ID, "login", familyID, "")
+	logins.WithLabelValues("success").Inc()
+	return cfg.setSessionCookies(w, dbUser.ID, refreshToken)
+}
+
+func (cfg *ApiConfig) refreshTokenParams(req *http.Request, token string, userID, familyID uuid.UUID) database.CreateRefreshTokenParams {
+	return database.CreateRefreshTokenParams{
+		Token:     token,
+		ExpiresAt: sql.NullTime{Time: time.Now().Add(refreshTokenTTL), Valid: true},
+		RevokedAt: sql.NullTime{Valid: false},
+		UserID:    userID,
+		FamilyID:  familyID,
+		UserAgent: req.UserAgent(),
+		IpAddress: middleware.ClientIP(req),
+	}
+}
+
+// setSessionCookies creates a fresh access token for the user and sets it
+// alongside the given refresh token.
+func (cfg *ApiConfig) setSessionCookies(w http.ResponseWriter, userID uuid.UUID, refreshToken string) error {
+	accessToken, err := cfg.Keyring.MakeAccessToken(userID, time.Hour)
+	if err != nil {
+		return err
 	}
 
 	http.SetCookie(w, &http.Cookie{
@@ -74,12 +179,10 @@ func (cfg *ApiConfig) Login(w http.ResponseWriter, req *http.Request) {
 		Name:     "refresh_token",
 		Value:    refreshToken,
 		Path:     "/",
-		Expires:  time.Now().Add(60 * 24 * time.Hour),
+		Expires:  time.Now().Add(refreshTokenTTL),
 		HttpOnly: true,
 		Secure:   true,
 		SameSite: http.SameSiteNoneMode,
 	})
-
-	user := User{ID: dbUser.ID, CreatedAt: dbUser.CreatedAt, UpdatedAt: dbUser.UpdatedAt, Email: dbUser.Email}
-	respondWithJSON(w, 200, user)
+	return nil
 }
@@ -10,9 +10,18 @@ func (cfg *ApiConfig) Logout(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 	if refreshCookie, err := req.Cookie("refresh_token"); err == nil {
-		_ = cfg.Queries.RevokeToken(req.Context(), refreshCookie.Value)
+		if dbRefToken, err := cfg.Queries.GetUserByToken(req.Context(), refreshCookie.Value); err == nil {
+			if cfg.Queries.RevokeTokenFamily(req.Context(), dbRefToken.FamilyID) == nil {
+				cfg.audit(req, dbRefToken.UserID, "logout", dbRefToken.FamilyID, "")
+			}
+		}
 	}
 
+	clearSessionCookies(w)
+	w.WriteHeader(http.StatusOK)
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
 	expire := func(name string) {
 		http.SetCookie(w, &http.Cookie{
 			Name:     name,
@@ -26,6 +35,4 @@ func (cfg *ApiConfig) Logout(w http.ResponseWriter, req *http.Request) {
 	}
 	expire("access_token")
 	expire("refresh_token")
-
-	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/curtisbraxdale/taday/internal/validate"
+)
+
+// mergePatch is a JSON Merge Patch (RFC 7396) document. Members that are
+// present replace the current value, null clears it, and absent members are
+// left alone.
+type mergePatch map[string]json.RawMessage
+
+func decodeMergePatch(w http.ResponseWriter, req *http.Request) (mergePatch, bool) {
+	patch := mergePatch{}
+	if !decodeJSON(w, req, &patch) {
+		return nil, false
+	}
+	return patch, true
+}
+
+// apply decodes the member named field into dst if it is present. null resets
+// dst to its zero value when the field is nullable and is reported as a
+// validation error otherwise.
+func (p mergePatch) apply(v *validate.Validator, field string, dst any, nullable bool) {
+	raw, ok := p[field]
+	if !ok {
+		return
+	}
+	if string(raw) == "null" {
+		if !nullable {
+			v.Add(field, "required", fmt.Sprintf("%s cannot be null", field))
+			return
+		}
+		reflect.ValueOf(dst).Elem().SetZero()
+		return
+	}
+	if err := json.Unmarshal(raw, dst); err != nil {
+		v.Add(field, "invalid_type", fmt.Sprintf("%s has the wrong type", field))
+	}
+}
+
+func (p mergePatch) has(field string) bool {
+	_, ok := p[field]
+	return ok
+}
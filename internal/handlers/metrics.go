@@ -0,0 +1,17 @@
+package handlers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	logins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "taday_logins_total",
+		Help: "Login attempts, by result.",
+	}, []string{"result"})
+	webhookEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "taday_stripe_webhook_events_total",
+		Help: "Stripe webhook events, by type and outcome.",
+	}, []string{"type", "outcome"})
+)
@@ -0,0 +1,376 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/curtisbraxdale/taday/internal/auth"
+	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/oidc"
+	"github.com/curtisbraxdale/taday/internal/tracing"
+	"github.com/google/uuid"
+)
+
+const oidcStateTTL = 10 * time.Minute
+
+// oidcStateCookie holds the state of a sign-in started by this browser. The
+// callback only accepts a state that matches it, so nobody can complete a
+// sign-in they started in someone else's browser.
+const oidcStateCookie = "oidc_state"
+
+// noPassword is stored as the hashed password of accounts created through a
+// sign-in provider, and is the column default in 001_users.sql. It is not a
+// valid bcrypt hash, so password login is impossible until the user sets one.
+const noPassword = "unset"
+
+type Identity struct {
+	ID          uuid.UUID  `json:"id"`
+	Provider    string     `json:"provider"`
+	Email       string     `json:"email"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+}
+
+// StartOIDCLogin redirects the browser to the provider. With ?link=true the
+// caller must already be signed in and the identity is linked to their account
+// instead of signing them in.
+func (cfg *ApiConfig) StartOIDCLogin(w http.ResponseWriter, req *http.Request) {
+	providerName := req.PathValue("provider")
+	provider, err := cfg.OIDC.Get(req.Context(), providerName)
+	if errors.Is(err, oidc.ErrUnknownProvider) {
+		respondWithError(w, http.StatusNotFound, "Sign-in provider not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error loading OIDC provider", "provider", providerName, "error", err)
+		respondWithError(w, http.StatusBadGateway, "Sign-in provider is unavailable")
+		return
+	}
+
+	linkUserID := uuid.NullUUID{}
+	if req.URL.Query().Get("link") == "true" {
+		dbUser, err := cfg.userFromAccessCookie(req)
+		if err != nil {
+			slog.InfoContext(req.Context(), "Error getting user from access token", "error", err)
+			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		linkUserID = uuid.NullUUID{UUID: dbUser.ID, Valid: true}
+	}
+
+	state, err := oidc.RandomString()
+	if err != nil {
+		respondWithInternalError(w, req, "Error creating OIDC state", err)
+		return
+	}
+	nonce, err := oidc.RandomString()
+	if err != nil {
+		respondWithInternalError(w, req, "Error creating OIDC nonce", err)
+		return
+	}
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		respondWithInternalError(w, req, "Error creating PKCE verifier", err)
+		return
+	}
+	err = cfg.Queries.CreateOIDCLoginState(req.Context(), database.CreateOIDCLoginStateParams{State: state, Provider: providerName, Nonce: nonce, CodeVerifier: verifier, LinkUserID: linkUserID, ExpiresAt: time.Now().Add(oidcStateTTL)})
+	if err != nil {
+		respondWithInternalError(w, req, "Error storing OIDC state", err)
+		return
+	}
+	setOIDCStateCookie(w, state, time.Now().Add(oidcStateTTL))
+	http.Redirect(w, req, provider.AuthCodeURL(state, nonce, challenge), http.StatusFound)
+}
+
+// OIDCCallback completes the authorization code flow and redirects back to the
+// frontend, signed in on success or with an error code otherwise.
+func (cfg *ApiConfig) OIDCCallback(w http.ResponseWriter, req *http.Request) {
+	providerName := req.PathValue("provider")
+	query := req.URL.Query()
+	if query.Get("error") != "" {
+		slog.InfoContext(req.Context(), "OIDC provider returned error", "provider", providerName, "oidc_error", query.Get("error"))
+		redirectToFrontend(w, req, "/login", "error", "provider_error")
+		return
+	}
+
+	cookie, err := req.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(query.Get("state"))) != 1 {
+		slog.WarnContext(req.Context(), "OIDC state does not match this browser", "provider", providerName)
+		redirectToFrontend(w, req, "/login", "error", "invalid_state")
+		return
+	}
+	setOIDCStateCookie(w, "", time.Unix(0, 0))
+	loginState, err := cfg.Queries.ConsumeOIDCLoginState(req.Context(), query.Get("state"))
+	if err != nil || loginState.Provider != providerName || loginState.ExpiresAt.Before(time.Now()) {
+		redirectToFrontend(w, req, "/login", "error", "invalid_state")
+		return
+	}
+	provider, err := cfg.OIDC.Get(req.Context(), providerName)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error loading OIDC provider", "provider", providerName, "error", err)
+		redirectToFrontend(w, req, "/login", "error", "provider_error")
+		return
+	}
+	token, err := provider.Exchange(req.Context(), query.Get("code"), loginState.CodeVerifier)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error exchanging OIDC code", "provider", providerName, "error", err)
+		redirectToFrontend(w, req, "/login", "error", "provider_error")
+		return
+	}
+	claims, err := provider.VerifyIDToken(req.Context(), token.IDToken, loginState.Nonce)
+	if err != nil {
+		slog.WarnContext(req.Context(), "Invalid ID token", "provider", providerName, "error", err)
+		redirectToFrontend(w, req, "/login", "error", "invalid_token")
+		return
+	}
+
+	identity, err := cfg.Queries.GetUserIdentity(req.Context(), database.GetUserIdentityParams{Provider: providerName, Subject: claims.Subject})
+	switch {
+	case err == nil:
+		if loginState.LinkUserID.Valid {
+			if identity.UserID != loginState.LinkUserID.UUID {
+				redirectToFrontend(w, req, "/settings", "error", "identity_in_use")
+				return
+			}
+			redirectToFrontend(w, req, "/settings", "linked", providerName)
+			return
+		}
+		err = cfg.Queries.TouchUserIdentity(req.Context(), database.TouchUserIdentityParams{ID: identity.ID, Email: claims.Email})
+		if err != nil {
+			slog.ErrorContext(req.Context(), "Error updating identity", "error", err)
+		}
+		cfg.completeOIDCLogin(w, req, identity.UserID)
+	case errors.Is(err, sql.ErrNoRows):
+		if loginState.LinkUserID.Valid {
+			_, err = cfg.Queries.CreateUserIdentity(req.Context(), database.CreateUserIdentityParams{UserID: loginState.LinkUserID.UUID, Provider: providerName, Subject: claims.Subject, Email: claims.Email})
+			if err != nil {
+				slog.ErrorContext(req.Context(), "Error linking identity", "error", err)
+				redirectToFrontend(w, req, "/settings", "error", "server_error")
+				return
+			}
+			redirectToFrontend(w, req, "/settings", "linked", providerName)
+			return
+		}
+		userID, err := cfg.signUpWithIdentity(req.Context(), providerName, claims)
+		if errors.Is(err, errAccountExists) {
+			// Signing in to an existing account by email alone would let
+			// anyone who controls that address at the provider take it over,
+			// so the user has to log in and link the provider themselves.
+			redirectToFrontend(w, req, "/login", "error", "account_exists")
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(req.Context(), "Error creating user from identity", "error", err)
+			redirectToFrontend(w, req, "/login", "error", "server_error")
+			return
+		}
+		cfg.completeOIDCLogin(w, req, userID)
+	default:
+		slog.ErrorContext(req.Context(), "Error getting identity", "error", err)
+		redirectToFrontend(w, req, "/login", "error", "server_error")
+	}
+}
+
+var errAccountExists = errors.New("an account with this email already exists")
+
+// signUpWithIdentity creates a passwordless user for a new identity.
+func (cfg *ApiConfig) signUpWithIdentity(ctx context.Context, providerName string, claims *oidc.Claims) (uuid.UUID, error) {
+	if claims.Email == "" {
+		return uuid.Nil, errors.New("provider did not return an email address")
+	}
+	_, err := cfg.Queries.GetUserByEmail(ctx, claims.Email)
+	if err == nil {
+		return uuid.Nil, errAccountExists
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return uuid.Nil, err
+	}
+
+	tx, err := cfg.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback()
+	qtx := tracing.WithTx(tx)
+
+	username := usernameFromClaims(claims)
+	var dbUser database.User
+	for attempt := 0; ; attempt++ {
+		candidate := username
+		if attempt > 0 {
+			candidate = fmt.Sprintf("%s%04d", username, rand.IntN(10000))
+		}
+		// A failed statement aborts the transaction, so each attempt runs in
+		// its own savepoint.
+		_, err = tx.ExecContext(ctx, "SAVEPOINT create_user")
+		if err != nil {
+			return uuid.Nil, err
+		}
+		dbUser, err = qtx.CreateUser(ctx, database.CreateUserParams{Username: candidate, Email: claims.Email, HashedPassword: noPassword, PhoneNumber: ""})
+		constraint, conflict := uniqueViolation(err)
+		if conflict && constraint == "users_username_lower_idx" && attempt < 5 {
+			_, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT create_user")
+			if err != nil {
+				return uuid.Nil, err
+			}
+			continue
+		}
+		if conflict && constraint == "users_email_lower_idx" {
+			return uuid.Nil, errAccountExists
+		}
+		if err != nil {
+			return uuid.Nil, err
+		}
+		break
+	}
+	_, err = qtx.CreateUserIdentity(ctx, database.CreateUserIdentityParams{UserID: dbUser.ID, Provider: providerName, Subject: claims.Subject, Email: claims.Email})
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if claims.EmailVerified {
+		err = qtx.MarkUserVerified(ctx, database.MarkUserVerifiedParams{ID: dbUser.ID, Email: dbUser.Email})
+		if err != nil {
+			return uuid.Nil, err
+		}
+	}
+	return dbUser.ID, tx.Commit()
+}
+
+func (cfg *ApiConfig) completeOIDCLogin(w http.ResponseWriter, req *http.Request, userID uuid.UUID) {
+	dbUser, err := cfg.Queries.GetLoginUserByID(req.Context(), userID)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error getting user from userID", "user_id", userID, "error", err)
+		redirectToFrontend(w, req, "/login", "error", "server_error")
+		return
+	}
+	// The provider only replaces the password; accounts with two-factor
+	// enabled still have to pass the second step.
+	if dbUser.TotpEnabledAt.Valid {
+		challenge, challengeHash, err := auth.MakeVerificationToken()
+		if err == nil {
+			_, err = cfg.Queries.CreateLoginChallenge(req.Context(), database.CreateLoginChallengeParams{TokenHash: challengeHash, UserID: dbUser.ID, ExpiresAt: time.Now().Add(loginChallengeTTL)})
+		}
+		if err != nil {
+			slog.ErrorContext(req.Context(), "Error creating login challenge", "error", err)
+			redirectToFrontend(w, req, "/login", "error", "server_error")
+			return
+		}
+		redirectToFrontend(w, req, "/login/2fa", "challenge", challenge)
+		return
+	}
+	err = cfg.startSession(w, req, dbUser)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error starting session", "error", err)
+		redirectToFrontend(w, req, "/login", "error", "server_error")
+		return
+	}
+	redirectToFrontend(w, req, "/", "", "")
+}
+
+func (cfg *ApiConfig) GetIdentities(w http.ResponseWriter, req *http.Request) {
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+
+	dbIdentities, err := cfg.Queries.GetUserIdentitiesByUserID(req.Context(), userID)
+	if err != nil {
+		respondWithInternalError(w, req, "Error getting identities for user", err)
+		return
+	}
+	identities := []Identity{}
+	for _, i := range dbIdentities {
+		identity := Identity{ID: i.ID, Provider: i.Provider, Email: i.Email, CreatedAt: i.CreatedAt}
+		if i.LastLoginAt.Valid {
+			identity.LastLoginAt = &i.LastLoginAt.Time
+		}
+		identities = append(identities, identity)
+	}
+	respondWithJSON(w, 200, identities)
+}
+
+func (cfg *ApiConfig) DeleteIdentity(w http.ResponseWriter, req *http.Request) {
+	identityID, ok := pathUUID(w, req, "identity_id")
+	if !ok {
+		return
+	}
+	dbUser, err := cfg.userFromAccessCookie(req)
+	if err != nil {
+		slog.InfoContext(req.Context(), "Error getting user from access token", "error", err)
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// Don't let users lock themselves out by removing their only way in.
+	if dbUser.HashedPassword == noPassword {
+		dbIdentities, err := cfg.Queries.GetUserIdentitiesByUserID(req.Context(), dbUser.ID)
+		if err != nil {
+			respondWithInternalError(w, req, "Error getting identities for user", err)
+			return
+		}
+		if len(dbIdentities) <= 1 {
+			respondWithError(w, http.StatusConflict, "Set a password before removing your last sign-in provider")
+			return
+		}
+	}
+
+	rows, err := cfg.Queries.DeleteUserIdentity(req.Context(), database.DeleteUserIdentityParams{ID: identityID, UserID: dbUser.ID})
+	if err != nil {
+		respondWithInternalError(w, req, "Error deleting identity", err)
+		return
+	}
+	if rows == 0 {
+		respondWithError(w, http.StatusNotFound, "Identity not found")
+		return
+	}
+	cfg.audit(req, dbUser.ID, "identity_unlinked", identityID, "")
+	w.WriteHeader(204)
+}
+
+// setOIDCStateCookie stores state for the callback. Lax lets the browser send
+// it on the provider's redirect back, which is a top-level navigation.
+func setOIDCStateCookie(w http.ResponseWriter, state string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/auth/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func redirectToFrontend(w http.ResponseWriter, req *http.Request, path, key, value string) {
+	target := frontendURL + path
+	if key != "" {
+		target += "?" + url.Values{key: {value}}.Encode()
+	}
+	http.Redirect(w, req, target, http.StatusFound)
+}
+
+func usernameFromClaims(claims *oidc.Claims) string {
+	name := claims.PreferredUsername
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '.' || r == '-' {
+			return r
+		}
+		return -1
+	}, name)
+	if name == "" {
+		name = "user"
+	}
+	return name
+}
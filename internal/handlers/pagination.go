@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/curtisbraxdale/taday/internal/validate"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// Page is the envelope returned by list endpoints. NextCursor is omitted on
+// the last page.
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// pageCursor is the position after the last item of a page: the value of the
+// sort column and the ID that breaks ties. It is opaque to clients.
+type pageCursor struct {
+	Key string    `json:"k"`
+	ID  uuid.UUID `json:"id"`
+}
+
+func encodeCursor(key string, id uuid.UUID) string {
+	dat, _ := json.Marshal(pageCursor{Key: key, ID: id})
+	return base64.RawURLEncoding.EncodeToString(dat)
+}
+
+type pageParams struct {
+	Limit  int32
+	Cursor *pageCursor
+}
+
+// parsePageParams reads limit and cursor from the query string.
+func parsePageParams(v *validate.Validator, query url.Values) pageParams {
+	params := pageParams{Limit: parseLimit(v, query)}
+	if raw := query.Get("cursor"); raw != "" {
+		c := pageCursor{}
+		dat, err := base64.RawURLEncoding.DecodeString(raw)
+		if err == nil {
+			err = json.Unmarshal(dat, &c)
+		}
+		if err != nil || c.ID == uuid.Nil {
+			v.Add("cursor", "invalid_format", "cursor is not valid")
+		} else {
+			params.Cursor = &c
+		}
+	}
+	return params
+}
+
+// parseLimit reads the page size from the query string.
+func parseLimit(v *validate.Validator, query url.Values) int32 {
+	raw := query.Get("limit")
+	if raw == "" {
+		return defaultPageSize
+	}
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit < 1 || limit > maxPageSize {
+		v.Add("limit", "out_of_range", "limit must be between 1 and "+strconv.Itoa(maxPageSize))
+		return defaultPageSize
+	}
+	return int32(limit)
+}
+
+// cursorTime parses the key of a cursor over a timestamp column.
+func cursorTime(v *validate.Validator, c *pageCursor) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, c.Key)
+	if err != nil {
+		v.Add("cursor", "invalid_format", "cursor is not valid")
+	}
+	return t
+}
+
+// parseQueryTime accepts an RFC 3339 timestamp or a plain date.
+func parseQueryTime(v *validate.Validator, query url.Values, field string) time.Time {
+	raw := query.Get(field)
+	if raw == "" {
+		return time.Time{}
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t
+	}
+	if t, err := time.Parse(time.DateOnly, raw); err == nil {
+		return t
+	}
+	v.Add(field, "invalid_format", field+" must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+	return time.Time{}
+}
+
+// parseOrder reads order=asc|desc, falling back to the older sort parameter.
+func parseOrder(v *validate.Validator, query url.Values) bool {
+	order := query.Get("order")
+	if order == "" {
+		order = query.Get("sort")
+	}
+	switch order {
+	case "", "asc":
+		return false
+	case "desc":
+		return true
+	default:
+		v.Add("order", "invalid_value", "order must be asc or desc")
+		return false
+	}
+}
+
+// queryList collects a repeated parameter, also splitting comma separated
+// values, so both ?tag=a&tag=b and ?tag=a,b work.
+func queryList(query url.Values, field string) []string {
+	values := []string{}
+	for _, raw := range query[field] {
+		for _, value := range strings.Split(raw, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
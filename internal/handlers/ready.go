@@ -1,9 +1,101 @@
 package handlers
 
-import "net/http"
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
 
-func ReadyCheck(w http.ResponseWriter, req *http.Request) {
-	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(200)
-	w.Write([]byte("OK"))
+	"github.com/curtisbraxdale/taday/sql/schema"
+)
+
+// readyTimeout bounds how long the readiness checks can take, so a hung
+// database fails the check instead of the load balancer's request.
+const readyTimeout = 2 * time.Second
+
+type dependencyStatus struct {
+	Status          string `json:"status"`
+	Error           string `json:"error,omitempty"`
+	LatencyMS       int64  `json:"latency_ms"`
+	Version         int64  `json:"version,omitempty"`
+	ExpectedVersion int64  `json:"expected_version,omitempty"`
+}
+
+type readiness struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]dependencyStatus `json:"dependencies"`
+}
+
+// Healthz reports that the process is up and serving. It checks nothing
+// else, so a database outage doesn't get every instance restarted.
+func Healthz(w http.ResponseWriter, req *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Readyz reports whether the instance can serve requests: the database has
+// to answer within readyTimeout and have every migration the binary was
+// built with. It responds with 503 and the status of each dependency if not.
+func (cfg *ApiConfig) Readyz(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), readyTimeout)
+	defer cancel()
+
+	resp := readiness{Status: "ok", Dependencies: map[string]dependencyStatus{
+		"database":   cfg.checkDatabase(ctx),
+		"migrations": cfg.checkMigrations(ctx),
+	}}
+	code := http.StatusOK
+	for _, dep := range resp.Dependencies {
+		if dep.Status != "ok" {
+			resp.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	respondWithJSON(w, code, resp)
+}
+
+func (cfg *ApiConfig) checkDatabase(ctx context.Context) dependencyStatus {
+	start := time.Now()
+	err := cfg.DB.PingContext(ctx)
+	return dependency(ctx, "database", start, err, "database unreachable")
+}
+
+// migrationVersionQuery finds the newest migration still applied. goose adds
+// a row for every up and down, so only the latest row of each version counts.
+// goose_db_version belongs to goose rather than the schema, so sqlc doesn't
+// know about it.
+const migrationVersionQuery = `SELECT COALESCE(MAX(version_id), 0) FROM (
+    SELECT DISTINCT ON (version_id) version_id, is_applied FROM goose_db_version ORDER BY version_id, id DESC
+) latest WHERE is_applied`
+
+// checkMigrations compares the database's goose version with the latest
+// migration embedded in the binary. A database ahead of the binary passes,
+// since migrations run before the new release replaces the old one.
+func (cfg *ApiConfig) checkMigrations(ctx context.Context) dependencyStatus {
+	start := time.Now()
+	var version int64
+	err := cfg.DB.QueryRowContext(ctx, migrationVersionQuery).Scan(&version)
+	if err != nil {
+		return dependency(ctx, "migrations", start, err, "migration version unavailable")
+	}
+	expected := schema.Version()
+	if version < expected {
+		err = fmt.Errorf("database is at migration %d, %d is needed", version, expected)
+	}
+	status := dependency(ctx, "migrations", start, err, "migrations pending")
+	status.Version = version
+	status.ExpectedVersion = expected
+	return status
+}
+
+// dependency reports the result of a check. The endpoint is public, so a
+// failure is logged and the response only gets msg.
+func dependency(ctx context.Context, name string, start time.Time, err error, msg string) dependencyStatus {
+	status := dependencyStatus{Status: "ok", LatencyMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		slog.WarnContext(ctx, "Readiness check failed", "dependency", name, "error", err)
+		status.Status = "unavailable"
+		status.Error = msg
+	}
+	return status
 }
@@ -1,21 +1,28 @@
 package handlers
 
 import (
-	"log"
+	"database/sql"
+	"log/slog"
 	"net/http"
 	"time"
 
 	"github.com/curtisbraxdale/taday/internal/auth"
+	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/tracing"
 )
 
+// Refresh exchanges a refresh token for a new access token and rotates the
+// refresh token. Each refresh token can be used exactly once; presenting one
+// that has already been rotated out means it was copied, so the whole session
+// family is revoked.
 func (cfg *ApiConfig) Refresh(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "https://taday.io")
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 	refreshCookie, err := req.Cookie("refresh_token")
 	if err != nil {
-		log.Printf("Refresh token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+		slog.InfoContext(req.Context(), "Refresh token not found in cookies", "error", err)
+		respondWithError(w, http.StatusUnauthorized, "Missing refresh token")
 		return
 	}
 	refreshToken := refreshCookie.Value
@@ -23,31 +30,71 @@ func (cfg *ApiConfig) Refresh(w http.ResponseWriter, req *http.Request) {
 	// Get associated user from database.
 	dbRefToken, err := cfg.Queries.GetUserByToken(req.Context(), refreshToken)
 	if err != nil {
-		log.Printf("Invalid refresh token: %s", err)
-		w.WriteHeader(401)
+		slog.InfoContext(req.Context(), "Invalid refresh token", "error", err)
+		respondWithError(w, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	}
+	if dbRefToken.ReplacedBy.Valid {
+		cfg.revokeReusedFamily(req, dbRefToken)
+		respondWithError(w, http.StatusUnauthorized, "Invalid refresh token")
 		return
 	}
 	// Check if token has been revoked.
 	if dbRefToken.RevokedAt.Valid || !dbRefToken.ExpiresAt.Valid || dbRefToken.ExpiresAt.Time.Before(time.Now()) {
-		w.WriteHeader(401)
+		respondWithError(w, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	}
+
+	newRefreshToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithInternalError(w, req, "Error creating refresh token", err)
+		return
+	}
+	tx, err := cfg.DB.BeginTx(req.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, req, "Error starting transaction", err)
 		return
 	}
-	// Create new access token that expires in 1 hour.
-	token := ""
-	token, err = auth.MakeAccessToken(dbRefToken.UserID, cfg.Secret, time.Hour)
+	defer tx.Rollback()
+	qtx := tracing.WithTx(tx)
+
+	rows, err := qtx.RotateRefreshToken(req.Context(), database.RotateRefreshTokenParams{ReplacedBy: sql.NullString{String: newRefreshToken, Valid: true}, Token: refreshToken})
 	if err != nil {
-		log.Printf("Error creating JWT: %s", err)
-		w.WriteHeader(500)
+		respondWithInternalError(w, req, "Error rotating refresh token", err)
+		return
+	}
+	if rows == 0 {
+		// Another request rotated the token between our read and update.
+		tx.Rollback()
+		cfg.revokeReusedFamily(req, dbRefToken)
+		respondWithError(w, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	}
+	_, err = qtx.CreateRefreshToken(req.Context(), cfg.refreshTokenParams(req, newRefreshToken, dbRefToken.UserID, dbRefToken.FamilyID))
+	if err != nil {
+		respondWithInternalError(w, req, "Error storing refresh token", err)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		respondWithInternalError(w, req, "Error committing refresh token rotation", err)
+		return
+	}
+
+	err = cfg.setSessionCookies(w, dbRefToken.UserID, newRefreshToken)
+	if err != nil {
+		respondWithInternalError(w, req, "Error creating JWT", err)
 		return
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:     "access_token",
-		Value:    token,
-		Path:     "/",
-		Expires:  time.Now().Add(time.Hour),
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteNoneMode,
-	})
 	w.WriteHeader(200)
 }
+
+func (cfg *ApiConfig) revokeReusedFamily(req *http.Request, dbRefToken database.RefreshToken) {
+	slog.WarnContext(req.Context(), "Refresh token reuse detected, revoking session", "user_id", dbRefToken.UserID, "session_id", dbRefToken.FamilyID)
+	err := cfg.Queries.RevokeTokenFamily(req.Context(), dbRefToken.FamilyID)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error revoking session", "error", err)
+		return
+	}
+	cfg.audit(req, dbRefToken.UserID, "session_revoked", dbRefToken.FamilyID, "refresh token reused")
+}
@@ -1,15 +1,22 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+
+	"github.com/curtisbraxdale/taday/internal/apierror"
+	"github.com/curtisbraxdale/taday/internal/auth"
+	"github.com/google/uuid"
 )
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	dat, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Error marshalling JSON: %s", err)
+		slog.Error("Error marshalling JSON", "error", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -19,17 +26,80 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 }
 
 func respondWithError(w http.ResponseWriter, code int, msg string) {
-	type errorValues struct {
-		Error string `json:"error"`
+	apierror.Write(w, apierror.FromStatus(code, msg))
+}
+
+// respondWithInternalError logs err and responds with a generic 500 so
+// internal details never reach the client.
+func respondWithInternalError(w http.ResponseWriter, req *http.Request, msg string, err error) {
+	slog.ErrorContext(req.Context(), msg, "error", err)
+	respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+}
+
+// respondWithQueryError maps a database error to the matching API error:
+// missing rows become 404, unique violations 409, foreign key violations 422
+// and anything else 500.
+func respondWithQueryError(w http.ResponseWriter, req *http.Request, resource string, err error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, http.StatusNotFound, resource+" not found")
+		return
 	}
-	respBody := errorValues{Error: msg}
-	dat, err := json.Marshal(respBody)
-	if err != nil {
-		log.Printf("Error marshalling JSON: %s", err)
-		w.WriteHeader(500)
+	if constraint, ok := uniqueViolation(err); ok {
+		respondWithError(w, http.StatusConflict, conflictMessage(constraint))
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	w.Write(dat)
+	if foreignKeyViolation(err) {
+		respondWithError(w, http.StatusUnprocessableEntity, "Referenced resource does not exist")
+		return
+	}
+	respondWithInternalError(w, req, "Error querying "+resource, err)
+}
+
+// decodeJSON decodes the request body into dst and responds with 400 if it is
+// not valid JSON for dst, or 413 if it is over the limit of a
+// http.MaxBytesReader.
+func decodeJSON(w http.ResponseWriter, req *http.Request, dst any) bool {
+	err := json.NewDecoder(req.Body).Decode(dst)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		apierror.Write(w, apierror.New(http.StatusRequestEntityTooLarge, apierror.CodeTooLarge, fmt.Sprintf("Request body must be at most %d bytes", tooLarge.Limit)))
+		return false
+	}
+	if err != nil {
+		slog.InfoContext(req.Context(), "Error decoding parameters", "error", err)
+		apierror.Write(w, apierror.New(http.StatusBadRequest, apierror.CodeInvalidJSON, "Request body must be valid JSON"))
+		return false
+	}
+	return true
+}
+
+// pathUUID parses the named path value and responds with 400 if it is not a
+// UUID.
+func pathUUID(w http.ResponseWriter, req *http.Request, name string) (uuid.UUID, bool) {
+	id, err := uuid.Parse(req.PathValue(name))
+	if err != nil {
+		apierror.Write(w, apierror.New(http.StatusBadRequest, apierror.CodeInvalidID, name+" must be a UUID"))
+		return uuid.Nil, false
+	}
+	return id, true
+}
+
+// requestUserID returns the user authenticated by middleware.RequireAuth.
+func requestUserID(w http.ResponseWriter, req *http.Request) (uuid.UUID, bool) {
+	userID, ok := auth.UserIDFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+// respondWithValidationError writes err if it is non-nil and reports whether
+// it did.
+func respondWithValidationError(w http.ResponseWriter, err *apierror.Error) bool {
+	if err == nil {
+		return false
+	}
+	apierror.Write(w, err)
+	return true
 }
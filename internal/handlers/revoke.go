@@ -1,25 +1,31 @@
 package handlers
 
 import (
-	"context"
-	"log"
+	"log/slog"
 	"net/http"
 )
 
+// Revoke ends the session the refresh token belongs to, including any tokens
+// it has been rotated into.
 func (cfg *ApiConfig) Revoke(w http.ResponseWriter, req *http.Request) {
 	// Get refresh token from cookies.
 	refreshCookie, err := req.Cookie("refresh_token")
 	if err != nil {
-		log.Printf("Refresh token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+		slog.InfoContext(req.Context(), "Refresh token not found in cookies", "error", err)
+		respondWithError(w, http.StatusUnauthorized, "Missing refresh token")
 		return
 	}
-	refreshToken := refreshCookie.Value
-	err = cfg.Queries.RevokeToken(context.Background(), refreshToken)
+	dbRefToken, err := cfg.Queries.GetUserByToken(req.Context(), refreshCookie.Value)
 	if err != nil {
-		log.Printf("Error revoking refresh token: %s", err)
-		w.WriteHeader(401)
+		slog.InfoContext(req.Context(), "Error revoking refresh token", "error", err)
+		respondWithError(w, http.StatusUnauthorized, "Invalid refresh token")
 		return
 	}
+	err = cfg.Queries.RevokeTokenFamily(req.Context(), dbRefToken.FamilyID)
+	if err != nil {
+		respondWithInternalError(w, req, "Error revoking refresh token", err)
+		return
+	}
+	cfg.audit(req, dbRefToken.UserID, "session_revoked", dbRefToken.FamilyID, "")
 	w.WriteHeader(204)
 }
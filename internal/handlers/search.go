@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/validate"
+	"github.com/google/uuid"
+)
+
+const maxSearchQueryLength = 200
+
+type SearchResult struct {
+	Type    string     `json:"type"`
+	ID      uuid.UUID  `json:"id"`
+	Title   string     `json:"title"`
+	Snippet string     `json:"snippet"`
+	Date    *time.Time `json:"date,omitempty"`
+	Rank    float32    `json:"rank"`
+}
+
+// Search finds the user's events, todos and tags matching q, best match
+// first.
+func (cfg *ApiConfig) Search(w http.ResponseWriter, req *http.Request) {
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+
+	query := req.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	v := validate.New()
+	v.Required("q", q)
+	v.MaxLength("q", q, maxSearchQueryLength)
+	limit := parseLimit(v, query)
+	if respondWithValidationError(w, v.Err()) {
+		return
+	}
+
+	dbResults, err := cfg.Queries.Search(req.Context(), database.SearchParams{Query: q, UserID: userID, RowLimit: limit})
+	if err != nil {
+		respondWithInternalError(w, req, "Error searching", err)
+		return
+	}
+	results := Page[SearchResult]{Items: []SearchResult{}}
+	for _, r := range dbResults {
+		result := SearchResult{Type: r.Type, ID: r.ID, Title: r.Title, Snippet: highlightSnippet(r.Snippet), Rank: r.Rank}
+		if r.Date.Valid {
+			result.Date = &r.Date.Time
+		}
+		results.Items = append(results.Items, result)
+	}
+	respondWithJSON(w, 200, results)
+}
+
+// highlightSnippet escapes a snippet for use as HTML and turns the \x02 and
+// \x03 the Search query puts around matches into <mark> tags. The query strips
+// those characters from the stored text, so user input cannot produce a tag.
+func highlightSnippet(snippet string) string {
+	escaped := html.EscapeString(snippet)
+	return strings.NewReplacer("\x02", "<mark>", "\x03", "</mark>").Replace(escaped)
+}
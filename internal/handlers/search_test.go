@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/curtisbraxdale/taday/internal/auth"
+	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/dbtest"
+)
+
+func TestHighlightSnippet(t *testing.T) {
+	tests := []struct {
+		snippet string
+		want    string
+	}{
+		{"see the \x02dentist\x03 at 3", "see the <mark>dentist</mark> at 3"},
+		{"<mark>\x02dentist\x03</mark>", "&lt;mark&gt;<mark>dentist</mark>&lt;/mark&gt;"},
+		{"<script>alert(1)</script> & \x02dentist\x03", "&lt;script&gt;alert(1)&lt;/script&gt; &amp; <mark>dentist</mark>"},
+	}
+	for _, tt := range tests {
+		if got := highlightSnippet(tt.snippet); got != tt.want {
+			t.Errorf("highlightSnippet(%q) = %q, want %q", tt.snippet, got, tt.want)
+		}
+	}
+}
+
+func TestSearchEscapesStoredMarkup(t *testing.T) {
+	db := dbtest.Open(t)
+	cfg := &ApiConfig{DB: db, Queries: database.New(db)}
+	ctx := context.Background()
+	dbUser, err := cfg.Queries.CreateUser(ctx, database.CreateUserParams{Username: "alice", Email: "alice@example.com", HashedPassword: noPassword})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.Queries.CreateTodo(ctx, database.CreateTodoParams{
+		UserID:      dbUser.ID,
+		Title:       "Dentist",
+		Description: sql.NullString{String: "<mark>call</mark> \x02first\x03 <img src=x onerror=alert(1)>", Valid: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/search?q=dentist", nil)
+	req = req.WithContext(auth.ContextWithUserID(req.Context(), dbUser.ID))
+	rec := httptest.NewRecorder()
+	cfg.Search(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", rec.Code)
+	}
+	var results Page[SearchResult]
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Items) != 1 {
+		t.Fatalf("got %d results, want 1", len(results.Items))
+	}
+	snippet := results.Items[0].Snippet
+	if strings.Count(snippet, "<mark>") != 1 || !strings.Contains(snippet, "<mark>Dentist</mark>") {
+		t.Errorf("got snippet %q, want only the match marked", snippet)
+	}
+	if strings.Contains(snippet, "<img") {
+		t.Errorf("got unescaped markup in snippet %q", snippet)
+	}
+}
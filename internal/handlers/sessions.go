@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/google/uuid"
+)
+
+type Session struct {
+	ID         uuid.UUID `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+func (cfg *ApiConfig) GetSessions(w http.ResponseWriter, req *http.Request) {
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+
+	currentFamily := uuid.Nil
+	if refreshCookie, err := req.Cookie("refresh_token"); err == nil {
+		if dbRefToken, err := cfg.Queries.GetUserByToken(req.Context(), refreshCookie.Value); err == nil && dbRefToken.UserID == userID {
+			currentFamily = dbRefToken.FamilyID
+		}
+	}
+
+	dbSessions, err := cfg.Queries.GetUserSessions(req.Context(), userID)
+	if err != nil {
+		respondWithInternalError(w, req, "Error getting sessions for user", err)
+		return
+	}
+	sessions := []Session{}
+	for _, s := range dbSessions {
+		sessions = append(sessions, Session{ID: s.FamilyID, UserAgent: s.UserAgent, IPAddress: s.IpAddress, CreatedAt: s.StartedAt, LastUsedAt: s.LastUsedAt, ExpiresAt: s.ExpiresAt.Time, Current: s.FamilyID == currentFamily})
+	}
+	respondWithJSON(w, 200, sessions)
+}
+
+func (cfg *ApiConfig) DeleteSession(w http.ResponseWriter, req *http.Request) {
+	sessionID, ok := pathUUID(w, req, "session_id")
+	if !ok {
+		return
+	}
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+
+	rows, err := cfg.Queries.RevokeUserSession(req.Context(), database.RevokeUserSessionParams{FamilyID: sessionID, UserID: userID})
+	if err != nil {
+		respondWithInternalError(w, req, "Error revoking session", err)
+		return
+	}
+	if rows == 0 {
+		respondWithError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+	cfg.audit(req, userID, "session_revoked", sessionID, "")
+	w.WriteHeader(204)
+}
+
+// DeleteAllSessions logs the user out everywhere, including the current
+// device. Access tokens that were already issued remain valid until they
+// expire.
+func (cfg *ApiConfig) DeleteAllSessions(w http.ResponseWriter, req *http.Request) {
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+
+	err := cfg.Queries.RevokeAllUserTokens(req.Context(), userID)
+	if err != nil {
+		respondWithInternalError(w, req, "Error revoking sessions", err)
+		return
+	}
+	cfg.audit(req, userID, "all_sessions_revoked", uuid.Nil, "")
+	clearSessionCookies(w)
+	w.WriteHeader(204)
+}
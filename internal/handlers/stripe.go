@@ -2,129 +2,242 @@ package handlers
 
 import (
 	"database/sql"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
+	"os"
+	"time"
 
-	"github.com/curtisbraxdale/taday/internal/auth"
+	"github.com/curtisbraxdale/taday/internal/billing"
 	"github.com/curtisbraxdale/taday/internal/database"
-	"github.com/stripe/stripe-go/v82"
-	"github.com/stripe/stripe-go/v82/checkout/session"
-	"github.com/stripe/stripe-go/v82/customer"
-	"github.com/stripe/stripe-go/v82/subscription"
+	"github.com/curtisbraxdale/taday/internal/entitlements"
+	"github.com/curtisbraxdale/taday/internal/validate"
+	"github.com/google/uuid"
 )
 
-func (cfg *ApiConfig) CreateCheckoutSession(w http.ResponseWriter, req *http.Request) {
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+// Subscription is the billing state of the user's latest subscription. Users
+// who never subscribed get the free plan with status "none".
+type Subscription struct {
+	Plan              string     `json:"plan"`
+	Status            string     `json:"status"`
+	CurrentPeriodEnd  *time.Time `json:"current_period_end"`
+	CancelAtPeriodEnd bool       `json:"cancel_at_period_end"`
+	CanceledAt        *time.Time `json:"canceled_at"`
+	TrialStart        *time.Time `json:"trial_start"`
+	TrialEnd          *time.Time `json:"trial_end"`
+}
+
+func subscriptionFromDB(s database.Subscription) Subscription {
+	subscription := Subscription{Plan: s.Plan, Status: s.Status, CurrentPeriodEnd: &s.CurrentPeriodEnd, CancelAtPeriodEnd: s.CancelAtPeriodEnd}
+	if s.CanceledAt.Valid {
+		subscription.CanceledAt = &s.CanceledAt.Time
+	}
+	if s.TrialStart.Valid {
+		subscription.TrialStart = &s.TrialStart.Time
+	}
+	if s.TrialEnd.Valid {
+		subscription.TrialEnd = &s.TrialEnd.Time
+	}
+	return subscription
+}
+
+func (cfg *ApiConfig) GetSubscription(w http.ResponseWriter, req *http.Request) {
+	userID, ok := requestUserID(w, req)
+	if !ok {
 		return
 	}
-	accessToken := accessCookie.Value
 
-	userID, err := auth.ValidateAccessToken(accessToken, cfg.Secret)
+	dbSubscription, err := cfg.Queries.GetSubscriptionByUserID(req.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithJSON(w, 200, Subscription{Plan: entitlements.FreePlan, Status: "none"})
+		return
+	}
 	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+		respondWithInternalError(w, req, "Error getting subscription", err)
+		return
+	}
+	respondWithJSON(w, 200, subscriptionFromDB(dbSubscription))
+}
+
+// billingURL returns the URL in the named environment variable, or the path
+// on the frontend if it isn't set.
+func billingURL(env, path string) string {
+	if url := os.Getenv(env); url != "" {
+		return url
+	}
+	return frontendURL + path
+}
+
+// GetPlans lists the plans on offer, for the pricing page.
+func (cfg *ApiConfig) GetPlans(w http.ResponseWriter, req *http.Request) {
+	respondWithJSON(w, 200, cfg.Plans.Plans())
+}
+
+// CreateCheckoutSession starts a Stripe checkout for the plan in the body.
+// The plan can be left out when only one is on offer.
+func (cfg *ApiConfig) CreateCheckoutSession(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Plan string `json:"plan"`
+	}
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	if req.ContentLength != 0 && !decodeJSON(w, req, &params) {
+		return
+	}
+	if params.Plan == "" {
+		if plans := cfg.Plans.Plans(); len(plans) == 1 {
+			params.Plan = plans[0].Key
+		}
+	}
+	plan, ok := cfg.Plans.Plan(params.Plan)
+	if !ok || plan.PriceID == "" {
+		v := validate.New()
+		v.Add("plan", "invalid_value", "plan must be one of the plans from /api/plans")
+		respondWithValidationError(w, v.Err())
 		return
 	}
 
 	userStripeID, err := cfg.Queries.GetStripeID(req.Context(), userID)
 	if err != nil {
-		log.Printf("Error getting StripeID: %s", err)
-		w.WriteHeader(500)
+		respondWithInternalError(w, req, "Error getting StripeID", err)
 		return
 	}
 
-	domain := "https://taday.io"
-
 	if !userStripeID.Valid {
 		userEmail, err := cfg.Queries.GetEmail(req.Context(), userID)
 		if err != nil {
-			log.Printf("Error getting email: %s", err)
-			w.WriteHeader(500)
+			respondWithInternalError(w, req, "Error getting email", err)
 			return
 		}
-		stripeCustomer, err := customer.New(&stripe.CustomerParams{
-			Email: stripe.String(userEmail),
-		})
+		customerID, err := cfg.Billing.CreateCustomer(req.Context(), userEmail)
 		if err != nil {
-			log.Printf("Error creating Stripe user: %s", err)
-			w.WriteHeader(500)
+			respondWithInternalError(w, req, "Error creating Stripe user", err)
 			return
 		}
-		userStripeID = sql.NullString{String: stripeCustomer.ID, Valid: true}
+		userStripeID = sql.NullString{String: customerID, Valid: true}
 		err = cfg.Queries.UpdateStripeCustomerID(req.Context(), database.UpdateStripeCustomerIDParams{ID: userID, StripeCustomerID: userStripeID})
 		if err != nil {
-			log.Printf("Error updating Stripe customer ID: %s", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			respondWithInternalError(w, req, "Error updating Stripe customer ID", err)
 			return
 		}
 	}
-	params := &stripe.CheckoutSessionParams{
-		LineItems: []*stripe.CheckoutSessionLineItemParams{
-			{
-				Price:    stripe.String("price_1RkrUj03wkQu8EDp7ZBLneeB"),
-				Quantity: stripe.Int64(1),
-			},
-		},
-		Mode: stripe.String(string(stripe.CheckoutSessionModeSubscription)),
 
-		SuccessURL: stripe.String(domain + "/success"),
-		CancelURL:  stripe.String(domain + "/cancel"),
-
-		AutomaticTax: &stripe.CheckoutSessionAutomaticTaxParams{
-			Enabled: stripe.Bool(true),
-		},
+	url, err := cfg.Billing.CreateCheckoutSession(req.Context(), billing.CheckoutParams{
+		CustomerID: userStripeID.String,
+		// Lets the checkout.session.completed webhook find the user.
+		ClientReferenceID:   userID.String(),
+		PriceID:             plan.PriceID,
+		Plan:                plan.Key,
+		TrialDays:           plan.TrialDays,
+		AllowPromotionCodes: plan.AllowPromotionCodes,
+		SuccessURL:          billingURL("CHECKOUT_SUCCESS_URL", "/success"),
+		CancelURL:           billingURL("CHECKOUT_CANCEL_URL", "/cancel"),
+	})
+	if err != nil {
+		respondWithInternalError(w, req, "Stripe session creation failed", err)
+		return
+	}
 
-		Customer: stripe.String(userStripeID.String),
+	respondWithJSON(w, http.StatusOK, map[string]string{"url": url})
+}
 
-		CustomerUpdate: &stripe.CheckoutSessionCustomerUpdateParams{
-			Address: stripe.String("auto"),
-		},
+func (cfg *ApiConfig) CancelSub(w http.ResponseWriter, req *http.Request) {
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
 	}
 
-	s, err := session.New(params)
+	dbSubscription, err := cfg.Queries.GetOpenSubscriptionByUserID(req.Context(), userID)
 	if err != nil {
-		log.Printf("Stripe session creation failed: %v", err)
-		http.Error(w, "Stripe error", http.StatusInternalServerError)
+		respondWithQueryError(w, req, "Subscription", err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, map[string]string{"url": s.URL})
+	err = cfg.Billing.SetCancelAtPeriodEnd(req.Context(), dbSubscription.StripeSubscriptionID, true)
+	if err != nil {
+		respondWithInternalError(w, req, "Error updating subscription in Stripe", err)
+		return
+	}
+	cfg.audit(req, userID, "subscription_cancel_requested", dbSubscription.ID, "")
+	w.WriteHeader(http.StatusOK)
 }
 
-func (cfg *ApiConfig) CancelSub(w http.ResponseWriter, req *http.Request) {
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+// ResumeSub undoes CancelSub while the paid period is still running. The
+// webhook brings the stored subscription up to date.
+func (cfg *ApiConfig) ResumeSub(w http.ResponseWriter, req *http.Request) {
+	userID, ok := requestUserID(w, req)
+	if !ok {
 		return
 	}
-	accessToken := accessCookie.Value
 
-	userID, err := auth.ValidateAccessToken(accessToken, cfg.Secret)
+	dbSubscription, err := cfg.Queries.GetOpenSubscriptionByUserID(req.Context(), userID)
 	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+		respondWithQueryError(w, req, "Subscription", err)
 		return
 	}
-
-	dbSubscription, err := cfg.Queries.GetActiveSubscriptionByUserID(req.Context(), userID)
+	if !dbSubscription.CancelAtPeriodEnd {
+		respondWithError(w, http.StatusConflict, "Subscription is not set to cancel")
+		return
+	}
+	err = cfg.Billing.SetCancelAtPeriodEnd(req.Context(), dbSubscription.StripeSubscriptionID, false)
 	if err != nil {
-		http.Error(w, "No active subscription found", http.StatusNotFound)
+		slog.ErrorContext(req.Context(), "Error resuming subscription in Stripe", "error", err)
+		respondWithError(w, http.StatusBadGateway, "Could not resume your subscription, try again later")
+		return
+	}
+	cfg.audit(req, userID, "subscription_resume_requested", dbSubscription.ID, "")
+	dbSubscription.CancelAtPeriodEnd = false
+	respondWithJSON(w, 200, subscriptionFromDB(dbSubscription))
+}
+
+// CreateBillingPortalSession returns a link to Stripe's customer portal, where
+// users manage their payment method and see their invoices.
+func (cfg *ApiConfig) CreateBillingPortalSession(w http.ResponseWriter, req *http.Request) {
+	userID, ok := requestUserID(w, req)
+	if !ok {
 		return
 	}
 
-	// Call Stripe to update subscription
-	params := &stripe.SubscriptionParams{
-		CancelAtPeriodEnd: stripe.Bool(true),
+	userStripeID, err := cfg.Queries.GetStripeID(req.Context(), userID)
+	if err != nil {
+		respondWithQueryError(w, req, "User", err)
+		return
+	}
+	if !userStripeID.Valid {
+		respondWithError(w, http.StatusNotFound, "No billing account, subscribe first")
+		return
 	}
-	_, err = subscription.Update(dbSubscription.StripeSubscriptionID, params)
+	url, err := cfg.Billing.CreatePortalSession(req.Context(), userStripeID.String, billingURL("BILLING_PORTAL_RETURN_URL", "/account"))
 	if err != nil {
-		log.Printf("Error updating subscription in Stripe: %v", err)
-		http.Error(w, "Failed to cancel subscription", http.StatusInternalServerError)
+		slog.ErrorContext(req.Context(), "Error creating billing portal session", "error", err)
+		respondWithError(w, http.StatusBadGateway, "Could not open the billing portal, try again later")
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+	respondWithJSON(w, http.StatusOK, map[string]string{"url": url})
+}
+
+// cancelSubscriptionForDeletion stops the user's subscription from renewing,
+// including one still in its trial or behind on payment, writing an error
+// response if Stripe can't be reached.
+func (cfg *ApiConfig) cancelSubscriptionForDeletion(w http.ResponseWriter, req *http.Request, userID uuid.UUID) bool {
+	dbSubscription, err := cfg.Queries.GetOpenSubscriptionByUserID(req.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && dbSubscription.CancelAtPeriodEnd) {
+		return true
+	}
+	if err != nil {
+		respondWithInternalError(w, req, "Error getting subscription", err)
+		return false
+	}
+	err = cfg.Billing.SetCancelAtPeriodEnd(req.Context(), dbSubscription.StripeSubscriptionID, true)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error cancelling subscription in Stripe", "error", err)
+		respondWithError(w, http.StatusBadGateway, "Could not cancel your subscription, try again later")
+		return false
+	}
+	cfg.audit(req, userID, "subscription_cancel_requested", dbSubscription.ID, "account deletion")
+	return true
 }
@@ -3,91 +3,271 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/tracing"
+	"github.com/google/uuid"
 	"github.com/stripe/stripe-go/v82"
-	"github.com/stripe/stripe-go/v82/webhook"
 )
 
+// errInvalidWebhookPayload marks events that can't be handled as sent; they
+// are answered with 400 instead of 500.
+var errInvalidWebhookPayload = errors.New("invalid webhook payload")
+
 func (cfg *ApiConfig) StripeWebhookHandler(w http.ResponseWriter, r *http.Request) {
 	const MaxBodyBytes = int64(65536)
 	r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
 
 	payload, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Error reading webhook body: %v", err)
-		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		slog.WarnContext(r.Context(), "Error reading webhook body", "error", err)
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+		return
+	}
+
+	event, err := cfg.Billing.ConstructEvent(payload, r.Header.Get("Stripe-Signature"))
+	if err != nil {
+		slog.WarnContext(r.Context(), "Webhook signature verification failed", "error", err)
+		webhookEvents.WithLabelValues("unknown", "invalid_signature").Inc()
+		respondWithError(w, http.StatusBadRequest, "Invalid webhook signature")
+		return
+	}
+
+	// Stripe redelivers events, sometimes concurrently. Recording the event in
+	// the same transaction that handles it makes a redelivery wait for the
+	// first attempt and then find it already done.
+	tx, err := cfg.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, r, "Error starting webhook transaction", err)
 		return
 	}
+	defer tx.Rollback()
+	txCfg := *cfg
+	txCfg.Queries = tracing.WithTx(tx)
+	txCfg.tx = tx
 
-	// Use your Stripe webhook secret (get from Dashboard)
-	endpointSecret := os.Getenv("STRIPE_WEBHOOK_SECRET")
-	event, err := webhook.ConstructEvent(payload, r.Header.Get("Stripe-Signature"), endpointSecret)
+	rows, err := txCfg.Queries.RecordStripeEvent(r.Context(), database.RecordStripeEventParams{ID: event.ID, Type: string(event.Type)})
 	if err != nil {
-		log.Printf("⚠️ Webhook signature verification failed: %v", err)
-		http.Error(w, "Unauthorized", http.StatusBadRequest)
+		respondWithInternalError(w, r, "Error recording Stripe event", err)
 		return
 	}
+	if rows == 0 {
+		slog.InfoContext(r.Context(), "Skipping Stripe event, already processed", "stripe_event_id", event.ID)
+		webhookEvents.WithLabelValues(string(event.Type), "duplicate").Inc()
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	err = txCfg.handleStripeEvent(r, event)
+	if errors.Is(err, errInvalidWebhookPayload) {
+		slog.WarnContext(r.Context(), "Error handling Stripe event", "stripe_event_id", event.ID, "error", err)
+		webhookEvents.WithLabelValues(string(event.Type), "invalid").Inc()
+		respondWithError(w, http.StatusBadRequest, "Invalid webhook payload")
+		return
+	}
+	if err != nil {
+		webhookEvents.WithLabelValues(string(event.Type), "failed").Inc()
+		respondWithInternalError(w, r, "Error handling Stripe event "+event.ID, err)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		webhookEvents.WithLabelValues(string(event.Type), "failed").Inc()
+		respondWithInternalError(w, r, "Error committing Stripe event", err)
+		return
+	}
+	webhookEvents.WithLabelValues(string(event.Type), "processed").Inc()
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleStripeEvent applies an event to the database. Event types that aren't
+// handled are acknowledged so Stripe stops sending them.
+func (cfg *ApiConfig) handleStripeEvent(r *http.Request, event stripe.Event) error {
+	eventAt := time.Unix(event.Created, 0)
 	switch event.Type {
-	case "customer.subscription.created":
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted":
 		var sub stripe.Subscription
 		if err := json.Unmarshal(event.Data.Raw, &sub); err != nil {
-			log.Printf("Error parsing webhook subscription: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
+			return fmt.Errorf("%w: %s", errInvalidWebhookPayload, err)
 		}
-		user, err := cfg.Queries.GetUserByStripeID(r.Context(), sql.NullString{Valid: true, String: sub.Customer.ID})
-		_, err = cfg.Queries.CreateSubscription(r.Context(), database.CreateSubscriptionParams{
-			UserID:               user.ID,
-			StripeCustomerID:     sub.Customer.ID,
-			StripeSubscriptionID: sub.ID,
-			Plan:                 "pro",
-			Status:               string(sub.Status),
-			CurrentPeriodStart:   time.Unix(sub.Items.Data[0].CurrentPeriodStart, 0),
-			CurrentPeriodEnd:     time.Unix(sub.Items.Data[0].CurrentPeriodEnd, 0),
-			CancelAtPeriodEnd:    sub.CancelAtPeriodEnd,
-			CanceledAt:           TimeOrNil(sub.CanceledAt),
-			TrialStart:           TimeOrNil(sub.TrialStart),
-			TrialEnd:             TimeOrNil(sub.TrialEnd),
-			CreatedAt:            time.Now(),
-			UpdatedAt:            time.Now(),
-		})
-		if err != nil {
-			log.Printf("Error creating subscription: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		return cfg.syncSubscription(r, string(event.Type), eventAt, &sub)
+	case "checkout.session.completed":
+		var s stripe.CheckoutSession
+		if err := json.Unmarshal(event.Data.Raw, &s); err != nil {
+			return fmt.Errorf("%w: %s", errInvalidWebhookPayload, err)
 		}
-	case "customer.subscription.updated", "customer.subscription.deleted":
-		var sub stripe.Subscription
-		if err := json.Unmarshal(event.Data.Raw, &sub); err != nil {
-			log.Printf("Error parsing webhook subscription: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
+		return cfg.completeCheckout(r, &s)
+	case "invoice.paid", "invoice.payment_failed":
+		var inv stripe.Invoice
+		if err := json.Unmarshal(event.Data.Raw, &inv); err != nil {
+			return fmt.Errorf("%w: %s", errInvalidWebhookPayload, err)
+		}
+		return cfg.applyInvoice(r, string(event.Type), eventAt, &inv)
+	case "customer.deleted":
+		var c stripe.Customer
+		if err := json.Unmarshal(event.Data.Raw, &c); err != nil {
+			return fmt.Errorf("%w: %s", errInvalidWebhookPayload, err)
+		}
+		return cfg.deleteStripeCustomer(r, &c)
+	}
+	return nil
+}
+
+// stripeUser finds the user a Stripe customer belongs to. Customers that
+// aren't linked to a user come back as ok false.
+func (cfg *ApiConfig) stripeUser(r *http.Request, customerID string) (database.User, bool, error) {
+	user, err := cfg.Queries.GetUserByStripeID(r.Context(), sql.NullString{String: customerID, Valid: true})
+	if errors.Is(err, sql.ErrNoRows) {
+		slog.InfoContext(r.Context(), "Ignoring Stripe event for unknown customer", "stripe_customer_id", customerID)
+		return database.User{}, false, nil
+	}
+	if err != nil {
+		return database.User{}, false, err
+	}
+	return user, true, nil
+}
+
+func (cfg *ApiConfig) syncSubscription(r *http.Request, eventType string, eventAt time.Time, sub *stripe.Subscription) error {
+	if sub.Customer == nil || sub.Items == nil || len(sub.Items.Data) == 0 {
+		return fmt.Errorf("%w: subscription %s has no customer or items", errInvalidWebhookPayload, sub.ID)
+	}
+	user, ok, err := cfg.stripeUser(r, sub.Customer.ID)
+	if !ok || err != nil {
+		return err
+	}
+
+	item := sub.Items.Data[0]
+	plan, ok := cfg.Plans.Plan(sub.Metadata["plan"])
+	if item.Price != nil {
+		if p, found := cfg.Plans.PlanForPrice(item.Price.ID); found {
+			plan, ok = p, true
 		}
-		user, err := cfg.Queries.GetUserByStripeID(r.Context(), sql.NullString{Valid: true, String: sub.Customer.ID})
-		_, err = cfg.Queries.UpdateSubscription(r.Context(), database.UpdateSubscriptionParams{
-			Status:             string(sub.Status),
-			CurrentPeriodStart: time.Unix(sub.Items.Data[0].CurrentPeriodStart, 0),
-			CurrentPeriodEnd:   time.Unix(sub.Items.Data[0].CurrentPeriodEnd, 0),
-			CancelAtPeriodEnd:  sub.CancelAtPeriodEnd,
-			CanceledAt:         TimeOrNil(sub.CanceledAt),
-			TrialStart:         TimeOrNil(sub.TrialStart),
-			TrialEnd:           TimeOrNil(sub.TrialEnd),
-			UserID:             user.ID,
-		})
+	}
+	if !ok {
+		// Failing lets Stripe retry once the price is added to the catalog.
+		return fmt.Errorf("subscription %s is billed with a price that isn't in the plan catalog", sub.ID)
+	}
+	dbSubscription, err := cfg.Queries.UpsertSubscription(r.Context(), database.UpsertSubscriptionParams{
+		UserID:               user.ID,
+		StripeCustomerID:     sub.Customer.ID,
+		StripeSubscriptionID: sub.ID,
+		Plan:                 plan.Key,
+		Status:               string(sub.Status),
+		CurrentPeriodStart:   time.Unix(item.CurrentPeriodStart, 0),
+		CurrentPeriodEnd:     time.Unix(item.CurrentPeriodEnd, 0),
+		CancelAtPeriodEnd:    sub.CancelAtPeriodEnd,
+		CanceledAt:           TimeOrNil(sub.CanceledAt),
+		TrialStart:           TimeOrNil(sub.TrialStart),
+		TrialEnd:             TimeOrNil(sub.TrialEnd),
+		EventAt:              eventAt,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		slog.InfoContext(r.Context(), "Ignoring out of date event for Stripe subscription", "stripe_subscription_id", sub.ID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if resolution := dunningResolution(dbSubscription.Status); resolution != "" {
+		err = cfg.resolveDunning(r.Context(), sub.ID, resolution)
 		if err != nil {
-			log.Printf("Error updating subscription: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return err
 		}
 	}
+	action := map[string]string{
+		"customer.subscription.created": "subscription_created",
+		"customer.subscription.updated": "subscription_updated",
+		"customer.subscription.deleted": "subscription_deleted",
+	}[eventType]
+	return cfg.auditAs(r, "stripe", user.ID, action, dbSubscription.ID, string(sub.Status))
+}
 
-	w.WriteHeader(http.StatusOK)
+// completeCheckout links the Stripe customer to the user who started the
+// checkout. The subscription itself arrives in its own event.
+func (cfg *ApiConfig) completeCheckout(r *http.Request, s *stripe.CheckoutSession) error {
+	if s.Customer == nil {
+		return nil
+	}
+	userID, err := uuid.Parse(s.ClientReferenceID)
+	if err != nil {
+		user, ok, err := cfg.stripeUser(r, s.Customer.ID)
+		if !ok || err != nil {
+			return err
+		}
+		userID = user.ID
+	}
+	err = cfg.Queries.UpdateStripeCustomerID(r.Context(), database.UpdateStripeCustomerIDParams{ID: userID, StripeCustomerID: sql.NullString{String: s.Customer.ID, Valid: true}})
+	if err != nil {
+		return err
+	}
+	details := ""
+	if s.Subscription != nil {
+		details = s.Subscription.ID
+	}
+	return cfg.auditAs(r, "stripe", userID, "checkout_completed", uuid.Nil, details)
+}
+
+// applyInvoice moves a subscription back to active when a late payment goes
+// through, or to past due when a renewal payment fails.
+func (cfg *ApiConfig) applyInvoice(r *http.Request, eventType string, eventAt time.Time, inv *stripe.Invoice) error {
+	if inv.Customer == nil || inv.Parent == nil || inv.Parent.SubscriptionDetails == nil || inv.Parent.SubscriptionDetails.Subscription == nil {
+		return nil
+	}
+	user, ok, err := cfg.stripeUser(r, inv.Customer.ID)
+	if !ok || err != nil {
+		return err
+	}
+
+	params := database.TransitionSubscriptionStatusParams{Status: "active", EventAt: eventAt, StripeSubscriptionID: inv.Parent.SubscriptionDetails.Subscription.ID, FromStatuses: []string{"past_due", "unpaid", "incomplete"}}
+	action := "invoice_paid"
+	if eventType == "invoice.payment_failed" {
+		params.Status = "past_due"
+		params.FromStatuses = []string{"active", "trialing"}
+		action = "invoice_payment_failed"
+	}
+	subscriptionID := uuid.Nil
+	dbSubscription, err := cfg.Queries.TransitionSubscriptionStatus(r.Context(), params)
+	if err == nil {
+		subscriptionID = dbSubscription.ID
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	// The sender reminds the user until the payment goes through. It checks
+	// the subscription before every reminder, so a case opened by a failure
+	// that arrives after the payment is closed again without a message.
+	if eventType == "invoice.payment_failed" {
+		err = cfg.Queries.OpenDunningCase(r.Context(), database.OpenDunningCaseParams{UserID: user.ID, StripeSubscriptionID: params.StripeSubscriptionID, InvoiceID: inv.ID})
+	} else {
+		err = cfg.resolveDunning(r.Context(), params.StripeSubscriptionID, "recovered")
+	}
+	if err != nil {
+		return err
+	}
+	return cfg.auditAs(r, "stripe", user.ID, action, subscriptionID, inv.ID)
+}
+
+// deleteStripeCustomer ends the subscriptions of a customer removed in Stripe
+// and unlinks them from the user, so a new checkout creates a new customer.
+func (cfg *ApiConfig) deleteStripeCustomer(r *http.Request, c *stripe.Customer) error {
+	err := cfg.Queries.CancelSubscriptionsByCustomerID(r.Context(), c.ID)
+	if err != nil {
+		return err
+	}
+	user, ok, err := cfg.stripeUser(r, c.ID)
+	if !ok || err != nil {
+		return err
+	}
+	err = cfg.Queries.UpdateStripeCustomerID(r.Context(), database.UpdateStripeCustomerIDParams{ID: user.ID, StripeCustomerID: sql.NullString{}})
+	if err != nil {
+		return err
+	}
+	return cfg.auditAs(r, "stripe", user.ID, "billing_customer_deleted", uuid.Nil, c.ID)
 }
 
 func TimeOrNil(ts int64) sql.NullTime {
@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/curtisbraxdale/taday/internal/billing"
+	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/dbtest"
+	"github.com/curtisbraxdale/taday/internal/entitlements"
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/webhook"
+)
+
+const testWebhookSecret = "whsec_test"
+
+// webhookTest is an ApiConfig backed by a test database and the fake billing
+// provider, with one user who is the Stripe customer cus_test.
+type webhookTest struct {
+	t    *testing.T
+	cfg  *ApiConfig
+	fake *billing.Fake
+	user database.User
+}
+
+func newWebhookTest(t *testing.T) *webhookTest {
+	t.Helper()
+	db := dbtest.Open(t)
+	fake := billing.NewFake("", testWebhookSecret)
+	cfg := &ApiConfig{
+		DB:      db,
+		Queries: database.New(db),
+		Billing: fake,
+		Plans:   entitlements.NewCatalog(entitlements.Plan{Key: "pro", PriceID: "price_pro", Interval: "month"}),
+	}
+	user, err := cfg.Queries.CreateUser(context.Background(), database.CreateUserParams{Username: "alice", Email: "alice@example.com", HashedPassword: noPassword})
+	if err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+	err = cfg.Queries.UpdateStripeCustomerID(context.Background(), database.UpdateStripeCustomerIDParams{ID: user.ID, StripeCustomerID: sql.NullString{String: "cus_test", Valid: true}})
+	if err != nil {
+		t.Fatalf("linking customer: %v", err)
+	}
+	return &webhookTest{t: t, cfg: cfg, fake: fake, user: user}
+}
+
+// signedEvent builds a webhook payload signed with the test secret.
+func signedEvent(t *testing.T, id, eventType string, created time.Time, object any) ([]byte, string) {
+	t.Helper()
+	payload, err := json.Marshal(map[string]any{
+		"id":          id,
+		"object":      "event",
+		"api_version": stripe.APIVersion,
+		"created":     created.Unix(),
+		"type":        eventType,
+		"data":        map[string]any{"object": object},
+	})
+	if err != nil {
+		t.Fatalf("marshalling event: %v", err)
+	}
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: testWebhookSecret})
+	return payload, signed.Header
+}
+
+func postWebhook(cfg *ApiConfig, payload []byte, signature string) int {
+	req := httptest.NewRequest(http.MethodPost, "/api/webhook", bytes.NewReader(payload))
+	req.Header.Set("Stripe-Signature", signature)
+	rec := httptest.NewRecorder()
+	cfg.StripeWebhookHandler(rec, req)
+	return rec.Code
+}
+
+// send delivers an event and fails the test unless it gets want.
+func (wt *webhookTest) send(id, eventType string, created time.Time, object any, want int) {
+	wt.t.Helper()
+	payload, signature := signedEvent(wt.t, id, eventType, created, object)
+	if code := postWebhook(wt.cfg, payload, signature); code != want {
+		wt.t.Fatalf("%s %s: got status %d, want %d", eventType, id, code, want)
+	}
+}
+
+func (wt *webhookTest) subscription() database.Subscription {
+	wt.t.Helper()
+	dbSubscription, err := wt.cfg.Queries.GetSubscriptionByStripeID(context.Background(), "sub_test")
+	if err != nil {
+		wt.t.Fatalf("getting subscription: %v", err)
+	}
+	return dbSubscription
+}
+
+func subscriptionObject(status, priceID string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"id":                   "sub_test",
+		"object":               "subscription",
+		"customer":             "cus_test",
+		"status":               status,
+		"cancel_at_period_end": false,
+		"items": map[string]any{
+			"object": "list",
+			"data": []map[string]any{{
+				"id":                   "si_test",
+				"object":               "subscription_item",
+				"current_period_start": now.Unix(),
+				"current_period_end":   now.AddDate(0, 1, 0).Unix(),
+				"price":                map[string]any{"id": priceID, "object": "price"},
+			}},
+		},
+	}
+}
+
+func invoiceObject(id string) map[string]any {
+	return map[string]any{
+		"id":       id,
+		"object":   "invoice",
+		"customer": "cus_test",
+		"parent": map[string]any{
+			"type":                 "subscription_details",
+			"subscription_details": map[string]any{"subscription": "sub_test"},
+		},
+	}
+}
+
+func TestStripeWebhookRejectsBadSignature(t *testing.T) {
+	cfg := &ApiConfig{Billing: billing.NewFake("", testWebhookSecret)}
+	payload, _ := signedEvent(t, "evt_1", "customer.subscription.created", time.Now(), subscriptionObject("active", "price_pro"))
+	badSignature := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: "whsec_other"}).Header
+
+	for name, signature := range map[string]string{"wrong secret": badSignature, "missing": ""} {
+		if code := postWebhook(cfg, payload, signature); code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want 400", name, code)
+		}
+	}
+}
+
+func TestStripeWebhookSkipsDuplicateEvents(t *testing.T) {
+	wt := newWebhookTest(t)
+	now := time.Now()
+	wt.send("evt_1", "customer.subscription.created", now, subscriptionObject("active", "price_pro"), http.StatusOK)
+	// A redelivery carries the same ID; what it says must not be applied
+	// twice, even if it differs.
+	wt.send("evt_1", "customer.subscription.created", now, subscriptionObject("canceled", "price_pro"), http.StatusOK)
+
+	if got := wt.subscription().Status; got != "active" {
+		t.Errorf("got status %q, want active", got)
+	}
+}
+
+func TestStripeWebhookIgnoresOutOfOrderUpdates(t *testing.T) {
+	wt := newWebhookTest(t)
+	now := time.Now()
+	wt.send("evt_1", "customer.subscription.created", now.Add(-time.Hour), subscriptionObject("active", "price_pro"), http.StatusOK)
+	wt.send("evt_3", "customer.subscription.updated", now, subscriptionObject("past_due", "price_pro"), http.StatusOK)
+	// Sent before evt_3 but delivered after it.
+	wt.send("evt_2", "customer.subscription.updated", now.Add(-time.Minute), subscriptionObject("active", "price_pro"), http.StatusOK)
+
+	if got := wt.subscription().Status; got != "past_due" {
+		t.Errorf("got status %q, want past_due", got)
+	}
+}
+
+func TestStripeWebhookPaymentFailedThenPaid(t *testing.T) {
+	wt := newWebhookTest(t)
+	ctx := context.Background()
+	now := time.Now()
+	wt.send("evt_1", "customer.subscription.created", now.Add(-time.Hour), subscriptionObject("active", "price_pro"), http.StatusOK)
+
+	wt.send("evt_2", "invoice.payment_failed", now.Add(-time.Minute), invoiceObject("in_1"), http.StatusOK)
+	if got := wt.subscription().Status; got != "past_due" {
+		t.Fatalf("after payment_failed: got status %q, want past_due", got)
+	}
+	cases, err := wt.cfg.Queries.GetDueDunningCases(ctx, now.Add(48*time.Hour))
+	if err != nil {
+		t.Fatalf("getting dunning cases: %v", err)
+	}
+	if len(cases) != 1 || cases[0].InvoiceID != "in_1" {
+		t.Fatalf("after payment_failed: got dunning cases %+v, want one for in_1", cases)
+	}
+
+	wt.send("evt_3", "invoice.paid", now, invoiceObject("in_1"), http.StatusOK)
+	if got := wt.subscription().Status; got != "active" {
+		t.Errorf("after paid: got status %q, want active", got)
+	}
+	cases, err = wt.cfg.Queries.GetDueDunningCases(ctx, now.Add(48*time.Hour))
+	if err != nil {
+		t.Fatalf("getting dunning cases: %v", err)
+	}
+	if len(cases) != 0 {
+		t.Errorf("after paid: got %d open dunning cases, want 0", len(cases))
+	}
+}
+
+func TestStripeWebhookFailsOnUnknownPrice(t *testing.T) {
+	wt := newWebhookTest(t)
+	wt.send("evt_1", "customer.subscription.created", time.Now(), subscriptionObject("active", "price_unknown"), http.StatusInternalServerError)
+
+	// The event isn't recorded, so Stripe's retry is processed once the price
+	// is in the catalog.
+	wt.cfg.Plans = entitlements.NewCatalog(entitlements.Plan{Key: "pro", PriceID: "price_unknown", Interval: "month"})
+	wt.send("evt_1", "customer.subscription.created", time.Now(), subscriptionObject("active", "price_unknown"), http.StatusOK)
+	if got := wt.subscription().Plan; got != "pro" {
+		t.Errorf("got plan %q, want pro", got)
+	}
+}
+
+// deliver sends the events the fake billing provider has built so far.
+func (wt *webhookTest) deliver() {
+	wt.t.Helper()
+	for _, event := range wt.fake.Events() {
+		if code := postWebhook(wt.cfg, event.Payload, event.Signature); code != http.StatusOK {
+			wt.t.Fatalf("delivering %s: got status %d, want 200", event.Payload, code)
+		}
+	}
+}
+
+func TestStripeWebhookWithFakeBilling(t *testing.T) {
+	wt := newWebhookTest(t)
+	ctx := context.Background()
+	customerID, err := wt.fake.CreateCustomer(ctx, wt.user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = wt.fake.CreateCheckoutSession(ctx, billing.CheckoutParams{CustomerID: customerID, ClientReferenceID: wt.user.ID.String(), PriceID: "price_pro", Plan: "pro", SuccessURL: "https://taday.io/success"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt.deliver()
+	dbSubscription, err := wt.cfg.Queries.GetSubscriptionByUserID(ctx, wt.user.ID)
+	if err != nil {
+		t.Fatalf("after checkout: %v", err)
+	}
+	if dbSubscription.Status != "active" || dbSubscription.StripeCustomerID != customerID {
+		t.Fatalf("after checkout: got %s subscription for %s", dbSubscription.Status, dbSubscription.StripeCustomerID)
+	}
+
+	steps := []struct {
+		name string
+		do   func(string) error
+		want string
+	}{
+		{"failed payment", wt.fake.FailPayment, "past_due"},
+		{"recovery", wt.fake.PayInvoice, "active"},
+	}
+	for _, step := range steps {
+		if err := step.do(dbSubscription.StripeSubscriptionID); err != nil {
+			t.Fatal(err)
+		}
+		wt.deliver()
+		got, err := wt.cfg.Queries.GetSubscriptionByStripeID(ctx, dbSubscription.StripeSubscriptionID)
+		if err != nil {
+			t.Fatalf("after %s: %v", step.name, err)
+		}
+		if got.Status != step.want {
+			t.Errorf("after %s: got status %q, want %q", step.name, got.Status, step.want)
+		}
+	}
+	cases, err := wt.cfg.Queries.GetDueDunningCases(ctx, time.Now().Add(48*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) != 0 {
+		t.Errorf("got %d open dunning cases after recovery, want 0", len(cases))
+	}
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/tracing"
+	"github.com/curtisbraxdale/taday/internal/validate"
+	"github.com/google/uuid"
+)
+
+// SyncResponse holds everything that changed since the sync token: the
+// current state of records that were created or updated, and the IDs of
+// records that were deleted.
+type SyncResponse struct {
+	Events    []Event     `json:"events"`
+	ToDos     []ToDo      `json:"todos"`
+	Tags      []Tag       `json:"tags"`
+	EventTags []EventTag  `json:"event_tags"`
+	Deleted   SyncDeleted `json:"deleted"`
+	NextToken string      `json:"next_token"`
+	HasMore   bool        `json:"has_more"`
+}
+
+type SyncDeleted struct {
+	Events    []uuid.UUID `json:"events"`
+	ToDos     []uuid.UUID `json:"todos"`
+	Tags      []uuid.UUID `json:"tags"`
+	EventTags []EventTag  `json:"event_tags"`
+}
+
+// Sync returns the changes made after the since token. Without a token it
+// returns everything, so a new client can start from an empty store.
+func (cfg *ApiConfig) Sync(w http.ResponseWriter, req *http.Request) {
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+
+	query := req.URL.Query()
+	v := validate.New()
+	limit := parseLimit(v, query)
+	since := int64(0)
+	if raw := query.Get("since"); raw != "" {
+		var err error
+		since, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || since < 0 {
+			v.Add("since", "invalid_format", "since must be a token returned by a previous sync")
+		}
+	}
+	if respondWithValidationError(w, v.Err()) {
+		return
+	}
+
+	// The changes and the records they point to are read from one snapshot.
+	tx, err := cfg.DB.BeginTx(req.Context(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		respondWithInternalError(w, req, "Error starting sync", err)
+		return
+	}
+	defer tx.Rollback()
+	qtx := tracing.WithTx(tx)
+
+	// One extra row tells us whether there is more to fetch.
+	changes, err := qtx.ListChanges(req.Context(), database.ListChangesParams{UserID: userID, Since: since, RowLimit: limit + 1})
+	if err != nil {
+		respondWithInternalError(w, req, "Error listing changes", err)
+		return
+	}
+	resp := SyncResponse{
+		Events:    []Event{},
+		ToDos:     []ToDo{},
+		Tags:      []Tag{},
+		EventTags: []EventTag{},
+		Deleted:   SyncDeleted{Events: []uuid.UUID{}, ToDos: []uuid.UUID{}, Tags: []uuid.UUID{}, EventTags: []EventTag{}},
+		NextToken: strconv.FormatInt(since, 10),
+	}
+	if len(changes) > int(limit) {
+		changes = changes[:limit]
+		resp.HasMore = true
+	}
+
+	eventIDs, toDoIDs, tagIDs := []uuid.UUID{}, []uuid.UUID{}, []uuid.UUID{}
+	for _, c := range changes {
+		resp.NextToken = strconv.FormatInt(c.Seq, 10)
+		switch {
+		case c.Resource == "event_tag" && c.Deleted:
+			resp.Deleted.EventTags = append(resp.Deleted.EventTags, EventTag{EventID: c.RecordID, TagID: c.TagID.UUID})
+		case c.Resource == "event_tag":
+			resp.EventTags = append(resp.EventTags, EventTag{EventID: c.RecordID, TagID: c.TagID.UUID})
+		case c.Resource == "event" && c.Deleted:
+			resp.Deleted.Events = append(resp.Deleted.Events, c.RecordID)
+		case c.Resource == "event":
+			eventIDs = append(eventIDs, c.RecordID)
+		case c.Resource == "todo" && c.Deleted:
+			resp.Deleted.ToDos = append(resp.Deleted.ToDos, c.RecordID)
+		case c.Resource == "todo":
+			toDoIDs = append(toDoIDs, c.RecordID)
+		case c.Resource == "tag" && c.Deleted:
+			resp.Deleted.Tags = append(resp.Deleted.Tags, c.RecordID)
+		case c.Resource == "tag":
+			tagIDs = append(tagIDs, c.RecordID)
+		}
+	}
+
+	if len(eventIDs) > 0 {
+		dbEvents, err := qtx.GetEventsByIDs(req.Context(), database.GetEventsByIDsParams{UserID: userID, Ids: eventIDs})
+		if err != nil {
+			respondWithInternalError(w, req, "Error finding changed events", err)
+			return
+		}
+		for _, e := range dbEvents {
+			resp.Events = append(resp.Events, Event{ID: e.ID, UserID: e.UserID, CreatedAt: e.CreatedAt, UpdatedAt: e.UpdatedAt, StartDate: e.StartDate, EndDate: e.EndDate, Title: e.Title, Description: e.Description.String, Priority: e.Priority, RecurD: e.RecurD, RecurW: e.RecurW, RecurM: e.RecurM, RecurY: e.RecurY})
+		}
+	}
+	if len(toDoIDs) > 0 {
+		dbToDos, err := qtx.GetTodosByIDs(req.Context(), database.GetTodosByIDsParams{UserID: userID, Ids: toDoIDs})
+		if err != nil {
+			respondWithInternalError(w, req, "Error finding changed todos", err)
+			return
+		}
+		for _, t := range dbToDos {
+			resp.ToDos = append(resp.ToDos, ToDo{ID: t.ID, UserID: t.UserID, CreatedAt: t.CreatedAt, UpdatedAt: t.UpdatedAt, Date: t.Date.Time, Title: t.Title, Description: t.Description.String})
+		}
+	}
+	if len(tagIDs) > 0 {
+		dbTags, err := qtx.GetTagsByIDs(req.Context(), database.GetTagsByIDsParams{UserID: userID, Ids: tagIDs})
+		if err != nil {
+			respondWithInternalError(w, req, "Error finding changed tags", err)
+			return
+		}
+		for _, t := range dbTags {
+			resp.Tags = append(resp.Tags, Tag{ID: t.ID, UserID: t.UserID, Name: t.Name, Color: t.Color})
+		}
+	}
+	respondWithJSON(w, 200, resp)
+}
@@ -1,12 +1,15 @@
 package handlers
 
 import (
-	"encoding/json"
-	"log"
+	"database/sql"
+	"fmt"
 	"net/http"
+	"strings"
 
-	"github.com/curtisbraxdale/taday/internal/auth"
+	"github.com/curtisbraxdale/taday/internal/apierror"
 	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/entitlements"
+	"github.com/curtisbraxdale/taday/internal/validate"
 	"github.com/google/uuid"
 )
 
@@ -22,154 +25,161 @@ type EventTag struct {
 	TagID   uuid.UUID `json:"tag_id"`
 }
 
+const maxTagNameLength = 50
+
+func validateTag(name, color string) *apierror.Error {
+	v := validate.New()
+	v.Required("name", name)
+	v.MaxLength("name", name, maxTagNameLength)
+	v.HexColor("color", color)
+	return v.Err()
+}
+
 func (cfg *ApiConfig) CreateTag(w http.ResponseWriter, req *http.Request) {
 	type parameters struct {
 		Name  string `json:"name"`
 		Color string `json:"color"`
 	}
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	userID, ok := requestUserID(w, req)
+	if !ok {
 		return
 	}
-	accessToken := accessCookie.Value
 
-	decoder := json.NewDecoder(req.Body)
 	params := parameters{}
-	err = decoder.Decode(&params)
-	if err != nil {
-		log.Printf("Error decoding parameters: %s", err)
-		w.WriteHeader(500)
+	if !decodeJSON(w, req, &params) {
 		return
 	}
-
-	userID, err := auth.ValidateAccessToken(accessToken, cfg.Secret)
-	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	params.Name = strings.TrimSpace(params.Name)
+	if respondWithValidationError(w, validateTag(params.Name, params.Color)) {
+		return
+	}
+	if !cfg.allowAnotherTag(w, req, userID) {
 		return
 	}
 
 	dbTagParams := database.CreateTagParams{UserID: userID, Name: params.Name, Color: params.Color}
 	dbTag, err := cfg.Queries.CreateTag(req.Context(), dbTagParams)
 	if err != nil {
-		log.Printf("Error creating tag: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		respondWithQueryError(w, req, "Tag", err)
 		return
 	}
+	cfg.audit(req, userID, "tag_created", dbTag.ID, "")
 
 	tag := Tag{ID: dbTag.ID, UserID: dbTag.UserID, Name: dbTag.Name, Color: dbTag.Color}
 	respondWithJSON(w, 201, tag)
 }
 
+// allowAnotherTag checks the user's plan has room for one more tag. Tags in
+// the trash don't count.
+func (cfg *ApiConfig) allowAnotherTag(w http.ResponseWriter, req *http.Request, userID uuid.UUID) bool {
+	e, ok := cfg.requestEntitlements(w, req, userID)
+	if !ok {
+		return false
+	}
+	if e.MaxTags == entitlements.Unlimited {
+		return true
+	}
+	count, err := cfg.Queries.CountTagsByUserID(req.Context(), userID)
+	if err != nil {
+		respondWithInternalError(w, req, "Error counting tags", err)
+		return false
+	}
+	if !e.AllowsTags(count) {
+		respondWithPlanLimit(w, fmt.Sprintf("Your plan allows up to %d tags", e.MaxTags))
+		return false
+	}
+	return true
+}
+
 func (cfg *ApiConfig) CreateEventTag(w http.ResponseWriter, req *http.Request) {
 	type parameters struct {
 		TagID uuid.UUID `json:"tag_id"`
 	}
-	eventID, err := uuid.Parse(req.PathValue("event_id"))
-	if err != nil {
-		log.Printf("Invalid event_id in path: %s", err)
-		w.WriteHeader(http.StatusBadRequest)
+	eventID, ok := pathUUID(w, req, "event_id")
+	if !ok {
 		return
 	}
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	userID, ok := requestUserID(w, req)
+	if !ok {
 		return
 	}
-	accessToken := accessCookie.Value
 
-	decoder := json.NewDecoder(req.Body)
 	params := parameters{}
-	err = decoder.Decode(&params)
-	if err != nil {
-		log.Printf("Error decoding parameters: %s", err)
-		w.WriteHeader(500)
+	if !decodeJSON(w, req, &params) {
 		return
 	}
-
-	_, err = auth.ValidateAccessToken(accessToken, cfg.Secret)
-	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	v := validate.New()
+	v.RequiredUUID("tag_id", params.TagID)
+	if respondWithValidationError(w, v.Err()) {
 		return
 	}
 
-	dbEventTagParams := database.CreateEventTagParams{EventID: eventID, TagID: params.TagID}
+	// The insert only matches when both the event and the tag belong to the
+	// user, so anything else comes back as no rows.
+	dbEventTagParams := database.CreateEventTagParams{EventID: eventID, TagID: params.TagID, UserID: userID}
 	dbEventTag, err := cfg.Queries.CreateEventTag(req.Context(), dbEventTagParams)
 	if err != nil {
-		log.Printf("Error creating tag: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		respondWithQueryError(w, req, "Event or tag", err)
 		return
 	}
+	cfg.audit(req, userID, "event_tag_added", dbEventTag.EventID, dbEventTag.TagID.String())
 
 	eventTag := EventTag{EventID: dbEventTag.EventID, TagID: dbEventTag.TagID}
 	respondWithJSON(w, 201, eventTag)
 }
 
 func (cfg *ApiConfig) GetUserTags(w http.ResponseWriter, req *http.Request) {
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	userID, ok := requestUserID(w, req)
+	if !ok {
 		return
 	}
-	accessToken := accessCookie.Value
 
-	userID, err := auth.ValidateAccessToken(accessToken, cfg.Secret)
-	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	v := validate.New()
+	page := parsePageParams(v, req.URL.Query())
+	if respondWithValidationError(w, v.Err()) {
 		return
 	}
+	dbTagParams := database.ListTagsParams{UserID: userID, RowLimit: page.Limit + 1}
+	if page.Cursor != nil {
+		dbTagParams.CursorName = sql.NullString{String: page.Cursor.Key, Valid: true}
+		dbTagParams.CursorID = uuid.NullUUID{UUID: page.Cursor.ID, Valid: true}
+	}
 
-	dbTags, err := cfg.Queries.GetTagsByUserID(req.Context(), userID)
+	dbTags, err := cfg.Queries.ListTags(req.Context(), dbTagParams)
 	if err != nil {
-		log.Printf("Error finding tags for given userID: %s", err)
-		w.WriteHeader(500)
+		respondWithInternalError(w, req, "Error finding tags for given userID", err)
 		return
 	}
-	tags := []Tag{}
+	tags := Page[Tag]{Items: []Tag{}}
+	if len(dbTags) > int(page.Limit) {
+		dbTags = dbTags[:page.Limit]
+		last := dbTags[len(dbTags)-1]
+		tags.NextCursor = encodeCursor(last.Name, last.ID)
+	}
 	for _, t := range dbTags {
-		tags = append(tags, Tag{ID: t.ID, UserID: t.UserID, Name: t.Name, Color: t.Color})
+		tags.Items = append(tags.Items, Tag{ID: t.ID, UserID: t.UserID, Name: t.Name, Color: t.Color})
 	}
 	respondWithJSON(w, 200, tags)
 }
 
 func (cfg *ApiConfig) GetEventTags(w http.ResponseWriter, req *http.Request) {
-	eventID, err := uuid.Parse(req.PathValue("id"))
-	if err != nil {
-		log.Printf("Error parsing uuid: %s", err)
-		w.WriteHeader(500)
-		return
-	}
-
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	eventID, ok := pathUUID(w, req, "event_id")
+	if !ok {
 		return
 	}
-	accessToken := accessCookie.Value
-
-	_, err = auth.ValidateAccessToken(accessToken, cfg.Secret)
-	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	userID, ok := requestUserID(w, req)
+	if !ok {
 		return
 	}
 
-	dbTags, err := cfg.Queries.GetTagsByEventID(req.Context(), eventID)
+	dbTags, err := cfg.Queries.GetTagsByEventID(req.Context(), database.GetTagsByEventIDParams{EventID: eventID, UserID: userID})
 	if err != nil {
-		log.Printf("Error finding tags for given eventID: %s", err)
-		w.WriteHeader(500)
+		respondWithInternalError(w, req, "Error finding tags for given eventID", err)
 		return
 	}
 	tags := []Tag{}
 	for _, t := range dbTags {
-		tags = append(tags, Tag{ID: t.ID, Name: t.Name, Color: t.Color})
+		tags = append(tags, Tag{ID: t.ID, UserID: userID, Name: t.Name, Color: t.Color})
 	}
 	respondWithJSON(w, 200, tags)
 }
@@ -180,113 +190,83 @@ func (cfg *ApiConfig) UpdateTag(w http.ResponseWriter, req *http.Request) {
 		Color string `json:"color"`
 	}
 
-	tagID, err := uuid.Parse(req.PathValue("tag_id"))
-	if err != nil {
-		log.Printf("Error parsing uuid: %s", err)
-		w.WriteHeader(500)
+	tagID, ok := pathUUID(w, req, "tag_id")
+	if !ok {
 		return
 	}
-
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	userID, ok := requestUserID(w, req)
+	if !ok {
 		return
 	}
-	accessToken := accessCookie.Value
 
-	decoder := json.NewDecoder(req.Body)
 	params := parameters{}
-	err = decoder.Decode(&params)
-	if err != nil {
-		log.Printf("Error decoding parameters: %s", err)
-		w.WriteHeader(500)
+	if !decodeJSON(w, req, &params) {
 		return
 	}
-
-	_, err = auth.ValidateAccessToken(accessToken, cfg.Secret)
-	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	params.Name = strings.TrimSpace(params.Name)
+	if respondWithValidationError(w, validateTag(params.Name, params.Color)) {
 		return
 	}
 
-	dbTagParams := database.UpdateTagParams{Name: params.Name, Color: params.Color, TagID: tagID}
+	dbTagParams := database.UpdateTagParams{Name: params.Name, Color: params.Color, TagID: tagID, UserID: userID}
 	dbTag, err := cfg.Queries.UpdateTag(req.Context(), dbTagParams)
 	if err != nil {
-		log.Printf("Error updating tag: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		respondWithQueryError(w, req, "Tag", err)
 		return
 	}
+	cfg.audit(req, userID, "tag_updated", dbTag.ID, "")
 
 	tag := Tag{ID: dbTag.ID, UserID: dbTag.UserID, Name: dbTag.Name, Color: dbTag.Color}
 	respondWithJSON(w, 201, tag)
 }
 
 func (cfg *ApiConfig) DeleteTag(w http.ResponseWriter, req *http.Request) {
-	tagID, err := uuid.Parse(req.PathValue("tag_id"))
-	if err != nil {
-		log.Printf("Error parsing uuid: %s", err)
-		w.WriteHeader(500)
+	tagID, ok := pathUUID(w, req, "tag_id")
+	if !ok {
 		return
 	}
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	userID, ok := requestUserID(w, req)
+	if !ok {
 		return
 	}
-	accessToken := accessCookie.Value
 
-	_, err = auth.ValidateAccessToken(accessToken, cfg.Secret)
+	rows, err := cfg.Queries.DeleteTag(req.Context(), database.DeleteTagParams{ID: tagID, UserID: userID})
 	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+		respondWithInternalError(w, req, "Error deleting tag", err)
 		return
 	}
-
-	err = cfg.Queries.DeleteTag(req.Context(), tagID)
-	if err != nil {
-		log.Printf("Error deleting tag: %s", err)
-		w.WriteHeader(500)
+	if rows == 0 {
+		respondWithError(w, http.StatusNotFound, "Tag not found")
 		return
 	}
+	cfg.audit(req, userID, "tag_deleted", tagID, "")
 	w.WriteHeader(204)
 }
 
 func (cfg *ApiConfig) DeleteEventTag(w http.ResponseWriter, req *http.Request) {
-	tagID, err := uuid.Parse(req.PathValue("tag_id"))
-	if err != nil {
-		log.Printf("Error parsing uuid: %s", err)
-		w.WriteHeader(500)
+	tagID, ok := pathUUID(w, req, "tag_id")
+	if !ok {
 		return
 	}
-	eventID, err := uuid.Parse(req.PathValue("event_id"))
-	if err != nil {
-		log.Printf("Error parsing uuid: %s", err)
-		w.WriteHeader(500)
+	eventID, ok := pathUUID(w, req, "event_id")
+	if !ok {
 		return
 	}
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	userID, ok := requestUserID(w, req)
+	if !ok {
 		return
 	}
-	accessToken := accessCookie.Value
 
-	_, err = auth.ValidateAccessToken(accessToken, cfg.Secret)
+	deleteParams := database.DeleteEventTagParams{EventID: eventID, TagID: tagID, UserID: userID}
+	rows, err := cfg.Queries.DeleteEventTag(req.Context(), deleteParams)
 	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+		respondWithInternalError(w, req, "Error deleting event tag", err)
 		return
 	}
-	deleteParams := database.DeleteEventTagParams{EventID: eventID, TagID: tagID}
-	err = cfg.Queries.DeleteEventTag(req.Context(), deleteParams)
-	if err != nil {
-		log.Printf("Error deleting event tag: %s", err)
-		w.WriteHeader(500)
+	if rows == 0 {
+		respondWithError(w, http.StatusNotFound, "Tag is not on this event")
 		return
 	}
+	cfg.audit(req, userID, "event_tag_removed", eventID, tagID.String())
 	w.WriteHeader(204)
 }
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/curtisbraxdale/taday/internal/auth"
+	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/dbtest"
+)
+
+func TestGetEventTagsHidesTrashedEvents(t *testing.T) {
+	db := dbtest.Open(t)
+	cfg := &ApiConfig{DB: db, Queries: database.New(db)}
+	ctx := context.Background()
+	dbUser, err := cfg.Queries.CreateUser(ctx, database.CreateUserParams{Username: "alice", Email: "alice@example.com", HashedPassword: noPassword})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	dbEvent, err := cfg.Queries.CreateEvent(ctx, database.CreateEventParams{UserID: dbUser.ID, StartDate: now, EndDate: now.Add(time.Hour), Title: "Dentist"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbTag, err := cfg.Queries.CreateTag(ctx, database.CreateTagParams{UserID: dbUser.ID, Name: "health", Color: "#00ff00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.Queries.CreateEventTag(ctx, database.CreateEventTagParams{EventID: dbEvent.ID, TagID: dbTag.ID, UserID: dbUser.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getTags := func() []Tag {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/api/events/"+dbEvent.ID.String()+"/tags", nil)
+		req.SetPathValue("event_id", dbEvent.ID.String())
+		req = req.WithContext(auth.ContextWithUserID(req.Context(), dbUser.ID))
+		rec := httptest.NewRecorder()
+		cfg.GetEventTags(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d, want 200", rec.Code)
+		}
+		var tags []Tag
+		if err := json.Unmarshal(rec.Body.Bytes(), &tags); err != nil {
+			t.Fatal(err)
+		}
+		return tags
+	}
+
+	if tags := getTags(); len(tags) != 1 || tags[0].ID != dbTag.ID {
+		t.Fatalf("got tags %+v, want %s", tags, dbTag.Name)
+	}
+	_, err = cfg.Queries.DeleteEventByID(ctx, database.DeleteEventByIDParams{ID: dbEvent.ID, UserID: dbUser.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags := getTags(); len(tags) != 0 {
+		t.Errorf("trashed event: got tags %+v, want none", tags)
+	}
+}
@@ -2,14 +2,14 @@ package handlers
 
 import (
 	"database/sql"
-	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
-	"sort"
+	"strings"
 	"time"
 
-	"github.com/curtisbraxdale/taday/internal/auth"
+	"github.com/curtisbraxdale/taday/internal/apierror"
 	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/validate"
 	"github.com/google/uuid"
 )
 
@@ -23,121 +23,144 @@ type ToDo struct {
 	Description string    `json:"description"`
 }
 
+func validateToDo(title, description string) *apierror.Error {
+	v := validate.New()
+	v.Required("title", title)
+	v.MaxLength("title", title, maxTitleLength)
+	v.MaxLength("description", description, maxDescriptionLength)
+	return v.Err()
+}
+
 func (cfg *ApiConfig) CreateToDo(w http.ResponseWriter, req *http.Request) {
 	type parameters struct {
 		Date        time.Time `json:"date"`
 		Title       string    `json:"title"`
 		Description string    `json:"description"`
 	}
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	userID, ok := requestUserID(w, req)
+	if !ok {
 		return
 	}
-	accessToken := accessCookie.Value
 
-	decoder := json.NewDecoder(req.Body)
 	params := parameters{}
-	err = decoder.Decode(&params)
-	if err != nil {
-		log.Printf("Error decoding parameters: %s", err)
-		w.WriteHeader(500)
+	if !decodeJSON(w, req, &params) {
 		return
 	}
-
-	userID, err := auth.ValidateAccessToken(accessToken, cfg.Secret)
-	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	params.Title = strings.TrimSpace(params.Title)
+	if respondWithValidationError(w, validateToDo(params.Title, params.Description)) {
 		return
 	}
+
 	dbTodoParams := database.CreateTodoParams{UserID: userID, Date: sql.NullTime{Time: params.Date, Valid: true}, Title: params.Title, Description: sql.NullString{String: params.Description, Valid: true}}
 	dbTodo, err := cfg.Queries.CreateTodo(req.Context(), dbTodoParams)
 	if err != nil {
-		log.Printf("Error creating todo: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		respondWithQueryError(w, req, "Todo", err)
 		return
 	}
+	cfg.audit(req, userID, "todo_created", dbTodo.ID, "")
 
 	toDo := ToDo{ID: dbTodo.ID, UserID: dbTodo.UserID, CreatedAt: dbTodo.CreatedAt, UpdatedAt: dbTodo.UpdatedAt, Date: dbTodo.Date.Time, Title: dbTodo.Title, Description: dbTodo.Description.String}
 	respondWithJSON(w, 201, toDo)
 }
 
 func (cfg *ApiConfig) GetUserToDos(w http.ResponseWriter, req *http.Request) {
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	userID, ok := requestUserID(w, req)
+	if !ok {
 		return
 	}
-	accessToken := accessCookie.Value
 
-	userID, err := auth.ValidateAccessToken(accessToken, cfg.Secret)
-	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	query := req.URL.Query()
+	v := validate.New()
+	page := parsePageParams(v, query)
+	descending := parseOrder(v, query)
+	startDate := parseQueryTime(v, query, "from")
+	endDate := parseQueryTime(v, query, "to")
+	if !startDate.IsZero() && !endDate.IsZero() {
+		v.After("to", endDate, "from", startDate)
+	}
+	cursorDate := sql.NullTime{}
+	cursorID := uuid.NullUUID{}
+	if page.Cursor != nil {
+		cursorDate = sql.NullTime{Time: cursorTime(v, page.Cursor), Valid: true}
+		cursorID = uuid.NullUUID{UUID: page.Cursor.ID, Valid: true}
+	}
+	if respondWithValidationError(w, v.Err()) {
 		return
 	}
 
-	dbToDos, err := cfg.Queries.GetTodosByUserID(req.Context(), userID)
+	// Todos without a date sort first, as if they were dated 0001-01-01.
+	dbToDoParams := database.ListTodosParams{
+		UserID:     userID,
+		FromDate:   sql.NullTime{Time: startDate, Valid: !startDate.IsZero()},
+		ToDate:     sql.NullTime{Time: endDate, Valid: !endDate.IsZero()},
+		CursorDate: cursorDate,
+		Descending: descending,
+		CursorID:   cursorID,
+		RowLimit:   page.Limit + 1,
+	}
+	dbToDos, err := cfg.Queries.ListTodos(req.Context(), dbToDoParams)
 	if err != nil {
-		log.Printf("Error finding events for given userID: %s", err)
-		w.WriteHeader(500)
+		respondWithInternalError(w, req, "Error finding todos for given userID", err)
 		return
 	}
-	toDos := []ToDo{}
+	toDos := Page[ToDo]{Items: []ToDo{}}
+	if len(dbToDos) > int(page.Limit) {
+		dbToDos = dbToDos[:page.Limit]
+		last := dbToDos[len(dbToDos)-1]
+		toDos.NextCursor = encodeCursor(last.Date.Time.Format(time.RFC3339Nano), last.ID)
+	}
 	for _, t := range dbToDos {
 		toDoDescription := ""
 		if t.Description.String != "" {
 			toDoDescription = t.Description.String
 		}
-		toDos = append(toDos, ToDo{ID: t.ID, UserID: t.UserID, CreatedAt: t.CreatedAt, UpdatedAt: t.UpdatedAt, Date: t.Date.Time, Title: t.Title, Description: toDoDescription})
-	}
-	sortDir := req.URL.Query().Get("sort")
-	if sortDir == "desc" {
-		sort.Slice(toDos, func(i, j int) bool { return toDos[j].Date.Before(toDos[i].Date) })
+		toDos.Items = append(toDos.Items, ToDo{ID: t.ID, UserID: t.UserID, CreatedAt: t.CreatedAt, UpdatedAt: t.UpdatedAt, Date: t.Date.Time, Title: t.Title, Description: toDoDescription})
 	}
 	respondWithJSON(w, 200, toDos)
 }
 
 func (cfg *ApiConfig) GetToDo(w http.ResponseWriter, req *http.Request) {
-	toDoID, err := uuid.Parse(req.PathValue("todo_id"))
-	if err != nil {
-		log.Printf("Error parsing uuid: %s", err)
-		w.WriteHeader(500)
-		return
-	}
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	toDoID, ok := pathUUID(w, req, "todo_id")
+	if !ok {
 		return
 	}
-	accessToken := accessCookie.Value
-
-	userID, err := auth.ValidateAccessToken(accessToken, cfg.Secret)
-	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	userID, ok := requestUserID(w, req)
+	if !ok {
 		return
 	}
 
 	dbToDo, err := cfg.Queries.GetTodoByID(req.Context(), toDoID)
 	if err != nil {
-		log.Printf("Error finding events for given userID: %s", err)
-		w.WriteHeader(500)
+		respondWithQueryError(w, req, "Todo", err)
 		return
 	}
 	if dbToDo.UserID != userID {
-		log.Printf("Unauthorized access: user %s tried to access todo %s owned by %s", userID, dbToDo.ID, dbToDo.UserID)
-		w.WriteHeader(http.StatusUnauthorized)
+		slog.WarnContext(req.Context(), "Unauthorized access to todo", "todo_id", dbToDo.ID, "owner_id", dbToDo.UserID)
+		respondWithError(w, http.StatusNotFound, "Todo not found")
+		return
+	}
+	if notModified(w, req, dbToDo.UpdatedAt) {
 		return
 	}
 	toDo := ToDo{ID: dbToDo.ID, UserID: dbToDo.UserID, CreatedAt: dbToDo.CreatedAt, UpdatedAt: dbToDo.UpdatedAt, Date: dbToDo.Date.Time, Title: dbToDo.Title, Description: dbToDo.Description.String}
 	respondWithJSON(w, 200, toDo)
 }
 
+// userToDo loads a todo owned by the user, responding with 404 if there is no
+// such todo.
+func (cfg *ApiConfig) userToDo(w http.ResponseWriter, req *http.Request, toDoID, userID uuid.UUID) (database.Todo, bool) {
+	dbToDo, err := cfg.Queries.GetTodoByID(req.Context(), toDoID)
+	if err != nil {
+		respondWithQueryError(w, req, "Todo", err)
+		return database.Todo{}, false
+	}
+	if dbToDo.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Todo not found")
+		return database.Todo{}, false
+	}
+	return dbToDo, true
+}
+
 func (cfg *ApiConfig) UpdateToDo(w http.ResponseWriter, req *http.Request) {
 	type parameters struct {
 		Date        time.Time `json:"date"`
@@ -145,75 +168,123 @@ func (cfg *ApiConfig) UpdateToDo(w http.ResponseWriter, req *http.Request) {
 		Description string    `json:"description"`
 	}
 
-	toDoID, err := uuid.Parse(req.PathValue("todo_id"))
-	if err != nil {
-		log.Printf("Error parsing uuid: %s", err)
-		w.WriteHeader(500)
+	toDoID, ok := pathUUID(w, req, "todo_id")
+	if !ok {
 		return
 	}
-
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	userID, ok := requestUserID(w, req)
+	if !ok {
 		return
 	}
-	accessToken := accessCookie.Value
 
-	decoder := json.NewDecoder(req.Body)
 	params := parameters{}
-	err = decoder.Decode(&params)
-	if err != nil {
-		log.Printf("Error decoding parameters: %s", err)
-		w.WriteHeader(500)
+	if !decodeJSON(w, req, &params) {
 		return
 	}
-
-	_, err = auth.ValidateAccessToken(accessToken, cfg.Secret)
-	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	params.Title = strings.TrimSpace(params.Title)
+	if respondWithValidationError(w, validateToDo(params.Title, params.Description)) {
 		return
 	}
-	dbTodoParams := database.UpdateToDoParams{Date: sql.NullTime{Time: params.Date, Valid: true}, Title: params.Title, Description: sql.NullString{String: params.Description, Valid: true}, TodoID: toDoID}
+
+	ifUpdatedAt := sql.NullTime{}
+	if req.Header.Get("If-Match") != "" {
+		current, ok := cfg.userToDo(w, req, toDoID, userID)
+		if !ok {
+			return
+		}
+		ifUpdatedAt, ok = checkIfMatch(w, req, current.UpdatedAt)
+		if !ok {
+			return
+		}
+	}
+
+	dbTodoParams := database.UpdateToDoParams{Date: sql.NullTime{Time: params.Date, Valid: true}, Title: params.Title, Description: sql.NullString{String: params.Description, Valid: true}, TodoID: toDoID, UserID: userID, IfUpdatedAt: ifUpdatedAt}
 	dbTodo, err := cfg.Queries.UpdateToDo(req.Context(), dbTodoParams)
 	if err != nil {
-		log.Printf("Error updating todo: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		respondWithUpdateError(w, req, "Todo", ifUpdatedAt, err)
 		return
 	}
+	cfg.audit(req, userID, "todo_updated", dbTodo.ID, "")
 
+	setETag(w, dbTodo.UpdatedAt)
 	toDo := ToDo{ID: dbTodo.ID, UserID: dbTodo.UserID, CreatedAt: dbTodo.CreatedAt, UpdatedAt: dbTodo.UpdatedAt, Date: dbTodo.Date.Time, Title: dbTodo.Title, Description: dbTodo.Description.String}
 	respondWithJSON(w, 201, toDo)
 }
 
-func (cfg *ApiConfig) DeleteToDo(w http.ResponseWriter, req *http.Request) {
-	toDoID, err := uuid.Parse(req.PathValue("todo_id"))
-	if err != nil {
-		log.Printf("Error parsing uuid: %s", err)
-		w.WriteHeader(500)
+// PatchToDo applies a JSON Merge Patch to a todo. A null date removes it.
+func (cfg *ApiConfig) PatchToDo(w http.ResponseWriter, req *http.Request) {
+	toDoID, ok := pathUUID(w, req, "todo_id")
+	if !ok {
 		return
 	}
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+	current, ok := cfg.userToDo(w, req, toDoID, userID)
+	if !ok {
+		return
+	}
+	if _, ok := checkIfMatch(w, req, current.UpdatedAt); !ok {
+		return
+	}
+	patch, ok := decodeMergePatch(w, req)
+	if !ok {
+		return
+	}
+
+	date := current.Date.Time
+	title := current.Title
+	description := current.Description.String
+	v := validate.New()
+	patch.apply(v, "date", &date, true)
+	patch.apply(v, "title", &title, false)
+	patch.apply(v, "description", &description, true)
+	if respondWithValidationError(w, v.Err()) {
+		return
+	}
+	title = strings.TrimSpace(title)
+	if respondWithValidationError(w, validateToDo(title, description)) {
 		return
 	}
-	accessToken := accessCookie.Value
 
-	_, err = auth.ValidateAccessToken(accessToken, cfg.Secret)
+	dbTodoDate := current.Date
+	if patch.has("date") {
+		dbTodoDate = sql.NullTime{Time: date, Valid: !date.IsZero()}
+	}
+	// The update only applies to the version the patch was merged into.
+	dbTodoParams := database.UpdateToDoParams{Date: dbTodoDate, Title: title, Description: sql.NullString{String: description, Valid: true}, TodoID: toDoID, UserID: userID, IfUpdatedAt: sql.NullTime{Time: current.UpdatedAt, Valid: true}}
+	dbTodo, err := cfg.Queries.UpdateToDo(req.Context(), dbTodoParams)
 	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+		respondWithUpdateError(w, req, "Todo", dbTodoParams.IfUpdatedAt, err)
 		return
 	}
+	cfg.audit(req, userID, "todo_updated", dbTodo.ID, "")
+
+	setETag(w, dbTodo.UpdatedAt)
+	toDo := ToDo{ID: dbTodo.ID, UserID: dbTodo.UserID, CreatedAt: dbTodo.CreatedAt, UpdatedAt: dbTodo.UpdatedAt, Date: dbTodo.Date.Time, Title: dbTodo.Title, Description: dbTodo.Description.String}
+	respondWithJSON(w, 200, toDo)
+}
 
-	err = cfg.Queries.DeleteTodoByID(req.Context(), toDoID)
+func (cfg *ApiConfig) DeleteToDo(w http.ResponseWriter, req *http.Request) {
+	toDoID, ok := pathUUID(w, req, "todo_id")
+	if !ok {
+		return
+	}
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+
+	rows, err := cfg.Queries.DeleteTodoByID(req.Context(), database.DeleteTodoByIDParams{ID: toDoID, UserID: userID})
 	if err != nil {
-		log.Printf("Error deleting todo: %s", err)
-		w.WriteHeader(500)
+		respondWithInternalError(w, req, "Error deleting todo", err)
+		return
+	}
+	if rows == 0 {
+		respondWithError(w, http.StatusNotFound, "Todo not found")
 		return
 	}
+	cfg.audit(req, userID, "todo_deleted", toDoID, "")
 	w.WriteHeader(204)
 }
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/validate"
+	"github.com/google/uuid"
+)
+
+// TrashRetention is how long deleted events, todos and tags are kept before
+// the sender purges them.
+const TrashRetention = 30 * 24 * time.Hour
+
+type TrashItem struct {
+	Type      string    `json:"type"`
+	ID        uuid.UUID `json:"id"`
+	Title     string    `json:"title"`
+	DeletedAt time.Time `json:"deleted_at"`
+	PurgeAt   time.Time `json:"purge_at"`
+}
+
+// GetTrash lists the user's deleted events, todos and tags, most recently
+// deleted first.
+func (cfg *ApiConfig) GetTrash(w http.ResponseWriter, req *http.Request) {
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+
+	v := validate.New()
+	page := parsePageParams(v, req.URL.Query())
+	dbTrashParams := database.ListTrashParams{UserID: userID, RowLimit: page.Limit + 1}
+	if page.Cursor != nil {
+		dbTrashParams.CursorDeletedAt = sql.NullTime{Time: cursorTime(v, page.Cursor), Valid: true}
+		dbTrashParams.CursorID = uuid.NullUUID{UUID: page.Cursor.ID, Valid: true}
+	}
+	if respondWithValidationError(w, v.Err()) {
+		return
+	}
+
+	dbTrash, err := cfg.Queries.ListTrash(req.Context(), dbTrashParams)
+	if err != nil {
+		respondWithInternalError(w, req, "Error listing trash", err)
+		return
+	}
+	trash := Page[TrashItem]{Items: []TrashItem{}}
+	if len(dbTrash) > int(page.Limit) {
+		dbTrash = dbTrash[:page.Limit]
+		last := dbTrash[len(dbTrash)-1]
+		trash.NextCursor = encodeCursor(last.DeletedAt.Format(time.RFC3339Nano), last.ID)
+	}
+	for _, t := range dbTrash {
+		trash.Items = append(trash.Items, TrashItem{Type: t.Type, ID: t.ID, Title: t.Title, DeletedAt: t.DeletedAt, PurgeAt: t.DeletedAt.Add(TrashRetention)})
+	}
+	respondWithJSON(w, 200, trash)
+}
+
+// RestoreFromTrash moves an event, todo or tag out of the trash and returns
+// it. Tags come back on the events they were on.
+func (cfg *ApiConfig) RestoreFromTrash(w http.ResponseWriter, req *http.Request) {
+	id, ok := pathUUID(w, req, "id")
+	if !ok {
+		return
+	}
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+
+	switch req.PathValue("type") {
+	case "event":
+		dbEvent, err := cfg.Queries.RestoreEvent(req.Context(), database.RestoreEventParams{ID: id, UserID: userID})
+		if err != nil {
+			respondWithQueryError(w, req, "Event", err)
+			return
+		}
+		cfg.audit(req, userID, "event_restored", dbEvent.ID, "")
+		setETag(w, dbEvent.UpdatedAt)
+		event := Event{ID: dbEvent.ID, UserID: dbEvent.UserID, CreatedAt: dbEvent.CreatedAt, UpdatedAt: dbEvent.UpdatedAt, StartDate: dbEvent.StartDate, EndDate: dbEvent.EndDate, Title: dbEvent.Title, Description: dbEvent.Description.String, Priority: dbEvent.Priority, RecurD: dbEvent.RecurD, RecurW: dbEvent.RecurW, RecurM: dbEvent.RecurM, RecurY: dbEvent.RecurY}
+		respondWithJSON(w, 200, event)
+	case "todo":
+		dbTodo, err := cfg.Queries.RestoreTodo(req.Context(), database.RestoreTodoParams{ID: id, UserID: userID})
+		if err != nil {
+			respondWithQueryError(w, req, "Todo", err)
+			return
+		}
+		cfg.audit(req, userID, "todo_restored", dbTodo.ID, "")
+		setETag(w, dbTodo.UpdatedAt)
+		toDo := ToDo{ID: dbTodo.ID, UserID: dbTodo.UserID, CreatedAt: dbTodo.CreatedAt, UpdatedAt: dbTodo.UpdatedAt, Date: dbTodo.Date.Time, Title: dbTodo.Title, Description: dbTodo.Description.String}
+		respondWithJSON(w, 200, toDo)
+	case "tag":
+		if !cfg.allowAnotherTag(w, req, userID) {
+			return
+		}
+		dbTag, err := cfg.Queries.RestoreTag(req.Context(), database.RestoreTagParams{ID: id, UserID: userID})
+		if err != nil {
+			respondWithQueryError(w, req, "Tag", err)
+			return
+		}
+		cfg.audit(req, userID, "tag_restored", dbTag.ID, "")
+		tag := Tag{ID: dbTag.ID, UserID: dbTag.UserID, Name: dbTag.Name, Color: dbTag.Color}
+		respondWithJSON(w, 200, tag)
+	default:
+		respondWithError(w, http.StatusNotFound, "Trash type must be event, todo or tag")
+	}
+}
@@ -0,0 +1,337 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/curtisbraxdale/taday/internal/auth"
+	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/middleware"
+	"github.com/google/uuid"
+)
+
+const (
+	totpIssuer             = "Taday"
+	recoveryCodeCount      = 10
+	maxLoginChallengeTries = 5
+)
+
+// checkSecondFactor accepts either a current TOTP code or an unused recovery
+// code for the user. Accepted codes are consumed so they cannot be replayed.
+func (cfg *ApiConfig) checkSecondFactor(ctx context.Context, dbUser database.User, code, recoveryCode string) (bool, error) {
+	if code != "" && dbUser.TotpSecret.Valid {
+		step, ok := auth.ValidateTOTP(dbUser.TotpSecret.String, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		rows, err := cfg.Queries.AdvanceTOTPStep(ctx, database.AdvanceTOTPStepParams{Step: step, ID: dbUser.ID})
+		if err != nil {
+			return false, err
+		}
+		return rows == 1, nil
+	}
+	if recoveryCode != "" {
+		codeHash := auth.HashToken(auth.NormalizeRecoveryCode(recoveryCode))
+		rows, err := cfg.Queries.UseRecoveryCode(ctx, database.UseRecoveryCodeParams{UserID: dbUser.ID, CodeHash: codeHash})
+		if err != nil {
+			return false, err
+		}
+		return rows == 1, nil
+	}
+	return false, nil
+}
+
+// replaceRecoveryCodes discards the user's existing recovery codes and returns
+// a fresh set. Only hashes are stored.
+func (cfg *ApiConfig) replaceRecoveryCodes(ctx context.Context, dbUser database.User) ([]string, error) {
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.Queries.DeleteRecoveryCodes(ctx, dbUser.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		err = cfg.Queries.CreateRecoveryCode(ctx, database.CreateRecoveryCodeParams{UserID: dbUser.ID, CodeHash: auth.HashToken(auth.NormalizeRecoveryCode(code))})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+func (cfg *ApiConfig) userFromAccessCookie(req *http.Request) (database.User, error) {
+	accessCookie, err := req.Cookie("access_token")
+	if err != nil {
+		return database.User{}, err
+	}
+	userID, err := cfg.Keyring.ValidateAccessToken(accessCookie.Value)
+	if err != nil {
+		return database.User{}, err
+	}
+	return cfg.Queries.GetUserByID(req.Context(), userID)
+}
+
+func (cfg *ApiConfig) EnrollTOTP(w http.ResponseWriter, req *http.Request) {
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+	dbUser, err := cfg.Queries.GetUserByID(req.Context(), userID)
+	if err != nil {
+		respondWithQueryError(w, req, "User", err)
+		return
+	}
+	if dbUser.TotpEnabledAt.Valid {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		respondWithInternalError(w, req, "Error generating TOTP secret", err)
+		return
+	}
+	err = cfg.Queries.SetTOTPSecret(req.Context(), database.SetTOTPSecretParams{ID: dbUser.ID, TotpSecret: sql.NullString{String: secret, Valid: true}})
+	if err != nil {
+		respondWithInternalError(w, req, "Error storing TOTP secret", err)
+		return
+	}
+	respondWithJSON(w, 200, map[string]string{"secret": secret, "otpauth_uri": auth.TOTPURI(secret, dbUser.Email, totpIssuer)})
+}
+
+func (cfg *ApiConfig) ConfirmTOTP(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+	}
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+	dbUser, err := cfg.Queries.GetUserByID(req.Context(), userID)
+	if err != nil {
+		respondWithQueryError(w, req, "User", err)
+		return
+	}
+
+	params := parameters{}
+	if !decodeJSON(w, req, &params) {
+		return
+	}
+	if dbUser.TotpEnabledAt.Valid {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+	if !dbUser.TotpSecret.Valid {
+		respondWithError(w, http.StatusBadRequest, "Two-factor enrollment has not been started")
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(dbUser.TotpSecret.String, params.Code, time.Now())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+	err = cfg.Queries.EnableTOTP(req.Context(), database.EnableTOTPParams{ID: dbUser.ID, TotpLastStep: step})
+	if err != nil {
+		respondWithInternalError(w, req, "Error enabling TOTP", err)
+		return
+	}
+	cfg.audit(req, dbUser.ID, "two_factor_enabled", uuid.Nil, "")
+	codes, err := cfg.replaceRecoveryCodes(req.Context(), dbUser)
+	if err != nil {
+		respondWithInternalError(w, req, "Error creating recovery codes", err)
+		return
+	}
+	respondWithJSON(w, 200, map[string][]string{"recovery_codes": codes})
+}
+
+func (cfg *ApiConfig) DisableTOTP(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+	dbUser, err := cfg.Queries.GetUserByID(req.Context(), userID)
+	if err != nil {
+		respondWithQueryError(w, req, "User", err)
+		return
+	}
+
+	params := parameters{}
+	if !decodeJSON(w, req, &params) {
+		return
+	}
+	if !dbUser.TotpEnabledAt.Valid {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is not enabled")
+		return
+	}
+
+	// Accounts created through a sign-in provider have no password to
+	// confirm, so the second factor alone has to do.
+	if dbUser.HashedPassword != noPassword {
+		err = auth.CheckPasswordHash(dbUser.HashedPassword, params.Password)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Incorrect password")
+			return
+		}
+	}
+	ok, err = cfg.checkSecondFactor(req.Context(), dbUser, params.Code, params.RecoveryCode)
+	if err != nil {
+		respondWithInternalError(w, req, "Error checking second factor", err)
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+
+	err = cfg.Queries.DisableTOTP(req.Context(), dbUser.ID)
+	if err != nil {
+		respondWithInternalError(w, req, "Error disabling TOTP", err)
+		return
+	}
+	err = cfg.Queries.DeleteRecoveryCodes(req.Context(), dbUser.ID)
+	if err != nil {
+		respondWithInternalError(w, req, "Error deleting recovery codes", err)
+		return
+	}
+	cfg.audit(req, dbUser.ID, "two_factor_disabled", uuid.Nil, "")
+	w.WriteHeader(204)
+}
+
+func (cfg *ApiConfig) RegenerateRecoveryCodes(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+	}
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+	dbUser, err := cfg.Queries.GetUserByID(req.Context(), userID)
+	if err != nil {
+		respondWithQueryError(w, req, "User", err)
+		return
+	}
+
+	params := parameters{}
+	if !decodeJSON(w, req, &params) {
+		return
+	}
+	if !dbUser.TotpEnabledAt.Valid {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is not enabled")
+		return
+	}
+
+	ok, err = cfg.checkSecondFactor(req.Context(), dbUser, params.Code, "")
+	if err != nil {
+		respondWithInternalError(w, req, "Error checking second factor", err)
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+	codes, err := cfg.replaceRecoveryCodes(req.Context(), dbUser)
+	if err != nil {
+		respondWithInternalError(w, req, "Error creating recovery codes", err)
+		return
+	}
+	cfg.audit(req, dbUser.ID, "recovery_codes_regenerated", uuid.Nil, "")
+	respondWithJSON(w, 200, map[string][]string{"recovery_codes": codes})
+}
+
+// LoginTwoFactor completes a login started by Login for users with two-factor
+// authentication enabled.
+func (cfg *ApiConfig) LoginTwoFactor(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Challenge    string `json:"challenge"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "https://taday.io")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	params := parameters{}
+	if !decodeJSON(w, req, &params) {
+		return
+	}
+
+	challengeHash := auth.HashToken(params.Challenge)
+	challenge, err := cfg.Queries.GetLoginChallenge(req.Context(), challengeHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired login challenge")
+		return
+	}
+	if err != nil {
+		respondWithInternalError(w, req, "Error getting login challenge", err)
+		return
+	}
+	if challenge.UsedAt.Valid || challenge.ExpiresAt.Before(time.Now()) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired login challenge")
+		return
+	}
+
+	attempts, err := cfg.Queries.IncrementLoginChallengeAttempts(req.Context(), challengeHash)
+	if err != nil {
+		respondWithInternalError(w, req, "Error updating login challenge", err)
+		return
+	}
+	if attempts > maxLoginChallengeTries {
+		// Burn the challenge so the user has to enter their password again.
+		_ = cfg.Queries.UseLoginChallenge(req.Context(), challengeHash)
+		respondWithError(w, http.StatusUnauthorized, "Too many attempts, log in again")
+		return
+	}
+
+	if !cfg.allowAccountAttempt(w, req, challenge.UserID.String()) {
+		return
+	}
+	dbUser, err := cfg.Queries.GetLoginUserByID(req.Context(), challenge.UserID)
+	if err != nil {
+		respondWithInternalError(w, req, "Error getting user from userID", err)
+		return
+	}
+	if dbUser.LockedUntil.Valid && dbUser.LockedUntil.Time.After(time.Now()) {
+		middleware.TooManyRequests(w, time.Until(dbUser.LockedUntil.Time))
+		return
+	}
+	ok, err := cfg.checkSecondFactor(req.Context(), dbUser, params.Code, params.RecoveryCode)
+	if err != nil {
+		respondWithInternalError(w, req, "Error checking second factor", err)
+		return
+	}
+	if !ok {
+		slog.InfoContext(req.Context(), "Incorrect two-factor code")
+		cfg.recordFailedLogin(req, dbUser.ID, "incorrect two-factor code")
+		respondWithError(w, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+	err = cfg.Queries.ResetFailedLogins(req.Context(), dbUser.ID)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error resetting failed logins", "error", err)
+	}
+
+	err = cfg.Queries.UseLoginChallenge(req.Context(), challengeHash)
+	if err != nil {
+		respondWithInternalError(w, req, "Error using login challenge", err)
+		return
+	}
+	err = cfg.startSession(w, req, dbUser)
+	if err != nil {
+		respondWithInternalError(w, req, "Error starting session", err)
+		return
+	}
+
+	user := User{ID: dbUser.ID, CreatedAt: dbUser.CreatedAt, UpdatedAt: dbUser.UpdatedAt, Email: dbUser.Email}
+	respondWithJSON(w, 200, user)
+}
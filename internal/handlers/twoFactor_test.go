@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/curtisbraxdale/taday/internal/auth"
+	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/dbtest"
+)
+
+// twoFactorUser creates a user with two-factor authentication enabled and
+// returns one of their recovery codes.
+func twoFactorUser(t *testing.T, cfg *ApiConfig, hashedPassword string) (database.User, string) {
+	t.Helper()
+	ctx := context.Background()
+	dbUser, err := cfg.Queries.CreateUser(ctx, database.CreateUserParams{Username: "alice", Email: "alice@example.com", HashedPassword: hashedPassword})
+	if err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.Queries.SetTOTPSecret(ctx, database.SetTOTPSecretParams{ID: dbUser.ID, TotpSecret: sql.NullString{String: secret, Valid: true}})
+	if err != nil {
+		t.Fatalf("setting secret: %v", err)
+	}
+	err = cfg.Queries.EnableTOTP(ctx, database.EnableTOTPParams{ID: dbUser.ID})
+	if err != nil {
+		t.Fatalf("enabling TOTP: %v", err)
+	}
+	codes, err := cfg.replaceRecoveryCodes(ctx, dbUser)
+	if err != nil {
+		t.Fatalf("creating recovery codes: %v", err)
+	}
+	return dbUser, codes[0]
+}
+
+func disableTOTP(cfg *ApiConfig, dbUser database.User, body string) int {
+	req := httptest.NewRequest(http.MethodPost, "/api/2fa/disable", strings.NewReader(body))
+	req = req.WithContext(auth.ContextWithUserID(req.Context(), dbUser.ID))
+	rec := httptest.NewRecorder()
+	cfg.DisableTOTP(rec, req)
+	return rec.Code
+}
+
+func TestDisableTOTPWithoutPassword(t *testing.T) {
+	db := dbtest.Open(t)
+	cfg := &ApiConfig{DB: db, Queries: database.New(db)}
+	dbUser, recoveryCode := twoFactorUser(t, cfg, noPassword)
+
+	if code := disableTOTP(cfg, dbUser, `{"recovery_code": "`+recoveryCode+`"}`); code != http.StatusNoContent {
+		t.Fatalf("got status %d, want 204", code)
+	}
+	dbUser, err := cfg.Queries.GetUserByID(context.Background(), dbUser.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dbUser.TotpEnabledAt.Valid {
+		t.Error("two-factor authentication still enabled")
+	}
+}
+
+func TestDisableTOTPRequiresPassword(t *testing.T) {
+	db := dbtest.Open(t)
+	cfg := &ApiConfig{DB: db, Queries: database.New(db)}
+	hashedPassword, err := auth.HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbUser, recoveryCode := twoFactorUser(t, cfg, hashedPassword)
+
+	if code := disableTOTP(cfg, dbUser, `{"recovery_code": "`+recoveryCode+`"}`); code != http.StatusUnauthorized {
+		t.Errorf("without password: got status %d, want 401", code)
+	}
+	if code := disableTOTP(cfg, dbUser, `{"password": "correct horse", "recovery_code": "`+recoveryCode+`"}`); code != http.StatusNoContent {
+		t.Errorf("with password: got status %d, want 204", code)
+	}
+}
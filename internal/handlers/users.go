@@ -2,48 +2,67 @@ package handlers
 
 import (
 	"context"
-	"encoding/json"
-	"log"
+	"database/sql"
+	"errors"
+	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/curtisbraxdale/taday/internal/auth"
 	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/validate"
 	"github.com/google/uuid"
 )
 
 type User struct {
-	ID          uuid.UUID `json:"id"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
-	Username    string    `json:"username"`
-	Email       string    `json:"email"`
-	PhoneNumber string    `json:"phone_number"`
+	ID            uuid.UUID `json:"id"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	Username      string    `json:"username"`
+	Email         string    `json:"email"`
+	PhoneNumber   string    `json:"phone_number"`
+	EmailVerified bool      `json:"email_verified"`
+	TwoFactor     bool      `json:"two_factor_enabled"`
+}
+
+const (
+	maxUsernameLength    = 50
+	maxEmailLength       = 254
+	maxPhoneNumberLength = 20
+	// bcrypt ignores everything after the first 72 bytes.
+	maxPasswordBytes = 72
+)
+
+func validateUser(v *validate.Validator, username, email, phoneNumber string) {
+	v.Required("username", username)
+	v.MaxLength("username", username, maxUsernameLength)
+	v.Required("email", email)
+	v.MaxLength("email", email, maxEmailLength)
+	v.Email("email", email)
+	v.MaxLength("phone_number", phoneNumber, maxPhoneNumberLength)
+}
+
+func validatePassword(v *validate.Validator, password string) {
+	v.Required("password", password)
+	v.MaxBytes("password", password, maxPasswordBytes)
 }
 
 func (cfg *ApiConfig) GetUser(w http.ResponseWriter, req *http.Request) {
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	userID, ok := requestUserID(w, req)
+	if !ok {
 		return
 	}
-	accessToken := accessCookie.Value
 
-	userID, err := auth.ValidateAccessToken(accessToken, cfg.Secret)
+	dbUser, err := cfg.Queries.GetUserByID(req.Context(), userID)
 	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+		respondWithQueryError(w, req, "User", err)
 		return
 	}
-
-	dbUser, err := cfg.Queries.GetUserByID(context.Background(), userID)
-	if err != nil {
-		log.Printf("Error getting user from userID: %s", err)
-		w.WriteHeader(500)
+	if notModified(w, req, dbUser.UpdatedAt) {
 		return
 	}
-	user := User{ID: dbUser.ID, CreatedAt: dbUser.CreatedAt, UpdatedAt: dbUser.UpdatedAt, Username: dbUser.Username, Email: dbUser.Email, PhoneNumber: dbUser.PhoneNumber}
+	user := User{ID: dbUser.ID, CreatedAt: dbUser.CreatedAt, UpdatedAt: dbUser.UpdatedAt, Username: dbUser.Username, Email: dbUser.Email, PhoneNumber: dbUser.PhoneNumber, EmailVerified: dbUser.VerifiedAt.Valid, TwoFactor: dbUser.TotpEnabledAt.Valid}
 	respondWithJSON(w, 200, user)
 }
 
@@ -57,30 +76,37 @@ func (cfg *ApiConfig) CreateUser(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "https://taday.io")
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 
-	decoder := json.NewDecoder(req.Body)
 	params := parameters{}
-	err := decoder.Decode(&params)
-	if err != nil {
-		log.Printf("Error decoding parameters: %s", err)
-		w.WriteHeader(500)
+	if !decodeJSON(w, req, &params) {
+		return
+	}
+	params.Username = strings.TrimSpace(params.Username)
+	params.Email = strings.TrimSpace(params.Email)
+	v := validate.New()
+	validateUser(v, params.Username, params.Email, params.PhoneNumber)
+	validatePassword(v, params.Password)
+	if respondWithValidationError(w, v.Err()) {
 		return
 	}
 
 	hashedPassword, err := auth.HashPassword(params.Password)
 	if err != nil {
-		log.Printf("Error hashing password: %s", err)
-		w.WriteHeader(500)
+		respondWithInternalError(w, req, "Error hashing password", err)
 		return
 	}
 
 	dbUserParams := database.CreateUserParams{Username: params.Username, Email: params.Email, HashedPassword: hashedPassword, PhoneNumber: params.PhoneNumber}
-	dbUser, err := cfg.Queries.CreateUser(context.Background(), dbUserParams)
+	dbUser, err := cfg.Queries.CreateUser(req.Context(), dbUserParams)
 	if err != nil {
-		log.Printf("Error creating user: %s", err)
-		w.WriteHeader(500)
+		respondWithQueryError(w, req, "User", err)
 		return
 	}
-	newUser := User{ID: dbUser.ID, CreatedAt: dbUser.CreatedAt, UpdatedAt: dbUser.UpdatedAt, Username: dbUser.Username, Email: dbUser.Email, PhoneNumber: dbUser.PhoneNumber}
+	cfg.audit(req, dbUser.ID, "account_created", uuid.Nil, "")
+	err = cfg.sendVerificationEmail(req.Context(), dbUser.ID, dbUser.Email)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error sending verification email", "error", err)
+	}
+	newUser := User{ID: dbUser.ID, CreatedAt: dbUser.CreatedAt, UpdatedAt: dbUser.UpdatedAt, Username: dbUser.Username, Email: dbUser.Email, PhoneNumber: dbUser.PhoneNumber, EmailVerified: dbUser.VerifiedAt.Valid, TwoFactor: dbUser.TotpEnabledAt.Valid}
 	respondWithJSON(w, 201, newUser)
 }
 
@@ -92,69 +118,174 @@ func (cfg *ApiConfig) UpdateUser(w http.ResponseWriter, req *http.Request) {
 		PhoneNumber string `json:"phone_number"`
 	}
 
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	userID, ok := requestUserID(w, req)
+	if !ok {
 		return
 	}
-	accessToken := accessCookie.Value
 
-	userID, err := auth.ValidateAccessToken(accessToken, cfg.Secret)
-	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	params := parameters{}
+	if !decodeJSON(w, req, &params) {
+		return
+	}
+	params.Username = strings.TrimSpace(params.Username)
+	params.Email = strings.TrimSpace(params.Email)
+	v := validate.New()
+	validateUser(v, params.Username, params.Email, params.PhoneNumber)
+	validatePassword(v, params.Password)
+	if respondWithValidationError(w, v.Err()) {
 		return
 	}
 
-	decoder := json.NewDecoder(req.Body)
-	params := parameters{}
-	err = decoder.Decode(&params)
+	current, err := cfg.Queries.GetUserByID(req.Context(), userID)
 	if err != nil {
-		log.Printf("Error decoding parameters: %s", err)
-		w.WriteHeader(500)
+		respondWithQueryError(w, req, "User", err)
+		return
+	}
+	ifUpdatedAt, ok := checkIfMatch(w, req, current.UpdatedAt)
+	if !ok {
 		return
 	}
 
-	hashedPassword, err := auth.HashPassword(params.Password)
+	// Sending the current password again leaves the stored hash alone, so it
+	// isn't recorded as a password change.
+	hashedPassword := current.HashedPassword
+	if auth.CheckPasswordHash(current.HashedPassword, params.Password) != nil {
+		hashedPassword, err = auth.HashPassword(params.Password)
+		if err != nil {
+			respondWithInternalError(w, req, "Error hashing password", err)
+			return
+		}
+	}
+
+	dbUserParams := database.UpdateUserParams{Username: params.Username, Email: params.Email, HashedPassword: hashedPassword, PhoneNumber: params.PhoneNumber, Userid: userID, IfUpdatedAt: ifUpdatedAt}
+	cfg.saveUser(w, req, current, dbUserParams, 201)
+}
+
+// PatchUser applies a JSON Merge Patch to the current user. The password is
+// only changed when one is sent.
+func (cfg *ApiConfig) PatchUser(w http.ResponseWriter, req *http.Request) {
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+	current, err := cfg.Queries.GetUserByID(req.Context(), userID)
 	if err != nil {
-		log.Printf("Error hashing password: %s", err)
-		w.WriteHeader(500)
+		respondWithQueryError(w, req, "User", err)
+		return
+	}
+	if _, ok := checkIfMatch(w, req, current.UpdatedAt); !ok {
+		return
+	}
+	patch, ok := decodeMergePatch(w, req)
+	if !ok {
+		return
+	}
+
+	// The update only applies to the version the patch was merged into.
+	dbUserParams := database.UpdateUserParams{Username: current.Username, Email: current.Email, HashedPassword: current.HashedPassword, PhoneNumber: current.PhoneNumber, Userid: userID, IfUpdatedAt: sql.NullTime{Time: current.UpdatedAt, Valid: true}}
+	password := ""
+	v := validate.New()
+	patch.apply(v, "username", &dbUserParams.Username, false)
+	patch.apply(v, "email", &dbUserParams.Email, false)
+	patch.apply(v, "phone_number", &dbUserParams.PhoneNumber, true)
+	patch.apply(v, "password", &password, false)
+	if respondWithValidationError(w, v.Err()) {
+		return
+	}
+	dbUserParams.Username = strings.TrimSpace(dbUserParams.Username)
+	dbUserParams.Email = strings.TrimSpace(dbUserParams.Email)
+	validateUser(v, dbUserParams.Username, dbUserParams.Email, dbUserParams.PhoneNumber)
+	if patch.has("password") {
+		validatePassword(v, password)
+	}
+	if respondWithValidationError(w, v.Err()) {
 		return
 	}
 
-	dbUserParams := database.UpdateUserParams{Username: params.Username, Email: params.Email, HashedPassword: hashedPassword, PhoneNumber: params.PhoneNumber, Userid: userID}
+	if patch.has("password") {
+		dbUserParams.HashedPassword, err = auth.HashPassword(password)
+		if err != nil {
+			respondWithInternalError(w, req, "Error hashing password", err)
+			return
+		}
+	}
+	cfg.saveUser(w, req, current, dbUserParams, 200)
+}
+
+// saveUser writes the update, records what changed in the audit log and, if
+// the email changed, sends a verification email for the new address.
+func (cfg *ApiConfig) saveUser(w http.ResponseWriter, req *http.Request, current database.User, dbUserParams database.UpdateUserParams, code int) {
 	dbUser, err := cfg.Queries.UpdateUser(req.Context(), dbUserParams)
 	if err != nil {
-		log.Printf("Error updating user: %s", err)
-		w.WriteHeader(500)
+		respondWithUpdateError(w, req, "User", dbUserParams.IfUpdatedAt, err)
 		return
 	}
-	updatedUser := User{ID: dbUser.ID, CreatedAt: dbUser.CreatedAt, UpdatedAt: dbUser.UpdatedAt, Username: dbUser.Username, Email: dbUser.Email, PhoneNumber: dbUser.PhoneNumber}
-	respondWithJSON(w, 201, updatedUser)
+	if dbUser.HashedPassword != current.HashedPassword {
+		cfg.audit(req, dbUser.ID, "password_changed", uuid.Nil, "")
+	}
+	changed := []string{}
+	if dbUser.Username != current.Username {
+		changed = append(changed, "username")
+	}
+	if dbUser.Email != current.Email {
+		changed = append(changed, "email")
+	}
+	if dbUser.PhoneNumber != current.PhoneNumber {
+		changed = append(changed, "phone_number")
+	}
+	if len(changed) > 0 {
+		cfg.audit(req, dbUser.ID, "account_updated", uuid.Nil, strings.Join(changed, ","))
+	}
+	if !strings.EqualFold(current.Email, dbUser.Email) {
+		err = cfg.sendVerificationEmail(req.Context(), dbUser.ID, dbUser.Email)
+		if err != nil {
+			slog.ErrorContext(req.Context(), "Error sending verification email", "error", err)
+		}
+	}
+	setETag(w, dbUser.UpdatedAt)
+	updatedUser := User{ID: dbUser.ID, CreatedAt: dbUser.CreatedAt, UpdatedAt: dbUser.UpdatedAt, Username: dbUser.Username, Email: dbUser.Email, PhoneNumber: dbUser.PhoneNumber, EmailVerified: dbUser.VerifiedAt.Valid, TwoFactor: dbUser.TotpEnabledAt.Valid}
+	respondWithJSON(w, code, updatedUser)
+}
+
+// AccountDeletionGrace is how long a deleted account is kept, and can be
+// restored by logging in, before the sender purges it.
+const AccountDeletionGrace = 30 * 24 * time.Hour
+
+// UserActive reports whether the account exists and isn't scheduled for
+// deletion.
+func (cfg *ApiConfig) UserActive(ctx context.Context, userID uuid.UUID) (bool, error) {
+	_, err := cfg.Queries.GetUserByID(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
 }
 
 func (cfg *ApiConfig) DeleteUser(w http.ResponseWriter, req *http.Request) {
-	accessCookie, err := req.Cookie("access_token")
-	if err != nil {
-		log.Printf("Access token not found in cookies: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	userID, ok := requestUserID(w, req)
+	if !ok {
 		return
 	}
-	accessToken := accessCookie.Value
 
-	userID, err := auth.ValidateAccessToken(accessToken, cfg.Secret)
-	if err != nil {
-		log.Printf("Access token invalid: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	// Billing stops before anything else, so a failure here leaves the account
+	// as it was.
+	if !cfg.cancelSubscriptionForDeletion(w, req, userID) {
 		return
 	}
 
-	err = cfg.Queries.DeleteUserByID(req.Context(), userID)
+	// The account is purged once the grace period is over. Logging in before
+	// then cancels the deletion; until then its sessions are ended.
+	err := cfg.Queries.DeleteUserByID(req.Context(), userID)
+	if err != nil {
+		respondWithInternalError(w, req, "Error deleting user", err)
+		return
+	}
+	err = cfg.Queries.RevokeAllUserTokens(req.Context(), userID)
 	if err != nil {
-		log.Printf("Error deleting user: %s", err)
-		w.WriteHeader(500)
+		respondWithInternalError(w, req, "Error revoking sessions", err)
 		return
 	}
-	w.WriteHeader(204)
+	cfg.audit(req, userID, "account_deletion_scheduled", uuid.Nil, "")
+	clearSessionCookies(w)
+	respondWithJSON(w, http.StatusAccepted, map[string]time.Time{"deletion_scheduled_for": time.Now().Add(AccountDeletionGrace)})
 }
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/curtisbraxdale/taday/internal/auth"
+	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/validate"
+	"github.com/google/uuid"
+)
+
+const verificationTokenTTL = 48 * time.Hour
+
+// sendVerificationEmail invalidates any outstanding verification links for the
+// user and mails a fresh one for the given address.
+func (cfg *ApiConfig) sendVerificationEmail(ctx context.Context, userID uuid.UUID, email string) error {
+	if cfg.Mailer == nil {
+		return errors.New("no mailer configured")
+	}
+	token, tokenHash, err := auth.MakeVerificationToken()
+	if err != nil {
+		return err
+	}
+	err = cfg.Queries.DeleteUnusedEmailVerificationTokens(ctx, userID)
+	if err != nil {
+		return err
+	}
+	_, err = cfg.Queries.CreateEmailVerificationToken(ctx, database.CreateEmailVerificationTokenParams{TokenHash: tokenHash, UserID: userID, Email: email, ExpiresAt: time.Now().Add(verificationTokenTTL)})
+	if err != nil {
+		return err
+	}
+	link := fmt.Sprintf("%s/verify-email?token=%s", frontendURL, token)
+	body := fmt.Sprintf("Welcome to Taday!\n\nConfirm your email address by opening the link below:\n\n%s\n\nThe link expires in 48 hours.", link)
+	return cfg.Mailer.Send(ctx, email, "Verify your Taday email address", body)
+}
+
+func (cfg *ApiConfig) VerifyEmail(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+	params := parameters{}
+	if !decodeJSON(w, req, &params) {
+		return
+	}
+	v := validate.New()
+	v.Required("token", params.Token)
+	if respondWithValidationError(w, v.Err()) {
+		return
+	}
+
+	dbToken, err := cfg.Queries.GetEmailVerificationToken(req.Context(), auth.HashToken(params.Token))
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired verification token")
+		return
+	}
+	if err != nil {
+		respondWithInternalError(w, req, "Error getting verification token", err)
+		return
+	}
+	if dbToken.UsedAt.Valid || dbToken.ExpiresAt.Before(time.Now()) {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired verification token")
+		return
+	}
+
+	err = cfg.Queries.UseEmailVerificationToken(req.Context(), dbToken.TokenHash)
+	if err != nil {
+		respondWithInternalError(w, req, "Error using verification token", err)
+		return
+	}
+	// The update is a no-op if the user has changed their email since the
+	// token was issued.
+	err = cfg.Queries.MarkUserVerified(req.Context(), database.MarkUserVerifiedParams{ID: dbToken.UserID, Email: dbToken.Email})
+	if err != nil {
+		respondWithInternalError(w, req, "Error marking user verified", err)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func (cfg *ApiConfig) ResendVerificationEmail(w http.ResponseWriter, req *http.Request) {
+	userID, ok := requestUserID(w, req)
+	if !ok {
+		return
+	}
+
+	dbUser, err := cfg.Queries.GetUserByID(req.Context(), userID)
+	if err != nil {
+		respondWithInternalError(w, req, "Error getting user from userID", err)
+		return
+	}
+	if dbUser.VerifiedAt.Valid {
+		respondWithError(w, http.StatusConflict, "Email is already verified")
+		return
+	}
+
+	err = cfg.sendVerificationEmail(req.Context(), dbUser.ID, dbUser.Email)
+	if err != nil {
+		respondWithInternalError(w, req, "Error sending verification email", err)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,117 @@
+// Package ical writes events and todos as an iCalendar (RFC 5545) file that
+// calendar apps can import.
+package ical
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+)
+
+type Event struct {
+	UID         string
+	Start       time.Time
+	End         time.Time
+	Summary     string
+	Description string
+	// RRule is a recurrence rule such as "FREQ=WEEKLY", or empty for a one-off
+	// event.
+	RRule    string
+	Created  time.Time
+	Modified time.Time
+}
+
+type Todo struct {
+	UID         string
+	Due         time.Time
+	Summary     string
+	Description string
+	Created     time.Time
+	Modified    time.Time
+}
+
+const timeFormat = "20060102T150405Z"
+
+// Write writes a calendar holding the events and todos to w.
+func Write(w io.Writer, prodID string, events []Event, todos []Todo) error {
+	cw := &writer{w: bufio.NewWriter(w)}
+	cw.line("BEGIN", "VCALENDAR")
+	cw.line("VERSION", "2.0")
+	cw.line("PRODID", prodID)
+	cw.line("CALSCALE", "GREGORIAN")
+	now := time.Now()
+	for _, e := range events {
+		cw.line("BEGIN", "VEVENT")
+		cw.line("UID", e.UID)
+		cw.line("DTSTAMP", now.UTC().Format(timeFormat))
+		cw.line("DTSTART", e.Start.UTC().Format(timeFormat))
+		cw.line("DTEND", e.End.UTC().Format(timeFormat))
+		cw.line("SUMMARY", escape(e.Summary))
+		if e.Description != "" {
+			cw.line("DESCRIPTION", escape(e.Description))
+		}
+		if e.RRule != "" {
+			cw.line("RRULE", e.RRule)
+		}
+		cw.line("CREATED", e.Created.UTC().Format(timeFormat))
+		cw.line("LAST-MODIFIED", e.Modified.UTC().Format(timeFormat))
+		cw.line("END", "VEVENT")
+	}
+	for _, t := range todos {
+		cw.line("BEGIN", "VTODO")
+		cw.line("UID", t.UID)
+		cw.line("DTSTAMP", now.UTC().Format(timeFormat))
+		if !t.Due.IsZero() {
+			cw.line("DUE", t.Due.UTC().Format(timeFormat))
+		}
+		cw.line("SUMMARY", escape(t.Summary))
+		if t.Description != "" {
+			cw.line("DESCRIPTION", escape(t.Description))
+		}
+		cw.line("CREATED", t.Created.UTC().Format(timeFormat))
+		cw.line("LAST-MODIFIED", t.Modified.UTC().Format(timeFormat))
+		cw.line("END", "VTODO")
+	}
+	cw.line("END", "VCALENDAR")
+	if cw.err != nil {
+		return cw.err
+	}
+	return cw.w.Flush()
+}
+
+// writer writes content lines, folding them at 75 octets and keeping the first
+// error.
+type writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (cw *writer) line(name, value string) {
+	if cw.err != nil {
+		return
+	}
+	line := name + ":" + value
+	// Continuation lines start with a space, which counts towards the limit.
+	limit := 75
+	for len(line) > limit {
+		// Never split a UTF-8 sequence across lines.
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		_, cw.err = cw.w.WriteString(line[:cut] + "\r\n ")
+		if cw.err != nil {
+			return
+		}
+		line = line[cut:]
+		limit = 74
+	}
+	_, cw.err = cw.w.WriteString(line + "\r\n")
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+func escape(text string) string {
+	return escaper.Replace(text)
+}
@@ -0,0 +1,91 @@
+// Package logging writes structured JSON logs. Lines written with a request's
+// context carry its request ID, route, user and trace, and secrets, tokens and phone
+// numbers are redacted before anything is written.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// New returns a logger writing JSON lines to w.
+func New(w io.Writer) *slog.Logger {
+	return slog.New(handler{slog.NewJSONHandler(w, &slog.HandlerOptions{ReplaceAttr: redactAttr})})
+}
+
+// handler adds the request attributes from the context to each record.
+type handler struct {
+	slog.Handler
+}
+
+func (h handler) Handle(ctx context.Context, r slog.Record) error {
+	if info, ok := ctx.Value(requestContextKey).(*requestInfo); ok {
+		r.AddAttrs(info.attrs()...)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return handler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h handler) WithGroup(name string) slog.Handler {
+	return handler{h.Handler.WithGroup(name)}
+}
+
+// requestInfo is shared by everything handling a request, so the user ID set
+// by the auth middleware also shows up on the access log line written by the
+// middleware around it.
+type requestInfo struct {
+	mu     sync.Mutex
+	id     string
+	route  string
+	userID uuid.UUID
+}
+
+func (i *requestInfo) attrs() []slog.Attr {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	attrs := []slog.Attr{slog.String("request_id", i.id)}
+	if i.route != "" {
+		attrs = append(attrs, slog.String("route", i.route))
+	}
+	if i.userID != uuid.Nil {
+		attrs = append(attrs, slog.String("user_id", i.userID.String()))
+	}
+	return attrs
+}
+
+type contextKey string
+
+const requestContextKey = contextKey("request")
+
+// NewContext starts the log context of a request.
+func NewContext(ctx context.Context, requestID, route string) context.Context {
+	return context.WithValue(ctx, requestContextKey, &requestInfo{id: requestID, route: route})
+}
+
+// SetUserID adds the authenticated user to the log context of a request.
+func SetUserID(ctx context.Context, userID uuid.UUID) {
+	if info, ok := ctx.Value(requestContextKey).(*requestInfo); ok {
+		info.mu.Lock()
+		info.userID = userID
+		info.mu.Unlock()
+	}
+}
+
+// RequestID returns the ID of the request the context belongs to.
+func RequestID(ctx context.Context) string {
+	if info, ok := ctx.Value(requestContextKey).(*requestInfo); ok {
+		return info.id
+	}
+	return ""
+}
@@ -0,0 +1,72 @@
+package logging
+
+import (
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are attribute keys whose values are never logged. A key
+// matches if it contains one of them.
+var sensitiveKeys = []string{"password", "secret", "token", "authorization", "cookie", "signature"}
+
+// recipientKeys are attribute keys whose values are phone numbers or other
+// addresses, in whatever format they were given. A key matches if it contains
+// "phone" or is one of the others.
+var recipientKeys = []string{"to", "recipient", "recipients"}
+
+var (
+	// jwtPattern matches access tokens and ID tokens.
+	jwtPattern = regexp.MustCompile(`eyJ[\w-]+\.[\w-]+\.[\w-]*`)
+	// keyPattern matches Stripe API keys and webhook secrets.
+	keyPattern = regexp.MustCompile(`\b(sk|rk|whsec)_\w+`)
+	// phonePattern matches phone numbers in E.164 format, as users store them.
+	phonePattern = regexp.MustCompile(`\+\d{7,15}`)
+)
+
+// Redact removes tokens, keys and phone numbers from s. Phone numbers keep
+// their last two digits so support can still tell them apart.
+func Redact(s string) string {
+	s = jwtPattern.ReplaceAllString(s, redacted)
+	s = keyPattern.ReplaceAllString(s, redacted)
+	return phonePattern.ReplaceAllStringFunc(s, func(phone string) string {
+		return "+" + strings.Repeat("*", len(phone)-3) + phone[len(phone)-2:]
+	})
+}
+
+// mask hides all but the last two characters of a recipient.
+func mask(s string) string {
+	if len(s) <= 2 {
+		return strings.Repeat("*", len(s))
+	}
+	return strings.Repeat("*", len(s)-2) + s[len(s)-2:]
+}
+
+func isRecipientKey(key string) bool {
+	return strings.Contains(key, "phone") || slices.Contains(recipientKeys, key)
+}
+
+// redactAttr is applied to every attribute, including the message.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return slog.String(a.Key, redacted)
+		}
+	}
+	if isRecipientKey(key) && a.Value.Kind() != slog.KindGroup {
+		return slog.String(a.Key, mask(a.Value.String()))
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, Redact(err.Error()))
+		}
+	}
+	return a
+}
@@ -0,0 +1,41 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedactsRecipientsByKey(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf)
+	logger.Info("Sent SMS message", "to", "(555) 010-4477", "phone_number", "555 010 4477", "recipient", "alice@example.com")
+
+	out := buf.String()
+	for _, leaked := range []string{"010-4477", "010 4477", "alice@example.com"} {
+		if strings.Contains(out, leaked) {
+			t.Errorf("log line contains %q: %s", leaked, out)
+		}
+	}
+	if !strings.Contains(out, `"to":"************77"`) {
+		t.Errorf("to not masked to its last two digits: %s", out)
+	}
+}
+
+func TestRedactsSecretsAndMessages(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf)
+	logger.Info("Texting +15550104477", "refresh_token", "abc", "error", errors.New("bad key sk_test_123"), slog.Int("count", 2))
+
+	out := buf.String()
+	for _, leaked := range []string{"+15550104477", "abc", "sk_test_123"} {
+		if strings.Contains(out, leaked) {
+			t.Errorf("log line contains %q: %s", leaked, out)
+		}
+	}
+	if !strings.Contains(out, `"count":2`) {
+		t.Errorf("count was changed: %s", out)
+	}
+}
@@ -0,0 +1,79 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+
+	"github.com/curtisbraxdale/taday/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type Mailer interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// SMTPMailer delivers plain-text mail through an SMTP relay using PLAIN auth.
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m SMTPMailer) Send(ctx context.Context, to, subject, body string) error {
+	msg := strings.Join([]string{
+		"From: " + m.From,
+		"To: " + to,
+		"Subject: " + subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")
+	addr := net.JoinHostPort(m.Host, m.Port)
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	_, span := tracing.StartClient(ctx, "smtp SendMail", attribute.String("server.address", m.Host))
+	err := smtp.SendMail(addr, auth, m.From, []string{to}, []byte(msg))
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("sending mail to %s: %w", to, err)
+	}
+	return nil
+}
+
+// LogMailer writes messages to the log instead of sending them. It is used
+// when no SMTP relay is configured, e.g. in local development.
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, to, subject, body string) error {
+	slog.InfoContext(ctx, "Mail", "to", to, "subject", subject, "body", body)
+	return nil
+}
+
+// FromEnv returns an SMTPMailer when SMTP_HOST is set and a LogMailer otherwise.
+func FromEnv() Mailer {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return LogMailer{}
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	return SMTPMailer{
+		Host:     host,
+		Port:     port,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+	}
+}
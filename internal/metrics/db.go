@@ -0,0 +1,52 @@
+// Package metrics times database queries for Prometheus.
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "taday_db_query_duration_seconds",
+	Help: "Time taken by database queries, by sqlc query name.",
+}, []string{"query"})
+
+// DB times the queries run through it, labelled with the sqlc query name. It
+// wraps the DBTX given to database.New, either the *sql.DB or a *sql.Tx.
+type DB struct {
+	database.DBTX
+}
+
+func (db DB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	defer prometheus.NewTimer(queryDuration.WithLabelValues(QueryName(query))).ObserveDuration()
+	return db.DBTX.ExecContext(ctx, query, args...)
+}
+
+func (db DB) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return db.DBTX.PrepareContext(ctx, query)
+}
+
+func (db DB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	defer prometheus.NewTimer(queryDuration.WithLabelValues(QueryName(query))).ObserveDuration()
+	return db.DBTX.QueryContext(ctx, query, args...)
+}
+
+func (db DB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	defer prometheus.NewTimer(queryDuration.WithLabelValues(QueryName(query))).ObserveDuration()
+	return db.DBTX.QueryRowContext(ctx, query, args...)
+}
+
+// QueryName reads the name sqlc puts at the start of every query.
+func QueryName(query string) string {
+	rest, ok := strings.CutPrefix(query, "-- name: ")
+	if !ok {
+		return "other"
+	}
+	name, _, _ := strings.Cut(rest, " ")
+	return name
+}
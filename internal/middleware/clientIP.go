@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// proxyTrust says which proxy headers ClientIP believes. Clients can send
+// any header they like, so none are trusted unless a proxy in front of the
+// app is known to set them.
+var proxyTrust struct {
+	fly  bool
+	hops int
+}
+
+// TrustProxyFromEnv reads TRUST_PROXY, which is "fly" behind Fly.io's proxy,
+// the number of proxies that append to X-Forwarded-For behind others, or
+// empty when clients connect directly. It has to be called before serving.
+func TrustProxyFromEnv() error {
+	switch value := os.Getenv("TRUST_PROXY"); value {
+	case "":
+	case "fly":
+		proxyTrust.fly = true
+	default:
+		hops, err := strconv.Atoi(value)
+		if err != nil || hops < 1 {
+			return fmt.Errorf("TRUST_PROXY must be fly or a number of proxies, got %q", value)
+		}
+		proxyTrust.hops = hops
+	}
+	return nil
+}
+
+// ClientIP returns the address of the client that made the request. Fly.io
+// terminates TLS in front of the app and reports the original address in
+// Fly-Client-IP, overwriting whatever the client sent. Other proxies append
+// the address they were connected from to X-Forwarded-For, so the client is
+// the entry added by the outermost trusted proxy; anything left of it came
+// from the client.
+func ClientIP(r *http.Request) string {
+	if proxyTrust.fly {
+		if ip := r.Header.Get("Fly-Client-IP"); ip != "" {
+			return ip
+		}
+	}
+	if proxyTrust.hops > 0 {
+		forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		if len(forwarded) >= proxyTrust.hops {
+			if ip := strings.TrimSpace(forwarded[len(forwarded)-proxyTrust.hops]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
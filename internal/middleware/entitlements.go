@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/curtisbraxdale/taday/internal/apierror"
+	"github.com/curtisbraxdale/taday/internal/auth"
+	"github.com/curtisbraxdale/taday/internal/entitlements"
+	"github.com/curtisbraxdale/taday/internal/tracing"
+	"github.com/google/uuid"
+)
+
+// LoadEntitlements looks up what the authenticated user's plan allows and
+// stores it in the request context for the handler to enforce. It has to run
+// after RequireAuth.
+func LoadEntitlements(resolve func(context.Context, uuid.UUID) (entitlements.Entitlements, error), next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if !ok {
+			apierror.Write(w, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Unauthorized"))
+			return
+		}
+		ctx, span := tracing.Start(r.Context(), "entitlements")
+		e, err := resolve(ctx, userID)
+		tracing.End(span, err)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error resolving entitlements", "error", err)
+			apierror.Write(w, apierror.New(http.StatusInternalServerError, apierror.CodeInternal, "Something went wrong"))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(entitlements.NewContext(r.Context(), e)))
+	})
+}
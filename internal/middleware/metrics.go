@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "taday_http_requests_total",
+		Help: "HTTP requests, by route pattern and status.",
+	}, []string{"route", "status"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "taday_http_request_duration_seconds",
+		Help: "Time taken to answer HTTP requests, by route pattern and status.",
+	}, []string{"route", "status"})
+)
+
+// Metrics counts and times requests by the route they match in mux. Requests
+// that match no route are grouped together so scanners can't add series.
+func Metrics(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		status := strconv.Itoa(rec.status)
+		httpRequests.WithLabelValues(route, status).Inc()
+		httpRequestDuration.WithLabelValues(route, status).Observe(time.Since(start).Seconds())
+	})
+}
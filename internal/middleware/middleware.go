@@ -1,26 +1,50 @@
 package middleware
 
 import (
+	"context"
+	"log/slog"
 	"net/http"
 
+	"github.com/curtisbraxdale/taday/internal/apierror"
 	"github.com/curtisbraxdale/taday/internal/auth"
+	"github.com/curtisbraxdale/taday/internal/logging"
+	"github.com/curtisbraxdale/taday/internal/tracing"
+	"github.com/google/uuid"
 )
 
-func RequireAuth(secret string, next http.Handler) http.Handler {
+// RequireAuth lets through requests with a valid access token for an account
+// that active reports as still in use. Deleting an account revokes its
+// refresh tokens, but its last access token stays valid until it expires.
+func RequireAuth(keyring *auth.Keyring, active func(context.Context, uuid.UUID) (bool, error), next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		spanCtx, span := tracing.Start(r.Context(), "auth")
 		cookie, err := r.Cookie("access_token")
 		if err != nil {
-			http.Error(w, "Unauthorized: No token", http.StatusUnauthorized)
+			tracing.End(span, err)
+			apierror.Write(w, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Unauthorized: No token"))
 			return
 		}
 
-		userID, err := auth.ValidateAccessToken(cookie.Value, secret)
+		userID, err := keyring.ValidateAccessToken(cookie.Value)
 		if err != nil {
-			http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
+			tracing.End(span, err)
+			apierror.Write(w, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Unauthorized: Invalid token"))
+			return
+		}
+		ok, err := active(spanCtx, userID)
+		tracing.End(span, err)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error checking account", "error", err)
+			apierror.Write(w, apierror.New(http.StatusInternalServerError, apierror.CodeInternal, "Something went wrong"))
+			return
+		}
+		if !ok {
+			apierror.Write(w, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Unauthorized: Account is scheduled for deletion"))
 			return
 		}
 
 		ctx := auth.ContextWithUserID(r.Context(), userID)
+		logging.SetUserID(ctx, userID)
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
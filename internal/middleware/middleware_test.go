@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/curtisbraxdale/taday/internal/auth"
+	"github.com/google/uuid"
+)
+
+func TestRequireAuthRejectsInactiveAccounts(t *testing.T) {
+	keyring := auth.NewKeyring("taday", "taday-api")
+	if err := keyring.AddHMAC("default", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.SetActive("default"); err != nil {
+		t.Fatal(err)
+	}
+	userID := uuid.New()
+	token, err := keyring.MakeAccessToken(userID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, _ := auth.UserIDFromContext(r.Context()); got != userID {
+			t.Errorf("got user %v, want %v", got, userID)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	for _, tt := range []struct {
+		name   string
+		active bool
+		err    error
+		want   int
+	}{
+		{"active", true, nil, http.StatusNoContent},
+		{"scheduled for deletion", false, nil, http.StatusUnauthorized},
+		{"lookup failed", false, errors.New("connection refused"), http.StatusInternalServerError},
+	} {
+		active := func(ctx context.Context, id uuid.UUID) (bool, error) {
+			return tt.active, tt.err
+		}
+		req := httptest.NewRequest(http.MethodGet, "/api/events", nil)
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: token})
+		rec := httptest.NewRecorder()
+		RequireAuth(keyring, active, next).ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/curtisbraxdale/taday/internal/apierror"
+	"github.com/curtisbraxdale/taday/internal/ratelimit"
+	"github.com/curtisbraxdale/taday/internal/tracing"
+)
+
+// RateLimit limits requests per client IP. If the store is unavailable the
+// request is let through rather than locking everyone out.
+func RateLimit(limiter *ratelimit.Limiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracing.Start(r.Context(), "rate limit")
+		allowed, retryAfter, err := limiter.Allow(ctx, ClientIP(r))
+		tracing.End(span, err)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error checking rate limit", "error", err)
+		} else if !allowed {
+			TooManyRequests(w, retryAfter)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TooManyRequests responds with 429 and a Retry-After header rounded up to
+// whole seconds.
+func TooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	apierror.Write(w, apierror.New(http.StatusTooManyRequests, apierror.CodeRateLimited, "Too many requests"))
+}
@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/curtisbraxdale/taday/internal/logging"
+	"github.com/google/uuid"
+)
+
+// validRequestID limits the request IDs taken from clients and proxies to
+// something safe to log and echo back.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// statusRecorder remembers the status code a handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// RequestLog gives every request an ID, taken from X-Request-ID if the client
+// or a proxy sent one, and returns it in the same header. Log lines written
+// with the request's context carry the ID, the route matched in mux and the
+// user, and one line is logged per request once it is done.
+func RequestLog(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := r.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(requestID) {
+			requestID = uuid.NewString()
+		}
+		_, route := mux.Handler(r)
+		ctx := logging.NewContext(r.Context(), requestID, route)
+		w.Header().Set("X-Request-ID", requestID)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		if rec.status >= 500 {
+			level = slog.LevelError
+		}
+		slog.Log(ctx, level, "Request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"latency_ms", time.Since(start).Milliseconds(),
+			"client_ip", ClientIP(r),
+		)
+	})
+}
@@ -0,0 +1,263 @@
+// Package oidc implements the parts of OpenID Connect needed to sign users in
+// with an external provider: discovery, the authorization code flow with PKCE
+// and ID token validation against the provider's published keys.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type Config struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Metadata is the subset of the discovery document we rely on.
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type Provider struct {
+	Config   Config
+	Metadata Metadata
+	client   *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]any
+	keysFetched time.Time
+}
+
+// Discover fetches the provider's discovery document and checks that it
+// belongs to the configured issuer.
+func Discover(ctx context.Context, cfg Config, client *http.Client) (*Provider, error) {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	wellKnown := strings.TrimSuffix(cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	var metadata Metadata
+	err := getJSON(ctx, client, wellKnown, &metadata)
+	if err != nil {
+		return nil, fmt.Errorf("discovering %s: %w", cfg.Name, err)
+	}
+	if metadata.Issuer != cfg.Issuer {
+		return nil, fmt.Errorf("discovering %s: issuer %q does not match configured %q", cfg.Name, metadata.Issuer, cfg.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, fmt.Errorf("discovering %s: incomplete discovery document", cfg.Name)
+	}
+	return &Provider{Config: cfg, Metadata: metadata, client: client}, nil
+}
+
+// AuthCodeURL returns the URL to send the user to. The code challenge is the
+// S256 transform of a verifier from NewPKCE.
+func (p *Provider) AuthCodeURL(state, nonce, codeChallenge string) string {
+	scopes := p.Config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.Config.ClientID)
+	params.Set("redirect_uri", p.Config.RedirectURL)
+	params.Set("scope", strings.Join(scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", codeChallenge)
+	params.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(p.Metadata.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.Metadata.AuthorizationEndpoint + sep + params.Encode()
+}
+
+type Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// Exchange trades an authorization code for tokens.
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier string) (*Token, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.Config.RedirectURL)
+	form.Set("client_id", p.Config.ClientID)
+	form.Set("code_verifier", codeVerifier)
+	if p.Config.ClientSecret != "" {
+		form.Set("client_secret", p.Config.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.Metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, body)
+	}
+	var token Token
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return nil, err
+	}
+	if token.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+	return &token, nil
+}
+
+type Claims struct {
+	jwt.RegisteredClaims
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     flexBool `json:"email_verified"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+}
+
+// VerifyIDToken checks the ID token's signature against the provider's keys
+// and validates issuer, audience, expiry and nonce.
+func (p *Provider) VerifyIDToken(ctx context.Context, rawIDToken, nonce string) (*Claims, error) {
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, kid)
+	}
+	token, err := jwt.ParseWithClaims(rawIDToken, &Claims{}, keyFunc,
+		jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}),
+		jwt.WithIssuer(p.Metadata.Issuer),
+		jwt.WithAudience(p.Config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(*Claims)
+	if !ok {
+		return nil, errors.New("unexpected claims type")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+// key returns the verification key with the given ID, refetching the JWKS
+// when an unknown key appears since providers rotate keys without notice.
+func (p *Provider) key(ctx context.Context, kid string) (any, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < time.Minute && p.keys != nil {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+	var set jwks
+	err := getJSON(ctx, p.client, p.Metadata.JWKSURI, &set)
+	if err != nil {
+		return nil, fmt.Errorf("fetching keys: %w", err)
+	}
+	p.keys = set.publicKeys()
+	p.keysFetched = time.Now()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	// Providers with a single key sometimes omit kid entirely.
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key ID %q", kid)
+}
+
+// NewPKCE returns a code verifier and its S256 challenge.
+func NewPKCE() (string, string, error) {
+	verifier, err := RandomString()
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// RandomString returns 32 random bytes encoded for use in URLs, suitable for
+// state, nonce and PKCE verifier values.
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// flexBool accepts both true and "true"; some providers send email_verified
+// as a string.
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "true":
+		*b = true
+	case "false", "null", "":
+		*b = false
+	default:
+		return fmt.Errorf("invalid boolean %s", data)
+	}
+	return nil
+}
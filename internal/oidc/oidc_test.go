@@ -0,0 +1,267 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockProvider is a minimal OpenID provider. It issues one authorization
+// code, bound to the PKCE challenge and nonce of the last authorization
+// request, and signs ID tokens with signingKey.
+type mockProvider struct {
+	t          *testing.T
+	server     *httptest.Server
+	key        *rsa.PrivateKey
+	signingKey *rsa.PrivateKey
+	challenge  string
+	nonce      string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockProvider{t: t, key: key, signingKey: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Metadata{
+			Issuer:                m.server.URL,
+			AuthorizationEndpoint: m.server.URL + "/authorize",
+			TokenEndpoint:         m.server.URL + "/token",
+			JWKSURI:               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jwks{Keys: []jwk{{
+			Kty: "RSA",
+			Kid: "key-1",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("POST /token", m.token)
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+// authorize stands in for the user approving the sign-in at the provider.
+func (m *mockProvider) authorize(authURL string) {
+	m.t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" {
+		m.t.Fatalf("got code_challenge_method %q, want S256", q.Get("code_challenge_method"))
+	}
+	m.challenge = q.Get("code_challenge")
+	m.nonce = q.Get("nonce")
+}
+
+func (m *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if r.PostFormValue("code") != "code-1" || base64.RawURLEncoding.EncodeToString(sum[:]) != m.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    m.server.URL,
+			Subject:   "user-1",
+			Audience:  jwt.ClaimStrings{r.PostFormValue("client_id")},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		Nonce:         m.nonce,
+		Email:         "alice@example.com",
+		EmailVerified: true,
+	})
+	idToken.Header["kid"] = "key-1"
+	signed, err := idToken.SignedString(m.signingKey)
+	if err != nil {
+		m.t.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(Token{AccessToken: "access-1", TokenType: "Bearer", IDToken: signed})
+}
+
+func (m *mockProvider) provider(t *testing.T) *Provider {
+	t.Helper()
+	registry := NewRegistry(Config{Name: "mock", Issuer: m.server.URL, ClientID: "taday", RedirectURL: "https://api.taday.io/api/auth/mock/callback"})
+	registry.Client = m.server.Client()
+	provider, err := registry.Get(context.Background(), "mock")
+	if err != nil {
+		t.Fatalf("discovery: %v", err)
+	}
+	return provider
+}
+
+// signIn runs the authorization code flow up to the token exchange.
+func (m *mockProvider) signIn(t *testing.T, provider *Provider, verifierOverride string) (*Token, string, error) {
+	t.Helper()
+	nonce, _ := RandomString()
+	verifier, challenge, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.authorize(provider.AuthCodeURL("state-1", nonce, challenge))
+	if verifierOverride != "" {
+		verifier = verifierOverride
+	}
+	token, err := provider.Exchange(context.Background(), "code-1", verifier)
+	return token, nonce, err
+}
+
+func TestSignIn(t *testing.T) {
+	m := newMockProvider(t)
+	provider := m.provider(t)
+	if provider.Metadata.TokenEndpoint != m.server.URL+"/token" {
+		t.Errorf("got token endpoint %q", provider.Metadata.TokenEndpoint)
+	}
+
+	token, nonce, err := m.signIn(t, provider, "")
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	claims, err := provider.VerifyIDToken(context.Background(), token.IDToken, nonce)
+	if err != nil {
+		t.Fatalf("verifying ID token: %v", err)
+	}
+	if claims.Subject != "user-1" || claims.Email != "alice@example.com" || !claims.EmailVerified {
+		t.Errorf("got claims %+v", claims)
+	}
+}
+
+func TestDiscoveryRejectsOtherIssuer(t *testing.T) {
+	m := newMockProvider(t)
+	_, err := Discover(context.Background(), Config{Name: "mock", Issuer: m.server.URL + "/other"}, m.server.Client())
+	if err == nil {
+		t.Error("discovery accepted a document for another issuer")
+	}
+}
+
+func TestExchangeRequiresPKCEVerifier(t *testing.T) {
+	m := newMockProvider(t)
+	provider := m.provider(t)
+	wrongVerifier, _ := RandomString()
+	if _, _, err := m.signIn(t, provider, wrongVerifier); err == nil {
+		t.Error("exchange succeeded with the wrong code verifier")
+	}
+}
+
+func TestVerifyIDTokenChecksNonce(t *testing.T) {
+	m := newMockProvider(t)
+	provider := m.provider(t)
+	token, _, err := m.signIn(t, provider, "")
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if _, err := provider.VerifyIDToken(context.Background(), token.IDToken, "another-nonce"); err == nil {
+		t.Error("ID token accepted with the wrong nonce")
+	}
+}
+
+func TestVerifyIDTokenChecksSignature(t *testing.T) {
+	m := newMockProvider(t)
+	provider := m.provider(t)
+	// A token signed with a key other than the published one.
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.signingKey = other
+	token, nonce, err := m.signIn(t, provider, "")
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if _, err := provider.VerifyIDToken(context.Background(), token.IDToken, nonce); err == nil {
+		t.Error("ID token accepted with an invalid signature")
+	}
+}
+
+func TestRegistryDiscoversOutsideLock(t *testing.T) {
+	m := newMockProvider(t)
+	release := make(chan struct{})
+	var requests atomic.Int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+
+	registry := NewRegistry(
+		Config{Name: "mock", Issuer: m.server.URL, ClientID: "taday"},
+		Config{Name: "slow", Issuer: slow.URL, ClientID: "taday"},
+	)
+	registry.Client = m.server.Client()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := registry.Get(context.Background(), "slow")
+		errs <- err
+	}()
+	for requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := registry.Get(ctx, "mock"); err != nil {
+		t.Fatalf("mock provider blocked behind a slow discovery: %v", err)
+	}
+
+	// A second caller joins the discovery in flight and can give up on it.
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer waitCancel()
+	if _, err := registry.Get(waitCtx, "slow"); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+
+	close(release)
+	if err := <-errs; err == nil {
+		t.Error("got slow provider despite a failed discovery")
+	}
+	for {
+		registry.mu.Lock()
+		n := len(registry.pending)
+		registry.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("got %d discovery requests for concurrent callers, want 1", n)
+	}
+	if _, ok := registry.providers["slow"]; ok {
+		t.Error("cached a failed discovery")
+	}
+}
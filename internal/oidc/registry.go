@@ -0,0 +1,119 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Registry holds the configured providers. Discovery happens on first use so
+// an unreachable provider does not stop the API from starting.
+type Registry struct {
+	// Client makes the requests to the providers. When nil a client with a
+	// timeout is used.
+	Client *http.Client
+
+	mu        sync.Mutex
+	configs   map[string]Config
+	providers map[string]*Provider
+	pending   map[string]*discovery
+}
+
+// discovery is a provider lookup in flight. done is closed once provider or
+// err is set.
+type discovery struct {
+	done     chan struct{}
+	provider *Provider
+	err      error
+}
+
+func NewRegistry(configs ...Config) *Registry {
+	r := &Registry{configs: map[string]Config{}, providers: map[string]*Provider{}, pending: map[string]*discovery{}}
+	for _, cfg := range configs {
+		r.configs[cfg.Name] = cfg
+	}
+	return r
+}
+
+// RegistryFromEnv reads OIDC_PROVIDERS, a comma separated list of provider
+// names, and for each name NAME the variables OIDC_NAME_ISSUER,
+// OIDC_NAME_CLIENT_ID, OIDC_NAME_CLIENT_SECRET, OIDC_NAME_REDIRECT_URL and
+// optionally OIDC_NAME_SCOPES (space separated).
+func RegistryFromEnv() (*Registry, error) {
+	configs := []Config{}
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		cfg := Config{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+			Scopes:       strings.Fields(os.Getenv(prefix + "SCOPES")),
+		}
+		if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+			return nil, fmt.Errorf("OIDC provider %q needs %sISSUER, %sCLIENT_ID and %sREDIRECT_URL", name, prefix, prefix, prefix)
+		}
+		configs = append(configs, cfg)
+	}
+	return NewRegistry(configs...), nil
+}
+
+// Get returns the named provider, discovering it on first use. Discovery runs
+// outside the lock so a slow provider only holds up sign-ins through that
+// provider; concurrent callers for the same provider share one discovery.
+// A failed discovery is not cached and is retried by the next call.
+func (r *Registry) Get(ctx context.Context, name string) (*Provider, error) {
+	r.mu.Lock()
+	if provider, ok := r.providers[name]; ok {
+		r.mu.Unlock()
+		return provider, nil
+	}
+	cfg, ok := r.configs[name]
+	if !ok {
+		r.mu.Unlock()
+		return nil, ErrUnknownProvider
+	}
+	d, ok := r.pending[name]
+	if !ok {
+		d = &discovery{done: make(chan struct{})}
+		r.pending[name] = d
+		// The discovery is shared, so one caller giving up must not fail
+		// the others. The client timeout still bounds it.
+		go r.discover(context.WithoutCancel(ctx), name, cfg, d)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-d.done:
+		return d.provider, d.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (r *Registry) discover(ctx context.Context, name string, cfg Config, d *discovery) {
+	provider, err := Discover(ctx, cfg, r.Client)
+	r.mu.Lock()
+	delete(r.pending, name)
+	if err == nil {
+		if existing, ok := r.providers[name]; ok {
+			provider = existing
+		} else {
+			r.providers[name] = provider
+		}
+	}
+	r.mu.Unlock()
+	d.provider, d.err = provider, err
+	close(d.done)
+}
+
+var ErrUnknownProvider = errors.New("unknown OIDC provider")
@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// MemoryStore keeps buckets in process memory. Limits are per instance, so it
+// is only suitable when the API runs on a single machine.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]*bucket{}}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updatedAt: now}
+		s.buckets[key] = b
+	}
+	tokens, allowed, wait := take(b.tokens, b.updatedAt, limit, now)
+	b.tokens = tokens
+	b.updatedAt = now
+	return allowed, wait, nil
+}
+
+// sweep drops buckets that have not been touched for an hour. Every limit we
+// use refills completely within that time, so a dropped bucket is
+// indistinguishable from a full one.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		if now.Sub(b.updatedAt) > time.Hour {
+			delete(s.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/tracing"
+)
+
+// PostgresStore keeps buckets in the rate_limit_buckets table so limits hold
+// across every API machine.
+type PostgresStore struct {
+	DB      *sql.DB
+	Queries *database.Queries
+}
+
+func NewPostgresStore(db *sql.DB, queries *database.Queries) *PostgresStore {
+	return &PostgresStore{DB: db, Queries: queries}
+}
+
+func (s *PostgresStore) Take(ctx context.Context, key string, limit Limit, now time.Time) (bool, time.Duration, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback()
+	qtx := tracing.WithTx(tx)
+
+	err = qtx.EnsureRateLimitBucket(ctx, database.EnsureRateLimitBucketParams{Key: key, Tokens: float64(limit.Burst), UpdatedAt: now})
+	if err != nil {
+		return false, 0, err
+	}
+	b, err := qtx.GetRateLimitBucketForUpdate(ctx, key)
+	if err != nil {
+		return false, 0, err
+	}
+	tokens, allowed, wait := take(b.Tokens, b.UpdatedAt, limit, now)
+	err = qtx.UpdateRateLimitBucket(ctx, database.UpdateRateLimitBucketParams{Key: key, Tokens: tokens, UpdatedAt: now})
+	if err != nil {
+		return false, 0, err
+	}
+	return allowed, wait, tx.Commit()
+}
+
+// Prune deletes buckets that have not been used since before.
+func (s *PostgresStore) Prune(ctx context.Context, before time.Time) error {
+	return s.Queries.DeleteStaleRateLimitBuckets(ctx, before)
+}
@@ -0,0 +1,56 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Limit describes a token bucket: it holds at most Burst tokens and refills at
+// Rate tokens per second.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Every returns a limit that allows burst requests at once and refills one
+// token every interval.
+func Every(interval time.Duration, burst int) Limit {
+	return Limit{Rate: 1 / interval.Seconds(), Burst: burst}
+}
+
+// Store keeps the state of the buckets. Take removes one token from the
+// bucket for key and reports whether one was available and, if not, how long
+// until the next one is.
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (bool, time.Duration, error)
+}
+
+type Limiter struct {
+	Store Store
+	Limit Limit
+	// Prefix namespaces the keys so several limiters can share one store.
+	Prefix string
+}
+
+func New(store Store, prefix string, limit Limit) *Limiter {
+	return &Limiter{Store: store, Limit: limit, Prefix: prefix}
+}
+
+func (l *Limiter) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	return l.Store.Take(ctx, l.Prefix+":"+key, l.Limit, time.Now())
+}
+
+// take applies one request to a bucket that held tokens at updatedAt and
+// returns the bucket's new token count.
+func take(tokens float64, updatedAt time.Time, limit Limit, now time.Time) (float64, bool, time.Duration) {
+	elapsed := now.Sub(updatedAt).Seconds()
+	if elapsed > 0 {
+		tokens = math.Min(float64(limit.Burst), tokens+elapsed*limit.Rate)
+	}
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+	wait := time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+	return tokens, false, wait
+}
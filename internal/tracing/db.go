@@ -0,0 +1,55 @@
+package tracing
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/curtisbraxdale/taday/internal/database"
+	"github.com/curtisbraxdale/taday/internal/metrics"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DB starts a span for every query run through it, named after the sqlc
+// query. It wraps the DBTX given to database.New.
+type DB struct {
+	database.DBTX
+}
+
+// WithTx returns queries that run in tx, timed and with a span each. It is
+// used in place of Queries.WithTx, whose queries go to the *sql.Tx directly.
+func WithTx(tx *sql.Tx) *database.Queries {
+	return database.New(DB{DBTX: metrics.DB{DBTX: tx}})
+}
+
+func (db DB) start(ctx context.Context, query string) (context.Context, trace.Span) {
+	name := metrics.QueryName(query)
+	return StartClient(ctx, "db "+name,
+		semconv.DBSystemNamePostgreSQL,
+		semconv.DBOperationName(name),
+		attribute.String("db.query.text", query),
+	)
+}
+
+func (db DB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, span := db.start(ctx, query)
+	res, err := db.DBTX.ExecContext(ctx, query, args...)
+	End(span, err)
+	return res, err
+}
+
+func (db DB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	ctx, span := db.start(ctx, query)
+	rows, err := db.DBTX.QueryContext(ctx, query, args...)
+	End(span, err)
+	return rows, err
+}
+
+// QueryRowContext ends its span before the row is scanned, so errors such as
+// sql.ErrNoRows are not recorded on it.
+func (db DB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	ctx, span := db.start(ctx, query)
+	defer span.End()
+	return db.DBTX.QueryRowContext(ctx, query, args...)
+}
@@ -0,0 +1,87 @@
+// Package tracing sets up OpenTelemetry tracing and holds the helpers the
+// rest of the code uses to start spans.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/curtisbraxdale/taday")
+
+// Setup installs the tracer provider for service. OTEL_TRACES_EXPORTER picks
+// the exporter: "otlp" sends spans over OTLP/HTTP to the collector set in
+// OTEL_EXPORTER_OTLP_ENDPOINT, "stdout" prints
+// them, and anything else leaves tracing off. The returned function flushes
+// the spans still buffered and has to be called before the process exits.
+func Setup(ctx context.Context, service string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch os.Getenv("OTEL_TRACES_EXPORTER") {
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return func(context.Context) error { return nil }, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating trace exporter: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(service))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Start starts a span as a child of the one in ctx.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartServer starts the span of a request served by this process.
+func StartServer(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+}
+
+// StartClient starts a span for a call to another service.
+func StartClient(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// End records err on the span, if there is one, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Handler runs next in a span named after the route, so the handler's time
+// shows up apart from the middleware in front of it.
+func Handler(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := Start(r.Context(), "handler "+route)
+		defer span.End()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
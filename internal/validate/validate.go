@@ -0,0 +1,104 @@
+// Package validate checks decoded request bodies and collects every problem
+// so clients can show all of them at once.
+package validate
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"time"
+	"unicode/utf8"
+
+	"github.com/curtisbraxdale/taday/internal/apierror"
+	"github.com/google/uuid"
+)
+
+var hexColor = regexp.MustCompile(`^#(?:[0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+type Validator struct {
+	errs []apierror.FieldError
+}
+
+func New() *Validator {
+	return &Validator{}
+}
+
+// Add records a failed check that is not covered by the helpers below.
+func (v *Validator) Add(field, code, message string) {
+	v.errs = append(v.errs, apierror.FieldError{Field: field, Code: code, Message: message})
+}
+
+// Required fails if value is empty.
+func (v *Validator) Required(field, value string) {
+	if value == "" {
+		v.Add(field, "required", fmt.Sprintf("%s is required", field))
+	}
+}
+
+// MaxLength fails if value is longer than max characters.
+func (v *Validator) MaxLength(field, value string, max int) {
+	if utf8.RuneCountInString(value) > max {
+		v.Add(field, "too_long", fmt.Sprintf("%s must be at most %d characters", field, max))
+	}
+}
+
+// MaxBytes fails if value is longer than max bytes.
+func (v *Validator) MaxBytes(field, value string, max int) {
+	if len(value) > max {
+		v.Add(field, "too_long", fmt.Sprintf("%s must be at most %d bytes", field, max))
+	}
+}
+
+// RequiredUUID fails if id is the nil UUID.
+func (v *Validator) RequiredUUID(field string, id uuid.UUID) {
+	if id == uuid.Nil {
+		v.Add(field, "required", fmt.Sprintf("%s is required", field))
+	}
+}
+
+// RequiredTime fails if t is the zero time.
+func (v *Validator) RequiredTime(field string, t time.Time) {
+	if t.IsZero() {
+		v.Add(field, "required", fmt.Sprintf("%s is required", field))
+	}
+}
+
+// After fails if t is not strictly after other. It is skipped when either time
+// is missing, since RequiredTime reports that.
+func (v *Validator) After(field string, t time.Time, otherField string, other time.Time) {
+	if t.IsZero() || other.IsZero() {
+		return
+	}
+	if !t.After(other) {
+		v.Add(field, "out_of_range", fmt.Sprintf("%s must be after %s", field, otherField))
+	}
+}
+
+// HexColor fails unless value is a CSS hex color such as #1e90ff or #fff.
+func (v *Validator) HexColor(field, value string) {
+	if !hexColor.MatchString(value) {
+		v.Add(field, "invalid_format", fmt.Sprintf("%s must be a hex color like #1e90ff", field))
+	}
+}
+
+// Email fails unless value is a bare email address.
+func (v *Validator) Email(field, value string) {
+	if value == "" {
+		return
+	}
+	addr, err := mail.ParseAddress(value)
+	if err != nil || addr.Address != value {
+		v.Add(field, "invalid_format", fmt.Sprintf("%s must be a valid email address", field))
+	}
+}
+
+// Err returns a 422 error listing every failed check, or nil if all passed.
+func (v *Validator) Err() *apierror.Error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	e := apierror.New(http.StatusUnprocessableEntity, apierror.CodeValidation, "Request body failed validation")
+	e.Details = v.errs
+	return e
+}
@@ -4,6 +4,7 @@ FROM events
 WHERE user_id = @user_id
   AND start_date < @date_plus_1_day
   AND end_date >= @date
+  AND deleted_at IS NULL
 ORDER BY start_date ASC;
 
 -- name: GetUserEventsWeek :many
@@ -12,7 +13,8 @@ FROM events
 WHERE user_id = @user_id
   AND start_date < @date_plus_7_days
   AND end_date >= @date
+  AND deleted_at IS NULL
 ORDER BY start_date ASC;
 
 -- name: GetAllUsers :many
-SELECT id, username, phone_number FROM users;
+SELECT id, username, phone_number FROM users WHERE deleted_at IS NULL;
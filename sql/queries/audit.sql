@@ -0,0 +1,24 @@
+-- name: CreateAuditEvent :exec
+INSERT INTO audit_events (id, user_id, actor, action, resource_id, details, ip_address, user_agent, created_at)
+VALUES (
+    gen_random_uuid(),
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    $6,
+    $7,
+    NOW()
+);
+
+-- name: GetAuditEventsByUserID :many
+SELECT * FROM audit_events WHERE user_id = $1 ORDER BY created_at;
+
+-- name: ListAuditEvents :many
+SELECT * FROM audit_events
+WHERE user_id = @user_id
+  AND (sqlc.narg(cursor_created_at)::timestamp IS NULL
+   OR (created_at, id) < (sqlc.narg(cursor_created_at), sqlc.narg(cursor_id)::uuid))
+ORDER BY created_at DESC, id DESC
+LIMIT @row_limit;
@@ -0,0 +1,12 @@
+-- name: ListChanges :many
+-- Only the latest change to each record is returned, in the order they were
+-- made.
+SELECT seq, resource, record_id, tag_id, deleted
+FROM (
+    SELECT DISTINCT ON (resource, record_id, tag_id) seq, resource, record_id, tag_id, deleted
+    FROM changes
+    WHERE user_id = @user_id AND seq > @since
+    ORDER BY resource, record_id, tag_id, seq DESC
+) AS latest
+ORDER BY seq
+LIMIT @row_limit;
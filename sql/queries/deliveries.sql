@@ -0,0 +1,17 @@
+-- name: CreateDelivery :exec
+INSERT INTO deliveries (id, user_id, channel, kind, recipient, body, status, provider_message_id, error, created_at)
+VALUES (
+    gen_random_uuid(),
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    $6,
+    $7,
+    $8,
+    NOW()
+);
+
+-- name: GetDeliveriesByUserID :many
+SELECT * FROM deliveries WHERE user_id = $1 ORDER BY created_at;
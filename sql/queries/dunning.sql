@@ -0,0 +1,38 @@
+-- name: OpenDunningCase :exec
+-- Further failures of the same subscription belong to the case already open.
+INSERT INTO dunning_cases (id, user_id, stripe_subscription_id, invoice_id, next_notice_at, created_at, updated_at)
+VALUES (
+    gen_random_uuid(),
+    $1,
+    $2,
+    $3,
+    NOW(),
+    NOW(),
+    NOW()
+)
+ON CONFLICT (stripe_subscription_id) WHERE resolved_at IS NULL DO NOTHING;
+
+-- name: ResolveDunningCase :execrows
+UPDATE dunning_cases
+SET
+    updated_at = NOW(),
+    resolved_at = NOW(),
+    resolution = $2,
+    next_notice_at = NULL
+WHERE stripe_subscription_id = $1 AND resolved_at IS NULL;
+
+-- name: GetOpenDunningCaseBySubscriptionID :one
+SELECT * FROM dunning_cases WHERE stripe_subscription_id = $1 AND resolved_at IS NULL;
+
+-- name: GetDueDunningCases :many
+SELECT * FROM dunning_cases
+WHERE resolved_at IS NULL AND next_notice_at <= @now::timestamp
+ORDER BY next_notice_at;
+
+-- name: RecordDunningNotice :exec
+UPDATE dunning_cases
+SET
+    updated_at = NOW(),
+    notices_sent = notices_sent + 1,
+    next_notice_at = $2
+WHERE id = $1;
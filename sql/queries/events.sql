@@ -30,17 +30,30 @@ SET
     recur_w = @recur_w,
     recur_m = @recur_m,
     recur_y = @recur_y
-WHERE id = @event_id
+WHERE id = @event_id AND user_id = @user_id AND deleted_at IS NULL
+    AND (sqlc.narg(if_updated_at)::timestamp IS NULL OR updated_at = sqlc.narg(if_updated_at))
 RETURNING *;
 
 -- name: DeleteEvents :exec
 DELETE FROM events;
 
--- name: DeleteEventByID :exec
-DELETE FROM events WHERE id = $1;
+-- name: DeleteEventByID :execrows
+UPDATE events SET deleted_at = NOW() WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL;
 
 -- name: GetEventByID :one
-SELECT * FROM events WHERE id = $1;
+SELECT * FROM events WHERE id = $1 AND deleted_at IS NULL;
+
+-- name: GetEventsByIDs :many
+SELECT * FROM events WHERE user_id = $1 AND id = ANY($2::uuid[]) AND deleted_at IS NULL;
 
 -- name: GetEventsByUserID :many
-SELECT * FROM events WHERE user_id = $1;
+SELECT * FROM events WHERE user_id = $1 AND deleted_at IS NULL;
+
+-- name: RestoreEvent :one
+UPDATE events
+SET updated_at = NOW(), deleted_at = NULL
+WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL
+RETURNING *;
+
+-- name: PurgeDeletedEvents :execrows
+DELETE FROM events WHERE deleted_at < @before::timestamp;
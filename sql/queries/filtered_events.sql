@@ -1,21 +1,47 @@
--- name: GetFilteredEvents :many
+-- name: ListEvents :many
 SELECT *
 FROM events
 WHERE events.user_id = @user_id
+  AND events.deleted_at IS NULL
   AND (
-      @start_date::timestamptz IS NULL OR
-      events.start_date >= @start_date
+      sqlc.narg(from_date)::timestamp IS NULL OR
+      events.start_date >= sqlc.narg(from_date)
   )
   AND (
-      @end_date::timestamptz IS NULL OR
-      events.start_date < @end_date
+      sqlc.narg(to_date)::timestamp IS NULL OR
+      events.start_date < sqlc.narg(to_date)
   )
   AND (
-      @tag::text IS NULL OR
-      EXISTS (
-          SELECT 1
-          FROM event_tags et
-          JOIN tags t ON t.id = et.tag_id
-          WHERE et.event_id = events.id AND t.name = @tag
+      sqlc.narg(priority)::boolean IS NULL OR
+      events.priority = sqlc.narg(priority)
+  )
+  AND (
+      cardinality(@tags::text[]) = 0 OR
+      (
+          @match_all_tags::boolean AND (
+              SELECT COUNT(DISTINCT t.name)
+              FROM event_tags et
+              JOIN tags t ON t.id = et.tag_id AND t.deleted_at IS NULL
+              WHERE et.event_id = events.id AND t.name = ANY(@tags::text[])
+          ) = cardinality(@tags::text[])
+      ) OR
+      (
+          NOT @match_all_tags::boolean AND EXISTS (
+              SELECT 1
+              FROM event_tags et
+              JOIN tags t ON t.id = et.tag_id AND t.deleted_at IS NULL
+              WHERE et.event_id = events.id AND t.name = ANY(@tags::text[])
+          )
       )
-  );
+  )
+  AND (
+      sqlc.narg(cursor_start_date)::timestamp IS NULL OR
+      (@descending::boolean AND (events.start_date, events.id) < (sqlc.narg(cursor_start_date), sqlc.narg(cursor_id)::uuid)) OR
+      (NOT @descending::boolean AND (events.start_date, events.id) > (sqlc.narg(cursor_start_date), sqlc.narg(cursor_id)::uuid))
+  )
+ORDER BY
+    CASE WHEN @descending::boolean THEN events.start_date END DESC,
+    CASE WHEN @descending::boolean THEN events.id END DESC,
+    events.start_date ASC,
+    events.id ASC
+LIMIT @row_limit;
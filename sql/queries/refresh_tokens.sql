@@ -1,12 +1,15 @@
 -- name: CreateRefreshToken :one
-INSERT INTO refresh_tokens (token, created_at, updated_at, expires_at, revoked_at, user_id)
+INSERT INTO refresh_tokens (token, created_at, updated_at, expires_at, revoked_at, user_id, family_id, user_agent, ip_address)
 VALUES (
     $1,
     NOW(),
     NOW(),
     $2,
     $3,
-    $4
+    $4,
+    $5,
+    $6,
+    $7
 )
 RETURNING *;
 
@@ -17,3 +20,37 @@ SELECT * FROM refresh_tokens WHERE token = $1;
 UPDATE refresh_tokens
 SET updated_at = NOW(), revoked_at = NOW()
 WHERE token = $1;
+
+-- name: RotateRefreshToken :execrows
+UPDATE refresh_tokens
+SET updated_at = NOW(), revoked_at = NOW(), replaced_by = @replaced_by
+WHERE token = @token AND revoked_at IS NULL;
+
+-- name: RevokeTokenFamily :exec
+UPDATE refresh_tokens
+SET updated_at = NOW(), revoked_at = NOW()
+WHERE family_id = $1 AND revoked_at IS NULL;
+
+-- name: RevokeUserSession :execrows
+UPDATE refresh_tokens
+SET updated_at = NOW(), revoked_at = NOW()
+WHERE family_id = @family_id AND user_id = @user_id AND revoked_at IS NULL;
+
+-- name: RevokeAllUserTokens :exec
+UPDATE refresh_tokens
+SET updated_at = NOW(), revoked_at = NOW()
+WHERE user_id = $1 AND revoked_at IS NULL;
+
+-- name: GetUserSessions :many
+SELECT
+    rt.family_id,
+    rt.user_agent,
+    rt.ip_address,
+    rt.expires_at,
+    rt.created_at AS last_used_at,
+    (SELECT MIN(f.created_at) FROM refresh_tokens f WHERE f.family_id = rt.family_id)::timestamp AS started_at
+FROM refresh_tokens rt
+WHERE rt.user_id = $1
+  AND rt.revoked_at IS NULL
+  AND rt.expires_at > NOW()
+ORDER BY rt.created_at DESC;
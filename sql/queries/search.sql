@@ -0,0 +1,47 @@
+-- name: Search :many
+-- The to_tsvector expressions must match the ones in 014_search.sql so the
+-- GIN indexes are used. Snippets mark matches with \x02 and \x03, which are
+-- first turned into spaces in the text so only Postgres can produce them.
+WITH query AS (
+    SELECT websearch_to_tsquery('english', @query::text) AS q
+)
+SELECT results.type, results.id, results.title, results.snippet, results.date, results.rank
+FROM (
+    SELECT
+        'event'::text AS type,
+        events.id,
+        events.title,
+        ts_headline('english', translate(events.title || ' ' || COALESCE(events.description, ''), E'\x02\x03', '  '), query.q, E'StartSel=\x02, StopSel=\x03, MaxWords=30, MinWords=10') AS snippet,
+        events.start_date::timestamp AS date,
+        ts_rank(to_tsvector('english', events.title || ' ' || COALESCE(events.description, '')), query.q) AS rank
+    FROM events, query
+    WHERE events.user_id = @user_id
+      AND events.deleted_at IS NULL
+      AND to_tsvector('english', events.title || ' ' || COALESCE(events.description, '')) @@ query.q
+    UNION ALL
+    SELECT
+        'todo'::text AS type,
+        todos.id,
+        todos.title,
+        ts_headline('english', translate(todos.title || ' ' || COALESCE(todos.description, ''), E'\x02\x03', '  '), query.q, E'StartSel=\x02, StopSel=\x03, MaxWords=30, MinWords=10') AS snippet,
+        todos.date,
+        ts_rank(to_tsvector('english', todos.title || ' ' || COALESCE(todos.description, '')), query.q) AS rank
+    FROM todos, query
+    WHERE todos.user_id = @user_id
+      AND todos.deleted_at IS NULL
+      AND to_tsvector('english', todos.title || ' ' || COALESCE(todos.description, '')) @@ query.q
+    UNION ALL
+    SELECT
+        'tag'::text AS type,
+        tags.id,
+        tags.name AS title,
+        ts_headline('english', translate(tags.name, E'\x02\x03', '  '), query.q, E'StartSel=\x02, StopSel=\x03') AS snippet,
+        NULL::timestamp AS date,
+        ts_rank(to_tsvector('english', tags.name), query.q) AS rank
+    FROM tags, query
+    WHERE tags.user_id = @user_id
+      AND tags.deleted_at IS NULL
+      AND to_tsvector('english', tags.name) @@ query.q
+) AS results
+ORDER BY results.rank DESC, results.date DESC NULLS LAST, results.id
+LIMIT @row_limit;
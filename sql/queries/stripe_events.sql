@@ -0,0 +1,7 @@
+-- name: RecordStripeEvent :execrows
+INSERT INTO stripe_events (id, type, processed_at)
+VALUES ($1, $2, NOW())
+ON CONFLICT (id) DO NOTHING;
+
+-- name: DeleteStripeEventsBefore :execrows
+DELETE FROM stripe_events WHERE processed_at < @before::timestamp;
@@ -1,45 +1,75 @@
--- name: CreateSubscription :one
-INSERT INTO subscriptions (id, user_id, stripe_customer_id, stripe_subscription_id, plan, status, current_period_start, current_period_end, cancel_at_period_end, canceled_at, trial_start, trial_end, created_at, updated_at)
+-- name: UpsertSubscription :one
+-- Stripe can deliver events out of order, so an existing row is only
+-- overwritten by an event at least as new as the one that last wrote it.
+INSERT INTO subscriptions (id, user_id, stripe_customer_id, stripe_subscription_id, plan, status, current_period_start, current_period_end, cancel_at_period_end, canceled_at, trial_start, trial_end, created_at, updated_at, last_event_at)
 VALUES (
     gen_random_uuid(),
-    $1,
-    $2,
-    $3,
-    $4,
-    $5,
-    $6,
-    $7,
-    $8,
-    $9,
-    $10,
-    $11,
-    $12,
-    $13
+    @user_id,
+    @stripe_customer_id,
+    @stripe_subscription_id,
+    @plan,
+    @status,
+    @current_period_start,
+    @current_period_end,
+    @cancel_at_period_end,
+    @canceled_at,
+    @trial_start,
+    @trial_end,
+    NOW(),
+    NOW(),
+    @event_at::timestamp
 )
+ON CONFLICT (stripe_subscription_id) DO UPDATE
+SET
+    updated_at = NOW(),
+    plan = EXCLUDED.plan,
+    status = EXCLUDED.status,
+    current_period_start = EXCLUDED.current_period_start,
+    current_period_end = EXCLUDED.current_period_end,
+    cancel_at_period_end = EXCLUDED.cancel_at_period_end,
+    canceled_at = EXCLUDED.canceled_at,
+    trial_start = EXCLUDED.trial_start,
+    trial_end = EXCLUDED.trial_end,
+    last_event_at = EXCLUDED.last_event_at
+WHERE subscriptions.last_event_at IS NULL OR subscriptions.last_event_at <= EXCLUDED.last_event_at
 RETURNING *;
 
--- name: UpdateSubscription :one
+-- name: TransitionSubscriptionStatus :one
+-- Moves a subscription to status if it is in one of from_statuses, so an
+-- invoice event can't override a state Stripe has since moved past.
 UPDATE subscriptions
 SET
     updated_at = NOW(),
     status = @status,
-    current_period_start = @current_period_start,
-    current_period_end = @current_period_end,
-    cancel_at_period_end = @cancel_at_period_end,
-    canceled_at = @canceled_at,
-    trial_start = @trial_start,
-    trial_end = @trial_end
-WHERE user_id = @user_id
+    last_event_at = @event_at::timestamp
+WHERE stripe_subscription_id = @stripe_subscription_id
+    AND status = ANY(@from_statuses::text[])
+    AND (last_event_at IS NULL OR last_event_at <= @event_at::timestamp)
 RETURNING *;
 
+-- name: CancelSubscriptionsByCustomerID :exec
+UPDATE subscriptions
+SET
+    updated_at = NOW(),
+    status = 'canceled',
+    canceled_at = COALESCE(canceled_at, NOW())
+WHERE stripe_customer_id = $1 AND status <> 'canceled';
+
 -- name: DeleteSubscriptions :exec
 DELETE FROM subscriptions;
 
+-- name: GetSubscriptionByStripeID :one
+SELECT * FROM subscriptions WHERE stripe_subscription_id = $1;
+
 -- name: GetSubscriptionByUserID :one
-SELECT * FROM subscriptions WHERE user_id = $1;
+SELECT * FROM subscriptions WHERE user_id = $1 ORDER BY created_at DESC LIMIT 1;
+
+-- name: GetSubscriptionsByUserID :many
+SELECT * FROM subscriptions WHERE user_id = $1 ORDER BY created_at;
 
 -- name: UserIDFromStripeID :one
 SELECT user_id FROM subscriptions WHERE stripe_customer_id = $1;
 
--- name: GetActiveSubscriptionByUserID :one
-SELECT * FROM subscriptions WHERE user_id = $1 AND status = "active";
+-- name: GetOpenSubscriptionByUserID :one
+-- Returns the user's latest subscription that Stripe may still charge for.
+SELECT * FROM subscriptions WHERE user_id = $1 AND status IN ('active', 'trialing', 'past_due', 'unpaid', 'incomplete') ORDER BY created_at DESC LIMIT 1;
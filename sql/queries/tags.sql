@@ -10,34 +10,70 @@ RETURNING *;
 
 -- name: CreateEventTag :one
 INSERT INTO event_tags (event_id, tag_id)
-VALUES (
-    $1,
-    $2
-)
+SELECT events.id, tags.id
+FROM events
+JOIN tags ON tags.user_id = events.user_id
+WHERE events.id = @event_id AND tags.id = @tag_id AND events.user_id = @user_id
+    AND events.deleted_at IS NULL AND tags.deleted_at IS NULL
 RETURNING *;
 
+-- name: CountTagsByUserID :one
+SELECT COUNT(*) FROM tags WHERE user_id = $1 AND deleted_at IS NULL;
+
+-- name: GetTagsByIDs :many
+SELECT * FROM tags WHERE user_id = $1 AND id = ANY($2::uuid[]) AND deleted_at IS NULL;
+
 -- name: GetTagsByUserID :many
-SELECT * FROM tags WHERE user_id = $1;
+SELECT * FROM tags WHERE user_id = $1 AND deleted_at IS NULL;
 
--- name: GetEventTagsByEventID :many
-SELECT * FROM event_tags WHERE event_id = $1;
+-- name: GetEventTagsByUserID :many
+SELECT event_tags.*
+FROM event_tags
+JOIN events ON events.id = event_tags.event_id
+JOIN tags ON tags.id = event_tags.tag_id
+WHERE events.user_id = $1 AND events.deleted_at IS NULL AND tags.deleted_at IS NULL;
 
 -- name: GetTagsByEventID :many
 SELECT tags.id, tags.name, tags.color
 FROM event_tags
+JOIN events ON events.id = event_tags.event_id
 JOIN tags ON tags.id = event_tags.tag_id
-WHERE event_tags.event_id = @event_id;
+WHERE event_tags.event_id = @event_id
+    AND events.user_id = @user_id AND events.deleted_at IS NULL
+    AND tags.user_id = @user_id AND tags.deleted_at IS NULL;
 
 -- name: UpdateTag :one
 UPDATE tags
 SET
     name = @name,
     color = @color
-WHERE id = @tag_id
+WHERE id = @tag_id AND user_id = @user_id AND deleted_at IS NULL
 RETURNING *;
 
--- name: DeleteTag :exec
-DELETE FROM tags WHERE id = $1;
+-- name: DeleteTag :execrows
+UPDATE tags SET deleted_at = NOW() WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL;
+
+-- name: DeleteEventTag :execrows
+DELETE FROM event_tags
+WHERE event_id = @event_id AND tag_id = @tag_id
+    AND event_id IN (SELECT id FROM events WHERE deleted_at IS NULL AND user_id = @user_id);
+
+-- name: ListTags :many
+SELECT * FROM tags
+WHERE user_id = @user_id
+  AND deleted_at IS NULL
+  AND (
+      sqlc.narg(cursor_name)::text IS NULL OR
+      (name, id) > (sqlc.narg(cursor_name), sqlc.narg(cursor_id)::uuid)
+  )
+ORDER BY name, id
+LIMIT @row_limit;
+
+-- name: RestoreTag :one
+UPDATE tags
+SET deleted_at = NULL
+WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL
+RETURNING *;
 
--- name: DeleteEventTag :exec
-DELETE FROM event_tags WHERE event_id = $1 AND tag_id = $2;
+-- name: PurgeDeletedTags :execrows
+DELETE FROM tags WHERE deleted_at < @before::timestamp;
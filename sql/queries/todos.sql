@@ -18,17 +18,54 @@ SET
     date = @date,
     title = @title,
     description = @description
-WHERE id = @todo_id
+WHERE id = @todo_id AND user_id = @user_id AND deleted_at IS NULL
+    AND (sqlc.narg(if_updated_at)::timestamp IS NULL OR updated_at = sqlc.narg(if_updated_at))
 RETURNING *;
 
 -- name: DeleteTodos :exec
 DELETE FROM todos;
 
--- name: DeleteTodoByID :exec
-DELETE FROM todos WHERE id = $1;
+-- name: DeleteTodoByID :execrows
+UPDATE todos SET deleted_at = NOW() WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL;
 
 -- name: GetTodoByID :one
-SELECT * FROM todos WHERE id = $1;
+SELECT * FROM todos WHERE id = $1 AND deleted_at IS NULL;
+
+-- name: GetTodosByIDs :many
+SELECT * FROM todos WHERE user_id = $1 AND id = ANY($2::uuid[]) AND deleted_at IS NULL;
 
 -- name: GetTodosByUserID :many
-SELECT * FROM todos WHERE user_id = $1;
+SELECT * FROM todos WHERE user_id = $1 AND deleted_at IS NULL;
+
+-- name: ListTodos :many
+SELECT * FROM todos
+WHERE user_id = @user_id
+  AND deleted_at IS NULL
+  AND (
+      sqlc.narg(from_date)::timestamp IS NULL OR
+      todos.date >= sqlc.narg(from_date)
+  )
+  AND (
+      sqlc.narg(to_date)::timestamp IS NULL OR
+      todos.date < sqlc.narg(to_date)
+  )
+  AND (
+      sqlc.narg(cursor_date)::timestamp IS NULL OR
+      (@descending::boolean AND (COALESCE(todos.date, '0001-01-01'), todos.id) < (sqlc.narg(cursor_date), sqlc.narg(cursor_id)::uuid)) OR
+      (NOT @descending::boolean AND (COALESCE(todos.date, '0001-01-01'), todos.id) > (sqlc.narg(cursor_date), sqlc.narg(cursor_id)::uuid))
+  )
+ORDER BY
+    CASE WHEN @descending::boolean THEN COALESCE(todos.date, '0001-01-01') END DESC,
+    CASE WHEN @descending::boolean THEN todos.id END DESC,
+    COALESCE(todos.date, '0001-01-01') ASC,
+    todos.id ASC
+LIMIT @row_limit;
+
+-- name: RestoreTodo :one
+UPDATE todos
+SET updated_at = NOW(), deleted_at = NULL
+WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL
+RETURNING *;
+
+-- name: PurgeDeletedTodos :execrows
+DELETE FROM todos WHERE deleted_at < @before::timestamp;
@@ -0,0 +1,19 @@
+-- name: ListTrash :many
+SELECT trash.type, trash.id, trash.title, trash.deleted_at
+FROM (
+    SELECT 'event'::text AS type, id, title, deleted_at::timestamp AS deleted_at
+    FROM events
+    WHERE user_id = @user_id AND deleted_at IS NOT NULL
+    UNION ALL
+    SELECT 'todo'::text AS type, id, title, deleted_at::timestamp AS deleted_at
+    FROM todos
+    WHERE user_id = @user_id AND deleted_at IS NOT NULL
+    UNION ALL
+    SELECT 'tag'::text AS type, id, name AS title, deleted_at::timestamp AS deleted_at
+    FROM tags
+    WHERE user_id = @user_id AND deleted_at IS NOT NULL
+) AS trash
+WHERE sqlc.narg(cursor_deleted_at)::timestamp IS NULL
+   OR (trash.deleted_at, trash.id) < (sqlc.narg(cursor_deleted_at), sqlc.narg(cursor_id)::uuid)
+ORDER BY trash.deleted_at DESC, trash.id DESC
+LIMIT @row_limit;
@@ -0,0 +1,60 @@
+-- name: SetTOTPSecret :exec
+UPDATE users
+SET updated_at = NOW(), totp_secret = $2, totp_enabled_at = NULL, totp_last_step = 0
+WHERE id = $1;
+
+-- name: EnableTOTP :exec
+UPDATE users
+SET updated_at = NOW(), totp_enabled_at = NOW(), totp_last_step = $2
+WHERE id = $1;
+
+-- name: DisableTOTP :exec
+UPDATE users
+SET updated_at = NOW(), totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0
+WHERE id = $1;
+
+-- name: AdvanceTOTPStep :execrows
+UPDATE users
+SET totp_last_step = @step
+WHERE id = @id AND totp_last_step < @step;
+
+-- name: CreateRecoveryCode :exec
+INSERT INTO recovery_codes (id, user_id, code_hash, created_at)
+VALUES (
+    gen_random_uuid(),
+    $1,
+    $2,
+    NOW()
+);
+
+-- name: DeleteRecoveryCodes :exec
+DELETE FROM recovery_codes WHERE user_id = $1;
+
+-- name: UseRecoveryCode :execrows
+UPDATE recovery_codes
+SET used_at = NOW()
+WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL;
+
+-- name: CreateLoginChallenge :one
+INSERT INTO login_challenges (token_hash, user_id, created_at, expires_at)
+VALUES (
+    $1,
+    $2,
+    NOW(),
+    $3
+)
+RETURNING *;
+
+-- name: GetLoginChallenge :one
+SELECT * FROM login_challenges WHERE token_hash = $1;
+
+-- name: IncrementLoginChallengeAttempts :one
+UPDATE login_challenges
+SET attempts = attempts + 1
+WHERE token_hash = $1
+RETURNING attempts;
+
+-- name: UseLoginChallenge :exec
+UPDATE login_challenges
+SET used_at = NOW()
+WHERE token_hash = $1;
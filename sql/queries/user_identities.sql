@@ -0,0 +1,46 @@
+-- name: CreateUserIdentity :one
+INSERT INTO user_identities (id, user_id, provider, subject, email, created_at, last_login_at)
+VALUES (
+    gen_random_uuid(),
+    $1,
+    $2,
+    $3,
+    $4,
+    NOW(),
+    NOW()
+)
+RETURNING *;
+
+-- name: GetUserIdentity :one
+SELECT * FROM user_identities WHERE provider = $1 AND subject = $2;
+
+-- name: GetUserIdentitiesByUserID :many
+SELECT * FROM user_identities WHERE user_id = $1 ORDER BY created_at;
+
+-- name: TouchUserIdentity :exec
+UPDATE user_identities
+SET last_login_at = NOW(), email = $2
+WHERE id = $1;
+
+-- name: DeleteUserIdentity :execrows
+DELETE FROM user_identities WHERE id = @id AND user_id = @user_id;
+
+-- name: CreateOIDCLoginState :exec
+INSERT INTO oidc_login_states (state, provider, nonce, code_verifier, link_user_id, created_at, expires_at)
+VALUES (
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    NOW(),
+    $6
+);
+
+-- name: ConsumeOIDCLoginState :one
+DELETE FROM oidc_login_states
+WHERE state = $1
+RETURNING *;
+
+-- name: DeleteExpiredOIDCLoginStates :exec
+DELETE FROM oidc_login_states WHERE expires_at < NOW();
@@ -18,23 +18,27 @@ SET
     username = @username,
     email = @email,
     hashed_password = @hashed_password,
-    phone_number = @phone_number
-WHERE id = @userID
+    phone_number = @phone_number,
+    verified_at = CASE WHEN LOWER(email) = LOWER(@email) THEN verified_at ELSE NULL END
+WHERE id = @userID AND deleted_at IS NULL
+    AND (sqlc.narg(if_updated_at)::timestamp IS NULL OR updated_at = sqlc.narg(if_updated_at))
 RETURNING *;
 
 -- name: DeleteUsers :exec
 DELETE FROM users;
 
 -- name: DeleteUserByID :exec
-DELETE FROM users WHERE id = $1;
+UPDATE users SET deleted_at = NOW() WHERE id = $1;
 
 -- name: GetUserByEmail :one
-SELECT * FROM users WHERE email = $1;
+SELECT * FROM users WHERE LOWER(email) = LOWER($1) AND deleted_at IS NULL;
 
 -- name: GetUserByID :one
-SELECT * FROM users WHERE id = $1;
+SELECT * FROM users WHERE id = $1 AND deleted_at IS NULL;
 
 -- name: GetUserByStripeID :one
+-- Accounts pending deletion are included, since their subscription keeps
+-- sending events until it ends.
 SELECT * FROM users WHERE stripe_customer_id = $1;
 
 -- name: UpdateStripeCustomerID :exec
@@ -43,7 +47,47 @@ SET stripe_customer_id = $2
 WHERE id = $1;
 
 -- name: GetStripeID :one
-SELECT stripe_customer_id FROM users WHERE id = $1;
+SELECT stripe_customer_id FROM users WHERE id = $1 AND deleted_at IS NULL;
 
 -- name: GetEmail :one
-SELECT email FROM users WHERE id = $1;
+SELECT email FROM users WHERE id = $1 AND deleted_at IS NULL;
+
+-- name: MarkUserVerified :exec
+UPDATE users
+SET updated_at = NOW(), verified_at = NOW()
+WHERE id = @id AND LOWER(email) = LOWER(@email) AND deleted_at IS NULL;
+
+-- name: RecordFailedLogin :one
+UPDATE users
+SET
+    failed_login_attempts = failed_login_attempts + 1,
+    locked_until = CASE
+        WHEN failed_login_attempts + 1 >= @lockout_threshold::int
+        THEN NOW() + MAKE_INTERVAL(mins => LEAST(POWER(2, failed_login_attempts + 1 - @lockout_threshold::int), 60)::int)
+        ELSE locked_until
+    END
+WHERE id = @id
+RETURNING failed_login_attempts, locked_until;
+
+-- name: ResetFailedLogins :exec
+UPDATE users
+SET failed_login_attempts = 0, locked_until = NULL
+WHERE id = $1;
+
+-- name: PurgeDeletedUsers :execrows
+DELETE FROM users WHERE deleted_at < @before::timestamp;
+
+-- name: GetLoginUserByEmail :one
+-- Unlike GetUserByEmail and GetUserByID this also finds accounts that are
+-- scheduled for deletion, so logging in can cancel it.
+SELECT * FROM users WHERE LOWER(email) = LOWER($1);
+
+-- name: GetLoginUserByID :one
+-- Unlike GetUserByEmail and GetUserByID this also finds accounts that are
+-- scheduled for deletion, so logging in can cancel it.
+SELECT * FROM users WHERE id = $1;
+
+-- name: CancelUserDeletion :exec
+UPDATE users
+SET updated_at = NOW(), deleted_at = NULL
+WHERE id = $1 AND deleted_at IS NOT NULL;
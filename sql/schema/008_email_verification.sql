@@ -0,0 +1,71 @@
+-- +goose Up
+ALTER TABLE users ADD COLUMN verified_at TIMESTAMP;
+
+-- Accounts created before emails and usernames were unique can clash once
+-- case is ignored. The oldest account keeps the value and the others get a
+-- placeholder, so the indexes below can be built. The original values are
+-- kept here for support to sort out with the owners.
+CREATE TABLE renamed_user_identifiers (
+    user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    field TEXT NOT NULL,
+    original_value TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+INSERT INTO renamed_user_identifiers (user_id, field, original_value, created_at)
+SELECT id, 'email', email, NOW()
+FROM (
+    SELECT id, email, ROW_NUMBER() OVER (PARTITION BY LOWER(email) ORDER BY created_at, id) AS position
+    FROM users
+) ranked
+WHERE position > 1;
+
+UPDATE users
+SET email = 'duplicate-' || id || '@taday.invalid', updated_at = NOW()
+WHERE id IN (SELECT user_id FROM renamed_user_identifiers WHERE field = 'email');
+
+INSERT INTO renamed_user_identifiers (user_id, field, original_value, created_at)
+SELECT id, 'username', username, NOW()
+FROM (
+    SELECT id, username, ROW_NUMBER() OVER (PARTITION BY LOWER(username) ORDER BY created_at, id) AS position
+    FROM users
+) ranked
+WHERE position > 1;
+
+UPDATE users
+SET username = username || '-' || id, updated_at = NOW()
+WHERE id IN (SELECT user_id FROM renamed_user_identifiers WHERE field = 'username');
+
+CREATE UNIQUE INDEX users_email_lower_idx ON users (LOWER(email));
+
+CREATE UNIQUE INDEX users_username_lower_idx ON users (LOWER(username));
+
+CREATE TABLE email_verification_tokens (
+    token_hash TEXT PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+-- +goose Down
+DROP TABLE email_verification_tokens;
+
+DROP INDEX users_username_lower_idx;
+
+DROP INDEX users_email_lower_idx;
+
+UPDATE users
+SET email = renamed.original_value
+FROM renamed_user_identifiers renamed
+WHERE renamed.user_id = users.id AND renamed.field = 'email';
+
+UPDATE users
+SET username = renamed.original_value
+FROM renamed_user_identifiers renamed
+WHERE renamed.user_id = users.id AND renamed.field = 'username';
+
+DROP TABLE renamed_user_identifiers;
+
+ALTER TABLE users DROP COLUMN verified_at;
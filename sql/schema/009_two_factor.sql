@@ -0,0 +1,36 @@
+-- +goose Up
+ALTER TABLE users ADD COLUMN totp_secret TEXT;
+
+ALTER TABLE users ADD COLUMN totp_enabled_at TIMESTAMP;
+
+ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE recovery_codes (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX recovery_codes_user_id_idx ON recovery_codes (user_id);
+
+CREATE TABLE login_challenges (
+    token_hash TEXT PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    used_at TIMESTAMP
+);
+
+-- +goose Down
+DROP TABLE login_challenges;
+
+DROP TABLE recovery_codes;
+
+ALTER TABLE users DROP COLUMN totp_last_step;
+
+ALTER TABLE users DROP COLUMN totp_enabled_at;
+
+ALTER TABLE users DROP COLUMN totp_secret;
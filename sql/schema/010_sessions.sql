@@ -0,0 +1,27 @@
+-- +goose Up
+ALTER TABLE refresh_tokens ADD COLUMN family_id UUID NOT NULL DEFAULT gen_random_uuid();
+
+ALTER TABLE refresh_tokens ALTER COLUMN family_id DROP DEFAULT;
+
+ALTER TABLE refresh_tokens ADD COLUMN replaced_by TEXT;
+
+ALTER TABLE refresh_tokens ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE refresh_tokens ADD COLUMN ip_address TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+
+CREATE INDEX refresh_tokens_user_id_idx ON refresh_tokens (user_id);
+
+-- +goose Down
+DROP INDEX refresh_tokens_user_id_idx;
+
+DROP INDEX refresh_tokens_family_id_idx;
+
+ALTER TABLE refresh_tokens DROP COLUMN ip_address;
+
+ALTER TABLE refresh_tokens DROP COLUMN user_agent;
+
+ALTER TABLE refresh_tokens DROP COLUMN replaced_by;
+
+ALTER TABLE refresh_tokens DROP COLUMN family_id;
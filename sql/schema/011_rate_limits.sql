@@ -0,0 +1,17 @@
+-- +goose Up
+CREATE TABLE rate_limit_buckets (
+    key TEXT PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+ALTER TABLE users ADD COLUMN failed_login_attempts INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE users ADD COLUMN locked_until TIMESTAMP;
+
+-- +goose Down
+ALTER TABLE users DROP COLUMN locked_until;
+
+ALTER TABLE users DROP COLUMN failed_login_attempts;
+
+DROP TABLE rate_limit_buckets;
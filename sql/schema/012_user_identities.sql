@@ -0,0 +1,28 @@
+-- +goose Up
+CREATE TABLE user_identities (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    provider TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    email TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    last_login_at TIMESTAMP,
+    UNIQUE (provider, subject)
+);
+
+CREATE INDEX user_identities_user_id_idx ON user_identities (user_id);
+
+CREATE TABLE oidc_login_states (
+    state TEXT PRIMARY KEY,
+    provider TEXT NOT NULL,
+    nonce TEXT NOT NULL,
+    code_verifier TEXT NOT NULL,
+    link_user_id UUID REFERENCES users (id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+-- +goose Down
+DROP TABLE oidc_login_states;
+
+DROP TABLE user_identities;
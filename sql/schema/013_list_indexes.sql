@@ -0,0 +1,17 @@
+-- +goose Up
+CREATE INDEX events_user_id_start_date_idx ON events (user_id, start_date, id);
+
+CREATE INDEX todos_user_id_date_idx ON todos (user_id, COALESCE(date, '0001-01-01'::timestamp), id);
+
+CREATE INDEX tags_user_id_name_idx ON tags (user_id, name, id);
+
+CREATE INDEX event_tags_tag_id_idx ON event_tags (tag_id);
+
+-- +goose Down
+DROP INDEX event_tags_tag_id_idx;
+
+DROP INDEX tags_user_id_name_idx;
+
+DROP INDEX todos_user_id_date_idx;
+
+DROP INDEX events_user_id_start_date_idx;
@@ -0,0 +1,13 @@
+-- +goose Up
+CREATE INDEX events_search_idx ON events USING GIN (to_tsvector('english', title || ' ' || COALESCE(description, '')));
+
+CREATE INDEX todos_search_idx ON todos USING GIN (to_tsvector('english', title || ' ' || COALESCE(description, '')));
+
+CREATE INDEX tags_search_idx ON tags USING GIN (to_tsvector('english', name));
+
+-- +goose Down
+DROP INDEX tags_search_idx;
+
+DROP INDEX todos_search_idx;
+
+DROP INDEX events_search_idx;
@@ -0,0 +1,97 @@
+-- +goose Up
+-- Every write to events, todos, tags and event_tags is recorded here so
+-- clients can fetch what changed since their last sync. Deletions are kept as
+-- tombstones (deleted = true).
+CREATE TABLE changes (
+    seq BIGSERIAL PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    resource TEXT NOT NULL,
+    record_id UUID NOT NULL,
+    tag_id UUID,
+    deleted BOOLEAN NOT NULL,
+    changed_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX changes_user_id_seq_idx ON changes (user_id, seq);
+
+-- +goose StatementBegin
+CREATE FUNCTION record_change() RETURNS trigger AS $$
+DECLARE
+    rec RECORD;
+    change_user_id UUID;
+    change_resource TEXT;
+    change_record_id UUID;
+    change_tag_id UUID;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        rec := OLD;
+    ELSE
+        rec := NEW;
+    END IF;
+
+    IF TG_TABLE_NAME = 'event_tags' THEN
+        change_resource := 'event_tag';
+        change_record_id := rec.event_id;
+        change_tag_id := rec.tag_id;
+        SELECT user_id INTO change_user_id FROM events WHERE id = rec.event_id;
+    ELSE
+        change_resource := rtrim(TG_TABLE_NAME, 's');
+        change_record_id := rec.id;
+        change_user_id := rec.user_id;
+    END IF;
+
+    -- Rows removed because their user, or for links their event, was deleted
+    -- need no tombstone.
+    IF change_user_id IS NULL OR NOT EXISTS (SELECT 1 FROM users WHERE id = change_user_id) THEN
+        RETURN NULL;
+    END IF;
+
+    -- Serialising each user's writes makes seq follow commit order, so a
+    -- client never skips a change that commits after it synced.
+    PERFORM pg_advisory_xact_lock(hashtextextended(change_user_id::text, 0));
+    INSERT INTO changes (user_id, resource, record_id, tag_id, deleted)
+    VALUES (change_user_id, change_resource, change_record_id, change_tag_id, TG_OP = 'DELETE');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER events_record_change AFTER INSERT OR UPDATE OR DELETE ON events
+FOR EACH ROW EXECUTE FUNCTION record_change();
+
+CREATE TRIGGER todos_record_change AFTER INSERT OR UPDATE OR DELETE ON todos
+FOR EACH ROW EXECUTE FUNCTION record_change();
+
+CREATE TRIGGER tags_record_change AFTER INSERT OR UPDATE OR DELETE ON tags
+FOR EACH ROW EXECUTE FUNCTION record_change();
+
+CREATE TRIGGER event_tags_record_change AFTER INSERT OR UPDATE OR DELETE ON event_tags
+FOR EACH ROW EXECUTE FUNCTION record_change();
+
+-- Existing rows count as created, so a first sync returns everything.
+INSERT INTO changes (user_id, resource, record_id, deleted)
+SELECT user_id, 'event', id, false FROM events;
+
+INSERT INTO changes (user_id, resource, record_id, deleted)
+SELECT user_id, 'todo', id, false FROM todos;
+
+INSERT INTO changes (user_id, resource, record_id, deleted)
+SELECT user_id, 'tag', id, false FROM tags;
+
+INSERT INTO changes (user_id, resource, record_id, tag_id, deleted)
+SELECT events.user_id, 'event_tag', event_tags.event_id, event_tags.tag_id, false
+FROM event_tags
+JOIN events ON events.id = event_tags.event_id;
+
+-- +goose Down
+DROP TRIGGER event_tags_record_change ON event_tags;
+
+DROP TRIGGER tags_record_change ON tags;
+
+DROP TRIGGER todos_record_change ON todos;
+
+DROP TRIGGER events_record_change ON events;
+
+DROP FUNCTION record_change();
+
+DROP TABLE changes;
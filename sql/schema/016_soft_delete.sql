@@ -0,0 +1,127 @@
+-- +goose Up
+-- Deleting an event, todo, tag or user moves it to the trash. Trashed rows are
+-- hidden from every query and purged for good after the retention period.
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMP;
+
+ALTER TABLE events ADD COLUMN deleted_at TIMESTAMP;
+
+ALTER TABLE todos ADD COLUMN deleted_at TIMESTAMP;
+
+ALTER TABLE tags ADD COLUMN deleted_at TIMESTAMP;
+
+CREATE INDEX events_deleted_at_idx ON events (deleted_at) WHERE deleted_at IS NOT NULL;
+
+CREATE INDEX todos_deleted_at_idx ON todos (deleted_at) WHERE deleted_at IS NOT NULL;
+
+CREATE INDEX tags_deleted_at_idx ON tags (deleted_at) WHERE deleted_at IS NOT NULL;
+
+CREATE INDEX users_deleted_at_idx ON users (deleted_at) WHERE deleted_at IS NOT NULL;
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION record_change() RETURNS trigger AS $$
+DECLARE
+    rec RECORD;
+    change_user_id UUID;
+    change_resource TEXT;
+    change_record_id UUID;
+    change_tag_id UUID;
+    change_deleted BOOLEAN;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        rec := OLD;
+    ELSE
+        rec := NEW;
+    END IF;
+
+    IF TG_TABLE_NAME = 'event_tags' THEN
+        change_resource := 'event_tag';
+        change_record_id := rec.event_id;
+        change_tag_id := rec.tag_id;
+        change_deleted := TG_OP = 'DELETE';
+        SELECT user_id INTO change_user_id FROM events WHERE id = rec.event_id;
+    ELSE
+        -- Purging a trashed row needs no new tombstone, moving a row to the
+        -- trash records one and restoring it counts as an update.
+        IF TG_OP = 'DELETE' AND OLD.deleted_at IS NOT NULL THEN
+            RETURN NULL;
+        END IF;
+        change_resource := rtrim(TG_TABLE_NAME, 's');
+        change_record_id := rec.id;
+        change_deleted := TG_OP = 'DELETE' OR rec.deleted_at IS NOT NULL;
+        change_user_id := rec.user_id;
+    END IF;
+
+    -- Rows removed because their user, or for links their event, was deleted
+    -- need no tombstone.
+    IF change_user_id IS NULL OR NOT EXISTS (SELECT 1 FROM users WHERE id = change_user_id) THEN
+        RETURN NULL;
+    END IF;
+
+    -- Serialising each user's writes makes seq follow commit order, so a
+    -- client never skips a change that commits after it synced.
+    PERFORM pg_advisory_xact_lock(hashtextextended(change_user_id::text, 0));
+    INSERT INTO changes (user_id, resource, record_id, tag_id, deleted)
+    VALUES (change_user_id, change_resource, change_record_id, change_tag_id, change_deleted);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION record_change() RETURNS trigger AS $$
+DECLARE
+    rec RECORD;
+    change_user_id UUID;
+    change_resource TEXT;
+    change_record_id UUID;
+    change_tag_id UUID;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        rec := OLD;
+    ELSE
+        rec := NEW;
+    END IF;
+
+    IF TG_TABLE_NAME = 'event_tags' THEN
+        change_resource := 'event_tag';
+        change_record_id := rec.event_id;
+        change_tag_id := rec.tag_id;
+        SELECT user_id INTO change_user_id FROM events WHERE id = rec.event_id;
+    ELSE
+        change_resource := rtrim(TG_TABLE_NAME, 's');
+        change_record_id := rec.id;
+        change_user_id := rec.user_id;
+    END IF;
+
+    -- Rows removed because their user, or for links their event, was deleted
+    -- need no tombstone.
+    IF change_user_id IS NULL OR NOT EXISTS (SELECT 1 FROM users WHERE id = change_user_id) THEN
+        RETURN NULL;
+    END IF;
+
+    -- Serialising each user's writes makes seq follow commit order, so a
+    -- client never skips a change that commits after it synced.
+    PERFORM pg_advisory_xact_lock(hashtextextended(change_user_id::text, 0));
+    INSERT INTO changes (user_id, resource, record_id, tag_id, deleted)
+    VALUES (change_user_id, change_resource, change_record_id, change_tag_id, TG_OP = 'DELETE');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+DROP INDEX users_deleted_at_idx;
+
+DROP INDEX tags_deleted_at_idx;
+
+DROP INDEX todos_deleted_at_idx;
+
+DROP INDEX events_deleted_at_idx;
+
+ALTER TABLE tags DROP COLUMN deleted_at;
+
+ALTER TABLE todos DROP COLUMN deleted_at;
+
+ALTER TABLE events DROP COLUMN deleted_at;
+
+ALTER TABLE users DROP COLUMN deleted_at;
@@ -0,0 +1,20 @@
+-- +goose Up
+-- Every agenda message the sender tries to deliver, so users can see and
+-- export what was sent to them.
+CREATE TABLE deliveries (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    channel TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    recipient TEXT NOT NULL,
+    body TEXT NOT NULL,
+    status TEXT NOT NULL,
+    provider_message_id TEXT NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX deliveries_user_id_created_at_idx ON deliveries (user_id, created_at);
+
+-- +goose Down
+DROP TABLE deliveries;
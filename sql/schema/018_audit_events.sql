@@ -0,0 +1,37 @@
+-- +goose Up
+-- A record of who did what to an account and its data. Rows are never
+-- changed or removed, except when the account itself is purged.
+CREATE TABLE audit_events (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    actor TEXT NOT NULL,
+    action TEXT NOT NULL,
+    resource_id UUID,
+    details TEXT NOT NULL DEFAULT '',
+    ip_address TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX audit_events_user_id_created_at_idx ON audit_events (user_id, created_at DESC, id DESC);
+
+-- +goose StatementBegin
+CREATE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+    -- A delete cascading from users runs inside the foreign key trigger, so
+    -- it is the only delete that arrives with a trigger depth above one.
+    IF TG_OP = 'DELETE' AND pg_trigger_depth() > 1 THEN
+        RETURN OLD;
+    END IF;
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER audit_events_append_only
+BEFORE UPDATE OR DELETE ON audit_events
+FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+
+-- +goose Down
+DROP TABLE audit_events;
+DROP FUNCTION audit_events_append_only();
@@ -0,0 +1,25 @@
+-- +goose Up
+-- Stripe events that have been handled, so a redelivered event is skipped.
+CREATE TABLE stripe_events (
+    id TEXT PRIMARY KEY,
+    type TEXT NOT NULL,
+    processed_at TIMESTAMP NOT NULL
+);
+
+-- The creation time of the Stripe event that last wrote the row, so an
+-- older event arriving late doesn't undo a newer one.
+ALTER TABLE subscriptions ADD COLUMN last_event_at TIMESTAMP;
+
+-- Redeliveries used to insert the same subscription again; keep the newest
+-- copy before making the Stripe ID unique.
+DELETE FROM subscriptions a
+USING subscriptions b
+WHERE a.stripe_subscription_id = b.stripe_subscription_id
+    AND (a.updated_at, a.id) < (b.updated_at, b.id);
+
+CREATE UNIQUE INDEX subscriptions_stripe_subscription_id_key ON subscriptions (stripe_subscription_id);
+
+-- +goose Down
+DROP INDEX subscriptions_stripe_subscription_id_key;
+ALTER TABLE subscriptions DROP COLUMN last_event_at;
+DROP TABLE stripe_events;
@@ -0,0 +1,22 @@
+-- +goose Up
+-- A failed subscription payment the user is being reminded about. The case
+-- stays open until the subscription recovers or ends.
+CREATE TABLE dunning_cases (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    stripe_subscription_id TEXT NOT NULL,
+    invoice_id TEXT NOT NULL,
+    notices_sent INTEGER NOT NULL DEFAULT 0,
+    next_notice_at TIMESTAMP,
+    resolution TEXT NOT NULL DEFAULT '',
+    resolved_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE UNIQUE INDEX dunning_cases_open_idx ON dunning_cases (stripe_subscription_id) WHERE resolved_at IS NULL;
+
+CREATE INDEX dunning_cases_next_notice_at_idx ON dunning_cases (next_notice_at) WHERE resolved_at IS NULL;
+
+-- +goose Down
+DROP TABLE dunning_cases;
@@ -0,0 +1,31 @@
+// Package schema embeds the goose migrations so the binaries know which
+// version of the database they were built against.
+package schema
+
+import (
+	"embed"
+	"io/fs"
+	"strconv"
+	"strings"
+)
+
+//go:embed *.sql
+var Migrations embed.FS
+
+// Version returns the number of the latest migration.
+func Version() int64 {
+	files, err := fs.Glob(Migrations, "*.sql")
+	if err != nil {
+		panic(err)
+	}
+	var latest int64
+	for _, file := range files {
+		prefix, _, _ := strings.Cut(file, "_")
+		v, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			continue
+		}
+		latest = max(latest, v)
+	}
+	return latest
+}